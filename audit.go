@@ -0,0 +1,332 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoAuditSink is returned by Audit if no AuditSink is set.
+var ErrNoAuditSink error = notRegisteredError("audit sink is not set")
+
+// AuditPutTimeout limits time MemcachedAuditSink waits for memcached
+// to accept single event (including connecting and authenticating
+// if there is no connection).
+var AuditPutTimeout = 5 * time.Second
+
+// auditQueueSize limits number of events cbauth emits itself (see
+// AuditConfig) that wait for sink. Events that don't fit are
+// dropped, so that slow audit never delays auth.
+const auditQueueSize = 1024
+
+// AuditSink interface is destination of audit events (see
+// SetAuditSink).
+type AuditSink interface {
+	// AuditPut method emits given json encoded event with given
+	// id.
+	AuditPut(eventID uint32, event []byte) error
+}
+
+// AuditConfig struct sets ids of events that cbauth emits itself.
+// Zero id disables respective event.
+type AuditConfig struct {
+	// AuthSuccess is emitted for creds AuthWebCreds accepts.
+	AuthSuccess uint32
+	// AuthFailure is emitted for requests AuthWebCreds refuses.
+	AuthFailure uint32
+	// PrivilegeDenied is emitted when creds are denied permission
+	// (see HasPermission).
+	PrivilegeDenied uint32
+	// OnBehalfOf is emitted for creds that internal user asserted
+	// (see OnBehalfOfHeader).
+	OnBehalfOf uint32
+}
+
+// AuditUser struct identifies user in audit events.
+type AuditUser struct {
+	Domain string `json:"domain"`
+	User   string `json:"user"`
+}
+
+type auditState struct {
+	sink  AuditSink
+	cfg   AuditConfig
+	queue chan auditEvent
+	// done is closed when sink is replaced
+	done chan struct{}
+}
+
+type auditEvent struct {
+	id    uint32
+	event []byte
+}
+
+var (
+	auditL       sync.Mutex
+	auditCurrent atomic.Value
+)
+
+// SetAuditSink sets (or clears if nil is passed) sink of audit events
+// emitted by Audit and of events given config enables.
+func SetAuditSink(s AuditSink, cfg AuditConfig) {
+	auditL.Lock()
+	defer auditL.Unlock()
+	if old := getAudit(); old != nil && old.done != nil {
+		close(old.done)
+	}
+	if s == nil {
+		auditCurrent.Store((*auditState)(nil))
+		return
+	}
+	st := &auditState{sink: s, cfg: cfg}
+	if cfg != (AuditConfig{}) {
+		st.queue = make(chan auditEvent, auditQueueSize)
+		st.done = make(chan struct{})
+		go st.drain()
+	}
+	auditCurrent.Store(st)
+}
+
+func getAudit() *auditState {
+	st, _ := auditCurrent.Load().(*auditState)
+	return st
+}
+
+// drain passes queued events to sink until sink is replaced.
+// Events that are queued then are dropped.
+func (st *auditState) drain() {
+	for {
+		select {
+		case e := <-st.queue:
+			if err := st.sink.AuditPut(e.id, e.event); err != nil {
+				recordError("failed to emit audit event %d: %s", e.id, err)
+			}
+		case <-st.done:
+			return
+		}
+	}
+}
+
+// auditCreds returns real and effective identities of given creds.
+// Effective identity is only set for creds that internal user
+// asserted on behalf of other user.
+func auditCreds(c Creds) (realID AuditUser, effectiveID *AuditUser) {
+	domain := c.Identity().Domain
+	if domain == "" {
+		domain = c.Source()
+	}
+	user := AuditUser{Domain: domain, User: c.Name()}
+	if actor := c.Actor(); actor != "" {
+		// actors are internal users, which are verified
+		// against cache
+		return AuditUser{Domain: "ns_server", User: actor}, &user
+	}
+	return user, nil
+}
+
+// auditEventOf returns json encoding of event with given fields that
+// also carries timestamp and identities of given creds (if they are
+// non-nil and not set by fields).
+func auditEventOf(c Creds, fields map[string]interface{}) ([]byte, error) {
+	ev := make(map[string]interface{}, len(fields)+3)
+	ev["timestamp"] = time.Now().Format(time.RFC3339Nano)
+	if c != nil && c != NoAccessCreds {
+		realID, effectiveID := auditCreds(c)
+		ev["real_userid"] = realID
+		if effectiveID != nil {
+			ev["effective_userid"] = effectiveID
+		}
+	}
+	for k, v := range fields {
+		ev[k] = v
+	}
+	return json.Marshal(ev)
+}
+
+// Audit emits audit event with given id and fields into sink set by
+// SetAuditSink. Event carries timestamp and identities of creds of
+// given context (see CredsFromContext): identity of user as
+// "real_userid" or, for creds asserted on behalf of other user,
+// identity of internal user as "real_userid" and of asserted user as
+// "effective_userid". Fields take precedence over them.
+func Audit(ctx context.Context, eventID uint32, fields map[string]interface{}) error {
+	st := getAudit()
+	if st == nil {
+		return ErrNoAuditSink
+	}
+	c, _ := CredsFromContext(ctx)
+	event, err := auditEventOf(c, fields)
+	if err != nil {
+		return err
+	}
+	return st.sink.AuditPut(eventID, event)
+}
+
+// emittedAudit returns current audit state if cbauth emits events
+// itself.
+func emittedAudit() *auditState {
+	if st := getAudit(); st != nil && st.queue != nil {
+		return st
+	}
+	return nil
+}
+
+// emit queues event with given id (if it's enabled) that cbauth
+// emits itself.
+func (st *auditState) emit(id uint32, c Creds, fields map[string]interface{}) {
+	if id == 0 {
+		return
+	}
+	event, err := auditEventOf(c, fields)
+	if err != nil {
+		recordError("failed to encode audit event %d: %s", id, err)
+		return
+	}
+	select {
+	case st.queue <- auditEvent{id, event}:
+	default:
+		recordError("audit queue is full, event %d is dropped", id)
+	}
+}
+
+func requestAuditFields(req *http.Request) map[string]interface{} {
+	fields := map[string]interface{}{
+		"method":         req.Method,
+		"path":           req.URL.Path,
+		"correlation_id": CorrelationID(req),
+	}
+	if host, port, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		fields["remote"] = map[string]string{"ip": host, "port": port}
+	}
+	return fields
+}
+
+// auditAuth emits auth and on-behalf-of events of given result of
+// auth of given request. Every failure, except for auth schemes that
+// cbauth leaves to caller, is emitted as AuthFailure event with error
+// (if any) as its reason.
+func auditAuth(req *http.Request, c Creds, err error) {
+	st := emittedAudit()
+	if st == nil {
+		return
+	}
+	switch {
+	case err == nil && c != nil && c != NoAccessCreds:
+		fields := requestAuditFields(req)
+		fields["mechanism"] = c.Mechanism()
+		st.emit(st.cfg.AuthSuccess, c, fields)
+		if c.Actor() != "" {
+			st.emit(st.cfg.OnBehalfOf, c, requestAuditFields(req))
+		}
+	case !errors.Is(err, errNonBasicAuth):
+		fields := requestAuditFields(req)
+		if user, _, _ := req.BasicAuth(); user != "" {
+			fields["user"] = user
+		}
+		if err != nil {
+			fields["reason"] = err.Error()
+		}
+		st.emit(st.cfg.AuthFailure, nil, fields)
+	}
+}
+
+// auditDenied emits event of permission given creds were denied.
+func auditDenied(c Creds, permission string) {
+	if st := emittedAudit(); st != nil {
+		st.emit(st.cfg.PrivilegeDenied, c, map[string]interface{}{"permission": permission})
+	}
+}
+
+// MemcachedAuditSink type is AuditSink that passes events to audit
+// daemon via memcached (with AUDIT_PUT command of memcached binary
+// protocol). Connection to memcached is authenticated with creds of
+// given authenticator (see ScramAuthenticate) and is re-established
+// once it fails.
+type MemcachedAuditSink struct {
+	a        Authenticator
+	hostport string
+
+	l    sync.Mutex
+	conn net.Conn
+}
+
+// NewMemcachedAuditSink returns MemcachedAuditSink that passes
+// events to memcached at given host:port. Default authenticator is
+// used if given authenticator is nil.
+func NewMemcachedAuditSink(a Authenticator, hostport string) *MemcachedAuditSink {
+	return &MemcachedAuditSink{a: a, hostport: hostport}
+}
+
+func (s *MemcachedAuditSink) connectLocked(deadline time.Time) error {
+	conn, err := net.DialTimeout("tcp", s.hostport, time.Until(deadline))
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(deadline)
+	if err := ScramAuthenticate(s.a, s.hostport, NewMemcachedSASLConn(conn)); err != nil {
+		conn.Close()
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// AuditPut method implements AuditSink.
+func (s *MemcachedAuditSink) AuditPut(eventID uint32, event []byte) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	deadline := time.Now().Add(AuditPutTimeout)
+	if s.conn == nil {
+		if err := s.connectLocked(deadline); err != nil {
+			return err
+		}
+	}
+	s.conn.SetDeadline(deadline)
+	var extras [4]byte
+	binary.BigEndian.PutUint32(extras[:], eventID)
+	mc := &memcachedSASLConn{rw: s.conn}
+	status, _, err := mc.roundTripExtras(mcAuditPut, extras[:], "", event)
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	if status != mcStatusSuccess {
+		return fmt.Errorf("memcached refused audit event %d: status 0x%x", eventID, status)
+	}
+	return nil
+}
+
+// Close method closes connection to memcached.
+func (s *MemcachedAuditSink) Close() error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
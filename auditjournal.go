@@ -0,0 +1,239 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrAuditJournalFull is returned by AuditJournal when auditor is
+// unavailable and journal has no room for more records. Elevation
+// is refused then, as it is without journal.
+var ErrAuditJournalFull = errors.New("audit journal is full")
+
+// auditRecord is what AuditJournal keeps on disk for every
+// elevation that auditor failed to accept.
+type auditRecord struct {
+	Elevation     *Elevation `json:"elevation"`
+	Time          time.Time  `json:"time"`
+	Used          bool       `json:"used,omitempty"`
+	Method        string     `json:"method,omitempty"`
+	Path          string     `json:"path,omitempty"`
+	RemoteAddr    string     `json:"remoteAddr,omitempty"`
+	CorrelationID string     `json:"correlationId,omitempty"`
+}
+
+func (r *auditRecord) request() *http.Request {
+	if !r.Used {
+		return nil
+	}
+	req := &http.Request{Method: r.Method, URL: &url.URL{Path: r.Path},
+		RemoteAddr: r.RemoteAddr, Header: make(http.Header)}
+	if r.CorrelationID != "" {
+		req.Header.Set(CorrelationIDHeader, r.CorrelationID)
+	}
+	return req
+}
+
+// AuditJournal type is write-ahead journal of elevation audit
+// records. Its Audit method is ElevationAuditor that passes records
+// to underlying auditor and, when auditor fails (e.g. because audit
+// daemon is down), spools them to bounded on-disk journal instead
+// of refusing elevation. Spooled records are replayed to auditor in
+// order before any new record, so auditor sees every record of the
+// outage window once it recovers. Delivery is at least once: record
+// may be passed to auditor again if journal can't be rewritten after
+// replay.
+type AuditJournal struct {
+	path     string
+	maxBytes int64
+	auditor  ElevationAuditor
+
+	l       sync.Mutex
+	size    int64
+	pending int
+}
+
+// OpenAuditJournal opens (or creates) journal kept in file at given
+// path that is limited to maxBytes and passes records to given
+// auditor. Records left in journal by previous process are kept and
+// replayed when auditor becomes available. Typical usage is:
+//
+//	j, err := cbauth.OpenAuditJournal(path, 16<<20, auditor)
+//	...
+//	cbauth.SetElevationAuditor(j.Audit)
+func OpenAuditJournal(path string, maxBytes int64, auditor ElevationAuditor) (*AuditJournal, error) {
+	j := &AuditJournal{path: path, maxBytes: maxBytes, auditor: auditor}
+	records, err := j.readLocked()
+	if err != nil {
+		return nil, err
+	}
+	j.pending = len(records)
+	if fi, err := os.Stat(path); err == nil {
+		j.size = fi.Size()
+	}
+	return j, nil
+}
+
+// Audit method audits given elevation (see ElevationAuditor).
+func (j *AuditJournal) Audit(e *Elevation, req *http.Request) error {
+	j.l.Lock()
+	defer j.l.Unlock()
+	if j.pending > 0 {
+		if err := j.replayLocked(); err != nil {
+			return j.spoolLocked(e, req, err)
+		}
+	}
+	if err := j.auditor(e, req); err != nil {
+		return j.spoolLocked(e, req, err)
+	}
+	return nil
+}
+
+// Replay method passes spooled records to auditor and returns
+// number of records that are still pending. It is called by Audit
+// too, but services may call it periodically so that records are
+// delivered soon after auditor recovers even if no elevations
+// happen.
+func (j *AuditJournal) Replay() (int, error) {
+	j.l.Lock()
+	defer j.l.Unlock()
+	if j.pending == 0 {
+		return 0, nil
+	}
+	err := j.replayLocked()
+	return j.pending, err
+}
+
+// Pending method returns number of records that are spooled and
+// were not accepted by auditor yet.
+func (j *AuditJournal) Pending() int {
+	j.l.Lock()
+	defer j.l.Unlock()
+	return j.pending
+}
+
+func (j *AuditJournal) spoolLocked(e *Elevation, req *http.Request, auditErr error) error {
+	r := &auditRecord{Elevation: e, Time: time.Now()}
+	if req != nil {
+		r.Used = true
+		r.Method = req.Method
+		r.Path = req.URL.Path
+		r.RemoteAddr = req.RemoteAddr
+		r.CorrelationID = req.Header.Get(CorrelationIDHeader)
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if j.size+int64(len(data)) > j.maxBytes {
+		tracef(e.Approver, "audit journal %s is full, refusing elevation of %s: %v",
+			j.path, TagUserData(e.User), auditErr)
+		return ErrAuditJournalFull
+	}
+
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	j.size += int64(len(data))
+	j.pending++
+	tracef(e.Approver, "auditor failed (%v), spooled elevation of %s to %s", auditErr, TagUserData(e.User), j.path)
+	return nil
+}
+
+func (j *AuditJournal) readLocked() ([]*auditRecord, error) {
+	data, err := os.ReadFile(j.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rv []*auditRecord
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(nil, len(data)+1)
+	for s.Scan() {
+		r := &auditRecord{}
+		// torn tail of record that was being written during
+		// crash is skipped
+		if err := json.Unmarshal(s.Bytes(), r); err != nil || r.Elevation == nil {
+			continue
+		}
+		rv = append(rv, r)
+	}
+	return rv, s.Err()
+}
+
+// replayLocked passes spooled records to auditor in order until
+// auditor fails and rewrites journal to keep records that were not
+// accepted.
+func (j *AuditJournal) replayLocked() error {
+	records, err := j.readLocked()
+	if err != nil {
+		return err
+	}
+	done := 0
+	for _, r := range records {
+		if err = j.auditor(r.Elevation, r.request()); err != nil {
+			break
+		}
+		done++
+	}
+	if done == 0 && err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for _, r := range records[done:] {
+		data, merr := json.Marshal(r)
+		if merr != nil {
+			return merr
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	tmp := j.path + ".tmp"
+	if werr := os.WriteFile(tmp, buf.Bytes(), 0600); werr != nil {
+		return werr
+	}
+	if rerr := os.Rename(tmp, j.path); rerr != nil {
+		return rerr
+	}
+	j.size = int64(buf.Len())
+	j.pending = len(records) - done
+	tracef("", "replayed %d records of audit journal %s, %d are pending", done, j.path, j.pending)
+	return err
+}
@@ -0,0 +1,239 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	mathrand "math/rand"
+	"sync"
+	"time"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// AuthHeaderCacheTTL is how long AuthWebCreds reuses result of
+// authenticating some exact Authorization header value. It is meant
+// to be short: just enough for retried or pipelined identical
+// requests to skip verification. Zero disables reuse.
+var AuthHeaderCacheTTL = 500 * time.Millisecond
+
+// AdaptiveAuthHeaderCacheTTL makes AuthWebCreds adjust
+// AuthHeaderCacheTTL per user: it is halved for every recent change
+// of user's creds pushed by ns_server (see
+// cbauthimpl.ChurnWindow) and multiplied by stableTTLFactor for
+// internal users whose creds didn't change recently.
+var AdaptiveAuthHeaderCacheTTL = true
+
+// stableTTLFactor is how much longer auth results of stable internal
+// users are reused.
+const stableTTLFactor = 4
+
+// maxTTLHalvings limits how much TTL of frequently changing users is
+// shortened.
+const maxTTLHalvings = 8
+
+// authHeaderTTL returns how long auth result of given creds is
+// reused.
+func authHeaderTTL(c *cbauthimpl.CredsImpl) time.Duration {
+	ttl := AuthHeaderCacheTTL
+	if !AdaptiveAuthHeaderCacheTTL || ttl <= 0 {
+		return ttl
+	}
+	if n := c.RecentChanges(); n > 0 {
+		if n > maxTTLHalvings {
+			n = maxTTLHalvings
+		}
+		return ttl >> uint(n)
+	}
+	if c.IsInternal() {
+		return ttl * stableTTLFactor
+	}
+	return ttl
+}
+
+// authHeaderCacheSize is maximal number of remembered headers.
+const authHeaderCacheSize = 256
+
+type authHeaderEntry struct {
+	key     string
+	creds   *cbauthimpl.CredsImpl
+	expires time.Time
+}
+
+// authHeaderCache is LRU of recent successful auth results keyed by
+// fingerprint of Authorization header value (see authCacheKey). Zero
+// value is empty cache.
+type authHeaderCache struct {
+	l       sync.Mutex
+	lru     list.List
+	entries map[string]*list.Element
+}
+
+func authHeaderFingerprint(header string) string {
+	mac := hmac.New(sha256.New, authCacheKey)
+	mac.Write([]byte(header))
+	return string(mac.Sum(nil))
+}
+
+func (c *authHeaderCache) get(header string) *cbauthimpl.CredsImpl {
+	if header == "" {
+		return nil
+	}
+	key := authHeaderFingerprint(header)
+	c.l.Lock()
+	elem := c.entries[key]
+	if elem == nil {
+		c.l.Unlock()
+		return nil
+	}
+	e := elem.Value.(*authHeaderEntry)
+	if time.Now().After(e.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		c.l.Unlock()
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	c.l.Unlock()
+
+	// creds are only reused if cache wasn't updated in a way
+	// that affects them
+	if e.creds.Revalidate() != nil {
+		return nil
+	}
+	return e.creds
+}
+
+// put remembers given auth result. Only results of basic auth that
+// produced real (i.e. not NoAccessCreds) creds are remembered.
+func (c *authHeaderCache) put(header string, creds Creds) {
+	ci, ok := creds.(*cbauthimpl.CredsImpl)
+	if !ok || header == "" {
+		return
+	}
+	ttl := authHeaderTTL(ci)
+	if ttl <= 0 {
+		return
+	}
+	key := authHeaderFingerprint(header)
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	e := &authHeaderEntry{key: key, creds: ci, expires: time.Now().Add(ttl)}
+	if elem := c.entries[key]; elem != nil {
+		elem.Value = e
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	if c.lru.Len() > authHeaderCacheSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*authHeaderEntry).key)
+	}
+}
+
+// NegativeAuthCacheTTL is how long Auth and AuthWebCreds remember
+// that ns_server refused some exact user name and password, so that
+// retries of same wrong creds (e.g. by misconfigured clients or
+// brute-force storms) don't all reach ns_server. TTL of every entry
+// is randomly shortened by up to a quarter, so that entries created
+// by a storm don't expire at once. Only identical creds are refused
+// from cache, so every distinct password still reaches ns_server and
+// counts towards its lockout, and entries are forgotten once cache
+// is updated (e.g. because user was created or its password was
+// reset). Zero disables negative caching.
+var NegativeAuthCacheTTL = 2 * time.Second
+
+// negativeAuthCacheSize is maximal number of remembered refusals.
+const negativeAuthCacheSize = 4096
+
+// authCacheKey is per process key that is used to fingerprint creds
+// remembered by auth caches, so that caches never hold passwords.
+var authCacheKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+type negativeAuthEntry struct {
+	expires    time.Time
+	generation uint64
+}
+
+// negativeAuthCache remembers creds that ns_server refused keyed by
+// their fingerprint. Zero value is empty cache.
+type negativeAuthCache struct {
+	l       sync.Mutex
+	entries map[string]negativeAuthEntry
+}
+
+func negativeAuthFingerprint(user, pwd string) string {
+	mac := hmac.New(sha256.New, authCacheKey)
+	mac.Write([]byte(user))
+	mac.Write([]byte{0})
+	mac.Write([]byte(pwd))
+	return string(mac.Sum(nil))
+}
+
+// refused returns true if creds with given fingerprint were refused
+// by ns_server recently while cache of given generation was current.
+func (c *negativeAuthCache) refused(key string, generation uint64) bool {
+	c.l.Lock()
+	defer c.l.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	if e.generation != generation || !time.Now().Before(e.expires) {
+		delete(c.entries, key)
+		return false
+	}
+	return true
+}
+
+func (c *negativeAuthCache) put(key string, generation uint64) {
+	ttl := NegativeAuthCacheTTL
+	if ttl <= 0 {
+		return
+	}
+	ttl -= time.Duration(mathrand.Int63n(int64(ttl)/4 + 1))
+
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]negativeAuthEntry)
+	}
+	if len(c.entries) >= negativeAuthCacheSize {
+		now := time.Now()
+		for k, e := range c.entries {
+			if e.generation != generation || !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= negativeAuthCacheSize {
+			c.entries = make(map[string]negativeAuthEntry)
+		}
+	}
+	c.entries[key] = negativeAuthEntry{expires: time.Now().Add(ttl), generation: generation}
+}
@@ -0,0 +1,81 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// VerifierBackend is what authenticator verifies credentials
+// against. Default backend is cbauth cache that is kept in sync with
+// ns_server. Specialized builds (e.g. in-memory test clusters) may
+// substitute their own (see Authenticator.SetVerifierBackend) while
+// keeping the rest of Authenticator API.
+type VerifierBackend interface {
+	// VerifyPassword verifies given user/password creds. It
+	// returns nil creds and nil error if creds are not
+	// recognised at all, in which case they are verified with
+	// ns_server.
+	VerifyPassword(user, pwd string) (Creds, error)
+	// LookupRoles returns roles and domain of given user of
+	// given domain (any domain if it's empty), e.g. for users
+	// that client certificates are mapped to. Empty domain is
+	// returned if user is unknown or ambiguous.
+	LookupRoles(user, domain string) (roles []Role, userDomain string, err error)
+}
+
+// cacheBackend is default VerifierBackend.
+type cacheBackend struct {
+	svc *cbauthimpl.Svc
+}
+
+func (b cacheBackend) VerifyPassword(user, pwd string) (Creds, error) {
+	ci, err := cbauthimpl.VerifyPassword(b.svc, user, pwd)
+	if ci == nil {
+		return nil, err
+	}
+	return ci, err
+}
+
+func (b cacheBackend) LookupRoles(user, domain string) ([]Role, string, error) {
+	return cbauthimpl.LookupRoles(b.svc, user, domain)
+}
+
+type backendBox struct{ b VerifierBackend }
+
+// CacheVerifierBackend returns default backend of given
+// authenticator, i.e. the one that verifies credentials against
+// cbauth cache. Custom backends may use it to fall back to cache.
+func CacheVerifierBackend(a Authenticator) VerifierBackend {
+	ai, ok := a.(*authImpl)
+	if !ok {
+		return nil
+	}
+	return cacheBackend{ai.svc}
+}
+
+func (a *authImpl) SetVerifierBackend(b VerifierBackend) {
+	a.backend.Store(backendBox{b})
+}
+
+// verifier returns backend that is currently in use.
+func (a *authImpl) verifier() VerifierBackend {
+	box, _ := a.backend.Load().(backendBox)
+	if box.b == nil {
+		return cacheBackend{a.svc}
+	}
+	return box.b
+}
@@ -0,0 +1,143 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// ErrNonCanonicalPath is returned by CanonicalPathSegments for paths
+// that services could interpret differently.
+var ErrNonCanonicalPath = errors.New("request path is not canonical")
+
+// CanonicalPathSegments returns percent-decoded segments of path of
+// given url. Escaped path is split on "/" before segments are
+// decoded, so that "%2F" is part of segment rather than separator,
+// and every segment is decoded exactly once ("+" is kept as is).
+// Trailing slash yields empty last segment. Paths with empty
+// segments, "." or ".." segments (escaped or not) or malformed
+// escapes are rejected with ErrNonCanonicalPath, since cleaning
+// them is ambiguous. RouteTable matches routes against these
+// segments, so services that derive names from urls with this
+// function see same names as RouteTable.
+func CanonicalPathSegments(u *url.URL) ([]string, error) {
+	p := u.EscapedPath()
+	if !strings.HasPrefix(p, "/") {
+		return nil, ErrNonCanonicalPath
+	}
+	raw := strings.Split(p[1:], "/")
+	rv := make([]string, len(raw))
+	for i, s := range raw {
+		seg, err := url.PathUnescape(s)
+		if err != nil || seg == "." || seg == ".." || (seg == "" && i != len(raw)-1) {
+			return nil, ErrNonCanonicalPath
+		}
+		rv[i] = seg
+	}
+	return rv, nil
+}
+
+// Keyspace struct describes bucket, scope and collection that
+// request refers to. Scope and Collection are empty if request
+// refers to whole bucket or scope.
+type Keyspace struct {
+	Bucket     string
+	Scope      string
+	Collection string
+}
+
+// bucketPathPrefixes are ns_server REST paths that are followed by
+// bucket name.
+var bucketPathPrefixes = [][]string{
+	{"pools", "default", "buckets"},
+	{"pools", "default", "b"},
+	{"pools", "default", "bs"},
+	{"pools", "default", "bucketsStreaming"},
+}
+
+// KeyspaceFromURL returns keyspace that given ns_server style REST
+// url refers to (e.g. "/pools/default/buckets/foo/scopes/s/
+// collections/c"). Names are taken from CanonicalPathSegments and
+// must be valid bucket, scope and collection names. Returns false if
+// url doesn't refer to bucket or is not canonical.
+func KeyspaceFromURL(u *url.URL) (Keyspace, bool) {
+	segs, err := CanonicalPathSegments(u)
+	if err != nil {
+		return Keyspace{}, false
+	}
+	var rest []string
+	for _, prefix := range bucketPathPrefixes {
+		if len(segs) > len(prefix) && equalSegments(segs[:len(prefix)], prefix) {
+			rest = segs[len(prefix):]
+			break
+		}
+	}
+	if len(rest) == 0 || !ValidBucketName(rest[0]) {
+		return Keyspace{}, false
+	}
+	rv := Keyspace{Bucket: rest[0]}
+	if len(rest) >= 3 && rest[1] == "scopes" {
+		if !ValidCollectionName(rest[2]) {
+			return Keyspace{}, false
+		}
+		rv.Scope = rest[2]
+		if len(rest) >= 5 && rest[3] == "collections" {
+			if !ValidCollectionName(rest[4]) {
+				return Keyspace{}, false
+			}
+			rv.Collection = rest[4]
+		}
+	}
+	return rv, true
+}
+
+func equalSegments(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func validNameChars(name, extra string) bool {
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			strings.ContainsRune(extra, c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidBucketName returns true iff given string is valid bucket
+// name as enforced by ns_server: 1 to 100 characters among letters,
+// digits and "._%-", not starting with ".". Bucket names are case
+// sensitive and are never folded.
+func ValidBucketName(name string) bool {
+	return name != "" && len(name) <= 100 && name[0] != '.' && validNameChars(name, "._%-")
+}
+
+// ValidCollectionName returns true iff given string is valid scope
+// or collection name as enforced by ns_server: 1 to 251 characters
+// among letters, digits and "_%-", not starting with "%". Names
+// starting with "_" are reserved for "_default" and system scopes
+// and collections (e.g. "_system"), that requests may refer to too.
+func ValidCollectionName(name string) bool {
+	return name != "" && len(name) <= 251 && name[0] != '%' && validNameChars(name, "_%-")
+}
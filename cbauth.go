@@ -17,8 +17,16 @@
 package cbauth
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/couchbase/cbauth/cbauthimpl"
 )
@@ -35,6 +43,13 @@ import (
 type Authenticator interface {
 	// AuthWebCreds method extracts credentials from given http request.
 	AuthWebCreds(req *http.Request) (creds Creds, err error)
+	// AuthWebCredsFresh method is like AuthWebCreds, but always
+	// verifies creds with ns_server rather than against
+	// (possibly stale) cache. It is meant for security sensitive
+	// operations like changing credentials or deleting buckets.
+	// Digest auth is not supported since ns_server can't verify
+	// it.
+	AuthWebCredsFresh(req *http.Request) (creds Creds, err error)
 	// Auth method constructs credentials from given user and password pair.
 	Auth(user, pwd string) (creds Creds, err error)
 	// GetHTTPServiceAuth returns user/password creds giving
@@ -43,8 +58,262 @@ type Authenticator interface {
 	// GetMemcachedServiceAuth returns user/password creds given
 	// "admin" access to given memcached service.
 	GetMemcachedServiceAuth(hostport string) (user, pwd string, err error)
+	// AuthWebCredsContext method is AuthWebCreds that stops
+	// waiting for cbauth database to become fresh and aborts
+	// verification with ns_server once given context is done,
+	// in which case context's error is returned.
+	AuthWebCredsContext(ctx context.Context, req *http.Request) (creds Creds, err error)
+	// AuthWebCredsFreshContext method is AuthWebCredsFresh that
+	// obeys given context like AuthWebCredsContext.
+	AuthWebCredsFreshContext(ctx context.Context, req *http.Request) (creds Creds, err error)
+	// AuthContext method is Auth that obeys given context like
+	// AuthWebCredsContext.
+	AuthContext(ctx context.Context, user, pwd string) (creds Creds, err error)
+	// GetHTTPServiceAuthContext method is GetHTTPServiceAuth that
+	// stops waiting for cbauth database once given context is
+	// done.
+	GetHTTPServiceAuthContext(ctx context.Context, hostport string) (user, pwd string, err error)
+	// GetMemcachedServiceAuthContext method is
+	// GetMemcachedServiceAuth that stops waiting for cbauth
+	// database once given context is done.
+	GetMemcachedServiceAuthContext(ctx context.Context, hostport string) (user, pwd string, err error)
+	// GetScopedServiceAuth returns user/password creds giving
+	// access to given service inside couchbase cluster that is
+	// restricted to given permissions. Returned password is short
+	// lived token, so it should be obtained for every request (or
+	// connection) rather than cached. See BucketPermission.
+	GetScopedServiceAuth(hostport string, permissions ...string) (user, pwd string, err error)
+	// GetReadOnlyServiceAuth returns scoped creds (see
+	// GetScopedServiceAuth) restricted to ReadOnlyPermissions,
+	// i.e. reading metadata and docs but not changing anything.
+	// It is meant for monitoring and scraping components that
+	// shouldn't wield full internal admin creds.
+	GetReadOnlyServiceAuth(hostport string) (user, pwd string, err error)
+	// ResolveNodeAddress returns address to dial and creds to use
+	// in order to reach service listening on given internal port
+	// of node with given uuid. If external is true and node has
+	// alternate address, that address is returned.
+	ResolveNodeAddress(nodeUUID string, port int, external bool) (*NodeAddress, error)
+	// ValidateHost returns HostNotAllowedError if given request
+	// is addressed (by Host header or absolute request target)
+	// to host not allowed by given policy (nil means default
+	// policy). It is meant to be called before authenticating
+	// requests to browser exposed ports (see HostPolicy).
+	ValidateHost(req *http.Request, p *HostPolicy) error
+	// WaitForPermissionChange blocks until next cache update that
+	// changes password or roles of given user (or any group) is
+	// installed, so that code that has just changed RBAC via
+	// ns_server can wait until this service honors it. It
+	// returns ctx.Err() if context is done first. Since update
+	// may arrive before call is made, callers that can't afford
+	// waiting for the next one should obtain PermissionChange
+	// channel before changing RBAC.
+	WaitForPermissionChange(ctx context.Context, user string) error
+	// PermissionChange returns channel that is closed once next
+	// cache update affecting given user is installed (see
+	// WaitForPermissionChange). Returned release function must be
+	// called once caller stops waiting for channel.
+	PermissionChange(user string) (ch <-chan struct{}, release func())
+	// GetClientTLSConfig returns tls.Config for dialing other
+	// services of the cluster: it trusts cluster CA and presents
+	// node's client certificate. It must not be used for
+	// listening. Given server name (e.g. NodeAddress.TLSName) is
+	// used to verify server certificate; if empty, crypto/tls
+	// uses host of dialed address. Client certificate is taken
+	// from cbauth's cert store on every handshake, so rotations
+	// are picked up; trusted CAs, minimal TLS version and cipher
+	// suites are those of the time of call.
+	GetClientTLSConfig(serverName string) (*tls.Config, error)
+	// GetServerTLSConfig returns tls.Config for listening: it
+	// presents node certificate and honours minimal TLS version,
+	// cipher suites and client cert auth state of the cluster.
+	// Every handshake uses config built out of latest TLS
+	// settings (via GetConfigForClient), so listeners don't need
+	// to be rebuilt when certificates are rotated. Last known
+	// settings keep being used while cache is stale.
+	GetServerTLSConfig() (*tls.Config, error)
+	// GetTLSSettings returns TLS settings of the cluster as
+	// pushed by ns_server.
+	GetTLSSettings() (TLSSettings, error)
+	// RegisterTLSRefreshCallback registers function that is
+	// called (from separate goroutine) every time TLS settings or
+	// client cert auth state of the cluster change, e.g. because
+	// certificates were rotated. Any number of callbacks may be
+	// registered; they are called one by one in order of
+	// registration. Panics of callbacks are reported to
+	// ErrorReporter and don't affect other callbacks. Returned
+	// function unregisters callback.
+	RegisterTLSRefreshCallback(cb func()) (unregister func())
+	// RegisterConfigRefreshCallback is RegisterTLSRefreshCallback
+	// that subscribes only to changes of given kinds (or-ed
+	// ConfigChange flags) and passes subscribed kinds of changes
+	// that happened since last call to callback.
+	RegisterConfigRefreshCallback(kinds uint64, cb func(changed uint64)) (unregister func())
+	// GetClusterEncryption returns encryption settings of node
+	// to node traffic.
+	GetClusterEncryption() (ClusterEncryption, error)
+	// GetClusterEncryptionConfig returns whether node to node
+	// traffic has to be encrypted and whether non-TLS listeners
+	// must be disabled. Changes are reported to config refresh
+	// callbacks subscribed to ConfigChangeClusterEncryption.
+	GetClusterEncryptionConfig() (ClusterEncryptionConfig, error)
+	// RegisterCustomCredType registers verifier of service
+	// specific credentials of given type that ns_server pushes
+	// to cache (see VerifyCustomCred). Registering type again
+	// replaces its verifier. Returned function unregisters it.
+	RegisterCustomCredType(typ string, verify CustomCredVerifier) (unregister func())
+	// VerifyCustomCred verifies given secret against credential
+	// of given registered type and id pushed by ns_server.
+	// NoAccessCreds are returned if credential is unknown or
+	// secret doesn't match. Returned creds get revoked (see
+	// Creds.Revalidate) once ns_server changes or deletes
+	// credential.
+	VerifyCustomCred(typ, id string, secret []byte) (Creds, error)
+	// MintElevationToken returns token that grants given
+	// permission to given user of given domain (domain reported by
+	// ns_server or source of creds verified by cbauth itself) for
+	// given period of time. Approver must be admin in its own
+	// right, i.e. not via elevation, scoped token or on-behalf-of
+	// assertion. Token is passed by user in ElevationTokenHeader
+	// and is only valid on this node.
+	MintElevationToken(approver Creds, user, domain, permission string, ttl time.Duration) (string, error)
+	// MintMetakvToken returns token that grants given user (e.g.
+	// backup agent) access only to metakv keys under given prefix
+	// (which must begin and end with "/"), possibly read only,
+	// for given period of time. Token is signed by password of
+	// local node and is meant for metakv.ScopedStore.
+	MintMetakvToken(user, prefix string, readOnly bool, ttl time.Duration) (string, error)
+	// VerifyMetakvToken verifies token minted by MintMetakvToken on
+	// this node and returns scope that it grants.
+	VerifyMetakvToken(token string) (*MetakvScope, error)
+	// ResolveGroupRoles returns roles granted by cluster's
+	// group mappings to members of given groups. Groups may be
+	// given either by name or by external (LDAP/SSO) group name.
+	ResolveGroupRoles(groups []string) ([]Role, error)
+	// ListUsers returns page of up to limit users (name, domain
+	// and roles) known to local cache, starting after given
+	// cursor ("" for first page). Next page is fetched by passing
+	// returned cursor, which is "" after last page. Non-positive
+	// limit returns all remaining users.
+	ListUsers(cursor string, limit int) (users []UserInfo, next string, err error)
+	// GetBuckets returns buckets (names and uuids) known to
+	// local cache sorted by name.
+	GetBuckets() ([]BucketInfo, error)
+	// LookupBucket returns bucket with given name. ok is false if
+	// there is no such bucket. It is useful to validate bucket
+	// references during authorization.
+	LookupBucket(name string) (b BucketInfo, ok bool, err error)
+	// LookupBucketByUUID returns bucket with given uuid. ok is
+	// false if there is no such bucket (e.g. it was deleted or
+	// recreated since uuid was obtained).
+	LookupBucketByUUID(uuid string) (b BucketInfo, ok bool, err error)
+	// SetBucketsCallback registers function that is called (from
+	// separate goroutine) every time buckets are created, deleted
+	// or recreated with new uuid. nil disables notifications.
+	SetBucketsCallback(cb func(buckets []BucketInfo))
+	// GetHashParams returns algorithm and cost parameters of
+	// password hashes of users that are verified against local
+	// cache, so that tooling can report weak or legacy hashes.
+	GetHashParams() ([]HashParams, error)
+	// AuthClientCert maps given client certificate chain (leaf
+	// first, see tls.ConnectionState.PeerCertificates) to user
+	// using username extraction rules of client CA that trusts
+	// it. NoAccessCreds are returned if username can't be
+	// extracted or user is unknown, and ErrCertNotTrusted if no
+	// client CA trusts certificate. AuthWebCreds calls it for
+	// TLS requests when client certificate auth is enabled.
+	AuthClientCert(chain []*x509.Certificate) (Creds, error)
+	// Health returns how up to date authenticator's state is.
+	// Services can use it to shed load or alert before serving
+	// stale authorization decisions.
+	Health() HealthStatus
+	// SetLagPolicy configures when authenticator is reported as
+	// lagging and registers callback for lagging state changes. It
+	// also sets maximal acceptable age of cache (see
+	// CacheTooOldError).
+	SetLagPolicy(p LagPolicy)
+	// SetVerifierBackend replaces backend that credentials are
+	// verified against. nil restores default backend, i.e. cbauth
+	// cache. It may be called while authenticator is in use.
+	SetVerifierBackend(b VerifierBackend)
 }
 
+// HealthStatus type describes how up to date authenticator's state
+// is.
+type HealthStatus = cbauthimpl.HealthStatus
+
+// LagPolicy type configures when authenticator is reported as
+// lagging behind ns_server.
+type LagPolicy = cbauthimpl.LagPolicy
+
+// Permissions that can be passed to GetScopedServiceAuth. Bucket
+// permissions are constructed via BucketPermission.
+const (
+	PermissionAdmin           = cbauthimpl.PermissionAdmin
+	PermissionReadAnyMetadata = cbauthimpl.PermissionReadAnyMetadata
+)
+
+// ReadOnlyPermissions returns permissions creds returned by
+// GetReadOnlyServiceAuth are restricted to: PermissionReadAnyMetadata
+// and BucketOpRead on every bucket.
+func ReadOnlyPermissions() []string {
+	return []string{PermissionReadAnyMetadata, BucketPermission(AnyBucket, BucketOpRead)}
+}
+
+// Bucket operations that can be passed to BucketPermission.
+const (
+	BucketOpRead   = cbauthimpl.BucketOpRead
+	BucketOpWrite  = cbauthimpl.BucketOpWrite
+	BucketOpDDL    = cbauthimpl.BucketOpDDL
+	BucketOpDCP    = cbauthimpl.BucketOpDCP
+	BucketOpManage = cbauthimpl.BucketOpManage
+)
+
+// SetPrecomputedBucketOps sets bucket operations (e.g. BucketOpRead)
+// whose grants are precomputed from roles on every cache update, so
+// that checking them doesn't walk roles. BucketOpRead and
+// BucketOpWrite are precomputed by default. Change takes effect with
+// next cache update.
+func SetPrecomputedBucketOps(ops ...string) {
+	cbauthimpl.SetPrecomputedBucketOps(ops...)
+}
+
+// PrecomputedBucketOps returns bucket operations whose grants are
+// precomputed (see SetPrecomputedBucketOps).
+func PrecomputedBucketOps() []string {
+	return cbauthimpl.PrecomputedBucketOps()
+}
+
+// AnyBucket can be passed to BucketPermission to construct
+// permission that applies to every bucket.
+const AnyBucket = cbauthimpl.AnyBucket
+
+// BucketPermission returns permission string for given operation
+// (e.g. BucketOpRead) on given bucket.
+func BucketPermission(bucket, op string) string {
+	return cbauthimpl.BucketPermission(bucket, op)
+}
+
+// BucketInfo type describes bucket known to cluster (see
+// Authenticator.GetBuckets).
+type BucketInfo = cbauthimpl.BucketInfo
+
+// UserInfo type describes user known to cluster (see
+// Authenticator.ListUsers).
+type UserInfo = cbauthimpl.UserInfo
+
+// ErrInvalidCursor is returned by ListUsers when given cursor is
+// malformed.
+var ErrInvalidCursor = cbauthimpl.ErrInvalidCursor
+
+// HashParams type describes how password of cached user is hashed
+// (see Authenticator.GetHashParams).
+type HashParams = cbauthimpl.HashParams
+
+// Role type describes role (possibly parameterized by bucket)
+// granted to some user or group.
+type Role = cbauthimpl.Role
+
 // TODO: get rid of unnecessary error returns
 
 // Creds type represents credentials and answers queries on this creds
@@ -77,8 +346,149 @@ type Creds interface {
 	// this time it delegates to CanAccessBucket in only
 	// implementation.
 	CanDDLBucket(bucket string) (bool, error)
+	// CanWriteBucket method returns true iff this creds represent
+	// valid account that can write (but not necessarily read)
+	// docs in given bucket.
+	CanWriteBucket(bucket string) (bool, error)
+	// CanDCPBucket method returns true iff this creds represent
+	// valid account that can open DCP streams of given bucket.
+	CanDCPBucket(bucket string) (bool, error)
+	// CanManageBucket method returns true iff this creds
+	// represent valid account that can change settings of given
+	// bucket. Unlike other bucket operations it is never granted
+	// by bucket password.
+	CanManageBucket(bucket string) (bool, error)
+	// CanAccessCollection method returns true iff this creds
+	// represent valid account that can read/write docs in given
+	// collection of given scope of given bucket. Roles granted on
+	// collection, its scope or whole bucket are taken into
+	// account.
+	CanAccessCollection(bucket, scope, collection string) (bool, error)
+	// CanReadCollection method returns true iff this creds
+	// represent valid account that can read (but not necessarily
+	// write) docs in given collection (see CanAccessCollection).
+	CanReadCollection(bucket, scope, collection string) (bool, error)
+	// Limits method returns tenant, quota and scheduling
+	// priority attributes of this creds' user as set by
+	// ns_server. Services can use them for admission control.
+	Limits() Limits
+	// Revalidate method cheaply checks whether this creds are
+	// still valid according to latest cbauth cache. It returns
+	// ErrCredsRevoked if user's roles changed or user no longer
+	// exists since creds were obtained. Long running operations
+	// can call it periodically to abort if access was revoked.
+	Revalidate() error
+	// IsLegacy method returns true iff this creds were obtained
+	// via deprecated bucket name and password auth (including
+	// anonymous access to no-password buckets). Such auth will
+	// be removed, so services should help users migrate away.
+	IsLegacy() bool
+	// Identity method returns attributes of user (roles,
+	// domain, uuid, expiration and any fields unknown to this
+	// version of cbauth) reported by ns_server. Zero Identity is
+	// returned if creds were verified without ns_server.
+	Identity() Identity
+	// Mechanism method returns how identity of this creds was
+	// established (e.g. MechanismBasic or MechanismUIToken), so
+	// that services can audit it and refuse sensitive operations
+	// over weaker mechanisms. Note that Source reports where user
+	// is defined rather than how it authenticated.
+	Mechanism() Mechanism
+	// Explain method returns explanation of how check of given
+	// permission (see RouteTable) against this creds is decided:
+	// whether it is allowed and which role, elevation or scoped
+	// token permission granted it. It is meant for "why can't I
+	// do this" diagnostics.
+	Explain(permission string) (Explanation, error)
+	// IsInternal method returns true iff this creds represent
+	// one of reserved internal users (e.g. @cbq-engine or @fts),
+	// i.e. other service of this cluster (see InternalUsers).
+	IsInternal() bool
+	// IsAllowed method returns true iff this creds are granted
+	// given RBAC permission (e.g.
+	// "cluster.bucket[foo].data.docs!write"). Permission on
+	// object grants same operation on its children. Permission
+	// is decided by cached roles if possible and by ns_server
+	// otherwise (ErrUndecidedPermission is returned if ns_server
+	// can't be asked).
+	IsAllowed(permission string) (bool, error)
+	// Roles method returns roles (with their bucket, scope and
+	// collection parameters) granted to this creds' user, so
+	// that services can do their own authorization mapping or
+	// show effective roles. Roles are not known for all creds
+	// (e.g. scoped or legacy ones), in which case nil is
+	// returned.
+	Roles() []Role
+	// Actor method returns name of internal user (i.e. other
+	// service of this cluster) that made request on behalf of
+	// this creds' user (see OnBehalfOfHeader) or "" if request
+	// was made by user itself.
+	Actor() string
+}
+
+// InternalUsers returns sorted names of reserved internal users
+// that services of cluster use to authenticate to each other.
+func InternalUsers() []string {
+	return cbauthimpl.InternalUsers()
 }
 
+// RegisterInternalUser adds given name (which must begin with @) to
+// reserved internal users, e.g. for services newer than this
+// version of cbauth. Unknown names that begin with @ still
+// authenticate with special password, but are not reported as
+// internal users (see Creds.IsInternal). Returned function removes
+// name again unless it was already reserved.
+func RegisterInternalUser(name string) (unregister func()) {
+	return cbauthimpl.RegisterInternalUser(name)
+}
+
+// Explanation type describes how permission check was decided (see
+// Creds.Explain).
+type Explanation = cbauthimpl.Explanation
+
+// Grants that can be reported in Explanation.
+const (
+	GrantAuthenticated  = cbauthimpl.GrantAuthenticated
+	GrantElevation      = cbauthimpl.GrantElevation
+	GrantScope          = cbauthimpl.GrantScope
+	GrantRole           = cbauthimpl.GrantRole
+	GrantBucketPassword = cbauthimpl.GrantBucketPassword
+	GrantNone           = cbauthimpl.GrantNone
+)
+
+// Identity type describes attributes of user reported by ns_server.
+type Identity = cbauthimpl.Identity
+
+// Mechanism type describes how identity of creds was established.
+type Mechanism = cbauthimpl.Mechanism
+
+// Auth mechanisms that can be returned by Creds.Mechanism.
+const (
+	MechanismBasic      = cbauthimpl.MechanismBasic
+	MechanismDigest     = cbauthimpl.MechanismDigest
+	MechanismScram      = cbauthimpl.MechanismScram
+	MechanismJWT        = cbauthimpl.MechanismJWT
+	MechanismUIToken    = cbauthimpl.MechanismUIToken
+	MechanismClientCert = cbauthimpl.MechanismClientCert
+	MechanismOnBehalfOf = cbauthimpl.MechanismOnBehalfOf
+	MechanismInternal   = cbauthimpl.MechanismInternal
+	MechanismCustom     = cbauthimpl.MechanismCustom
+	MechanismMirror     = cbauthimpl.MechanismMirror
+)
+
+// ErrCredsRevoked is returned by Creds.Revalidate when creds were
+// revoked or their permissions changed.
+var ErrCredsRevoked = cbauthimpl.ErrCredsRevoked
+
+// ErrUndecidedPermission is returned by Creds.IsAllowed when
+// permission can't be decided by cached roles and ns_server doesn't
+// support permission checks.
+var ErrUndecidedPermission = cbauthimpl.ErrUndecidedPermission
+
+// Limits type describes tenant, quota and scheduling priority
+// attributes of some user. Meaning of quotas is defined by services.
+type Limits = cbauthimpl.Limits
+
 var _ Creds = (*cbauthimpl.CredsImpl)(nil)
 
 type naCreds struct{}
@@ -91,6 +501,53 @@ func (na naCreds) CanReadAnyMetadata() bool                    { return false }
 func (na naCreds) CanAccessBucket(bucket string) (bool, error) { return false, nil }
 func (na naCreds) CanReadBucket(bucket string) (bool, error)   { return false, nil }
 func (na naCreds) CanDDLBucket(bucket string) (bool, error)    { return false, nil }
+func (na naCreds) CanWriteBucket(bucket string) (bool, error)  { return false, nil }
+func (na naCreds) CanDCPBucket(bucket string) (bool, error)    { return false, nil }
+func (na naCreds) CanManageBucket(bucket string) (bool, error) { return false, nil }
+func (na naCreds) Limits() Limits                              { return Limits{} }
+func (na naCreds) Revalidate() error                           { return nil }
+func (na naCreds) IsLegacy() bool                              { return false }
+func (na naCreds) Identity() Identity                          { return Identity{} }
+func (na naCreds) Mechanism() Mechanism                        { return "" }
+func (na naCreds) IsInternal() bool                            { return false }
+func (na naCreds) Roles() []Role                               { return nil }
+func (na naCreds) Actor() string                               { return "" }
+func (na naCreds) String() string                              { return "Creds(no access)" }
+func (na naCreds) LogValue() slog.Value                        { return slog.StringValue(na.String()) }
+
+func (na naCreds) CanAccessCollection(bucket, scope, collection string) (bool, error) {
+	return false, nil
+}
+
+func (na naCreds) CanReadCollection(bucket, scope, collection string) (bool, error) {
+	return false, nil
+}
+
+func (na naCreds) IsAllowed(permission string) (bool, error) {
+	return false, nil
+}
+
+func (na naCreds) Explain(permission string) (Explanation, error) {
+	if _, err := evalPermission(na, permission); err != nil {
+		return Explanation{}, err
+	}
+	return Explanation{Permission: permission, Grant: GrantNone, Reason: "not authenticated"}, nil
+}
+
+// TagUserData wraps given string (e.g. user name) into couchbase log
+// redaction tags. Creds are formatted (both by fmt and log/slog)
+// using these tags already.
+func TagUserData(s string) string {
+	return cbauthimpl.TagUserData(s)
+}
+
+// ErrNoAuthEndpoint is returned by AuthWebCredsFresh when ns_server
+// didn't provide its auth endpoint.
+var ErrNoAuthEndpoint = errors.New("ns_server auth endpoint is unknown")
+
+// ErrFreshDigestAuth is returned by AuthWebCredsFresh for requests
+// that use digest auth.
+var ErrFreshDigestAuth = errors.New("digest auth can't be verified by ns_server")
 
 // NoAccessCreds is Creds instance that has no access at
 // all. Authenticator returns this Creds instance for incoming auth
@@ -98,7 +555,19 @@ func (na naCreds) CanDDLBucket(bucket string) (bool, error)    { return false, n
 var NoAccessCreds Creds = naCreds{}
 
 type authImpl struct {
-	svc *cbauthimpl.Svc
+	svc           *cbauthimpl.Svc
+	hdrCache      authHeaderCache
+	negCache      negativeAuthCache
+	digestNonces  digestNonces
+	scramSessions scramSessions
+	jwtKeySets    jwtKeySets
+	liveTLS       liveTLS
+	customTypes   customCredTypes
+	uiTokens      uiTokenFlights
+	rateLimits    authRateLimiter
+	recordingL    sync.Mutex
+	recording     atomic.Value
+	backend       atomic.Value
 }
 
 // DBStaleError is kind of error that signals that cbauth internal
@@ -114,6 +583,21 @@ func (e *DBStaleError) Error() string {
 	return "CBAuth database is stale. Was never updated yet."
 }
 
+// Unwrap method returns reason of staleness, e.g. FatalError.
+func (e *DBStaleError) Unwrap() error {
+	return e.Err
+}
+
+// Is method returns true for ErrStaleCache.
+func (e *DBStaleError) Is(target error) bool {
+	return target == ErrStaleCache
+}
+
+// CacheTooOldError is returned instead of serving from cache that is
+// older than LagPolicy.MaxCacheAge. It wraps DBStaleError, so code
+// that treats DBStaleError as "try later" handles it too.
+type CacheTooOldError = cbauthimpl.CacheTooOldError
+
 // UnknownHostPortError is returned from GetMemcachedServiceAuth and
 // GetHTTPServiceAuth calls for unknown host:port arguments.
 type UnknownHostPortError string
@@ -122,28 +606,113 @@ func (s UnknownHostPortError) Error() string {
 	return fmt.Sprintf("Unable to find given hostport in cbauth database: `%s'", string(s))
 }
 
-func doOnServer(s *cbauthimpl.Svc, hdr http.Header) (Creds, error) {
-	rv, err := cbauthimpl.VerifyOnServer(s, hdr)
-	if rv == nil && err == nil {
+// UnknownNodeError is returned from ResolveNodeAddress for unknown
+// node uuid and port arguments.
+type UnknownNodeError struct {
+	UUID string
+	Port int
+}
+
+func (e UnknownNodeError) Error() string {
+	return fmt.Sprintf("Unable to find port %d of node `%s' in cbauth database", e.Port, e.UUID)
+}
+
+// NodeAddress type describes how to reach some service of some node
+// and which creds to use for that.
+type NodeAddress = cbauthimpl.NodeAddress
+
+// recordVerifyError records error of verification with ns_server.
+// Unexpected responses are also reported to ErrorReporter, while
+// e.g. connection errors are not, since they don't mean that
+// something is broken.
+func recordVerifyError(err error) {
+	var bad *BadResponseError
+	if !errors.As(err, &bad) {
+		recordError("ns_server verification failed: %s", err)
+		return
+	}
+	reportError("ns_server verification failed", err, map[string]string{
+		ReportComponent: "auth",
+	})
+}
+
+// doOnServer verifies given request headers with ns_server. User, if
+// known, is only used for tracing.
+func doOnServer(ctx context.Context, s *cbauthimpl.Svc, user string, hdr http.Header) (Creds, error) {
+	ctx, span := startSpan(ctx, SpanServerVerify)
+	defer span.End()
+	hdr, id := withCorrelationID(hdr)
+	rv, err := cbauthimpl.VerifyOnServerContext(ctx, s, withSpanContext(span, hdr))
+	span.SetAttribute(AttrDecision, decisionOutcome(rv != nil, err))
+	if err != nil {
+		span.RecordError(err)
+		tracef(user, "ns_server verification failed (correlation id %s): %v", id, err)
+		recordVerifyError(err)
+		return nil, err
+	}
+	if rv == nil {
+		tracef(user, "ns_server didn't recognise creds (correlation id %s)", id)
 		return NoAccessCreds, nil
 	}
-	return rv, err
+	tracef(rv.Name(), "ns_server verified creds: %v", rv)
+	return rv, nil
 }
 
-func doAuth(a *authImpl, user, pwd string, hdr http.Header) (Creds, error) {
-	ci, err := cbauthimpl.VerifyPassword(a.svc, user, pwd)
+// refuseRevoked returns NoAccessCreds in place of given creds if
+// ns_server revoked them (see cbauthimpl.Svc.Revoke).
+func refuseRevoked(creds Creds) Creds {
+	if ci, ok := creds.(*cbauthimpl.CredsImpl); ok && ci.Revoked() {
+		tracef(ci.Name(), "creds of %s are revoked", TagUserData(ci.Name()))
+		return NoAccessCreds
+	}
+	return creds
+}
+
+func doAuth(ctx context.Context, a *authImpl, user, pwd string, hdr http.Header, remoteAddr string) (Creds, error) {
+	if pwd == "" {
+		allowed, err := emptyPasswordAllowed(a, remoteAddr)
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			tracef(user, "empty password of %s is refused by policy", TagUserData(user))
+			return NoAccessCreds, nil
+		}
+	}
+
+	_, span := startSpan(ctx, SpanCacheLookup)
+	ci, err := a.verifier().VerifyPassword(user, pwd)
+	span.SetAttribute(AttrCacheHit, ci != nil)
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
 	if err != nil {
+		tracef(user, "cache lookup of %s failed: %v", TagUserData(user), err)
 		return nil, err
 	}
 
 	if ci != nil {
+		tracef(user, "cache verified creds: %v", ci)
+		if ci.IsLegacy() {
+			noteLegacyAuth(user)
+		}
 		return ci, nil
 	}
 
 	if user == "" {
+		tracef(user, "anonymous access is not allowed")
+		return NoAccessCreds, nil
+	}
+
+	negKey, gen := negativeAuthFingerprint(user, pwd), cbauthimpl.CurrentGeneration(a.svc)
+	if a.negCache.refused(negKey, gen) {
+		tracef(user, "ns_server refused same creds of %s recently", TagUserData(user))
 		return NoAccessCreds, nil
 	}
 
+	tracef(user, "cache didn't recognise %s, escalating to ns_server", TagUserData(user))
+
 	// TODO: consider short-cutting this when we know that
 	// ldap auth is not configured
 	if hdr == nil {
@@ -154,25 +723,219 @@ func doAuth(a *authImpl, user, pwd string, hdr http.Header) (Creds, error) {
 		req.SetBasicAuth(user, pwd)
 		hdr = req.Header
 	}
-	return doOnServer(a.svc, hdr)
+	creds, err := doOnServer(ctx, a.svc, user, hdr)
+	if err == nil && creds == NoAccessCreds {
+		a.negCache.put(negKey, gen)
+	}
+	return creds, err
 }
 
-func (a *authImpl) AuthWebCreds(req *http.Request) (creds Creds, err error) {
-	if cbauthimpl.IsAuthTokenPresent(req) {
-		return doOnServer(a.svc, req.Header)
+func (a *authImpl) AuthWebCreds(req *http.Request) (Creds, error) {
+	return a.AuthWebCredsContext(context.Background(), req)
+}
+
+func (a *authImpl) AuthWebCredsContext(ctx context.Context, req *http.Request) (Creds, error) {
+	ctx, span := startSpan(ctx, SpanAuthWebCreds)
+	defer span.End()
+	if err := cbauthimpl.WaitFresh(ctx, a.svc); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	if err := a.rateLimits.check(req); err != nil {
+		span.RecordError(err)
+		auditAuth(req, nil, err)
+		return nil, err
+	}
+	o := getDecisionObserver()
+	if o == nil {
+		creds, path, err := a.authWebCreds(ctx, req)
+		annotateAuthSpan(span, path, creds, err)
+		recordAuth(a, path, creds, err)
+		traceAuthFailure(req, creds, err)
+		auditAuth(req, creds, err)
+		return creds, err
 	}
-	user, pwd, err := ExtractCreds(req)
+	start := time.Now()
+	creds, path, err := a.authWebCreds(ctx, req)
+	annotateAuthSpan(span, path, creds, err)
+	observeAuth(o, start, path, creds, err)
+	recordAuth(a, path, creds, err)
+	traceAuthFailure(req, creds, err)
+	auditAuth(req, creds, err)
+	return creds, err
+}
+
+// traceAuthFailure traces correlation id of failed auth of given
+// request (see CorrelationID).
+func traceAuthFailure(req *http.Request, creds Creds, err error) {
+	if creds == NoAccessCreds || err != nil {
+		tracef("", "auth of request to %s failed, correlation id %s", req.URL.Path, CorrelationID(req))
+	}
+}
+
+func (a *authImpl) authWebCreds(ctx context.Context, req *http.Request) (creds Creds, path string, err error) {
+	var ok bool
+	if creds, ok, err = verifyCustom(req, VerifyBeforeBuiltin); ok {
+		path = PathCustom
+	} else if creds, path, err = a.authWebCredsBuiltin(ctx, req); creds == NoAccessCreds || errors.Is(err, errNonBasicAuth) {
+		if c, ok, cerr := verifyCustom(req, VerifyAfterBuiltin); ok {
+			creds, path, err = c, PathCustom, cerr
+		}
+	}
+	if err == nil && path == PathCustom {
+		creds, err = maybeElevate(a, creds, req)
+	}
+	if err == nil {
+		creds, err = maybeOnBehalfOf(ctx, a, creds, req)
+	}
+	if err == nil {
+		creds = refuseRevoked(creds)
+	}
+	// every failure (denied elevation, stale cache, etc.) spends
+	// allowance, except for auth schemes that cbauth leaves to
+	// caller
+	if creds == NoAccessCreds || (err != nil && !errors.Is(err, errNonBasicAuth)) {
+		a.rateLimits.fail(req)
+	}
+	if err != nil {
+		return nil, path, err
+	}
+	return creds, path, err
+}
+
+func (a *authImpl) authWebCredsBuiltin(ctx context.Context, req *http.Request) (creds Creds, path string, err error) {
+	var ok bool
+	if creds, ok, err = a.authWebCert(req); ok {
+		path = PathClientCert
+	} else if cbauthimpl.IsAuthTokenPresent(req) {
+		tracef("", "ui token is present in request to %s", req.URL.Path)
+		creds, err = a.uiTokens.verify(ctx, a.svc, req.Header)
+		path = PathServer
+	} else if params, ok := digestAuthParams(req.Header.Get("Authorization")); ok {
+		creds, err = doDigestAuth(ctx, a, req, params)
+		path = PathDigest
+	} else if mech, params, ok := scramAuthParams(req.Header.Get("Authorization")); ok {
+		creds, err = doScramAuth(ctx, a, req, mech, params)
+		path = PathScram
+	} else if token, settings, ok := a.jwtBearerToken(req); ok {
+		creds, err = doJWTAuth(ctx, a, req, token, settings)
+		path = PathJWT
+	} else if c := a.hdrCache.get(req.Header.Get("Authorization")); c != nil {
+		tracef(c.Name(), "reusing recent auth result of %s for request to %s", TagUserData(c.Name()), req.URL.Path)
+		if c.IsLegacy() {
+			noteLegacyAuth(c.Name())
+		}
+		creds = c
+		path = PathHeaderCache
+	} else {
+		var user, pwd string
+		user, pwd, err = ExtractCreds(req)
+		if err != nil {
+			tracef("", "failed to extract creds from request to %s: %v", req.URL.Path, err)
+			return nil, PathCache, err
+		}
+		tracef(user, "extracted basic creds of %s from request to %s", TagUserData(user), req.URL.Path)
+		creds, err = doAuth(ctx, a, user, pwd, req.Header, req.RemoteAddr)
+		mirrorAuth(user, pwd, req.Header, creds, err)
+		path = authPath(creds)
+		// empty passwords are subject to EmptyPasswordPolicy,
+		// so their auth results are not reused
+		if err == nil && pwd != "" {
+			a.hdrCache.put(req.Header.Get("Authorization"), creds)
+		}
+	}
+	if err != nil {
+		return nil, path, err
+	}
+	creds, err = maybeElevate(a, creds, req)
+	return creds, path, err
+}
+
+func (a *authImpl) AuthWebCredsFresh(req *http.Request) (Creds, error) {
+	return a.AuthWebCredsFreshContext(context.Background(), req)
+}
+
+func (a *authImpl) AuthWebCredsFreshContext(ctx context.Context, req *http.Request) (Creds, error) {
+	if err := cbauthimpl.WaitFresh(ctx, a.svc); err != nil {
+		return nil, err
+	}
+	o := getDecisionObserver()
+	start := time.Now()
+	creds, err := a.authWebCredsFresh(ctx, req)
+	if o != nil {
+		observeAuth(o, start, PathServer, creds, err)
+	}
+	recordAuth(a, PathServer, creds, err)
+	return creds, err
+}
+
+func (a *authImpl) authWebCredsFresh(ctx context.Context, req *http.Request) (Creds, error) {
+	if _, ok := digestAuthParams(req.Header.Get("Authorization")); ok {
+		return nil, ErrFreshDigestAuth
+	}
+	url, err := cbauthimpl.GetAuthEndpoint(a.svc)
+	if err != nil {
+		return nil, err
+	}
+	if url == "" {
+		return nil, ErrNoAuthEndpoint
+	}
+	tracef("", "verifying creds of request to %s with ns_server", req.URL.Path)
+	ctx, span := startSpan(ctx, SpanServerVerifyFresh)
+	hdr, _ := withCorrelationID(req.Header)
+	ci, err := cbauthimpl.VerifyOnEndpointContext(ctx, a.svc, url, withSpanContext(span, hdr))
+	span.SetAttribute(AttrDecision, decisionOutcome(ci != nil, err))
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
 	if err != nil {
+		tracef("", "ns_server verification failed: %v", err)
+		recordVerifyError(err)
 		return nil, err
 	}
-	return doAuth(a, user, pwd, req.Header)
+	if ci == nil {
+		tracef("", "ns_server didn't recognise creds")
+		return NoAccessCreds, nil
+	}
+	tracef(ci.Name(), "ns_server verified creds: %v", ci)
+	creds, err := maybeElevate(a, ci, req)
+	if err != nil {
+		return nil, err
+	}
+	return refuseRevoked(creds), nil
 }
 
 func (a *authImpl) Auth(user, pwd string) (creds Creds, err error) {
-	return doAuth(a, user, pwd, nil)
+	return a.AuthContext(context.Background(), user, pwd)
+}
+
+func (a *authImpl) AuthContext(ctx context.Context, user, pwd string) (creds Creds, err error) {
+	if err = cbauthimpl.WaitFresh(ctx, a.svc); err != nil {
+		return nil, err
+	}
+	o := getDecisionObserver()
+	start := time.Now()
+	creds, err = doAuth(ctx, a, user, pwd, nil, "")
+	if err == nil {
+		creds = refuseRevoked(creds)
+	}
+	mirrorAuth(user, pwd, nil, creds, err)
+	if o != nil {
+		observeAuth(o, start, authPath(creds), creds, err)
+	}
+	recordAuth(a, authPath(creds), creds, err)
+	return creds, err
 }
 
 func (a *authImpl) GetMemcachedServiceAuth(hostport string) (user, pwd string, err error) {
+	return a.GetMemcachedServiceAuthContext(context.Background(), hostport)
+}
+
+func (a *authImpl) GetMemcachedServiceAuthContext(ctx context.Context, hostport string) (user, pwd string, err error) {
+	if err = cbauthimpl.WaitFresh(ctx, a.svc); err != nil {
+		return "", "", err
+	}
 	host, port, err := SplitHostPort(hostport)
 	if err != nil {
 		return "", "", err
@@ -185,6 +948,13 @@ func (a *authImpl) GetMemcachedServiceAuth(hostport string) (user, pwd string, e
 }
 
 func (a *authImpl) GetHTTPServiceAuth(hostport string) (user, pwd string, err error) {
+	return a.GetHTTPServiceAuthContext(context.Background(), hostport)
+}
+
+func (a *authImpl) GetHTTPServiceAuthContext(ctx context.Context, hostport string) (user, pwd string, err error) {
+	if err = cbauthimpl.WaitFresh(ctx, a.svc); err != nil {
+		return "", "", err
+	}
 	host, port, err := SplitHostPort(hostport)
 	if err != nil {
 		return "", "", err
@@ -196,4 +966,79 @@ func (a *authImpl) GetHTTPServiceAuth(hostport string) (user, pwd string, err er
 	return
 }
 
+func (a *authImpl) GetScopedServiceAuth(hostport string, permissions ...string) (user, pwd string, err error) {
+	host, port, err := SplitHostPort(hostport)
+	if err != nil {
+		return "", "", err
+	}
+	user, pwd, err = cbauthimpl.MintScopedToken(a.svc, host, port, permissions)
+	if err == nil && user == "" && pwd == "" {
+		return "", "", UnknownHostPortError(hostport)
+	}
+	return
+}
+
+func (a *authImpl) GetReadOnlyServiceAuth(hostport string) (user, pwd string, err error) {
+	return a.GetScopedServiceAuth(hostport, ReadOnlyPermissions()...)
+}
+
+func (a *authImpl) PermissionChange(user string) (<-chan struct{}, func()) {
+	return cbauthimpl.PermissionChange(a.svc, user)
+}
+
+func (a *authImpl) WaitForPermissionChange(ctx context.Context, user string) error {
+	ch, release := a.PermissionChange(user)
+	defer release()
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *authImpl) ResolveNodeAddress(nodeUUID string, port int, external bool) (*NodeAddress, error) {
+	rv, err := cbauthimpl.ResolveNode(a.svc, nodeUUID, port, external)
+	if err == nil && rv == nil {
+		return nil, UnknownNodeError{nodeUUID, port}
+	}
+	return rv, err
+}
+
+func (a *authImpl) ResolveGroupRoles(groups []string) ([]Role, error) {
+	return cbauthimpl.ResolveGroupRoles(a.svc, groups)
+}
+
+func (a *authImpl) ListUsers(cursor string, limit int) ([]UserInfo, string, error) {
+	return cbauthimpl.ListUsers(a.svc, cursor, limit)
+}
+
+func (a *authImpl) GetBuckets() ([]BucketInfo, error) {
+	return cbauthimpl.GetBuckets(a.svc)
+}
+
+func (a *authImpl) LookupBucket(name string) (BucketInfo, bool, error) {
+	return cbauthimpl.LookupBucket(a.svc, name)
+}
+
+func (a *authImpl) LookupBucketByUUID(uuid string) (BucketInfo, bool, error) {
+	return cbauthimpl.LookupBucketByUUID(a.svc, uuid)
+}
+
+func (a *authImpl) SetBucketsCallback(cb func(buckets []BucketInfo)) {
+	cbauthimpl.SetBucketsCallback(a.svc, cb)
+}
+
+func (a *authImpl) GetHashParams() ([]HashParams, error) {
+	return cbauthimpl.GetHashParams(a.svc)
+}
+
+func (a *authImpl) Health() HealthStatus {
+	return cbauthimpl.GetHealth(a.svc)
+}
+
+func (a *authImpl) SetLagPolicy(p LagPolicy) {
+	cbauthimpl.SetLagPolicy(a.svc, p)
+}
+
 var _ Authenticator = (*authImpl)(nil)
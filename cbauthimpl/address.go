@@ -0,0 +1,110 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"net"
+	"strconv"
+)
+
+// NodeAddress struct describes how to reach some service of some
+// node and which creds to use for that.
+type NodeAddress struct {
+	// HostPort is address to dial.
+	HostPort string
+	// External is true if HostPort is alternate (external)
+	// address of node.
+	External bool
+	// TLSName is name to verify server certificate against
+	// (i.e. tls.Config.ServerName). It is node's internal host
+	// name even when external address is dialed, since that is
+	// name node certificates are issued for.
+	TLSName string
+	// MemcachedUser and User are memcached admin name and http
+	// special user (see GetCreds). Password is shared by both.
+	MemcachedUser string
+	User          string
+	Password      string
+}
+
+// ResolveNode returns address and creds of service listening on
+// given (internal) port of node with given uuid. If external is
+// true, alternate address of node is returned when node has one.
+// Returns nil, nil if node or port is unknown.
+func ResolveNode(s *Svc, uuid string, port int, external bool) (*NodeAddress, error) {
+	db := fetchDB(s)
+	if db == nil {
+		return nil, staleError(s)
+	}
+	for _, n := range db.nodes {
+		if uuid == "" || n.UUID != uuid {
+			continue
+		}
+		known := false
+		for _, p := range n.Ports {
+			if p == port {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, nil
+		}
+		rv := &NodeAddress{
+			HostPort:      net.JoinHostPort(n.Host, strconv.Itoa(port)),
+			TLSName:       n.Host,
+			MemcachedUser: n.User,
+			User:          db.specialUser,
+			Password:      n.Password,
+		}
+		if external && n.Alternate != nil && n.Alternate.Host != "" {
+			extPort := port
+			if p, ok := n.Alternate.Ports[port]; ok {
+				extPort = p
+			}
+			rv.HostPort = net.JoinHostPort(n.Alternate.Host, strconv.Itoa(extPort))
+			rv.External = true
+		}
+		return rv, nil
+	}
+	return nil, nil
+}
+
+// LocalAddresses returns host names (both internal and alternate)
+// and ports (likewise) of local node. Returns nils if local node is
+// not known.
+func LocalAddresses(s *Svc) (hosts []string, ports []int, err error) {
+	db := fetchDB(s)
+	if db == nil {
+		return nil, nil, staleError(s)
+	}
+	for _, n := range db.nodes {
+		if !n.Local {
+			continue
+		}
+		hosts = append(hosts, n.Host)
+		ports = append(ports, n.Ports...)
+		if n.Alternate != nil && n.Alternate.Host != "" {
+			hosts = append(hosts, n.Alternate.Host)
+			for _, p := range n.Ports {
+				if ext, ok := n.Alternate.Ports[p]; ok {
+					ports = append(ports, ext)
+				}
+			}
+		}
+	}
+	return hosts, ports, nil
+}
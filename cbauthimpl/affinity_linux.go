@@ -0,0 +1,39 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// pinThread restricts current thread to given CPUs.
+func pinThread(cpus []int) error {
+	var mask [16]uint64
+	for _, cpu := range cpus {
+		if cpu < 0 || cpu >= len(mask)*64 {
+			return fmt.Errorf("cpu %d is out of range", cpu)
+		}
+		mask[cpu/64] |= 1 << uint(cpu%64)
+	}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0,
+		unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask)))
+	if errno != 0 {
+		return fmt.Errorf("failed to pin hash worker to cpus %v: %v", cpus, errno)
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+// This file implements argon2id (RFC 9106) on top of BLAKE2b (RFC
+// 7693), since neither is part of standard library.
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+var blake2bIV = [8]uint64{
+	0x6a09e667f3bcc908, 0xbb67ae8584caa73b, 0x3c6ef372fe94f82b, 0xa54ff53a5f1d36f1,
+	0x510e527fade682d1, 0x9b05688c2b3e6c1f, 0x1f83d9abfb41bd6b, 0x5be0cd19137e2179,
+}
+
+var blake2bSigma = [12][16]byte{
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+	{14, 10, 4, 8, 9, 15, 13, 6, 1, 12, 0, 2, 11, 7, 5, 3},
+	{11, 8, 12, 0, 5, 2, 15, 13, 10, 14, 3, 6, 7, 1, 9, 4},
+	{7, 9, 3, 1, 13, 12, 11, 14, 2, 6, 5, 10, 4, 0, 15, 8},
+	{9, 0, 5, 7, 2, 4, 10, 15, 14, 1, 11, 12, 6, 8, 3, 13},
+	{2, 12, 6, 10, 0, 11, 8, 3, 4, 13, 7, 5, 15, 14, 1, 9},
+	{12, 5, 1, 15, 14, 13, 4, 10, 0, 7, 6, 3, 9, 2, 8, 11},
+	{13, 11, 7, 14, 12, 1, 3, 9, 5, 0, 15, 4, 8, 6, 2, 10},
+	{6, 15, 14, 9, 11, 3, 0, 8, 12, 2, 13, 7, 1, 4, 10, 5},
+	{10, 2, 8, 4, 7, 6, 1, 5, 15, 11, 9, 14, 3, 12, 13, 0},
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+	{14, 10, 4, 8, 9, 15, 13, 6, 1, 12, 0, 2, 11, 7, 5, 3},
+}
+
+func blake2bCompress(h *[8]uint64, block []byte, t uint64, final bool) {
+	var m [16]uint64
+	for i := range m {
+		m[i] = binary.LittleEndian.Uint64(block[i*8:])
+	}
+	var v [16]uint64
+	copy(v[:8], h[:])
+	copy(v[8:], blake2bIV[:])
+	v[12] ^= t
+	if final {
+		v[14] = ^v[14]
+	}
+	g := func(a, b, c, d int, x, y uint64) {
+		v[a] = v[a] + v[b] + x
+		v[d] = bits.RotateLeft64(v[d]^v[a], -32)
+		v[c] = v[c] + v[d]
+		v[b] = bits.RotateLeft64(v[b]^v[c], -24)
+		v[a] = v[a] + v[b] + y
+		v[d] = bits.RotateLeft64(v[d]^v[a], -16)
+		v[c] = v[c] + v[d]
+		v[b] = bits.RotateLeft64(v[b]^v[c], -63)
+	}
+	for i := range blake2bSigma {
+		s := &blake2bSigma[i]
+		g(0, 4, 8, 12, m[s[0]], m[s[1]])
+		g(1, 5, 9, 13, m[s[2]], m[s[3]])
+		g(2, 6, 10, 14, m[s[4]], m[s[5]])
+		g(3, 7, 11, 15, m[s[6]], m[s[7]])
+		g(0, 5, 10, 15, m[s[8]], m[s[9]])
+		g(1, 6, 11, 12, m[s[10]], m[s[11]])
+		g(2, 7, 8, 13, m[s[12]], m[s[13]])
+		g(3, 4, 9, 14, m[s[14]], m[s[15]])
+	}
+	for i := range h {
+		h[i] ^= v[i] ^ v[i+8]
+	}
+}
+
+// blake2b returns unkeyed BLAKE2b digest of given size (1 to 64
+// bytes) of concatenation of given inputs.
+func blake2b(size int, in ...[]byte) []byte {
+	var data []byte
+	for _, b := range in {
+		data = append(data, b...)
+	}
+	h := blake2bIV
+	h[0] ^= 0x01010000 ^ uint64(size)
+	var block [128]byte
+	t := uint64(0)
+	for len(data) > 128 {
+		t += 128
+		blake2bCompress(&h, data[:128], t, false)
+		data = data[128:]
+	}
+	copy(block[:], data)
+	t += uint64(len(data))
+	blake2bCompress(&h, block[:], t, true)
+
+	var out [64]byte
+	for i := range h {
+		binary.LittleEndian.PutUint64(out[i*8:], h[i])
+	}
+	return out[:size]
+}
+
+func le32(v uint32) []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	return b[:]
+}
+
+// argon2Hash is variable length hash function H' of argon2.
+func argon2Hash(size int, in ...[]byte) []byte {
+	in = append([][]byte{le32(uint32(size))}, in...)
+	if size <= 64 {
+		return blake2b(size, in...)
+	}
+	rv := make([]byte, 0, size)
+	v := blake2b(64, in...)
+	for size-len(rv) > 64 {
+		rv = append(rv, v[:32]...)
+		v = blake2b(64, v)
+	}
+	if n := size - len(rv); n < 64 {
+		v = blake2b(n, v)
+	}
+	return append(rv, v...)
+}
+
+const (
+	argon2BlockWords = 128
+	argon2SyncPoints = 4
+	argon2Version    = 0x13
+	argon2TypeID     = 2
+)
+
+type argon2Block [argon2BlockWords]uint64
+
+func blamka(v *argon2Block, i [16]int) {
+	gb := func(a, b, c, d int) {
+		mul := func(x, y uint64) uint64 {
+			return 2 * uint64(uint32(x)) * uint64(uint32(y))
+		}
+		v[a] = v[a] + v[b] + mul(v[a], v[b])
+		v[d] = bits.RotateLeft64(v[d]^v[a], -32)
+		v[c] = v[c] + v[d] + mul(v[c], v[d])
+		v[b] = bits.RotateLeft64(v[b]^v[c], -24)
+		v[a] = v[a] + v[b] + mul(v[a], v[b])
+		v[d] = bits.RotateLeft64(v[d]^v[a], -16)
+		v[c] = v[c] + v[d] + mul(v[c], v[d])
+		v[b] = bits.RotateLeft64(v[b]^v[c], -63)
+	}
+	gb(i[0], i[4], i[8], i[12])
+	gb(i[1], i[5], i[9], i[13])
+	gb(i[2], i[6], i[10], i[14])
+	gb(i[3], i[7], i[11], i[15])
+	gb(i[0], i[5], i[10], i[15])
+	gb(i[1], i[6], i[11], i[12])
+	gb(i[2], i[7], i[8], i[13])
+	gb(i[3], i[4], i[9], i[14])
+}
+
+// argon2Compress xors result of compression function G of x and y
+// into out.
+func argon2Compress(out, x, y *argon2Block) {
+	var r, q argon2Block
+	for i := range r {
+		r[i] = x[i] ^ y[i]
+	}
+	q = r
+	for row := 0; row < 8; row++ {
+		var idx [16]int
+		for k := range idx {
+			idx[k] = 16*row + k
+		}
+		blamka(&q, idx)
+	}
+	for col := 0; col < 8; col++ {
+		var idx [16]int
+		for k := 0; k < 8; k++ {
+			idx[2*k] = 2*col + 16*k
+			idx[2*k+1] = 2*col + 16*k + 1
+		}
+		blamka(&q, idx)
+	}
+	for i := range out {
+		out[i] ^= q[i] ^ r[i]
+	}
+}
+
+func (b *argon2Block) load(data []byte) {
+	for i := range b {
+		b[i] = binary.LittleEndian.Uint64(data[i*8:])
+	}
+}
+
+func (b *argon2Block) bytes() []byte {
+	rv := make([]byte, argon2BlockWords*8)
+	for i := range b {
+		binary.LittleEndian.PutUint64(rv[i*8:], b[i])
+	}
+	return rv
+}
+
+// argon2idKey derives key of given length from given password and
+// salt using argon2id with given number of passes, memory (in KiB)
+// and parallelism.
+func argon2idKey(password, salt []byte, passes, memory uint32, threads uint8, keyLen uint32) []byte {
+	return argon2id(password, salt, nil, nil, passes, memory, uint32(threads), keyLen)
+}
+
+func argon2id(password, salt, secret, data []byte, passes, memory, threads, keyLen uint32) []byte {
+	h0 := blake2b(64, le32(threads), le32(keyLen), le32(memory), le32(passes),
+		le32(argon2Version), le32(argon2TypeID),
+		le32(uint32(len(password))), password, le32(uint32(len(salt))), salt,
+		le32(uint32(len(secret))), secret, le32(uint32(len(data))), data)
+
+	memory = memory / (argon2SyncPoints * threads) * (argon2SyncPoints * threads)
+	if memory < 2*argon2SyncPoints*threads {
+		memory = 2 * argon2SyncPoints * threads
+	}
+	laneLen := memory / threads
+	segLen := laneLen / argon2SyncPoints
+	b := make([]argon2Block, memory)
+	for lane := uint32(0); lane < threads; lane++ {
+		b[lane*laneLen].load(argon2Hash(1024, h0, le32(0), le32(lane)))
+		b[lane*laneLen+1].load(argon2Hash(1024, h0, le32(1), le32(lane)))
+	}
+
+	var zero argon2Block
+	for n := uint32(0); n < passes; n++ {
+		for slice := uint32(0); slice < argon2SyncPoints; slice++ {
+			for lane := uint32(0); lane < threads; lane++ {
+				independent := n == 0 && slice < argon2SyncPoints/2
+				var in, addresses argon2Block
+				if independent {
+					in[0], in[1], in[2] = uint64(n), uint64(lane), uint64(slice)
+					in[3], in[4], in[5] = uint64(memory), uint64(passes), argon2TypeID
+				}
+				nextAddresses := func() {
+					in[6]++
+					addresses = zero
+					argon2Compress(&addresses, &zero, &in)
+					tmp := addresses
+					addresses = zero
+					argon2Compress(&addresses, &zero, &tmp)
+				}
+				index := uint32(0)
+				if n == 0 && slice == 0 {
+					// first two blocks are already there
+					index = 2
+					if independent {
+						nextAddresses()
+					}
+				}
+				offset := lane*laneLen + slice*segLen + index
+				for ; index < segLen; index, offset = index+1, offset+1 {
+					prev := offset - 1
+					if index == 0 && slice == 0 {
+						prev += laneLen
+					}
+					var rand uint64
+					if independent {
+						if index%argon2BlockWords == 0 {
+							nextAddresses()
+						}
+						rand = addresses[index%argon2BlockWords]
+					} else {
+						rand = b[prev][0]
+					}
+					ref := argon2RefIndex(rand, laneLen, segLen, threads, n, slice, lane, index)
+					argon2Compress(&b[offset], &b[prev], &b[ref])
+				}
+			}
+		}
+	}
+
+	final := b[laneLen-1]
+	for lane := uint32(1); lane < threads; lane++ {
+		last := &b[lane*laneLen+laneLen-1]
+		for i := range final {
+			final[i] ^= last[i]
+		}
+	}
+	return argon2Hash(int(keyLen), final.bytes())
+}
+
+// argon2RefIndex returns index of block that block at given index of
+// given segment references.
+func argon2RefIndex(rand uint64, laneLen, segLen, threads, n, slice, lane, index uint32) uint32 {
+	refLane := uint32(rand>>32) % threads
+	if n == 0 && slice == 0 {
+		refLane = lane
+	}
+	area, start := 3*segLen, ((slice+1)%argon2SyncPoints)*segLen
+	if lane == refLane {
+		area += index
+	}
+	if n == 0 {
+		area, start = slice*segLen, 0
+		if slice == 0 || lane == refLane {
+			area += index
+		}
+	}
+	if index == 0 || lane == refLane {
+		area--
+	}
+	p := rand & 0xffffffff
+	p = (p * p) >> 32
+	p = (p * uint64(area)) >> 32
+	return refLane*laneLen + uint32((uint64(start)+uint64(area)-(p+1))%uint64(laneLen))
+}
@@ -0,0 +1,129 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"github.com/couchbase/cbauth/rbac"
+)
+
+// AnyBucketRole is bucket name of roles that are granted on every
+// bucket.
+const AnyBucketRole = rbac.AnyParam
+
+// bucketRole returns name of role of this creds that grants given
+// operation on whole given bucket or "" if there is none. Roles are
+// only known for creds verified by ns_server (see Identity) and for
+// creds mapped to users known to cache.
+func (c *CredsImpl) bucketRole(bucket, op string) string {
+	return c.roleGranting(op, func(r Role) bool {
+		return r.OnBucket(bucket)
+	})
+}
+
+// collectionRole returns name of role of this creds that grants
+// given operation on given collection (either on collection itself,
+// its scope or its bucket) or "" if there is none.
+func (c *CredsImpl) collectionRole(bucket, scope, collection, op string) string {
+	return c.roleGranting(op, func(r Role) bool {
+		return r.OnCollection(bucket, scope, collection)
+	})
+}
+
+// credsRoles returns roles of this creds (see bucketRole).
+func (c *CredsImpl) credsRoles() []Role {
+	if c.identity != nil {
+		return c.identity.Roles
+	}
+	return c.roles
+}
+
+func (c *CredsImpl) roleGranting(op string, matches func(r Role) bool) string {
+	for _, r := range c.credsRoles() {
+		if matches(r) && r.Grants(op) {
+			return r.Name
+		}
+	}
+	return ""
+}
+
+// CanWriteBucket method returns true iff this creds represent
+// valid account that can write (but not necessarily read) docs in
+// given bucket.
+func (c *CredsImpl) CanWriteBucket(bucket string) (bool, error) {
+	if permsAllow(c.extra, bucket, BucketOpWrite) {
+		return true, nil
+	}
+	if c.scope != nil {
+		return c.scopeAllows(bucket, BucketOpWrite), nil
+	}
+	if c.hasBucketRole(bucket, BucketOpWrite) {
+		return true, nil
+	}
+	return c.CanAccessBucket(bucket)
+}
+
+// CanDCPBucket method returns true iff this creds represent valid
+// account that can open DCP streams of given bucket.
+func (c *CredsImpl) CanDCPBucket(bucket string) (bool, error) {
+	if permsAllow(c.extra, bucket, BucketOpDCP) {
+		return true, nil
+	}
+	if c.scope != nil {
+		return c.scopeAllows(bucket, BucketOpDCP), nil
+	}
+	if c.hasBucketRole(bucket, BucketOpDCP) {
+		return true, nil
+	}
+	return c.CanAccessBucket(bucket)
+}
+
+// CanManageBucket method returns true iff this creds represent
+// valid account that can change settings of given bucket (e.g.
+// flush or edit it). Unlike other bucket operations it is never
+// granted by bucket password.
+func (c *CredsImpl) CanManageBucket(bucket string) (bool, error) {
+	if permsAllow(c.extra, bucket, BucketOpManage) {
+		return true, nil
+	}
+	if c.scope != nil {
+		return c.scopeAllows(bucket, BucketOpManage), nil
+	}
+	return c.isAdmin || c.hasBucketRole(bucket, BucketOpManage), nil
+}
+
+// CanReadCollection method returns true iff this creds represent
+// valid account that can read docs in given collection, either
+// because they can read whole bucket or because of roles granted
+// on collection or its scope.
+func (c *CredsImpl) CanReadCollection(bucket, scope, collection string) (bool, error) {
+	ok, err := c.CanReadBucket(bucket)
+	if err != nil || ok || c.scope != nil {
+		return ok, err
+	}
+	return c.collectionRole(bucket, scope, collection, BucketOpRead) != "", nil
+}
+
+// CanAccessCollection method returns true iff this creds represent
+// valid account that can read and write docs in given collection
+// (see CanReadCollection).
+func (c *CredsImpl) CanAccessCollection(bucket, scope, collection string) (bool, error) {
+	ok, err := c.CanAccessBucket(bucket)
+	if err != nil || ok || c.scope != nil {
+		return ok, err
+	}
+	return c.collectionRole(bucket, scope, collection, BucketOpRead) != "" &&
+		c.collectionRole(bucket, scope, collection, BucketOpWrite) != "", nil
+}
@@ -0,0 +1,162 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import "sort"
+
+// BucketInfo struct describes bucket known to cbauth cache.
+type BucketInfo struct {
+	Name string
+	UUID string
+}
+
+// bucketWatch is state of bucket change notifications of Svc.
+type bucketWatch struct {
+	// known maps names of buckets of latest db to their uuids
+	known    map[string]string
+	version  uint64
+	callback func(buckets []BucketInfo)
+	// notified is version that was last reported to callback;
+	// it is protected by Svc.notifyL
+	notified uint64
+}
+
+func sortedBuckets(m map[string]string) []BucketInfo {
+	rv := make([]BucketInfo, 0, len(m))
+	for name, uuid := range m {
+		rv = append(rv, BucketInfo{Name: name, UUID: uuid})
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Name < rv[j].Name })
+	return rv
+}
+
+func sameBuckets(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, uuid := range a {
+		if other, ok := b[name]; !ok || other != uuid {
+			return false
+		}
+	}
+	return true
+}
+
+// GetBuckets returns buckets known to cache of given service sorted
+// by name.
+func GetBuckets(s *Svc) ([]BucketInfo, error) {
+	db := fetchDB(s)
+	if db == nil {
+		return nil, staleError(s)
+	}
+	return sortedBuckets(db.bucketUUIDs), nil
+}
+
+// LookupBucket returns bucket with given name. ok is false if
+// bucket is not known to cache of given service.
+func LookupBucket(s *Svc, name string) (b BucketInfo, ok bool, err error) {
+	db := fetchDB(s)
+	if db == nil {
+		return BucketInfo{}, false, staleError(s)
+	}
+	uuid, ok := db.bucketUUIDs[name]
+	if !ok {
+		return BucketInfo{}, false, nil
+	}
+	return BucketInfo{Name: name, UUID: uuid}, true, nil
+}
+
+// LookupBucketByUUID returns bucket with given uuid. ok is false if
+// no bucket known to cache of given service has that uuid (e.g.
+// because bucket was deleted or recreated since uuid was obtained).
+func LookupBucketByUUID(s *Svc, uuid string) (b BucketInfo, ok bool, err error) {
+	db := fetchDB(s)
+	if db == nil {
+		return BucketInfo{}, false, staleError(s)
+	}
+	name, ok := bucketByUUID(db, uuid)
+	if !ok {
+		return BucketInfo{}, false, nil
+	}
+	return BucketInfo{Name: name, UUID: uuid}, true, nil
+}
+
+func bucketByUUID(db *credsDB, uuid string) (string, bool) {
+	if uuid == "" {
+		return "", false
+	}
+	for name, other := range db.bucketUUIDs {
+		if other == uuid {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// BucketByUUID method returns name of bucket with given uuid
+// according to current cache (rather than cache this creds were
+// derived from), so that permissions of bucket that was recreated
+// under the same name are not granted by uuid of its predecessor.
+func (c *CredsImpl) BucketByUUID(uuid string) (name string, ok bool) {
+	db := latestDB(c.db)
+	if db == nil {
+		return "", false
+	}
+	return bucketByUUID(db, uuid)
+}
+
+// SetBucketsCallback sets function that is called (from separate
+// goroutine) every time set of buckets (or uuid of some bucket)
+// changes. Calls are serialized and report buckets at the time of
+// call, so intermediate changes may be coalesced. Losing ns_server
+// connection doesn't count as change. nil callback disables
+// notifications.
+func SetBucketsCallback(s *Svc, cb func(buckets []BucketInfo)) {
+	s.notifyL.Lock()
+	defer s.notifyL.Unlock()
+	s.l.Lock()
+	s.buckets.callback = cb
+	s.buckets.notified = s.buckets.version
+	s.l.Unlock()
+}
+
+// checkBucketsLocked notices changes of buckets of given (new) db
+// and notifies buckets callback about them.
+func checkBucketsLocked(s *Svc, db *credsDB) {
+	if db == nil || (s.buckets.known != nil && sameBuckets(s.buckets.known, db.bucketUUIDs)) {
+		return
+	}
+	s.buckets.known = db.bucketUUIDs
+	s.buckets.version++
+	if s.buckets.callback != nil {
+		go notifyBuckets(s)
+	}
+}
+
+func notifyBuckets(s *Svc) {
+	s.notifyL.Lock()
+	defer s.notifyL.Unlock()
+	s.l.Lock()
+	cb := s.buckets.callback
+	version := s.buckets.version
+	buckets := sortedBuckets(s.buckets.known)
+	s.l.Unlock()
+	if cb == nil || version == s.buckets.notified {
+		return
+	}
+	s.buckets.notified = version
+	cb(buckets)
+}
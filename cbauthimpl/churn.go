@@ -0,0 +1,209 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChurnWindow is how long changes of users' creds pushed by
+// ns_server are remembered (see RecentChanges).
+var ChurnWindow = time.Hour
+
+// maxRememberedChanges limits number of remembered changes per user.
+const maxRememberedChanges = 16
+
+// internalStampKey is key that creds of all internal users are
+// tracked under, since they share password of local node.
+const internalStampKey = "@internal"
+
+// userChurn tracks when creds (secrets or roles) of users changed
+// according to pushes of ns_server. Stamps of last push are kept
+// here rather than in db, so that changes are detected across
+// resets of service.
+type userChurn struct {
+	l       sync.Mutex
+	stamps  map[string]string
+	groups  string
+	changes map[string][]time.Time
+	// waiters are channels that are closed on next change of
+	// given user (see PermissionChange)
+	waiters map[string]*churnWaiter
+}
+
+// churnWaiter is channel that is closed on next change of some user
+// along with number of callers that wait for it. It is forgotten once
+// last of them gives up, so that waits for arbitrary user names that
+// never change don't pile up.
+type churnWaiter struct {
+	ch   chan struct{}
+	refs int
+}
+
+// groupsStamp returns fingerprint of groups of given cache. Group
+// membership of users is not known to cache, so change of any group
+// may affect any user.
+func groupsStamp(c *Cache) string {
+	parts := make([]string, 0, len(c.Groups))
+	for i := range c.Groups {
+		g := &c.Groups[i]
+		parts = append(parts, g.Name+"/"+g.LDAPGroupRef+"="+strings.Join(groupRoles(g), ","))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ";")
+}
+
+// userStamps returns fingerprints of creds of every user known to
+// given cache.
+func userStamps(c *Cache) map[string]string {
+	users := cacheUsers(c)
+	rv := make(map[string]string, len(users)+1)
+	for name, u := range users {
+		parts := make([]string, 0, len(u.roles))
+		for _, r := range u.roles {
+			parts = append(parts, r+"="+u.secrets[r])
+		}
+		sort.Strings(parts)
+		rv[name] = strings.Join(parts, ",")
+	}
+	for _, n := range c.Nodes {
+		if n.Local {
+			rv[internalStampKey] = fingerprint(n.Password)
+		}
+	}
+	return rv
+}
+
+// record remembers changes between previously pushed stamps and
+// given ones and wakes up waiters of changed users.
+func (uc *userChurn) record(stamps map[string]string, groups string, now time.Time) {
+	uc.l.Lock()
+	defer uc.l.Unlock()
+	// nothing is known about users before first push
+	if uc.stamps == nil || groups != uc.groups {
+		for name, w := range uc.waiters {
+			close(w.ch)
+			delete(uc.waiters, name)
+		}
+	}
+	uc.groups = groups
+	if uc.stamps != nil {
+		for name, stamp := range stamps {
+			if old, ok := uc.stamps[name]; ok && old != stamp {
+				uc.addLocked(name, now)
+			}
+		}
+		for name := range uc.stamps {
+			if _, ok := stamps[name]; !ok {
+				uc.addLocked(name, now)
+			}
+		}
+	}
+	uc.stamps = stamps
+}
+
+// add remembers change of creds of given user that didn't come with
+// cache update (e.g. revocation).
+func (uc *userChurn) add(name string, now time.Time) {
+	uc.l.Lock()
+	defer uc.l.Unlock()
+	uc.addLocked(name, now)
+}
+
+func (uc *userChurn) addLocked(name string, now time.Time) {
+	if uc.changes == nil {
+		uc.changes = make(map[string][]time.Time)
+	}
+	times := uc.changes[name]
+	if len(times) >= maxRememberedChanges {
+		times = times[1:]
+	}
+	uc.changes[name] = append(times, now)
+	if w := uc.waiters[name]; w != nil {
+		close(w.ch)
+		delete(uc.waiters, name)
+	}
+}
+
+func (uc *userChurn) wait(name string) (<-chan struct{}, func()) {
+	uc.l.Lock()
+	defer uc.l.Unlock()
+	if uc.waiters == nil {
+		uc.waiters = make(map[string]*churnWaiter)
+	}
+	w := uc.waiters[name]
+	if w == nil {
+		w = &churnWaiter{ch: make(chan struct{})}
+		uc.waiters[name] = w
+	}
+	w.refs++
+	var once sync.Once
+	return w.ch, func() { once.Do(func() { uc.release(name, w) }) }
+}
+
+func (uc *userChurn) release(name string, w *churnWaiter) {
+	uc.l.Lock()
+	defer uc.l.Unlock()
+	w.refs--
+	if w.refs == 0 && uc.waiters[name] == w {
+		delete(uc.waiters, name)
+	}
+}
+
+// PermissionChange returns channel that is closed when next cache
+// update that changes password or roles of given user (or any
+// group, since group membership is not known to cache) is
+// installed. Returned release function must be called once caller
+// stops waiting for channel. It may be called more than once.
+func PermissionChange(s *Svc, user string) (ch <-chan struct{}, release func()) {
+	return s.churn.wait(user)
+}
+
+// count returns number of changes of creds of given user within
+// ChurnWindow. Changes that are older are forgotten.
+func (uc *userChurn) count(name string, now time.Time) int {
+	uc.l.Lock()
+	defer uc.l.Unlock()
+	times := uc.changes[name]
+	i := 0
+	for i < len(times) && now.Sub(times[i]) > ChurnWindow {
+		i++
+	}
+	if i == len(times) {
+		delete(uc.changes, name)
+		return 0
+	}
+	uc.changes[name] = times[i:]
+	return len(times) - i
+}
+
+// RecentChanges method returns number of times creds (password or
+// roles) of this creds' user were changed by ns_server within
+// ChurnWindow. Changes of local node password are counted for
+// internal users.
+func (c *CredsImpl) RecentChanges() int {
+	if c.db == nil || c.db.svc == nil {
+		return 0
+	}
+	name := c.name
+	if c.IsInternal() {
+		name = internalStampKey
+	}
+	return c.db.svc.churn.count(name, Now())
+}
@@ -0,0 +1,277 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"crypto/x509"
+	"errors"
+	"strings"
+)
+
+// States of client certificate auth (see ClientCertAuth).
+const (
+	ClientCertDisable   = "disable"
+	ClientCertEnable    = "enable"
+	ClientCertMandatory = "mandatory"
+)
+
+// Certificate fields that username can be extracted from (see
+// CertUserRule).
+const (
+	CertPathSubjectCN = "subject.cn"
+	CertPathSANURI    = "san.uri"
+	CertPathSANDNS    = "san.dnsname"
+	CertPathSANEmail  = "san.email"
+)
+
+// ErrCertNotTrusted is returned by VerifyClientCert when client
+// certificate is not signed by any of trusted client CAs.
+var ErrCertNotTrusted = errors.New("client certificate is not trusted")
+
+// CertUserRule struct is used as part of Cache messages to describe
+// how username is extracted from client certificate. Value of
+// certificate field given by Path must begin with Prefix, which is
+// stripped. If Delimiter is not empty, username ends before first
+// of its characters.
+type CertUserRule struct {
+	Path      string `json:"path"`
+	Prefix    string `json:"prefix"`
+	Delimiter string `json:"delimiter"`
+	// Domain, if non-empty, is domain of users (e.g. "local" or
+	// "external") that names extracted by this rule refer to.
+	// Otherwise name must be unambiguous: certificate is refused
+	// if users of several domains have that name.
+	Domain string `json:"domain,omitempty"`
+}
+
+// ClientCA struct is used as part of Cache messages to describe
+// trusted client CA. Prefixes, if not empty, override cluster-wide
+// rules for certificates signed by this CA.
+type ClientCA struct {
+	PEM      string         `json:"pem"`
+	Prefixes []CertUserRule `json:"prefixes,omitempty"`
+}
+
+// ClientCertAuth struct is used as part of Cache messages to
+// describe client certificate auth settings of the cluster.
+type ClientCertAuth struct {
+	// State is ClientCertDisable (default), ClientCertEnable or
+	// ClientCertMandatory.
+	State string `json:"state,omitempty"`
+	// Prefixes are cluster-wide username extraction rules. They
+	// are tried in order and first rule that matches wins.
+	Prefixes []CertUserRule `json:"prefixes,omitempty"`
+	CAs      []ClientCA     `json:"cas,omitempty"`
+}
+
+type clientCA struct {
+	pool  *x509.CertPool
+	rules []CertUserRule
+}
+
+func parseClientCAs(a *ClientCertAuth) []clientCA {
+	var rv []clientCA
+	for _, ca := range a.CAs {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(ca.PEM)) {
+			// ns_server validates CAs before pushing them,
+			// so this is not expected; such CA trusts
+			// nothing
+			continue
+		}
+		rules := ca.Prefixes
+		if len(rules) == 0 {
+			rules = a.Prefixes
+		}
+		rv = append(rv, clientCA{pool, rules})
+	}
+	return rv
+}
+
+func certFieldValues(cert *x509.Certificate, path string) []string {
+	switch path {
+	case CertPathSubjectCN:
+		if cert.Subject.CommonName == "" {
+			return nil
+		}
+		return []string{cert.Subject.CommonName}
+	case CertPathSANURI:
+		var rv []string
+		for _, u := range cert.URIs {
+			rv = append(rv, u.String())
+		}
+		return rv
+	case CertPathSANDNS:
+		return cert.DNSNames
+	case CertPathSANEmail:
+		return cert.EmailAddresses
+	}
+	return nil
+}
+
+// CertUsername returns username that given rules extract from given
+// certificate or "" if no rule matches.
+func CertUsername(cert *x509.Certificate, rules []CertUserRule) string {
+	user, _ := certUser(cert, rules)
+	return user
+}
+
+// certUser returns username that given rules extract from given
+// certificate together with domain of rule that extracted it.
+func certUser(cert *x509.Certificate, rules []CertUserRule) (user, domain string) {
+	for _, r := range rules {
+		for _, v := range certFieldValues(cert, r.Path) {
+			if !strings.HasPrefix(v, r.Prefix) {
+				continue
+			}
+			v = v[len(r.Prefix):]
+			if r.Delimiter != "" {
+				if idx := strings.IndexAny(v, r.Delimiter); idx >= 0 {
+					v = v[:idx]
+				}
+			}
+			if v != "" {
+				return v, r.Domain
+			}
+		}
+	}
+	return "", ""
+}
+
+// GetClientCertState returns state of client certificate auth of
+// the cluster (ClientCertDisable if ns_server didn't set it).
+func GetClientCertState(s *Svc) (string, error) {
+	db := fetchDB(s)
+	if db == nil {
+		return "", staleError(s)
+	}
+	if db.certAuth.State == "" {
+		return ClientCertDisable, nil
+	}
+	return db.certAuth.State, nil
+}
+
+// VerifyClientCert verifies given client certificate chain (leaf
+// first, as in tls.ConnectionState.PeerCertificates) against
+// trusted client CAs and maps it to user known to cache using
+// username extraction rules of first CA that trusts it. Returns
+// ErrCertNotTrusted if no CA trusts certificate and nil creds if
+// username can't be extracted or user is unknown.
+func VerifyClientCert(s *Svc, chain []*x509.Certificate) (*CredsImpl, error) {
+	return VerifyClientCertVia(s, chain, nil)
+}
+
+// RolesLookup type describes functions that return roles and domain
+// of given user of given domain (any domain if it's empty). Empty
+// domain is returned if user is unknown or ambiguous.
+type RolesLookup func(user, domain string) (roles []Role, userDomain string, err error)
+
+// VerifyClientCertVia is VerifyClientCert that, if lookup is
+// non-nil, finds roles of user certificate is mapped to by calling
+// it rather than in cache.
+func VerifyClientCertVia(s *Svc, chain []*x509.Certificate, lookup RolesLookup) (*CredsImpl, error) {
+	db := fetchDB(s)
+	if db == nil {
+		return nil, staleError(s)
+	}
+	if len(chain) == 0 {
+		return nil, ErrCertNotTrusted
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	for _, ca := range db.clientCAs {
+		_, err := chain[0].Verify(x509.VerifyOptions{
+			Roots:         ca.pool,
+			Intermediates: intermediates,
+			CurrentTime:   Now(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err != nil {
+			continue
+		}
+		user, domain := certUser(chain[0], ca.rules)
+		if user == "" {
+			return nil, nil
+		}
+		if lookup == nil {
+			return certCreds(db, user, domain), nil
+		}
+		roles, userDomain, err := lookup(user, domain)
+		if err != nil || userDomain == "" {
+			return nil, err
+		}
+		rv := newCertCreds(db, user, userDomain, roles, buildRolePerms(roles, db.permsMask))
+		rv.lookup = lookup
+		return rv, nil
+	}
+	return nil, ErrCertNotTrusted
+}
+
+// lookupRolesDB returns roles and domain of given user of given
+// domain (any domain if it's empty) that is known to db. Empty domain
+// is returned if there is no such user or if domain is not given and
+// users of several domains have given name.
+func lookupRolesDB(db *credsDB, user, domain string) ([]Role, string) {
+	var match *UserInfo
+	for i := range db.users {
+		u := &db.users[i]
+		if u.Name != user || (domain != "" && u.Domain != domain) {
+			continue
+		}
+		if match != nil {
+			return nil, ""
+		}
+		match = u
+	}
+	if match == nil {
+		return nil, ""
+	}
+	return match.Roles, match.Domain
+}
+
+// LookupRoles returns roles and domain of given user of given domain
+// (any domain if it's empty) known to cbauth cache. Empty domain is
+// returned if user is unknown or ambiguous.
+func LookupRoles(s *Svc, user, domain string) (roles []Role, userDomain string, err error) {
+	db := fetchDB(s)
+	if db == nil {
+		return nil, "", staleError(s)
+	}
+	roles, userDomain = lookupRolesDB(db, user, domain)
+	return append([]Role(nil), roles...), userDomain, nil
+}
+
+// certCreds returns creds of given user of given domain (any domain
+// if it's empty) that is known to db or nil if there is no such
+// user. Nil is returned too if domain is not given and users of
+// several domains have given name.
+func certCreds(db *credsDB, user, domain string) *CredsImpl {
+	roles, userDomain := lookupRolesDB(db, user, domain)
+	if userDomain == "" {
+		return nil
+	}
+	perms := db.userPerms[userKey(&UserInfo{Name: user, Domain: userDomain})]
+	return newCertCreds(db, user, userDomain, roles, perms)
+}
+
+func newCertCreds(db *credsDB, user, domain string, roles []Role, perms *rolePerms) *CredsImpl {
+	rv := &CredsImpl{name: user, source: domain, db: db,
+		mechanism: MechanismClientCert, roles: roles, perms: perms}
+	applyRoles(rv, roles)
+	return rv
+}
@@ -0,0 +1,49 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+type nowFunc struct {
+	f func() time.Time
+}
+
+var clock atomic.Value
+
+// Now function returns current time as seen by expiry checks of
+// tokens and creds. It is real time unless other time source is set
+// by SetNow.
+func Now() time.Time {
+	if n, ok := clock.Load().(nowFunc); ok && n.f != nil {
+		return n.f()
+	}
+	return time.Now()
+}
+
+// SetNow makes Now return time given function returns (real time if
+// nil is passed) and returns function that was used before. Tests
+// may use it (see fakeserver.Clock) to exercise expiry
+// deterministically. It is safe to call while cbauth is in use by
+// other goroutines.
+func SetNow(now func() time.Time) (old func() time.Time) {
+	if n, ok := clock.Swap(nowFunc{now}).(nowFunc); ok {
+		return n.f
+	}
+	return nil
+}
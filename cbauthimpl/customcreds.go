@@ -0,0 +1,111 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// CustomCred struct is used as part of Cache messages to describe
+// service specific credential (e.g. FTS alias token) of some custom
+// type. Data is opaque to cbauth and is only interpreted by verifier
+// of the type (see VerifyCustomCred). Creds verified by it belong to
+// User of Domain and are granted Roles or, if Roles is empty, roles
+// of that user known to cache.
+type CustomCred struct {
+	Type   string          `json:"type"`
+	ID     string          `json:"id"`
+	User   string          `json:"user"`
+	Domain string          `json:"domain,omitempty"`
+	Roles  []Role          `json:"roles,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+// CustomCredVerifier type is function that tells whether secret
+// presented by client matches given custom credential.
+type CustomCredVerifier func(cred *CustomCred, secret []byte) bool
+
+func customCredKey(typ, id string) string {
+	return typ + "\x00" + id
+}
+
+func buildCustomCreds(creds []CustomCred) map[string]*CustomCred {
+	if len(creds) == 0 {
+		return nil
+	}
+	rv := make(map[string]*CustomCred, len(creds))
+	for i := range creds {
+		rv[customCredKey(creds[i].Type, creds[i].ID)] = &creds[i]
+	}
+	return rv
+}
+
+// VerifyCustomCred verifies given secret against custom credential
+// of given type and id using given verifier. Returns nil, nil if
+// credential is unknown, if verifier rejects secret or if user of
+// credential is unknown to cache. Creds are revalidated against
+// pushed credential, so that they are revoked once ns_server changes
+// or deletes it.
+func VerifyCustomCred(s *Svc, typ, id string, secret []byte, verify CustomCredVerifier) (*CredsImpl, error) {
+	db := fetchDB(s)
+	if db == nil {
+		return nil, staleError(s)
+	}
+	cred := db.customCreds[customCredKey(typ, id)]
+	if cred == nil || !verify(cred, secret) {
+		return nil, nil
+	}
+	return customCredsDB(db, cred), nil
+}
+
+func customCredsDB(db *credsDB, cred *CustomCred) *CredsImpl {
+	if cred.User == "" {
+		return nil
+	}
+	roles, domain := cred.Roles, cred.Domain
+	var perms *rolePerms
+	if len(roles) == 0 {
+		roles, domain = lookupRolesDB(db, cred.User, cred.Domain)
+		if domain == "" {
+			return nil
+		}
+		perms = db.userPerms[userKey(&UserInfo{Name: cred.User, Domain: domain})]
+	} else {
+		if domain == "" {
+			domain = "local"
+		}
+		perms = buildRolePerms(roles, db.permsMask)
+	}
+	rv := &CredsImpl{name: cred.User, source: domain, db: db,
+		mechanism: MechanismCustom, roles: roles, perms: perms, custom: cred}
+	applyRoles(rv, roles)
+	return rv
+}
+
+// CustomCredType method returns type of custom credential this creds
+// were verified by (see VerifyCustomCred) or "".
+func (c *CredsImpl) CustomCredType() string {
+	if c.custom == nil {
+		return ""
+	}
+	return c.custom.Type
+}
+
+func sameCustomCred(a, b *CustomCred) bool {
+	return a.User == b.User && a.Domain == b.Domain &&
+		equalRoles(a.Roles, b.Roles) && bytes.Equal(a.Data, b.Data)
+}
@@ -0,0 +1,78 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import "sync"
+
+// maxDecisions limits number of remembered authorization decisions.
+const maxDecisions = 16384
+
+type decisionKey struct {
+	user           string
+	source         string
+	isAdmin        bool
+	isROAdmin      bool
+	serverVerified bool
+	permission     string
+}
+
+// decisionCache remembers authorization decisions made against db
+// of single generation. Decisions of older generations are dropped.
+type decisionCache struct {
+	l          sync.Mutex
+	generation uint64
+	entries    map[decisionKey]bool
+}
+
+// CachedDecision method returns decision about given permission
+// that was made for same user against same cache generation before
+// or, if there is none, evaluates it by calling eval and remembers
+// result. Errors are not remembered. Scoped and elevated creds are
+// always evaluated.
+func (c *CredsImpl) CachedDecision(permission string, eval func() (bool, error)) (bool, error) {
+	if c.db == nil || c.db.svc == nil || c.scope != nil || c.extra != nil {
+		return eval()
+	}
+	dc := &c.db.svc.decisions
+	gen := c.db.generation
+	key := decisionKey{c.name, c.source, c.isAdmin, c.isROAdmin, c.serverVerified, permission}
+
+	dc.l.Lock()
+	if dc.generation == gen {
+		if v, ok := dc.entries[key]; ok {
+			dc.l.Unlock()
+			return v, nil
+		}
+	}
+	dc.l.Unlock()
+
+	v, err := eval()
+	if err != nil {
+		return v, err
+	}
+
+	dc.l.Lock()
+	defer dc.l.Unlock()
+	if gen < dc.generation {
+		return v, nil
+	}
+	if gen > dc.generation || dc.entries == nil || len(dc.entries) >= maxDecisions {
+		dc.generation = gen
+		dc.entries = make(map[decisionKey]bool)
+	}
+	dc.entries[key] = v
+	return v, nil
+}
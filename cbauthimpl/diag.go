@@ -0,0 +1,67 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+// State struct summarizes state of Svc for diagnostics. It carries
+// no secrets.
+type State struct {
+	HealthStatus
+	// Generation is number of db updates (including resets)
+	// applied so far.
+	Generation uint64
+	// StaleErr is reason of staleness if db is stale.
+	StaleErr      string
+	Nodes         int
+	Buckets       int
+	Groups        int
+	Limits        int
+	LocalNode     string
+	TokenCheckURL string
+	SpecialUser   string
+	HasAdmin      bool
+	HasROAdmin    bool
+}
+
+// GetState returns summary of current state of given service.
+func GetState(s *Svc) State {
+	s.l.Lock()
+	defer s.l.Unlock()
+	st := State{
+		HealthStatus: healthLocked(s),
+		Generation:   s.generation,
+	}
+	db := s.db
+	if db == nil {
+		if s.staleErr != nil {
+			st.StaleErr = s.staleErr.Error()
+		}
+		return st
+	}
+	st.Nodes = len(db.nodes)
+	st.Buckets = len(db.buckets)
+	st.Groups = len(db.groups)
+	st.Limits = len(db.limits)
+	for _, n := range db.nodes {
+		if n.Local {
+			st.LocalNode = n.Host
+		}
+	}
+	st.TokenCheckURL = db.tokenCheckURL
+	st.SpecialUser = db.specialUser
+	st.HasAdmin = db.admin.User != ""
+	st.HasROAdmin = db.roadmin.User != ""
+	return st
+}
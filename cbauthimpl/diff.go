@@ -0,0 +1,348 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// RoleChange struct describes change of set of roles of some user or
+// group.
+type RoleChange struct {
+	Name string
+	Old  []string
+	New  []string
+}
+
+// CacheDiff struct describes differences between two Cache
+// snapshots. It carries no secrets: changed passwords are only
+// reported by user or bucket name.
+type CacheDiff struct {
+	AddedUsers       []string
+	RemovedUsers     []string
+	PasswordChanged  []string
+	ChangedUserRoles []RoleChange
+	AddedGroups      []string
+	RemovedGroups    []string
+	ChangedGroups    []RoleChange
+	AddedBuckets     []string
+	RemovedBuckets   []string
+	ChangedBuckets   []string
+	// RecreatedBuckets are buckets whose uuid changed, i.e. that
+	// were deleted and created again under same name
+	RecreatedBuckets []string
+	AddedNodes       []string
+	RemovedNodes     []string
+}
+
+// Empty method returns true iff snapshots have no differences.
+func (d *CacheDiff) Empty() bool {
+	return len(d.AddedUsers)+len(d.RemovedUsers)+len(d.PasswordChanged)+
+		len(d.ChangedUserRoles)+len(d.AddedGroups)+len(d.RemovedGroups)+
+		len(d.ChangedGroups)+len(d.AddedBuckets)+len(d.RemovedBuckets)+
+		len(d.ChangedBuckets)+len(d.RecreatedBuckets)+len(d.AddedNodes)+
+		len(d.RemovedNodes) == 0
+}
+
+// fingerprintPrefix marks secrets of snapshot that were replaced by
+// their fingerprints.
+const fingerprintPrefix = "fp:"
+
+// fingerprintKey is key of HMAC that fingerprints are computed
+// with. It is not secret: fingerprints only spare snapshots from
+// carrying secrets verbatim, so that snapshots taken by different
+// processes can still be compared.
+var fingerprintKey = []byte("cbauth cache snapshot")
+
+// fingerprint returns fingerprint of given secret. Empty secrets and
+// fingerprints are returned as is, so that snapshots can also be
+// compared with caches exactly as pushed.
+func fingerprint(secret string) string {
+	if secret == "" || strings.HasPrefix(secret, fingerprintPrefix) {
+		return secret
+	}
+	mac := hmac.New(sha256.New, fingerprintKey)
+	mac.Write([]byte(secret))
+	return fingerprintPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// userFingerprint returns fingerprint of password hash of given
+// user.
+func userFingerprint(u User) string {
+	if u.Salt == nil && strings.HasPrefix(string(u.Mac), fingerprintPrefix) {
+		return string(u.Mac)
+	}
+	return fingerprint(fmt.Sprintf("%x:%x", u.Salt, u.Mac))
+}
+
+// fingerprintUser returns copy of given user with fingerprint instead
+// of salt and password hash.
+func fingerprintUser(u User) User {
+	if u.User == "" {
+		return u
+	}
+	u.Mac = []byte(userFingerprint(u))
+	u.Salt = nil
+	return u
+}
+
+type userInfo struct {
+	roles []string
+	// secrets maps role to secret user authenticates with in
+	// that role
+	secrets map[string]string
+}
+
+// cacheUsers returns users known to given cache together with their
+// roles. Bucket names are users too since buckets can be accessed
+// with bucket name and password.
+func cacheUsers(c *Cache) map[string]*userInfo {
+	rv := make(map[string]*userInfo)
+	add := func(name, role, secret string) {
+		if name == "" {
+			return
+		}
+		u := rv[name]
+		if u == nil {
+			u = &userInfo{secrets: make(map[string]string)}
+			rv[name] = u
+		}
+		u.roles = append(u.roles, role)
+		u.secrets[role] = secret
+	}
+	add(c.Admin.User, "admin", userFingerprint(c.Admin))
+	add(c.ROAdmin.User, "ro_admin", userFingerprint(c.ROAdmin))
+	for _, b := range c.Buckets {
+		add(b.Name, "bucket_user["+b.Name+"]", fingerprint(b.Password))
+	}
+	for i := range c.Users {
+		u := &c.Users[i]
+		for _, r := range groupRoles(&Group{Roles: u.Roles}) {
+			add(u.Name, r, "")
+		}
+	}
+	for _, u := range rv {
+		sort.Strings(u.roles)
+	}
+	return rv
+}
+
+func groupRoles(g *Group) []string {
+	var rv []string
+	for _, r := range g.Roles {
+		rv = append(rv, r.String())
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+func equalStrings(a, b []string) bool {
+	return strings.Join(a, "\x00") == strings.Join(b, "\x00")
+}
+
+func sortedKeys(m map[string]bool) []string {
+	var rv []string
+	for k := range m {
+		rv = append(rv, k)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// diffSets returns names that are only in a, only in b and in both.
+func diffSets(a, b map[string]bool) (onlyA, onlyB, both []string) {
+	for _, k := range sortedKeys(a) {
+		if b[k] {
+			both = append(both, k)
+		} else {
+			onlyA = append(onlyA, k)
+		}
+	}
+	for _, k := range sortedKeys(b) {
+		if !a[k] {
+			onlyB = append(onlyB, k)
+		}
+	}
+	return
+}
+
+// DiffCaches returns differences between given Cache snapshots:
+// what changed from given "from" snapshot to "to" one.
+func DiffCaches(from, to *Cache) *CacheDiff {
+	d := &CacheDiff{}
+
+	oldUsers, newUsers := cacheUsers(from), cacheUsers(to)
+	oldNames, newNames := make(map[string]bool), make(map[string]bool)
+	for n := range oldUsers {
+		oldNames[n] = true
+	}
+	for n := range newUsers {
+		newNames[n] = true
+	}
+	var both []string
+	d.RemovedUsers, d.AddedUsers, both = diffSets(oldNames, newNames)
+	for _, n := range both {
+		o, nw := oldUsers[n], newUsers[n]
+		if !equalStrings(o.roles, nw.roles) {
+			d.ChangedUserRoles = append(d.ChangedUserRoles, RoleChange{n, o.roles, nw.roles})
+		}
+		for role, secret := range o.secrets {
+			if s, ok := nw.secrets[role]; ok && s != secret {
+				d.PasswordChanged = append(d.PasswordChanged, n)
+				break
+			}
+		}
+	}
+
+	oldGroups, newGroups := make(map[string]*Group), make(map[string]*Group)
+	oldNames, newNames = make(map[string]bool), make(map[string]bool)
+	for i := range from.Groups {
+		oldGroups[from.Groups[i].Name] = &from.Groups[i]
+		oldNames[from.Groups[i].Name] = true
+	}
+	for i := range to.Groups {
+		newGroups[to.Groups[i].Name] = &to.Groups[i]
+		newNames[to.Groups[i].Name] = true
+	}
+	d.RemovedGroups, d.AddedGroups, both = diffSets(oldNames, newNames)
+	for _, n := range both {
+		o, nw := groupRoles(oldGroups[n]), groupRoles(newGroups[n])
+		if !equalStrings(o, nw) || oldGroups[n].LDAPGroupRef != newGroups[n].LDAPGroupRef {
+			d.ChangedGroups = append(d.ChangedGroups, RoleChange{n, o, nw})
+		}
+	}
+
+	oldBuckets, newBuckets := make(map[string]Bucket), make(map[string]Bucket)
+	oldNames, newNames = make(map[string]bool), make(map[string]bool)
+	for _, b := range from.Buckets {
+		oldBuckets[b.Name] = b
+		oldNames[b.Name] = true
+	}
+	for _, b := range to.Buckets {
+		newBuckets[b.Name] = b
+		newNames[b.Name] = true
+	}
+	d.RemovedBuckets, d.AddedBuckets, both = diffSets(oldNames, newNames)
+	for _, n := range both {
+		o, nw := oldBuckets[n], newBuckets[n]
+		if fingerprint(o.Password) != fingerprint(nw.Password) {
+			d.ChangedBuckets = append(d.ChangedBuckets, n)
+		}
+		if o.UUID != "" && nw.UUID != "" && o.UUID != nw.UUID {
+			d.RecreatedBuckets = append(d.RecreatedBuckets, n)
+		}
+	}
+
+	oldNames, newNames = make(map[string]bool), make(map[string]bool)
+	for _, n := range from.Nodes {
+		oldNames[n.Host] = true
+	}
+	for _, n := range to.Nodes {
+		newNames[n.Host] = true
+	}
+	d.RemovedNodes, d.AddedNodes, _ = diffSets(oldNames, newNames)
+	return d
+}
+
+// WriteTo method writes human readable description of diff to given
+// writer.
+func (d *CacheDiff) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	list := func(title string, names []string) {
+		for _, n := range names {
+			fmt.Fprintf(&buf, "%s: %s\n", title, n)
+		}
+	}
+	changes := func(title string, cs []RoleChange) {
+		for _, c := range cs {
+			fmt.Fprintf(&buf, "%s: %s: [%s] -> [%s]\n", title, c.Name,
+				strings.Join(c.Old, ", "), strings.Join(c.New, ", "))
+		}
+	}
+	list("added user", d.AddedUsers)
+	list("removed user", d.RemovedUsers)
+	list("password changed", d.PasswordChanged)
+	changes("user roles changed", d.ChangedUserRoles)
+	list("added group", d.AddedGroups)
+	list("removed group", d.RemovedGroups)
+	changes("group changed", d.ChangedGroups)
+	list("added bucket", d.AddedBuckets)
+	list("removed bucket", d.RemovedBuckets)
+	list("bucket password changed", d.ChangedBuckets)
+	list("bucket recreated", d.RecreatedBuckets)
+	list("added node", d.AddedNodes)
+	list("removed node", d.RemovedNodes)
+	if d.Empty() {
+		buf.WriteString("no differences\n")
+	}
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+// SnapshotCache returns Cache that describes current db of given
+// service. Passwords and password hashes are replaced by their
+// fingerprints, which are only good for comparison by DiffCaches, so
+// snapshot can't be used to authenticate.
+func SnapshotCache(s *Svc) (*Cache, error) {
+	db := fetchDB(s)
+	if db == nil {
+		return nil, staleError(s)
+	}
+	return snapshotDB(db), nil
+}
+
+func snapshotDB(db *credsDB) *Cache {
+	c := &Cache{
+		Admin:               fingerprintUser(db.admin),
+		ROAdmin:             fingerprintUser(db.roadmin),
+		TokenCheckURL:       db.tokenCheckURL,
+		PermissionCheckURL:  db.permCheckURL,
+		SpecialUser:         db.specialUser,
+		Groups:              db.groups,
+		TLS:                 db.tls,
+		AllowEmptyPasswords: db.allowEmptyPwds,
+		Users:               db.cacheUsers,
+		ClientCertAuth:      db.certAuth,
+		JWT:                 db.jwt,
+		ClusterEncryption:   db.encryption,
+	}
+	for _, cred := range db.cacheCustomCreds {
+		data, _ := json.Marshal(fingerprint(string(cred.Data)))
+		cred.Data = data
+		c.CustomCreds = append(c.CustomCreds, cred)
+	}
+	for _, n := range db.nodes {
+		n.Password = fingerprint(n.Password)
+		c.Nodes = append(c.Nodes, n)
+	}
+	for name, pwd := range db.buckets {
+		c.Buckets = append(c.Buckets, Bucket{Name: name, Password: fingerprint(pwd), UUID: db.bucketUUIDs[name]})
+	}
+	sort.Slice(c.Buckets, func(i, j int) bool { return c.Buckets[i].Name < c.Buckets[j].Name })
+	for _, l := range db.limits {
+		c.Limits = append(c.Limits, *l)
+	}
+	sort.Slice(c.Limits, func(i, j int) bool { return c.Limits[i].User < c.Limits[j].User })
+	return c
+}
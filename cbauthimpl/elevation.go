@@ -0,0 +1,108 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"errors"
+	"time"
+)
+
+const elevationTokenPrefix = "cbauth-elevation-v1:"
+
+// ErrElevationDenied is returned when elevation token is invalid,
+// expired or doesn't belong to given creds.
+var ErrElevationDenied = errors.New("privilege elevation denied")
+
+// Elevation struct describes privilege elevation granted by
+// elevation token.
+type Elevation struct {
+	User string `json:"sub"`
+	// Domain is domain of User as reported by creds, i.e. domain
+	// reported by ns_server or, for creds verified by cbauth
+	// itself, their source
+	Domain     string    `json:"domain"`
+	Permission string    `json:"perm"`
+	Approver   string    `json:"approver"`
+	Expires    time.Time `json:"exp"`
+	// tokenID is id of token elevation was verified from (see
+	// TokenID)
+	tokenID string
+}
+
+// MintElevationToken returns token that grants given permission to
+// given user until given expiration time. Token is signed by
+// password of local node, so it is only accepted by services of
+// this node.
+func MintElevationToken(s *Svc, e *Elevation) (string, error) {
+	db := fetchDB(s)
+	if db == nil {
+		return "", staleError(s)
+	}
+	if db.specialPassword == "" {
+		return "", errors.New("local node is unknown")
+	}
+	return signToken(elevationTokenPrefix, db.specialPassword, e)
+}
+
+// VerifyElevationToken verifies given elevation token and on
+// success returns elevation that it grants.
+func VerifyElevationToken(s *Svc, token string) (*Elevation, error) {
+	db := fetchDB(s)
+	if db == nil {
+		return nil, staleError(s)
+	}
+	var e Elevation
+	if !verifyToken(elevationTokenPrefix, db.specialPassword, token, &e) {
+		return nil, ErrElevationDenied
+	}
+	if e.User == "" || e.Domain == "" || !Now().Before(e.Expires) {
+		return nil, ErrElevationDenied
+	}
+	e.tokenID = TokenID(token)
+	if s.revoked.token(e.tokenID, Now()) {
+		return nil, ErrElevationDenied
+	}
+	return &e, nil
+}
+
+// CanApproveElevation returns true iff given creds are admin in
+// their own right, i.e. not via elevation, scoped token or
+// on-behalf-of assertion.
+func CanApproveElevation(c *CredsImpl) bool {
+	return c.isAdmin && c.scope == nil && c.extra == nil && c.actor == ""
+}
+
+// Elevate returns copy of given creds that additionally has
+// permission granted by given elevation. Given elevation must be
+// granted to user of given creds of same domain.
+func Elevate(c *CredsImpl, e *Elevation) (*CredsImpl, error) {
+	if c.name == "" || c.name != e.User || c.identityDomain() != e.Domain {
+		return nil, ErrElevationDenied
+	}
+	rv := *c
+	rv.extra = make(map[string]bool, len(c.extra)+1)
+	for p := range c.extra {
+		rv.extra[p] = true
+	}
+	rv.extra[e.Permission] = true
+	if e.tokenID != "" {
+		rv.tokens = append(append([]string(nil), c.tokens...), e.tokenID)
+	}
+	if e.Permission == PermissionAdmin {
+		rv.isAdmin = true
+	}
+	return &rv, nil
+}
@@ -0,0 +1,181 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Grants that can be reported in Explanation. They describe what
+// decided outcome of permission check.
+const (
+	GrantAuthenticated  = "authenticated"
+	GrantElevation      = "elevation"
+	GrantScope          = "scope"
+	GrantRole           = "role"
+	GrantBucketPassword = "bucket-password"
+	GrantNone           = "none"
+)
+
+// Explanation struct describes how permission check against some
+// creds was decided.
+type Explanation struct {
+	Permission string `json:"permission"`
+	Allowed    bool   `json:"allowed"`
+	// Grant is what decided the check (one of Grant* constants)
+	Grant string `json:"grant"`
+	// Role is name of role that granted permission, if any
+	// (e.g. "admin" or "ro_admin")
+	Role string `json:"role,omitempty"`
+	// Matched is permission of elevation or scoped token that
+	// matched checked permission, if any (e.g. permission on
+	// AnyBucket)
+	Matched string `json:"matched,omitempty"`
+	// Reason is human readable explanation
+	Reason string `json:"reason"`
+}
+
+// ParseBucketPermission splits bucket permission (see
+// BucketPermission) into bucket name and operation. ok is false if
+// given permission is not bucket permission.
+func ParseBucketPermission(permission string) (bucket, op string, ok bool) {
+	if !strings.HasPrefix(permission, "cluster.bucket[") {
+		return "", "", false
+	}
+	idx := strings.LastIndex(permission, "].")
+	if idx < 0 {
+		return "", "", false
+	}
+	return permission[len("cluster.bucket["):idx], permission[idx+2:], true
+}
+
+// permsMatch returns entry of given permission set that allows given
+// operation on given bucket or "" if there is none.
+func permsMatch(perms map[string]bool, bucket, op string) string {
+	for _, p := range []string{BucketPermission(bucket, op), BucketPermission(AnyBucket, op), PermissionAdmin} {
+		if perms[p] {
+			return p
+		}
+	}
+	return ""
+}
+
+func isBucketOp(op string) bool {
+	switch op {
+	case BucketOpRead, BucketOpWrite, BucketOpDDL, BucketOpDCP, BucketOpManage:
+		return true
+	}
+	return false
+}
+
+func (c *CredsImpl) adminRole() string {
+	switch {
+	case c.isAdmin:
+		return "admin"
+	case c.isROAdmin:
+		return "ro_admin"
+	}
+	return ""
+}
+
+// Explain method returns explanation of how check of given
+// permission (as understood by GetScopedServiceAuth) against this
+// creds is decided. It follows same rules as IsAdmin,
+// CanReadAnyMetadata and Can*Bucket methods.
+func (c *CredsImpl) Explain(permission string) (Explanation, error) {
+	e := Explanation{Permission: permission}
+	allow := func(grant, role, matched, format string, args ...interface{}) (Explanation, error) {
+		e.Allowed, e.Grant, e.Role, e.Matched = true, grant, role, matched
+		e.Reason = fmt.Sprintf(format, args...)
+		return e, nil
+	}
+	deny := func(format string, args ...interface{}) (Explanation, error) {
+		e.Grant = GrantNone
+		e.Reason = fmt.Sprintf(format, args...)
+		return e, nil
+	}
+
+	switch permission {
+	case "":
+		return allow(GrantAuthenticated, "", "", "any authenticated user is allowed")
+	case PermissionAdmin, PermissionReadAnyMetadata:
+		for _, p := range []string{permission, PermissionAdmin} {
+			if c.extra[p] {
+				return allow(GrantElevation, "", p, "granted by privilege elevation")
+			}
+		}
+		if c.scope != nil {
+			for _, p := range []string{permission, PermissionAdmin} {
+				if c.scope[p] {
+					return allow(GrantScope, "", p, "granted by scoped token")
+				}
+			}
+			return deny("scoped token doesn't include %s", permission)
+		}
+		if c.isAdmin || (c.isROAdmin && permission == PermissionReadAnyMetadata) {
+			return allow(GrantRole, c.adminRole(), "", "granted by %s role", c.adminRole())
+		}
+		if c.isROAdmin {
+			return deny("ro_admin role doesn't grant %s", permission)
+		}
+		return deny("user has neither admin nor ro_admin role")
+	}
+
+	bucket, op, ok := ParseBucketPermission(permission)
+	if !ok || !isBucketOp(op) {
+		return e, fmt.Errorf("unknown permission: `%s'", permission)
+	}
+	if p := permsMatch(c.extra, bucket, op); p != "" {
+		return allow(GrantElevation, "", p, "granted by privilege elevation")
+	}
+	if c.scope != nil {
+		if p := permsMatch(c.scope, bucket, op); p != "" {
+			return allow(GrantScope, "", p, "granted by scoped token")
+		}
+		if op == BucketOpRead {
+			if p := permsMatch(c.scope, bucket, BucketOpWrite); p != "" {
+				return allow(GrantScope, "", p, "granted by scoped token (write implies read)")
+			}
+		}
+		return deny("scoped token doesn't include %s", permission)
+	}
+	if c.isAdmin {
+		return allow(GrantRole, "admin", "", "granted by admin role")
+	}
+	if r := c.bucketRole(bucket, op); r != "" {
+		return allow(GrantRole, r, "", "granted by %s role on bucket %s", r, TagUserData(bucket))
+	}
+	if op == BucketOpManage {
+		return deny("user has no role that grants %s on bucket %s", op, TagUserData(bucket))
+	}
+	if r, w := c.bucketRole(bucket, BucketOpRead), c.bucketRole(bucket, BucketOpWrite); r != "" && w != "" {
+		return allow(GrantRole, w, "", "granted by %s and %s roles on bucket %s", r, w, TagUserData(bucket))
+	}
+	if c.name != "" && c.name != bucket {
+		return deny("user has no role that grants access to bucket %s", TagUserData(bucket))
+	}
+	if !checkBucketPassword(c.db, bucket, c.password) {
+		if c.name == "" {
+			return deny("anonymous access to bucket %s is not allowed", TagUserData(bucket))
+		}
+		return deny("bucket %s doesn't exist or its password changed", TagUserData(bucket))
+	}
+	if c.name == "" {
+		return allow(GrantBucketPassword, "", "", "bucket %s has no password", TagUserData(bucket))
+	}
+	return allow(GrantBucketPassword, "", "", "granted by password of bucket %s", TagUserData(bucket))
+}
@@ -0,0 +1,187 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"sync"
+	"time"
+)
+
+// ExternalGroupsTTL is how long group memberships of external users
+// that ns_server reported while verifying their creds are
+// remembered. While they are, such users can be resolved (e.g. in
+// on-behalf-of assertions) without asking ns_server, and roles of
+// their groups always come from current cache, so that changes of
+// group mappings apply immediately. Zero disables remembering.
+var ExternalGroupsTTL = 5 * time.Minute
+
+// maxExtGroupEntries limits number of remembered memberships.
+const maxExtGroupEntries = 4096
+
+type extGroupEntry struct {
+	source string
+	groups []string
+	// roles are roles ns_server granted to user directly rather
+	// than via groups
+	roles   []Role
+	expires time.Time
+}
+
+// extGroupCache remembers group memberships of external users keyed
+// by user and domain.
+type extGroupCache struct {
+	l       sync.Mutex
+	entries map[string]*extGroupEntry
+}
+
+func extGroupKey(user, domain string) string {
+	return user + "\x00" + domain
+}
+
+func (c *extGroupCache) get(user, domain string) *extGroupEntry {
+	c.l.Lock()
+	defer c.l.Unlock()
+	e := c.entries[extGroupKey(user, domain)]
+	if e == nil {
+		return nil
+	}
+	if !Now().Before(e.expires) {
+		delete(c.entries, extGroupKey(user, domain))
+		return nil
+	}
+	return e
+}
+
+func (c *extGroupCache) put(user, domain string, e *extGroupEntry) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*extGroupEntry)
+	}
+	if len(c.entries) >= maxExtGroupEntries {
+		now := Now()
+		for k, old := range c.entries {
+			if !now.Before(old.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxExtGroupEntries {
+			c.entries = make(map[string]*extGroupEntry)
+		}
+	}
+	c.entries[extGroupKey(user, domain)] = e
+}
+
+func (c *extGroupCache) forget(user, domain string) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	delete(c.entries, extGroupKey(user, domain))
+}
+
+// resolveGroupRolesDB returns roles of groups of given db that given
+// names refer to (either by name or by external group name). Every
+// role is returned once, in order of first appearance.
+func resolveGroupRolesDB(db *credsDB, groups []string) []Role {
+	seen := make(map[Role]bool)
+	var rv []Role
+	for _, name := range groups {
+		for _, g := range db.groups {
+			if name == "" || (g.Name != name && g.LDAPGroupRef != name) {
+				continue
+			}
+			for _, r := range g.Roles {
+				if !seen[r] {
+					seen[r] = true
+					rv = append(rv, r)
+				}
+			}
+		}
+	}
+	return rv
+}
+
+// rememberExternalGroups records group memberships of given creds
+// verified by ns_server if ns_server reported them.
+func rememberExternalGroups(s *Svc, c *CredsImpl) {
+	ttl := ExternalGroupsTTL
+	if ttl <= 0 || c.identity == nil || c.identity.Groups == nil || c.name == "" {
+		return
+	}
+	e := &extGroupEntry{
+		source:  c.source,
+		groups:  c.identity.Groups,
+		roles:   c.directRoles,
+		expires: Now().Add(ttl),
+	}
+	if exp := c.identity.Expires; !exp.IsZero() && exp.Before(e.expires) {
+		e.expires = exp
+	}
+	s.extGroups.put(c.name, c.identityDomain(), e)
+}
+
+// identityDomain returns domain of user of creds verified by
+// ns_server. Source is used if ns_server didn't report domain.
+func (c *CredsImpl) identityDomain() string {
+	if c.identity != nil && c.identity.Domain != "" {
+		return c.identity.Domain
+	}
+	return c.source
+}
+
+// ExternalCreds returns creds of given external user of given domain
+// built from group memberships that ns_server reported recently (see
+// ExternalGroupsTTL) or nil if they are not remembered. Roles of
+// groups are resolved against current cache. Returned creds expire
+// when remembered memberships do.
+func ExternalCreds(s *Svc, user, domain string) (*CredsImpl, error) {
+	db := fetchDB(s)
+	if db == nil {
+		return nil, staleError(s)
+	}
+	return externalCredsDB(db, user, domain), nil
+}
+
+func externalCredsDB(db *credsDB, user, domain string) *CredsImpl {
+	if db.svc == nil || user == "" {
+		return nil
+	}
+	e := db.svc.extGroups.get(user, domain)
+	if e == nil {
+		return nil
+	}
+	roles := append([]Role(nil), e.roles...)
+	roles = append(roles, resolveGroupRolesDB(db, e.groups)...)
+
+	rv := &CredsImpl{name: user, source: e.source, db: db, serverVerified: true,
+		mechanism: MechanismBasic, directRoles: e.roles}
+	rv.identity = &Identity{
+		Version: AuthResponseVersion,
+		Roles:   roles,
+		Domain:  domain,
+		Groups:  e.groups,
+		Expires: e.expires,
+	}
+	applyRoles(rv, roles)
+	rv.perms = buildRolePerms(roles, db.permsMask)
+	return rv
+}
+
+// ForgetExternalGroups drops remembered group memberships of given
+// external user of given domain, so that next resolution of the
+// user goes to ns_server.
+func ForgetExternalGroups(s *Svc, user, domain string) {
+	s.extGroups.forget(user, domain)
+}
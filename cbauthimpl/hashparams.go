@@ -0,0 +1,191 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+// AlgorithmHMACSHA1 is algorithm reported by GetHashParams for users
+// whose Mac is HMAC-SHA1 of password (i.e. whose Iterations is zero).
+const AlgorithmHMACSHA1 = "hmac-sha1"
+
+// AlgorithmArgon2id is algorithm of users whose Mac is argon2id of
+// password.
+const AlgorithmArgon2id = "argon2id"
+
+// Auth versions (i.e. versions of password storage scheme) of
+// PasswordHash. Hashes of unknown (newer) versions are ignored.
+const (
+	// AuthVersionHMACSHA1 hashes are HMAC-SHA1 of password.
+	AuthVersionHMACSHA1 = 1
+	// AuthVersionPBKDF2 hashes are PBKDF2 of password.
+	AuthVersionPBKDF2 = 2
+	// AuthVersionArgon2id hashes are argon2id of password.
+	AuthVersionArgon2id = 3
+
+	// MaxAuthVersion is newest auth version this cbauth knows
+	// about.
+	MaxAuthVersion = AuthVersionArgon2id
+)
+
+// MinPBKDF2Iterations is smallest number of PBKDF2 iterations that
+// GetHashParams doesn't report as weak.
+var MinPBKDF2Iterations = 10000
+
+// MinArgon2idMemory is smallest argon2id memory cost (in KiB) that
+// GetHashParams doesn't report as weak.
+var MinArgon2idMemory uint32 = 19456
+
+// MaxArgon2idMemory is largest argon2id memory cost (in KiB) that
+// cbauth agrees to verify passwords with. Hashes with larger cost are
+// never verified, so that bad hash parameters can't exhaust memory of
+// service.
+var MaxArgon2idMemory uint32 = 1 << 20
+
+// PasswordHash struct is used as part of Cache messages to describe
+// one of hashes of password of some user (see User). ns_server pushes
+// hashes of every auth version it still maintains and cbauth uses
+// newest one it supports. Fields have same meaning as fields of User.
+type PasswordHash struct {
+	AuthVersion int `json:"auth_version"`
+	Algorithm   string
+	Salt        []byte
+	Mac         []byte
+	Iterations  int    `json:"iterations,omitempty"`
+	Memory      uint32 `json:"memory,omitempty"`
+	Parallelism uint8  `json:"parallelism,omitempty"`
+}
+
+func supportedHashAlgorithm(algorithm string) bool {
+	return algorithm == AlgorithmHMACSHA1 || algorithm == AlgorithmArgon2id ||
+		pbkdf2Hash(algorithm) != nil
+}
+
+// selectPasswordHash returns given user with hash of newest supported
+// auth version among its Hashes moved to its hash fields. User's own
+// hash fields are kept if none of Hashes is supported.
+func selectPasswordHash(u User) User {
+	best := -1
+	for i := range u.Hashes {
+		h := &u.Hashes[i]
+		if h.AuthVersion > MaxAuthVersion || !supportedHashAlgorithm(h.Algorithm) {
+			continue
+		}
+		if best < 0 || h.AuthVersion > u.Hashes[best].AuthVersion {
+			best = i
+		}
+	}
+	if best < 0 {
+		u.Hashes = nil
+		return u
+	}
+	h := &u.Hashes[best]
+	rv := User{
+		User:        u.User,
+		Salt:        h.Salt,
+		Mac:         h.Mac,
+		Algorithm:   h.Algorithm,
+		Iterations:  h.Iterations,
+		Memory:      h.Memory,
+		Parallelism: h.Parallelism,
+		AuthVersion: h.AuthVersion,
+	}
+	if h.Algorithm == AlgorithmHMACSHA1 {
+		rv.Algorithm, rv.Iterations = "", 0
+	}
+	return rv
+}
+
+// authVersion returns auth version of hash of given user.
+func (u *User) authVersion() int {
+	switch {
+	case u.AuthVersion != 0:
+		return u.AuthVersion
+	case u.Algorithm == AlgorithmArgon2id:
+		return AuthVersionArgon2id
+	case u.Iterations > 0:
+		return AuthVersionPBKDF2
+	}
+	return AuthVersionHMACSHA1
+}
+
+func validArgon2Params(u *User) bool {
+	return u.Iterations > 0 && u.Parallelism > 0 && len(u.Mac) >= 4 &&
+		u.Memory >= 8*uint32(u.Parallelism) && u.Memory <= MaxArgon2idMemory
+}
+
+// HashParams struct describes how password of cached user is
+// hashed. It carries no secrets, so it is safe to report.
+type HashParams struct {
+	User   string `json:"user"`
+	Domain string `json:"domain"`
+	// AuthVersion is auth version of hash (see PasswordHash)
+	AuthVersion int `json:"authVersion"`
+	// Algorithm is AlgorithmHMACSHA1, "pbkdf2-sha512",
+	// "pbkdf2-sha256", "pbkdf2-sha1" or AlgorithmArgon2id (or
+	// algorithm unknown to cbauth, which is unable to verify such
+	// passwords)
+	Algorithm  string `json:"algorithm"`
+	Iterations int    `json:"iterations,omitempty"`
+	// Memory (in KiB) and Parallelism are set for argon2id
+	Memory      uint32 `json:"memory,omitempty"`
+	Parallelism uint8  `json:"parallelism,omitempty"`
+	SaltLen     int    `json:"saltLen"`
+	KeyLen      int    `json:"keyLen"`
+	// Weak is true if algorithm is HMAC-SHA1 or unknown, if
+	// number of PBKDF2 iterations is below MinPBKDF2Iterations or
+	// if argon2id memory cost is below MinArgon2idMemory.
+	Weak bool `json:"weak"`
+}
+
+func userHashParams(u *User, domain string) HashParams {
+	p := HashParams{
+		User:        u.User,
+		Domain:      domain,
+		AuthVersion: u.authVersion(),
+		Algorithm:   u.Algorithm,
+		Iterations:  u.Iterations,
+		Memory:      u.Memory,
+		Parallelism: u.Parallelism,
+		SaltLen:     len(u.Salt),
+		KeyLen:      len(u.Mac),
+	}
+	switch {
+	case u.Algorithm == AlgorithmArgon2id:
+		p.Weak = !validArgon2Params(u) || u.Memory < MinArgon2idMemory
+	case u.Iterations == 0:
+		p.Algorithm = AlgorithmHMACSHA1
+		p.Weak = true
+	default:
+		p.Weak = pbkdf2Hash(u.Algorithm) == nil || u.Iterations < MinPBKDF2Iterations
+	}
+	return p
+}
+
+// GetHashParams returns hash parameters of passwords of users that
+// are verified against cbauth cache of given service (admin and
+// ro-admin), so that tooling can find weak or legacy hashes.
+func GetHashParams(s *Svc) ([]HashParams, error) {
+	db := fetchDB(s)
+	if db == nil {
+		return nil, staleError(s)
+	}
+	var rv []HashParams
+	if db.admin.User != "" {
+		rv = append(rv, userHashParams(&db.admin, DomainAdmin))
+	}
+	if db.roadmin.User != "" {
+		rv = append(rv, userHashParams(&db.roadmin, DomainROAdmin))
+	}
+	return rv, nil
+}
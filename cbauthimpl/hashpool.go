@@ -0,0 +1,135 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// HashPoolConfig struct configures pool of workers that compute slow
+// password hashes (PBKDF2 and argon2id), so that bursts of new
+// connections don't take cycles from latency critical goroutines of
+// the process.
+type HashPoolConfig struct {
+	// Workers is number of hashes that are computed at once. If
+	// zero, it is number of CPUs (if given), otherwise hashes are
+	// computed by goroutines that verify passwords without limit.
+	Workers int
+	// CPUs, if non-empty, are CPUs workers are pinned to. Pinning
+	// is only supported on linux.
+	CPUs []int
+}
+
+// ErrAffinityUnsupported is returned by SetHashPool if CPUs are given
+// on platform where threads can't be pinned.
+var ErrAffinityUnsupported = errors.New("cpu affinity is not supported on this platform")
+
+// hashPool runs slow hashes on dedicated workers. Workers exit when
+// quit is closed, so hashes that don't get into work run inline.
+type hashPool struct {
+	work chan func()
+	quit chan struct{}
+}
+
+var (
+	hashPoolL   sync.Mutex
+	currentPool *hashPool
+)
+
+func (p *hashPool) worker(cpus []int, ready chan<- error) {
+	// thread is never unlocked, so that it is terminated together
+	// with worker rather than reused with changed affinity
+	runtime.LockOSThread()
+	if len(cpus) > 0 {
+		if err := pinThread(cpus); err != nil {
+			ready <- err
+			return
+		}
+	}
+	ready <- nil
+	for {
+		select {
+		case f := <-p.work:
+			f()
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// SetHashPool replaces pool of workers that compute slow password
+// hashes with one of given config. Hashes that are in flight complete
+// on old workers. Zero config makes hashes be computed inline again.
+func SetHashPool(cfg HashPoolConfig) error {
+	workers := cfg.Workers
+	if workers < 0 {
+		return fmt.Errorf("negative number of hash workers: %d", workers)
+	}
+	if workers == 0 {
+		workers = len(cfg.CPUs)
+	}
+	var p *hashPool
+	if workers > 0 {
+		p = &hashPool{work: make(chan func()), quit: make(chan struct{})}
+		ready := make(chan error, workers)
+		cpus := append([]int(nil), cfg.CPUs...)
+		for i := 0; i < workers; i++ {
+			go p.worker(cpus, ready)
+		}
+		var err error
+		for i := 0; i < workers; i++ {
+			if werr := <-ready; werr != nil && err == nil {
+				err = werr
+			}
+		}
+		if err != nil {
+			close(p.quit)
+			return err
+		}
+	}
+
+	hashPoolL.Lock()
+	old := currentPool
+	currentPool = p
+	hashPoolL.Unlock()
+	if old != nil {
+		close(old.quit)
+	}
+	return nil
+}
+
+// slowHash computes given hash on worker of current hash pool (if
+// there is one) and returns its result.
+func slowHash(hash func() []byte) []byte {
+	hashPoolL.Lock()
+	p := currentPool
+	hashPoolL.Unlock()
+	if p == nil {
+		return hash()
+	}
+	var dk []byte
+	done := make(chan struct{})
+	select {
+	case p.work <- func() { dk = hash(); close(done) }:
+		<-done
+		return dk
+	case <-p.quit:
+		return hash()
+	}
+}
@@ -0,0 +1,207 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// HealthStatus struct describes how up to date cbauth's state is.
+type HealthStatus struct {
+	// Stale is true if there is no usable db (i.e. ns_server
+	// connection was never established or was lost or db is
+	// older than LagPolicy.MaxCacheAge).
+	Stale bool
+	// Lagging is true if db is stale or if it is older than
+	// LagPolicy.MaxAge or if more than LagPolicy.MaxPending updates
+	// are waiting to be applied.
+	Lagging bool
+	// LastUpdate is time of last applied update (zero if there
+	// was none).
+	LastUpdate time.Time
+	// PendingUpdates is number of updates that were received but
+	// not applied yet.
+	PendingUpdates int
+}
+
+// LagPolicy struct configures when Svc is considered lagging.
+type LagPolicy struct {
+	// MaxAge, if positive, is maximal age of last update. Note
+	// that ns_server pushes updates only on changes, so this
+	// only makes sense in deployments where changes are
+	// frequent.
+	MaxAge time.Duration
+	// MaxPending, if positive, is maximal number of updates that
+	// may be waiting to be applied.
+	MaxPending int
+	// MaxCacheAge, if positive, is hard bound on age of last
+	// update. Unlike MaxAge it doesn't just mark Svc as lagging:
+	// once it is exceeded, cached auth data is not used and calls
+	// fail with CacheTooOldError until next update. This caps the
+	// window in which revoked credentials are still accepted, but
+	// in quiet clusters (see MaxAge) it will refuse perfectly
+	// valid credentials, so it has to be paired with ns_server
+	// pushing updates often enough.
+	MaxCacheAge time.Duration
+	// Callback, if non-nil, is called (from separate goroutine)
+	// every time Svc becomes lagging or stops lagging. Calls are
+	// serialized and report health at the time of call.
+	Callback func(h HealthStatus)
+}
+
+// CacheTooOldError is returned instead of using cached auth data
+// which is older than LagPolicy.MaxCacheAge. It wraps error that Svc
+// returns when it has no db at all, so it is also matched by checks
+// for that error.
+type CacheTooOldError struct {
+	// Age is age of last update at the time of failed call.
+	Age time.Duration
+	// MaxAge is LagPolicy.MaxCacheAge at the time of failed call.
+	MaxAge   time.Duration
+	staleErr error
+}
+
+func (e *CacheTooOldError) Error() string {
+	return fmt.Sprintf("stale auth data: last update was %s ago, maximal acceptable age is %s",
+		e.Age.Round(time.Millisecond), e.MaxAge)
+}
+
+// Unwrap method returns error of Svc that has no db.
+func (e *CacheTooOldError) Unwrap() error {
+	return e.staleErr
+}
+
+// cacheTooOldLocked returns true if given service has db that is
+// older than LagPolicy.MaxCacheAge.
+func cacheTooOldLocked(s *Svc) bool {
+	maxAge := s.lagPolicy.MaxCacheAge
+	return s.db != nil && maxAge > 0 && Now().Sub(s.lastUpdate) > maxAge
+}
+
+// usableDBLocked returns db of given service or nil if there is no db
+// or it is too old to be used.
+func usableDBLocked(s *Svc) *credsDB {
+	if cacheTooOldLocked(s) {
+		return nil
+	}
+	return s.db
+}
+
+// staleErrorLocked returns error for calls that found no usable db.
+func staleErrorLocked(s *Svc) error {
+	if cacheTooOldLocked(s) {
+		return &CacheTooOldError{
+			Age:      Now().Sub(s.lastUpdate),
+			MaxAge:   s.lagPolicy.MaxCacheAge,
+			staleErr: s.staleErr,
+		}
+	}
+	return s.staleErr
+}
+
+func healthLocked(s *Svc) HealthStatus {
+	h := HealthStatus{
+		Stale:          usableDBLocked(s) == nil,
+		LastUpdate:     s.lastUpdate,
+		PendingUpdates: int(atomic.LoadInt32(&s.pending)),
+	}
+	p := &s.lagPolicy
+	h.Lagging = h.Stale ||
+		(p.MaxAge > 0 && Now().Sub(s.lastUpdate) > p.MaxAge) ||
+		(p.MaxPending > 0 && h.PendingUpdates > p.MaxPending)
+	return h
+}
+
+// GetHealth returns current health of given service.
+func GetHealth(s *Svc) HealthStatus {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return healthLocked(s)
+}
+
+// SetLagPolicy sets lag policy of given service.
+func SetLagPolicy(s *Svc, p LagPolicy) {
+	s.notifyL.Lock()
+	defer s.notifyL.Unlock()
+	s.l.Lock()
+	s.lagPolicy = p
+	s.lagging = healthLocked(s).Lagging
+	s.lastNotified = s.lagging
+	armLagTimerLocked(s)
+	s.l.Unlock()
+}
+
+// checkLagLocked notices lagging state transitions and notifies
+// lag policy's callback about them.
+func checkLagLocked(s *Svc) {
+	h := healthLocked(s)
+	if h.Lagging == s.lagging {
+		return
+	}
+	s.lagging = h.Lagging
+	if s.lagPolicy.Callback != nil {
+		go notifyLag(s)
+	}
+}
+
+func notifyLag(s *Svc) {
+	s.notifyL.Lock()
+	defer s.notifyL.Unlock()
+	s.l.Lock()
+	h := healthLocked(s)
+	cb := s.lagPolicy.Callback
+	s.l.Unlock()
+	if cb == nil || h.Lagging == s.lastNotified {
+		return
+	}
+	s.lastNotified = h.Lagging
+	cb(h)
+}
+
+func armLagTimerLocked(s *Svc) {
+	if s.lagTimer != nil {
+		s.lagTimer.Stop()
+		s.lagTimer = nil
+	}
+	if s.db == nil {
+		return
+	}
+	// timer is armed for nearest of MaxAge and MaxCacheAge that is
+	// not exceeded yet; for later one it is re-armed when it fires
+	delay := time.Duration(-1)
+	for _, maxAge := range []time.Duration{s.lagPolicy.MaxAge, s.lagPolicy.MaxCacheAge} {
+		if maxAge <= 0 {
+			continue
+		}
+		left := maxAge - Now().Sub(s.lastUpdate)
+		if left >= 0 && (delay < 0 || left < delay) {
+			delay = left
+		}
+	}
+	if delay < 0 {
+		return
+	}
+	// +1 so that update is strictly older than max age when timer
+	// fires
+	s.lagTimer = time.AfterFunc(delay+1, func() {
+		s.l.Lock()
+		checkLagLocked(s)
+		armLagTimerLocked(s)
+		s.l.Unlock()
+	})
+}
@@ -0,0 +1,130 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// authHedgeDelay is delay after which unanswered calls to ns_server's
+// auth endpoints are hedged (see SetAuthHedgeDelay).
+var authHedgeDelay atomic.Int64
+
+// hedgedCalls counts calls to ns_server's auth endpoints that were
+// hedged.
+var hedgedCalls atomic.Uint64
+
+// SetAuthHedgeDelay makes calls to ns_server's auth endpoints that
+// are not answered within given delay be hedged: identical request
+// is sent once more and response that arrives first is used, while
+// the other request is cancelled. Zero delay (which is default)
+// disables hedging. Only requests without body are hedged.
+func SetAuthHedgeDelay(d time.Duration) {
+	authHedgeDelay.Store(int64(d))
+}
+
+// HedgedCalls returns number of calls to ns_server's auth endpoints
+// that were hedged.
+func HedgedCalls() uint64 {
+	return hedgedCalls.Load()
+}
+
+// cancelBody cancels context of request once its response body is
+// closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+type hedgeResult struct {
+	i    int
+	resp *http.Response
+	err  error
+}
+
+// authDo sends given request to ns_server's auth endpoint via
+// AuthClient, hedging it if it's slow (see SetAuthHedgeDelay).
+// Failure of first request before it's hedged is returned as is,
+// otherwise error is only returned if both requests fail.
+func authDo(req *http.Request) (*http.Response, error) {
+	delay := time.Duration(authHedgeDelay.Load())
+	if delay <= 0 || (req.Body != nil && req.Body != http.NoBody) {
+		return AuthClient.Do(req)
+	}
+
+	client := AuthClient
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	send := func() {
+		ctx, cancel := context.WithCancel(req.Context())
+		i := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			resp, err := client.Do(req.Clone(ctx))
+			results <- hedgeResult{i, resp, err}
+		}()
+	}
+
+	send()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	inflight := 1
+	for {
+		select {
+		case <-timer.C:
+			hedgedCalls.Add(1)
+			send()
+			inflight++
+			continue
+		case r := <-results:
+			inflight--
+			if r.err != nil && inflight > 0 {
+				continue
+			}
+			for i, cancel := range cancels {
+				if i != r.i {
+					cancel()
+				}
+			}
+			go drainHedged(results, inflight)
+			if r.err != nil {
+				cancels[r.i]()
+				return nil, r.err
+			}
+			r.resp.Body = &cancelBody{r.resp.Body, cancels[r.i]}
+			return r.resp, nil
+		}
+	}
+}
+
+// drainHedged closes responses of given number of losing requests.
+func drainHedged(results <-chan hedgeResult, n int) {
+	for ; n > 0; n-- {
+		if r := <-results; r.err == nil {
+			r.resp.Body.Close()
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// AuthResponseVersion is newest version of ns_server's auth endpoint
+// response schema this package knows about. Responses without
+// version are version 1.
+const AuthResponseVersion = 2
+
+// Identity struct describes attributes of user that ns_server
+// reported while verifying creds. Fields that are not known to this
+// version of cbauth are kept in Extra, so services can use them
+// without waiting for cbauth update.
+type Identity struct {
+	// Version is version of response schema.
+	Version int
+	Roles   []Role
+	Domain  string
+	UUID    string
+	// Groups are external (e.g. LDAP) groups of user as reported
+	// by ns_server. Roles of matching groups of cache are included
+	// in Roles. Nil if ns_server didn't report groups.
+	Groups []string
+	// Expires is time after which creds must not be used. Zero
+	// means no expiration.
+	Expires time.Time
+	Extra   map[string]json.RawMessage
+}
+
+// authResponse is body of ns_server's auth endpoint response.
+type authResponse struct {
+	Version int    `json:"version"`
+	Role    string `json:"role"`
+	User    string `json:"user"`
+	Source  string `json:"source"`
+	Roles   []Role `json:"roles"`
+	Domain  string `json:"domain"`
+	UUID    string `json:"uuid"`
+	// Groups are external groups of user
+	Groups []string `json:"groups"`
+	// Expiry is unix time in seconds
+	Expiry int64 `json:"expiry"`
+}
+
+var knownAuthResponseFields = []string{
+	"version", "role", "user", "source", "roles", "domain", "uuid", "groups", "expiry",
+}
+
+// parseAuthResponse parses ns_server's auth endpoint response. It
+// tolerates unknown fields and roles.
+func parseAuthResponse(body []byte, db *credsDB) (*CredsImpl, error) {
+	var resp authResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	for _, f := range knownAuthResponseFields {
+		delete(fields, f)
+	}
+	if len(fields) == 0 {
+		fields = nil
+	}
+
+	rv := &CredsImpl{name: resp.User, source: resp.Source, db: db, serverVerified: true}
+	rv.identity = &Identity{
+		Version: resp.Version,
+		Roles:   resp.Roles,
+		Domain:  resp.Domain,
+		UUID:    resp.UUID,
+		Groups:  resp.Groups,
+		Extra:   fields,
+	}
+	if rv.identity.Version == 0 {
+		rv.identity.Version = 1
+	}
+	if resp.Expiry != 0 {
+		rv.identity.Expires = time.Unix(resp.Expiry, 0)
+	}
+
+	roles := resp.Roles
+	if resp.Role != "" {
+		roles = append([]Role{{Name: resp.Role}}, roles...)
+	}
+	if resp.Groups != nil {
+		// roles of groups come from cache, so that they can be
+		// resolved again when cache changes (see
+		// ExternalGroupsTTL)
+		rv.directRoles = roles
+		if db != nil {
+			groupRoles := resolveGroupRolesDB(db, resp.Groups)
+			rv.identity.Roles = append(append([]Role(nil), resp.Roles...), groupRoles...)
+			roles = append(append([]Role(nil), roles...), groupRoles...)
+		}
+	}
+	applyRoles(rv, roles)
+	if db != nil {
+		rv.perms = buildRolePerms(rv.identity.Roles, db.permsMask)
+	}
+	return rv, nil
+}
+
+// applyRoles grants cluster-wide admin and ro-admin roles among
+// given ones to given creds.
+func applyRoles(c *CredsImpl, roles []Role) {
+	for _, r := range roles {
+		if r.Bucket != "" {
+			continue
+		}
+		// unknown roles grant nothing; newer ns_server may
+		// send roles this version doesn't understand
+		switch r.Name {
+		case "admin":
+			c.isAdmin = true
+		case "ro_admin":
+			c.isROAdmin = true
+		}
+	}
+}
+
+// Identity method returns attributes of user reported by ns_server
+// or zero Identity if creds were verified by cbauth itself.
+func (c *CredsImpl) Identity() Identity {
+	if c.identity == nil {
+		return Identity{}
+	}
+	// roles, groups and extra fields are copied so that callers
+	// can't change creds
+	rv := *c.identity
+	if rv.Roles != nil {
+		rv.Roles = append([]Role(nil), rv.Roles...)
+	}
+	if rv.Groups != nil {
+		rv.Groups = append([]string(nil), rv.Groups...)
+	}
+	if rv.Extra != nil {
+		rv.Extra = make(map[string]json.RawMessage, len(c.identity.Extra))
+		for k, v := range c.identity.Extra {
+			rv.Extra[k] = append(json.RawMessage(nil), v...)
+		}
+	}
+	return rv
+}
+
+// Roles method returns roles granted to this creds' user: roles
+// reported by ns_server or roles of user known to cache that creds
+// were mapped to. Creds verified against cache admin users get
+// admin or ro_admin role. Scoped, legacy and otherwise roleless
+// creds have no roles.
+func (c *CredsImpl) Roles() []Role {
+	roles := c.roles
+	if c.identity != nil {
+		roles = c.identity.Roles
+	}
+	if len(roles) == 0 && c.scope == nil && c.adminRole() != "" {
+		return []Role{{Name: c.adminRole()}}
+	}
+	return append([]Role(nil), roles...)
+}
+
+func (c *CredsImpl) expired() bool {
+	return c.identity != nil && !c.identity.Expires.IsZero() && !Now().Before(c.identity.Expires)
+}
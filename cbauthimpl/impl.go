@@ -18,14 +18,18 @@
 package cbauthimpl
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha1"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/couchbase/cbauth/rbac"
 )
 
 // Node struct is used as part of Cache messages to describe creds and
@@ -36,6 +40,20 @@ type Node struct {
 	Password string
 	Ports    []int
 	Local    bool
+	// UUID is cluster-wide identifier of node.
+	UUID string `json:"uuid"`
+	// Alternate, if non-nil, describes alternate (external)
+	// address of node.
+	Alternate *AlternateAddress `json:"alternateAddresses,omitempty"`
+}
+
+// AlternateAddress struct is used as part of Cache messages to
+// describe alternate (external) address of some node. Ports maps
+// internal ports to external ones. Ports that are not mapped are
+// the same externally.
+type AlternateAddress struct {
+	Host  string      `json:"hostname"`
+	Ports map[int]int `json:"ports,omitempty"`
 }
 
 func matchHost(n Node, host string) bool {
@@ -61,23 +79,65 @@ func getMemcachedCreds(n Node, host string, port int) (user, password string) {
 }
 
 // User struct is used as part of Cache messages to describe creds of
-// some user (admin or ro-admin).
+// some user (admin or ro-admin). If Iterations is zero, Mac is
+// HMAC-SHA1 of password keyed by Salt. Otherwise Mac is PBKDF2 of
+// password with given salt, number of iterations and Algorithm
+// ("pbkdf2-sha512" or "pbkdf2-sha256") or, if Algorithm is
+// AlgorithmArgon2id, argon2id of password with given salt, number of
+// passes (Iterations), Memory and Parallelism. If Hashes is
+// non-empty, hash of newest auth version this cbauth supports is
+// used instead (see MaxAuthVersion), so that ns_server can upgrade
+// password storage without breaking older services.
 type User struct {
-	User string
-	Salt []byte
-	Mac  []byte
+	User       string
+	Salt       []byte
+	Mac        []byte
+	Algorithm  string `json:"algorithm,omitempty"`
+	Iterations int    `json:"iterations,omitempty"`
+	// Memory is argon2id memory cost in KiB
+	Memory      uint32 `json:"memory,omitempty"`
+	Parallelism uint8  `json:"parallelism,omitempty"`
+	// AuthVersion is version of password storage scheme hash
+	// belongs to (see PasswordHash)
+	AuthVersion int            `json:"auth_version,omitempty"`
+	Hashes      []PasswordHash `json:"hashes,omitempty"`
 }
 
 // Bucket struct is used as part of Cache messages to describe bucket auth
 type Bucket struct {
 	Name     string
 	Password string
+	UUID     string `json:"uuid,omitempty"`
 }
 
-func verifyCreds(u User, user, password string) bool {
+// Role type is used as part of Cache messages to describe role
+// (possibly parameterized by bucket, scope and collection) granted
+// to some user or group. "*" parameter means any.
+type Role = rbac.Role
+
+// Group type is used as part of Cache messages to describe user
+// group and roles granted to members of that group. LDAPGroupRef,
+// if non-empty, is external (e.g. LDAP or SSO) group name that is
+// mapped to this group.
+type Group = rbac.Group
+
+// Limits struct is used as part of Cache messages to describe
+// tenant, quota and scheduling priority attributes of some user.
+// Meaning of quotas is defined by services.
+type Limits struct {
+	User     string
+	Tenant   string
+	Priority int
+	Quotas   map[string]int64
+}
+
+func verifyCreds(db *credsDB, u User, user, password string) bool {
 	if u.User == "" || u.User != user {
 		return false
 	}
+	if u.Algorithm == AlgorithmArgon2id || u.Iterations > 0 {
+		return verifySlowHash(db, u, password)
+	}
 
 	mac := hmac.New(sha1.New, u.Salt)
 	mac.Write([]byte(password))
@@ -87,12 +147,39 @@ func verifyCreds(u User, user, password string) bool {
 type credsDB struct {
 	nodes           []Node
 	buckets         map[string]string
+	bucketUUIDs     map[string]string
 	admin           User
 	roadmin         User
-	hasNoPwdBucket  bool
+	noPwdBuckets    int
 	tokenCheckURL   string
+	permCheckURL    string
 	specialUser     string
 	specialPassword string
+	groups          []Group
+	limits          map[string]*Limits
+	tls             TLSSettings
+	allowEmptyPwds  bool
+	// users are users of cache sorted for ListUsers and
+	// cacheUsers are users exactly as given in cache
+	users      []UserInfo
+	cacheUsers []UserInfo
+	certAuth   ClientCertAuth
+	jwt        JWTSettings
+	encryption ClusterEncryption
+	clientCAs  []clientCA
+	// customCreds are custom credentials of cache keyed by type
+	// and id (see VerifyCustomCred)
+	customCreds      map[string]*CustomCred
+	cacheCustomCreds []CustomCred
+	// userPerms are precomputed grants of roles of users with
+	// given userKey and permsMask is set of operations that they
+	// include (see SetPrecomputedBucketOps)
+	userPerms map[string]*rolePerms
+	permsMask opMask
+	// generation is number of UpdateDB call that installed this
+	// db and svc is service it was installed to (see Revalidate)
+	generation uint64
+	svc        *Svc
 }
 
 // Cache is a structure into which the revrpc json is unmarshalled
@@ -103,6 +190,29 @@ type Cache struct {
 	ROAdmin       User   `json:"roAdmin"`
 	TokenCheckURL string `json:"tokenCheckUrl"`
 	SpecialUser   string `json:"specialUser"`
+	Groups        []Group
+	Limits        []Limits
+	TLS           TLSSettings `json:"tls"`
+	// PermissionCheckURL is ns_server endpoint that decides
+	// permissions cached roles can't (see CredsImpl.IsAllowed).
+	PermissionCheckURL string `json:"permissionCheckUrl"`
+	// AllowEmptyPasswords is cluster setting that permits users
+	// with empty passwords (see cbauth.EmptyPasswordPolicy).
+	AllowEmptyPasswords bool `json:"allowEmptyPasswords"`
+	// Users describes users known to cluster (see ListUsers).
+	Users []UserInfo `json:"users,omitempty"`
+	// ClientCertAuth describes client certificate auth settings
+	// (see VerifyClientCert).
+	ClientCertAuth ClientCertAuth `json:"clientCertAuth"`
+	// JWT describes JWT bearer token auth settings (see
+	// JWTCreds).
+	JWT JWTSettings `json:"jwt"`
+	// ClusterEncryption describes encryption of node to node
+	// traffic.
+	ClusterEncryption ClusterEncryption `json:"clusterEncryption"`
+	// CustomCreds are service specific credentials (see
+	// VerifyCustomCred).
+	CustomCreds []CustomCred `json:"customCreds,omitempty"`
 }
 
 // CredsImpl implements cbauth.Creds interface.
@@ -113,19 +223,49 @@ type CredsImpl struct {
 	isROAdmin bool
 	password  string
 	db        *credsDB
-}
-
-func credsFromUserRoleSource(user, role, source string, db *credsDB) *CredsImpl {
-	rv := CredsImpl{name: user, source: source, db: db}
-	switch role {
-	case "admin":
-		rv.isAdmin = true
-	case "ro_admin":
-		rv.isROAdmin = true
-	default:
-		panic("unknown role: " + role)
-	}
-	return &rv
+	// scope, if non-nil, is set of permissions this creds are
+	// restricted to (see MintScopedToken)
+	scope map[string]bool
+	// extra is set of permissions granted to this creds on top
+	// of their usual permissions (see Elevate)
+	extra map[string]bool
+	// serverVerified is true if creds were verified by ns_server
+	// rather than against db
+	serverVerified bool
+	// legacy is true if creds were verified by bucket name and
+	// password (or are anonymous creds of no-password buckets)
+	legacy bool
+	// identity is set for creds verified by ns_server
+	identity *Identity
+	// mechanism is how identity of creds was established
+	mechanism Mechanism
+	// jwt is claims of JWT bearer token creds were derived from
+	// (see JWTCreds)
+	jwt *JWTClaims
+	// actor is internal user that asserted this creds (see
+	// OnBehalfOf)
+	actor string
+	// authInfo is Authentication-Info header value of
+	// response (see WithAuthInfo)
+	authInfo string
+	// roles are roles of creds that were mapped to user known
+	// to db (see VerifyClientCert)
+	roles []Role
+	// directRoles are roles ns_server granted to creds of user
+	// with external groups directly rather than via groups
+	directRoles []Role
+	// tokens are ids of tokens this creds were derived from (see
+	// TokenID)
+	tokens []string
+	// perms are precomputed grants of roles (either roles or
+	// roles of identity)
+	perms *rolePerms
+	// lookup, if non-nil, is where roles came from instead of db
+	// (see VerifyClientCertVia)
+	lookup RolesLookup
+	// custom is custom credential creds were verified by (see
+	// VerifyCustomCred)
+	custom *CustomCred
 }
 
 // Name method returns user name (e.g. for auditing)
@@ -133,6 +273,33 @@ func (c *CredsImpl) Name() string {
 	return c.name
 }
 
+// Limits method returns tenant, quota and priority attributes of
+// this creds' user. Zero Limits is returned if user has none.
+func (c *CredsImpl) Limits() Limits {
+	if c.db == nil || c.name == "" {
+		return Limits{}
+	}
+	l := c.db.limits[c.name]
+	if l == nil {
+		return Limits{}
+	}
+	rv := *l
+	if l.Quotas != nil {
+		// quotas are copied so that callers can't change cache
+		rv.Quotas = make(map[string]int64, len(l.Quotas))
+		for k, v := range l.Quotas {
+			rv.Quotas[k] = v
+		}
+	}
+	return rv
+}
+
+// IsLegacy method returns true iff this creds were obtained via
+// deprecated bucket name and password auth.
+func (c *CredsImpl) IsLegacy() bool {
+	return c.legacy
+}
+
 // Name method returns user source (for auditing)
 func (c *CredsImpl) Source() string {
 	return c.source
@@ -153,11 +320,17 @@ func (c *CredsImpl) IsROAdmin() (bool, error) {
 // CanReadAnyMetadata method returns true iff this creds represents
 // admin or ro-admin account.
 func (c *CredsImpl) CanReadAnyMetadata() bool {
+	if c.extra[PermissionAdmin] || c.extra[PermissionReadAnyMetadata] {
+		return true
+	}
+	if c.scope != nil {
+		return c.scope[PermissionAdmin] || c.scope[PermissionReadAnyMetadata]
+	}
 	return c.isROAdmin || c.isAdmin
 }
 
 func verifySpecialCreds(db *credsDB, user, password string) bool {
-	return len(user) > 0 && user[0] == '@' && password == db.specialPassword
+	return isSpecialUser(user) && password == db.specialPassword
 }
 
 func checkBucketPassword(db *credsDB, bucket, givenPassword string) bool {
@@ -173,9 +346,18 @@ func checkBucketPassword(db *credsDB, bucket, givenPassword string) bool {
 // represent valid account that can read/write/query docs in given
 // bucket.
 func (c *CredsImpl) CanAccessBucket(bucket string) (bool, error) {
+	if permsAllow(c.extra, bucket, BucketOpWrite) {
+		return true, nil
+	}
+	if c.scope != nil {
+		return c.scopeAllows(bucket, BucketOpWrite), nil
+	}
 	if c.isAdmin {
 		return true, nil
 	}
+	if c.hasBucketRole(bucket, BucketOpRead) && c.hasBucketRole(bucket, BucketOpWrite) {
+		return true, nil
+	}
 	if c.name != "" && c.name != bucket {
 		return false, nil
 	}
@@ -186,40 +368,96 @@ func (c *CredsImpl) CanAccessBucket(bucket string) (bool, error) {
 // valid account that can read (but not necessarily write)
 // docs in given bucket.
 func (c *CredsImpl) CanReadBucket(bucket string) (bool, error) {
+	if permsAllow(c.extra, bucket, BucketOpRead) {
+		return true, nil
+	}
+	if c.scope != nil {
+		return c.scopeAllows(bucket, BucketOpRead) || c.scopeAllows(bucket, BucketOpWrite), nil
+	}
+	if c.hasBucketRole(bucket, BucketOpRead) {
+		return true, nil
+	}
 	return c.CanAccessBucket(bucket)
 }
 
 // CanDDLBucket method returns true iff this creds represent
 // valid account that can DDL in given bucket. Note that at
-// this time it delegates to CanAccessBucket in only
-// implementation.
+// this time it delegates to CanAccessBucket for creds that are not
+// scoped and have no role that grants DDL.
 func (c *CredsImpl) CanDDLBucket(bucket string) (bool, error) {
+	if permsAllow(c.extra, bucket, BucketOpDDL) {
+		return true, nil
+	}
+	if c.scope != nil {
+		return c.scopeAllows(bucket, BucketOpDDL), nil
+	}
+	if c.hasBucketRole(bucket, BucketOpDDL) {
+		return true, nil
+	}
 	return c.CanAccessBucket(bucket)
 }
 
 // Svc is a struct that holds state of cbauth service.
 type Svc struct {
-	l         sync.Mutex
-	db        *credsDB
-	staleErr  error
-	freshChan chan struct{}
+	l          sync.Mutex
+	db         *credsDB
+	staleErr   error
+	freshChan  chan struct{}
+	lastUpdate time.Time
+	pending    int32
+	lagPolicy  LagPolicy
+	lagging    bool
+	lagTimer   *time.Timer
+	// notifyL serializes lag policy, buckets and config refresh
+	// callbacks
+	notifyL      sync.Mutex
+	lastNotified bool
+	generation   uint64
+	pwdCache     pwdCache
+	decisions    decisionCache
+	buckets      bucketWatch
+	config       configWatch
+	churn        userChurn
+	extGroups    extGroupCache
+	revoked      revocations
+	// recorder holds recorderBox (see SetRecorder)
+	recorder atomic.Value
 }
 
 func cacheToCredsDB(c *Cache) (db *credsDB) {
 	db = &credsDB{
-		nodes:          c.Nodes,
-		buckets:        make(map[string]string),
-		admin:          c.Admin,
-		roadmin:        c.ROAdmin,
-		hasNoPwdBucket: false,
-		tokenCheckURL:  c.TokenCheckURL,
-		specialUser:    c.SpecialUser,
+		nodes:            c.Nodes,
+		buckets:          make(map[string]string),
+		bucketUUIDs:      make(map[string]string),
+		admin:            selectPasswordHash(c.Admin),
+		roadmin:          selectPasswordHash(c.ROAdmin),
+		tokenCheckURL:    c.TokenCheckURL,
+		permCheckURL:     c.PermissionCheckURL,
+		specialUser:      c.SpecialUser,
+		groups:           c.Groups,
+		limits:           make(map[string]*Limits),
+		tls:              c.TLS,
+		allowEmptyPwds:   c.AllowEmptyPasswords,
+		users:            buildUserList(c),
+		cacheUsers:       c.Users,
+		certAuth:         c.ClientCertAuth,
+		clientCAs:        parseClientCAs(&c.ClientCertAuth),
+		jwt:              c.JWT,
+		encryption:       c.ClusterEncryption,
+		customCreds:      buildCustomCreds(c.CustomCreds),
+		cacheCustomCreds: c.CustomCreds,
+		permsMask:        precomputedOps.Load().(opMask),
+	}
+	db.userPerms = buildUserPerms(db.users, db.permsMask)
+	for i := range c.Limits {
+		db.limits[c.Limits[i].User] = &c.Limits[i]
 	}
 	for _, bucket := range c.Buckets {
 		if bucket.Password == "" {
-			db.hasNoPwdBucket = true
+			db.noPwdBuckets++
 		}
 		db.buckets[bucket.Name] = bucket.Password
+		db.bucketUUIDs[bucket.Name] = bucket.UUID
 	}
 	for _, node := range db.nodes {
 		if node.Local {
@@ -231,11 +469,20 @@ func cacheToCredsDB(c *Cache) (db *credsDB) {
 }
 
 func updateDBLocked(s *Svc, db *credsDB) {
+	s.generation++
+	if db != nil {
+		db.generation = s.generation
+		db.svc = s
+	}
 	s.db = db
+	checkBucketsLocked(s, db)
+	checkConfigLocked(s, db)
 	if s.freshChan != nil {
 		close(s.freshChan)
 		s.freshChan = nil
 	}
+	checkLagLocked(s)
+	armLagTimerLocked(s)
 }
 
 // UpdateDB is a revrpc method that is used by ns_server update cbauth
@@ -245,10 +492,75 @@ func (s *Svc) UpdateDB(c *Cache, outparam *bool) error {
 		*outparam = true
 	}
 	// BUG(alk): consider some kind of CAS later
+	atomic.AddInt32(&s.pending, 1)
+	mark := s.revoked.mark()
 	db := cacheToCredsDB(c)
+	stamps, groups := userStamps(c), groupsStamp(c)
 	s.l.Lock()
+	atomic.AddInt32(&s.pending, -1)
+	s.lastUpdate = Now()
 	updateDBLocked(s, db)
+	s.revoked.settle(mark)
+	// changes are recorded once db is installed, so that woken
+	// waiters see it
+	s.churn.record(stamps, groups, Now())
 	s.l.Unlock()
+	recordCache(s)
+	return nil
+}
+
+// BucketUpdate struct is used by ns_server to push changes of single
+// bucket without pushing whole Cache.
+type BucketUpdate struct {
+	Bucket
+	// Deleted is true if bucket was deleted.
+	Deleted bool
+}
+
+// ErrNoDB is returned by UpdateBucket if there is no db to apply
+// update to. In that case ns_server has to push whole Cache via
+// UpdateDB.
+var ErrNoDB = errors.New("cbauth db is stale; full update is needed")
+
+// UpdateBucket is a revrpc method that is used by ns_server to apply
+// change of single bucket to cbauth state. Unlike UpdateDB it
+// doesn't reprocess entries that are not related to that bucket.
+func (s *Svc) UpdateBucket(u *BucketUpdate, outparam *bool) error {
+	atomic.AddInt32(&s.pending, 1)
+	s.l.Lock()
+	atomic.AddInt32(&s.pending, -1)
+	if s.db == nil {
+		s.l.Unlock()
+		return ErrNoDB
+	}
+	defer recordCache(s)
+	defer s.l.Unlock()
+	db := *s.db
+	db.buckets = make(map[string]string, len(s.db.buckets)+1)
+	db.bucketUUIDs = make(map[string]string, len(s.db.bucketUUIDs)+1)
+	for name, pwd := range s.db.buckets {
+		db.buckets[name] = pwd
+		db.bucketUUIDs[name] = s.db.bucketUUIDs[name]
+	}
+	if old, exists := db.buckets[u.Name]; exists {
+		delete(db.buckets, u.Name)
+		delete(db.bucketUUIDs, u.Name)
+		if old == "" {
+			db.noPwdBuckets--
+		}
+	}
+	if !u.Deleted {
+		db.buckets[u.Name] = u.Password
+		db.bucketUUIDs[u.Name] = u.UUID
+		if u.Password == "" {
+			db.noPwdBuckets++
+		}
+	}
+	s.lastUpdate = Now()
+	updateDBLocked(s, &db)
+	if outparam != nil {
+		*outparam = true
+	}
 	return nil
 }
 
@@ -264,10 +576,12 @@ func ResetSvc(s *Svc, staleErr error) {
 }
 
 func staleError(s *Svc) error {
+	s.l.Lock()
+	defer s.l.Unlock()
 	if s.staleErr == nil {
 		panic("impossible Svc state where staleErr is nil!")
 	}
-	return s.staleErr
+	return staleErrorLocked(s)
 }
 
 // NewSVC constructs Svc instance. Period is initial period of time
@@ -284,7 +598,7 @@ func NewSVCForTest(period time.Duration, staleErr error, waitfn func(time.Durati
 	if staleErr == nil {
 		panic("staleErr must be non-nil")
 	}
-	s := &Svc{staleErr: staleErr}
+	s := &Svc{staleErr: staleErr, lagging: true, lastNotified: true}
 	if period != time.Duration(0) {
 		s.freshChan = make(chan struct{})
 		waitfn(period, s.freshChan, func() {
@@ -300,29 +614,59 @@ func NewSVCForTest(period time.Duration, staleErr error, waitfn func(time.Durati
 }
 
 func fetchDB(s *Svc) *credsDB {
+	db, _ := fetchDBContext(context.Background(), s)
+	return db
+}
+
+// fetchDBContext is fetchDB that stops waiting for fresh db once
+// given context is done.
+func fetchDBContext(ctx context.Context, s *Svc) (*credsDB, error) {
 	s.l.Lock()
-	db := s.db
+	db := usableDBLocked(s)
 	c := s.freshChan
 	s.l.Unlock()
 
 	if db != nil || c == nil {
-		return db
+		return db, nil
 	}
 
 	// if db is stale try to wait a bit
-	<-c
+	select {
+	case <-c:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 	// double receive doesn't change anything from correctness
 	// standpoint (we close channel), but helps a lot for tests
 	<-c
 	s.l.Lock()
-	db = s.db
+	db = usableDBLocked(s)
 	s.l.Unlock()
 
-	return db
+	return db, nil
+}
+
+// WaitFresh waits until given Svc either receives db or gives up
+// waiting for it (see NewSVC). If given context is done first, its
+// error is returned.
+func WaitFresh(ctx context.Context, s *Svc) error {
+	_, err := fetchDBContext(ctx, s)
+	return err
 }
 
 const tokenHeader = "ns-server-ui"
 
+// CorrelationIDHeader is header that is passed along to ns_server so
+// that auth attempts can be matched to ns_server's log entries.
+const CorrelationIDHeader = "cb-correlation-id"
+
+// W3C trace context headers that are passed along to ns_server, so
+// that its handling of auth shows up in distributed traces.
+const (
+	TraceParentHeader = "traceparent"
+	TraceStateHeader  = "tracestate"
+)
+
 // IsAuthTokenPresent returns true iff ns_server's ui token header
 // ("ns-server-ui") is set to "yes". UI is using that header to
 // indicate that request is using so called token auth.
@@ -339,28 +683,138 @@ func copyHeader(name string, from, to http.Header) {
 // VerifyOnServer verifies auth of given request by passing it to
 // ns_server.
 func VerifyOnServer(s *Svc, reqHeaders http.Header) (*CredsImpl, error) {
+	return VerifyOnServerContext(context.Background(), s, reqHeaders)
+}
+
+// VerifyOnServerContext is VerifyOnServer that gives up once given
+// context is done.
+func VerifyOnServerContext(ctx context.Context, s *Svc, reqHeaders http.Header) (*CredsImpl, error) {
+	db, err := fetchDBContext(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if db == nil {
+		return nil, staleError(s)
+	}
+	rv, err := verifyOnURL(ctx, db, db.tokenCheckURL, reqHeaders)
+	if rv != nil && db.svc != nil {
+		rememberExternalGroups(db.svc, rv)
+	}
+	return rv, err
+}
+
+// GetAuthEndpoint returns url of ns_server's auth endpoint or "" if
+// ns_server didn't provide it.
+func GetAuthEndpoint(s *Svc) (string, error) {
 	db := fetchDB(s)
+	if db == nil {
+		return "", staleError(s)
+	}
+	return db.tokenCheckURL, nil
+}
+
+// VerifyOnEndpoint verifies auth of given request by passing it to
+// given endpoint that speaks same protocol as ns_server's auth
+// endpoint (e.g. to shadow test new verification logic).
+func VerifyOnEndpoint(s *Svc, url string, reqHeaders http.Header) (*CredsImpl, error) {
+	return VerifyOnEndpointContext(context.Background(), s, url, reqHeaders)
+}
+
+// VerifyOnEndpointContext is VerifyOnEndpoint that gives up once
+// given context is done.
+func VerifyOnEndpointContext(ctx context.Context, s *Svc, url string, reqHeaders http.Header) (*CredsImpl, error) {
+	db, err := fetchDBContext(ctx, s)
+	if err != nil {
+		return nil, err
+	}
 	if db == nil {
 		return nil, staleError(s)
 	}
+	return verifyOnURL(ctx, db, url, reqHeaders)
+}
+
+// BadResponseError is returned when ns_server's auth endpoint replies
+// with something that can't be made sense of.
+type BadResponseError struct {
+	Err error
+}
+
+func (e *BadResponseError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap method returns underlying error.
+func (e *BadResponseError) Unwrap() error {
+	return e.Err
+}
+
+// ErrTemporaryRPCFailure is matched (via errors.Is) by errors of
+// requests to ns_server that may succeed if retried, i.e. connection
+// failures and 5xx responses.
+var ErrTemporaryRPCFailure = errors.New("temporary failure of request to ns_server")
+
+// RPCFailureError is returned when request to ns_server failed for
+// reasons that may go away by themselves. It matches
+// ErrTemporaryRPCFailure.
+type RPCFailureError struct {
+	Err error
+}
+
+func (e *RPCFailureError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrTemporaryRPCFailure, e.Err)
+}
+
+// Unwrap method returns underlying error.
+func (e *RPCFailureError) Unwrap() error {
+	return e.Err
+}
+
+// Is method returns true for ErrTemporaryRPCFailure.
+func (e *RPCFailureError) Is(target error) bool {
+	return target == ErrTemporaryRPCFailure
+}
 
-	if s.db.tokenCheckURL == "" {
+// rpcFailure wraps error of request to ns_server into
+// RPCFailureError. Errors of cancelled requests are returned as is,
+// since retrying them makes no sense.
+func rpcFailure(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return &RPCFailureError{err}
+}
+
+// badStatus returns BadResponseError for unexpected response status
+// of ns_server, wrapped into RPCFailureError if it is 5xx one.
+func badStatus(resp *http.Response, err error) error {
+	if resp.StatusCode >= 500 {
+		return &RPCFailureError{&BadResponseError{err}}
+	}
+	return &BadResponseError{err}
+}
+
+func verifyOnURL(ctx context.Context, db *credsDB, url string, reqHeaders http.Header) (*CredsImpl, error) {
+	if url == "" {
 		return nil, nil
 	}
 
-	req, err := http.NewRequest("POST", db.tokenCheckURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	copyHeader(tokenHeader, reqHeaders, req.Header)
 	copyHeader("ns-server-auth-token", reqHeaders, req.Header)
 	copyHeader("Cookie", reqHeaders, req.Header)
 	copyHeader("Authorization", reqHeaders, req.Header)
+	copyHeader(CorrelationIDHeader, reqHeaders, req.Header)
+	copyHeader(OnBehalfOfHeader, reqHeaders, req.Header)
+	copyHeader(TraceParentHeader, reqHeaders, req.Header)
+	copyHeader(TraceStateHeader, reqHeaders, req.Header)
 
-	hresp, err := http.DefaultClient.Do(req)
+	hresp, err := authDo(req)
 	if err != nil {
-		return nil, err
+		return nil, rpcFailure(err)
 	}
 	defer hresp.Body.Close()
 	if hresp.StatusCode == 401 {
@@ -369,23 +823,23 @@ func VerifyOnServer(s *Svc, reqHeaders http.Header) (*CredsImpl, error) {
 
 	if hresp.StatusCode != 200 {
 		err = fmt.Errorf("Expecting 200 or 401 from ns_server auth endpoint. Got: %s", hresp.Status)
-		return nil, err
+		return nil, badStatus(hresp, err)
 	}
 
 	body, err := ioutil.ReadAll(hresp.Body)
 	if err != nil {
-		return nil, err
+		return nil, rpcFailure(err)
 	}
 
-	resp := struct {
-		Role, User, Source string
-	}{}
-	err = json.Unmarshal(body, &resp)
+	rv, err := parseAuthResponse(body, db)
 	if err != nil {
-		return nil, err
+		return nil, &BadResponseError{err}
 	}
-
-	return credsFromUserRoleSource(resp.User, resp.Role, resp.Source, db), nil
+	rv.mechanism = MechanismBasic
+	if reqHeaders.Get(tokenHeader) == "yes" {
+		rv.mechanism = MechanismUIToken
+	}
+	return rv, nil
 }
 
 // VerifyPassword verifies given user/password creds against cbauth
@@ -396,32 +850,49 @@ func VerifyPassword(s *Svc, user, password string) (*CredsImpl, error) {
 	if db == nil {
 		return nil, staleError(s)
 	}
-	rv := &CredsImpl{name: user, source: "ns_server", password: password, db: db}
+	return verifyPasswordDB(db, user, password), nil
+}
+
+func verifyPasswordDB(db *credsDB, user, password string) *CredsImpl {
+	rv := &CredsImpl{name: user, source: "ns_server", password: password, db: db,
+		mechanism: MechanismBasic}
 
 	switch {
+	case isScopedToken(password):
+		rv.scope = verifyScopedCreds(db, user, password)
+		if rv.scope == nil {
+			return nil
+		}
+		rv.tokens = []string{TokenID(password)}
+		rv.password = ""
+		rv.isAdmin = rv.scope[PermissionAdmin]
+		rv.mechanism = MechanismInternal
 	case verifySpecialCreds(db, user, password):
 		rv.isAdmin = true
-	case verifyCreds(db.admin, user, password):
+		rv.mechanism = MechanismInternal
+	case verifyCreds(db, db.admin, user, password):
 		rv.isAdmin = true
-	case verifyCreds(db.roadmin, user, password):
+	case verifyCreds(db, db.roadmin, user, password):
 		rv.isROAdmin = true
 	case user == "":
-		if !(password == "" && db.hasNoPwdBucket) {
+		if !(password == "" && db.noPwdBuckets > 0) {
 			// we only allow anonymous access if password
 			// is also empty and there is at least one
 			// no-password bucket
-			return nil, nil
+			return nil
 		}
+		rv.legacy = true
 	default:
 		if !checkBucketPassword(db, user, password) {
 			// right now we only grant access if username
 			// matches specific bucket and bucket password
 			// is given
-			return nil, nil
+			return nil
 		}
+		rv.legacy = true
 	}
 
-	return rv, nil
+	return rv
 }
 
 // GetCreds returns service password for given host and port
@@ -441,3 +912,43 @@ func GetCreds(s *Svc, host string, port int) (memcachedUser, user, pwd string, e
 	}
 	return
 }
+
+// EmptyPasswordsAllowed returns cluster setting that permits users
+// with empty passwords.
+func EmptyPasswordsAllowed(s *Svc) (bool, error) {
+	db := fetchDB(s)
+	if db == nil {
+		return false, staleError(s)
+	}
+	return db.allowEmptyPwds, nil
+}
+
+// GetPassword returns password of given user if cbauth database
+// knows it in cleartext (i.e. for bucket and special users, but not
+// for admins since only password hashes of admins are known). It is
+// needed by challenge-response auth schemes like digest auth.
+func GetPassword(s *Svc, user string) (pwd string, ok bool, err error) {
+	db := fetchDB(s)
+	if db == nil {
+		return "", false, staleError(s)
+	}
+	if isSpecialUser(user) {
+		return db.specialPassword, db.specialPassword != "", nil
+	}
+	pwd, ok = db.buckets[user]
+	return pwd, ok && user != "", nil
+}
+
+// ResolveGroupRoles returns roles that are granted to members of
+// given groups according to group mappings of the cluster. Given
+// names are matched both against names of groups and against
+// external group names the groups are mapped to. Unknown names are
+// ignored. Every role is returned once, in order of first
+// appearance.
+func ResolveGroupRoles(s *Svc, groups []string) ([]Role, error) {
+	db := fetchDB(s)
+	if db == nil {
+		return nil, staleError(s)
+	}
+	return resolveGroupRolesDB(db, groups), nil
+}
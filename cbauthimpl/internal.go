@@ -0,0 +1,96 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"sort"
+	"sync"
+)
+
+var internalUsers = struct {
+	sync.RWMutex
+	names map[string]bool
+}{names: map[string]bool{
+	"@ns_server":  true,
+	"@cbq-engine": true,
+	"@fts":        true,
+	"@index":      true,
+	"@projector":  true,
+	"@goxdcr":     true,
+	"@cbas":       true,
+	"@eventing":   true,
+	"@backup":     true,
+	"@prometheus": true,
+}}
+
+// RegisterInternalUser adds given name (which must begin with @) to
+// set of reserved internal users. Any user that begins with @
+// authenticates with special password of local node, but only
+// reserved ones (and special user of cache) are reported as internal
+// (see IsInternal). Returned function removes name again unless it
+// was already reserved.
+func RegisterInternalUser(name string) (unregister func()) {
+	if len(name) < 2 || name[0] != '@' {
+		panic("internal user name must begin with @")
+	}
+	internalUsers.Lock()
+	defer internalUsers.Unlock()
+	if internalUsers.names[name] {
+		return func() {}
+	}
+	internalUsers.names[name] = true
+	return func() {
+		internalUsers.Lock()
+		delete(internalUsers.names, name)
+		internalUsers.Unlock()
+	}
+}
+
+// InternalUsers returns sorted names of reserved internal users.
+func InternalUsers() []string {
+	internalUsers.RLock()
+	defer internalUsers.RUnlock()
+	rv := make([]string, 0, len(internalUsers.names))
+	for name := range internalUsers.names {
+		rv = append(rv, name)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// isSpecialUser returns true iff given user authenticates with
+// special password of local node.
+func isSpecialUser(user string) bool {
+	return len(user) > 0 && user[0] == '@'
+}
+
+func isInternalUser(db *credsDB, user string) bool {
+	if len(user) < 2 || user[0] != '@' {
+		return false
+	}
+	if user == db.specialUser {
+		return true
+	}
+	internalUsers.RLock()
+	defer internalUsers.RUnlock()
+	return internalUsers.names[user]
+}
+
+// IsInternal method returns true iff this creds represent one of
+// internal users (i.e. other service of this cluster).
+func (c *CredsImpl) IsInternal() bool {
+	return c.mechanism == MechanismInternal && c.db != nil && isInternalUser(c.db, c.name)
+}
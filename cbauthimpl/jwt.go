@@ -0,0 +1,132 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"time"
+)
+
+// JWTIssuer struct is used as part of Cache messages to describe
+// issuer of JWT bearer tokens (ns_server itself or external identity
+// provider) that cluster trusts.
+type JWTIssuer struct {
+	// Name is expected "iss" claim of tokens.
+	Name string `json:"name"`
+	// JWKSURL is where public keys of issuer are published.
+	JWKSURL string `json:"jwksUri"`
+	// Audiences, if non-empty, are accepted "aud" claims. Tokens
+	// must carry at least one of them.
+	Audiences []string `json:"audiences,omitempty"`
+	// Algorithms, if non-empty, are accepted signing algorithms
+	// (e.g. "RS256" or "ES256"). All supported asymmetric
+	// algorithms are accepted otherwise.
+	Algorithms []string `json:"algorithms,omitempty"`
+	// SubClaim is claim that carries user name. Default is "sub".
+	SubClaim string `json:"subClaim,omitempty"`
+	// GroupsClaim, if non-empty, is claim that carries names
+	// of groups of user. Roles of those groups (see Group) are
+	// granted to user.
+	GroupsClaim string `json:"groupsClaim,omitempty"`
+	// RolesClaim, if non-empty, is claim that carries roles of
+	// user in ns_server notation (e.g. "data_reader[foo]").
+	RolesClaim string `json:"rolesClaim,omitempty"`
+	// Domain is domain of users of issuer. Default is
+	// "external". Roles of users of this domain known to cache
+	// are granted too.
+	Domain string `json:"domain,omitempty"`
+}
+
+// JWTSettings struct is used as part of Cache messages to describe
+// JWT bearer token auth settings of the cluster. Bearer tokens are
+// only verified by cbauth if some issuers are configured.
+type JWTSettings struct {
+	Issuers []JWTIssuer `json:"issuers,omitempty"`
+}
+
+// GetJWTSettings returns JWT bearer token auth settings of the
+// cluster.
+func GetJWTSettings(s *Svc) (JWTSettings, error) {
+	db := fetchDB(s)
+	if db == nil {
+		return JWTSettings{}, staleError(s)
+	}
+	return db.jwt, nil
+}
+
+func (db *credsDB) jwtIssuer(name string) *JWTIssuer {
+	for i := range db.jwt.Issuers {
+		if db.jwt.Issuers[i].Name == name {
+			return &db.jwt.Issuers[i]
+		}
+	}
+	return nil
+}
+
+// JWTClaims struct describes claims of verified JWT bearer token
+// that creds are derived from (see JWTCreds).
+type JWTClaims struct {
+	Issuer  string
+	User    string
+	Groups  []string
+	Roles   []Role
+	Expires time.Time
+	// TokenID is id of token claims were taken from (see TokenID
+	// function), so that creds are revoked with token.
+	TokenID string
+}
+
+// JWTCreds returns creds of user of given verified token claims or
+// nil if token's issuer is not trusted (anymore). Creds are granted
+// roles of token, roles of groups of token and roles of user of
+// issuer's domain that is known to cache. They expire when token
+// expires.
+func JWTCreds(s *Svc, claims *JWTClaims) (*CredsImpl, error) {
+	db := fetchDB(s)
+	if db == nil {
+		return nil, staleError(s)
+	}
+	return jwtCredsDB(db, claims), nil
+}
+
+func jwtCredsDB(db *credsDB, claims *JWTClaims) *CredsImpl {
+	iss := db.jwtIssuer(claims.Issuer)
+	if iss == nil || claims.User == "" {
+		return nil
+	}
+	domain := iss.Domain
+	if domain == "" {
+		domain = "external"
+	}
+	roles := append([]Role(nil), claims.Roles...)
+	userRoles, _ := lookupRolesDB(db, claims.User, domain)
+	roles = append(roles, userRoles...)
+	roles = append(roles, resolveGroupRolesDB(db, claims.Groups)...)
+
+	rv := &CredsImpl{name: claims.User, source: domain, db: db,
+		mechanism: MechanismJWT, jwt: claims}
+	if claims.TokenID != "" {
+		rv.tokens = []string{claims.TokenID}
+	}
+	rv.identity = &Identity{
+		Version: AuthResponseVersion,
+		Roles:   roles,
+		Domain:  domain,
+		Expires: claims.Expires,
+	}
+	applyRoles(rv, roles)
+	rv.perms = buildRolePerms(roles, db.permsMask)
+	return rv
+}
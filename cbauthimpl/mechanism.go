@@ -0,0 +1,80 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+// Mechanism type describes how identity of creds was established.
+type Mechanism string
+
+// Auth mechanisms reported by CredsImpl.Mechanism.
+const (
+	// MechanismBasic is user name and password (given via
+	// basic auth or to Auth directly).
+	MechanismBasic Mechanism = "basic"
+	// MechanismDigest is user name and password verified via
+	// http digest access auth.
+	MechanismDigest Mechanism = "digest"
+	// MechanismScram is user name and password verified via
+	// SCRAM exchange.
+	MechanismScram Mechanism = "scram"
+	// MechanismUIToken is ns_server ui session token.
+	MechanismUIToken Mechanism = "ui-token"
+	// MechanismClientCert is tls client certificate.
+	MechanismClientCert Mechanism = "client-cert"
+	// MechanismOnBehalfOf is identity asserted by other service
+	// on behalf of its user.
+	MechanismOnBehalfOf Mechanism = "on-behalf-of"
+	// MechanismInternal is credentials of cluster's own
+	// services (special user password or scoped token).
+	MechanismInternal Mechanism = "internal"
+	// MechanismJWT is JWT bearer token issued by ns_server or
+	// external identity provider.
+	MechanismJWT Mechanism = "jwt"
+	// MechanismCustom is service specific credential of custom
+	// type pushed by ns_server (see VerifyCustomCred).
+	MechanismCustom Mechanism = "custom"
+	// MechanismMirror is identity looked up in cache snapshot
+	// without verifying any secret (see MirrorCreds).
+	MechanismMirror Mechanism = "mirror"
+)
+
+// Mechanism method returns mechanism that was used to establish
+// identity of this creds.
+func (c *CredsImpl) Mechanism() Mechanism {
+	return c.mechanism
+}
+
+// WithMechanism returns copy of given creds that reports given
+// mechanism.
+func WithMechanism(c *CredsImpl, m Mechanism) *CredsImpl {
+	rv := *c
+	rv.mechanism = m
+	return &rv
+}
+
+// AuthInfo method returns value of Authentication-Info header that
+// response to request these creds were established by should carry
+// (e.g. server signature of SCRAM exchange) or "".
+func (c *CredsImpl) AuthInfo() string {
+	return c.authInfo
+}
+
+// WithAuthInfo returns copy of given creds that reports given
+// Authentication-Info header value.
+func WithAuthInfo(c *CredsImpl, info string) *CredsImpl {
+	rv := *c
+	rv.authInfo = info
+	return &rv
+}
@@ -0,0 +1,113 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"path"
+	"strings"
+	"time"
+)
+
+const metakvTokenPrefix = "cbauth-metakv-v1:"
+
+// ErrMetakvTokenInvalid is returned when metakv token is malformed,
+// expired or isn't signed by local node.
+var ErrMetakvTokenInvalid = errors.New("invalid metakv token")
+
+// MetakvScope struct describes metakv access granted by metakv
+// token: access to keys under Prefix (which begins and ends with
+// "/"), possibly read only, until Expires.
+type MetakvScope struct {
+	User     string    `json:"sub"`
+	Prefix   string    `json:"prefix"`
+	ReadOnly bool      `json:"ro,omitempty"`
+	Expires  time.Time `json:"exp"`
+}
+
+// Allows method returns true iff this scope allows given access to
+// given metakv path (key or directory). Paths that are not clean
+// (e.g. contain ".." or "//" segments) are never allowed.
+func (sc *MetakvScope) Allows(p string, write bool) bool {
+	clean := path.Clean(p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean == p && strings.HasPrefix(p, sc.Prefix) && !(write && sc.ReadOnly)
+}
+
+// Expired method returns true iff this scope is no longer valid.
+func (sc *MetakvScope) Expired() bool {
+	return !Now().Before(sc.Expires)
+}
+
+func validMetakvPrefix(prefix string) bool {
+	return strings.HasPrefix(prefix, "/") && strings.HasSuffix(prefix, "/")
+}
+
+// MintMetakvToken returns token that grants access described by
+// given scope. Token is signed by password of local node.
+func MintMetakvToken(s *Svc, sc *MetakvScope) (string, error) {
+	if !validMetakvPrefix(sc.Prefix) {
+		return "", errors.New("metakv prefix must begin and end with /")
+	}
+	db := fetchDB(s)
+	if db == nil {
+		return "", staleError(s)
+	}
+	if db.specialPassword == "" {
+		return "", errors.New("local node is unknown")
+	}
+	return signToken(metakvTokenPrefix, db.specialPassword, sc)
+}
+
+// VerifyMetakvToken verifies given metakv token and on success
+// returns scope that it grants.
+func VerifyMetakvToken(s *Svc, token string) (*MetakvScope, error) {
+	db := fetchDB(s)
+	if db == nil {
+		return nil, staleError(s)
+	}
+	var sc MetakvScope
+	if !verifyToken(metakvTokenPrefix, db.specialPassword, token, &sc) {
+		return nil, ErrMetakvTokenInvalid
+	}
+	if !validMetakvPrefix(sc.Prefix) || sc.Expired() {
+		return nil, ErrMetakvTokenInvalid
+	}
+	return &sc, nil
+}
+
+// DecodeMetakvToken returns scope of given metakv token without
+// verifying its signature. It lets holders of token (who don't
+// know the key) learn and enforce its scope.
+func DecodeMetakvToken(token string) (*MetakvScope, error) {
+	if !strings.HasPrefix(token, metakvTokenPrefix) {
+		return nil, ErrMetakvTokenInvalid
+	}
+	payload := strings.SplitN(token[len(metakvTokenPrefix):], ".", 2)[0]
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrMetakvTokenInvalid
+	}
+	var sc MetakvScope
+	if json.Unmarshal(b, &sc) != nil || !validMetakvPrefix(sc.Prefix) {
+		return nil, ErrMetakvTokenInvalid
+	}
+	return &sc, nil
+}
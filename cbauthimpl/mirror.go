@@ -0,0 +1,57 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"github.com/couchbase/cbauth/rbac"
+)
+
+// MirrorCreds returns creds of given user of given domain (any domain
+// if it's empty) as known to cache, without verifying any secret.
+// Built-in admin and read-only admin are users of rbac.DomainAdmin and
+// rbac.DomainROAdmin domains. Returns nil, nil if user is unknown or
+// ambiguous. It is meant for offline analysis of cache snapshots
+// (see cbauth.Mirror) and never for authentication.
+func MirrorCreds(s *Svc, user, domain string) (*CredsImpl, error) {
+	db := fetchDB(s)
+	if db == nil {
+		return nil, staleError(s)
+	}
+	return mirrorCredsDB(db, user, domain), nil
+}
+
+func mirrorCredsDB(db *credsDB, user, domain string) *CredsImpl {
+	if user == "" {
+		return nil
+	}
+	switch domain {
+	case rbac.DomainAdmin:
+		if user != db.admin.User {
+			return nil
+		}
+		return &CredsImpl{name: user, source: domain, db: db, mechanism: MechanismMirror, isAdmin: true}
+	case rbac.DomainROAdmin:
+		if user != db.roadmin.User {
+			return nil
+		}
+		return &CredsImpl{name: user, source: domain, db: db, mechanism: MechanismMirror, isROAdmin: true}
+	}
+	rv := certCreds(db, user, domain)
+	if rv != nil {
+		rv.mechanism = MechanismMirror
+	}
+	return rv
+}
@@ -0,0 +1,86 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"errors"
+)
+
+// OnBehalfOfHeader is http header by which internal users assert
+// user that request is made on behalf of. Its value is base64
+// encoding of "user:domain".
+const OnBehalfOfHeader = "cb-on-behalf-of"
+
+// ErrOnBehalfOfDenied is returned when creds that are not internal
+// (or are restricted or elevated) assert other user or when asserted
+// user is malformed.
+var ErrOnBehalfOfDenied = errors.New("on-behalf-of assertion denied")
+
+// OnBehalfOf returns creds of given user of given domain that given
+// actor makes request on behalf of. Actor must be internal user (see
+// IsInternal) that authenticated with special creds, i.e. creds of
+// scoped tokens or elevated creds can't act for other users.
+// External users are resolved from group memberships ns_server
+// reported recently (see ExternalCreds). Returns nil, nil if user
+// isn't known to cache otherwise, in which case ns_server has to be
+// asked.
+func OnBehalfOf(actor *CredsImpl, user, domain string) (*CredsImpl, error) {
+	if !actor.IsInternal() || actor.scope != nil || actor.extra != nil ||
+		user == "" || domain == "" {
+		return nil, ErrOnBehalfOfDenied
+	}
+	// actor's creds may be reused from earlier auth, so asserted
+	// user is resolved against current db
+	db := latestDB(actor.db)
+	rv := certCreds(db, user, domain)
+	if rv == nil {
+		rv = externalCredsDB(db, user, domain)
+	}
+	if rv == nil {
+		return nil, nil
+	}
+	return WithActor(rv, actor.name), nil
+}
+
+// latestDB returns db that is currently installed to service given
+// db was installed to or given db if service is stale.
+func latestDB(db *credsDB) *credsDB {
+	if db == nil || db.svc == nil {
+		return db
+	}
+	db.svc.l.Lock()
+	defer db.svc.l.Unlock()
+	if db.svc.db != nil {
+		return db.svc.db
+	}
+	return db
+}
+
+// WithActor returns copy of given creds that were asserted by given
+// actor (see OnBehalfOf).
+func WithActor(c *CredsImpl, actor string) *CredsImpl {
+	rv := *c
+	rv.actor = actor
+	rv.mechanism = MechanismOnBehalfOf
+	return &rv
+}
+
+// Actor method returns name of internal user that made request on
+// behalf of this creds' user or "" if request was made by user
+// itself.
+func (c *CredsImpl) Actor() string {
+	return c.actor
+}
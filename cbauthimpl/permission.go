@@ -0,0 +1,134 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/couchbase/cbauth/rbac"
+)
+
+// ErrUndecidedPermission is returned by IsAllowed when permission
+// can't be decided by cached roles and ns_server doesn't support
+// permission checks.
+var ErrUndecidedPermission = errors.New("permission can't be decided by cbauth cache")
+
+// allowedLocally decides given permission using cached roles. Only
+// scoped tokens have closed set of permissions, so for other creds
+// permission that no cached role grants is left to ns_server (i.e.
+// decided is false).
+func (c *CredsImpl) allowedLocally(o *rbac.Permission) (allowed, decided bool, err error) {
+	if rbac.PermsCover(c.extra, o) {
+		return true, true, nil
+	}
+	if c.scope != nil {
+		return rbac.PermsCover(c.scope, o), true, nil
+	}
+	if c.isAdmin {
+		return true, true, nil
+	}
+	if bucket := o.Bucket(); bucket != "" && !rbac.IsAnyBucket(bucket) {
+		for _, op := range rbac.BucketOps() {
+			p, _ := rbac.ParsePermission(BucketPermission(bucket, op))
+			if !p.Covers(o) {
+				continue
+			}
+			ok, err := c.canBucketOp(bucket, op)
+			if err != nil || ok {
+				return ok, true, err
+			}
+		}
+	}
+	if c.isROAdmin {
+		if d, ok := rbac.ROAdminDecision(o); ok {
+			return d.Allowed, d.Decided, nil
+		}
+	}
+	return false, false, nil
+}
+
+func (c *CredsImpl) canBucketOp(bucket, op string) (bool, error) {
+	switch op {
+	case BucketOpRead:
+		return c.CanReadBucket(bucket)
+	case BucketOpWrite:
+		return c.CanWriteBucket(bucket)
+	case BucketOpDDL:
+		return c.CanDDLBucket(bucket)
+	case BucketOpDCP:
+		return c.CanDCPBucket(bucket)
+	}
+	return c.CanManageBucket(bucket)
+}
+
+// IsAllowed method returns true iff this creds are granted given
+// RBAC permission (e.g. "cluster.bucket[foo].data.docs!write").
+// Permission is decided by cached roles if possible and by
+// ns_server otherwise. Decisions are cached per cache generation.
+func (c *CredsImpl) IsAllowed(permission string) (bool, error) {
+	o, err := rbac.ParsePermission(permission)
+	if err != nil {
+		return false, err
+	}
+	allowed, err := c.CachedDecision(permission, func() (bool, error) {
+		allowed, decided, err := c.allowedLocally(o)
+		if decided || err != nil {
+			return allowed, err
+		}
+		return c.checkOnServer(context.Background(), permission)
+	})
+	recordPermission(c, permission, allowed, err)
+	return allowed, err
+}
+
+// checkOnServer asks ns_server whether this creds are granted given
+// permission.
+func (c *CredsImpl) checkOnServer(ctx context.Context, permission string) (bool, error) {
+	if c.db == nil || c.db.permCheckURL == "" {
+		return false, ErrUndecidedPermission
+	}
+	domain := c.source
+	if c.identity != nil && c.identity.Domain != "" {
+		domain = c.identity.Domain
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", c.db.permCheckURL, nil)
+	if err != nil {
+		return false, err
+	}
+	req.URL.RawQuery = url.Values{
+		"user":       {c.name},
+		"domain":     {domain},
+		"permission": {permission},
+	}.Encode()
+
+	resp, err := authDo(req)
+	if err != nil {
+		return false, rpcFailure(err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 200:
+		return true, nil
+	case 401, 403:
+		return false, nil
+	}
+	err = fmt.Errorf("Expecting 200, 401 or 403 from ns_server permission check endpoint. Got: %s", resp.Status)
+	return false, badStatus(resp, err)
+}
@@ -0,0 +1,119 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// PoolLimits struct describes limits of HTTP connection pool. Zero
+// fields keep defaults of http.DefaultTransport.
+type PoolLimits struct {
+	// MaxIdleConns limits idle connections across all hosts.
+	MaxIdleConns int
+	// MaxIdleConnsPerHost limits idle connections kept per host.
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost limits all connections per host including
+	// ones in use. Requests above limit wait for a connection.
+	MaxConnsPerHost int
+	// IdleConnTimeout is how long idle connection is kept.
+	IdleConnTimeout time.Duration
+}
+
+// DefaultAuthPoolLimits are limits of pool used for calls to
+// ns_server's auth endpoint. Enough connections are kept idle so
+// that bursts of verifications don't redo handshakes.
+var DefaultAuthPoolLimits = PoolLimits{MaxIdleConnsPerHost: 16}
+
+// Pool is HTTP round tripper backed by its own connection pool, so
+// that traffic sent through it doesn't compete for connections with
+// other traffic. Limits may be changed while pool is in use.
+type Pool struct {
+	l sync.Mutex
+	t *http.Transport
+}
+
+func newTransport(limits PoolLimits) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if limits.MaxIdleConns != 0 {
+		t.MaxIdleConns = limits.MaxIdleConns
+	}
+	if limits.MaxIdleConnsPerHost != 0 {
+		t.MaxIdleConnsPerHost = limits.MaxIdleConnsPerHost
+	}
+	if limits.MaxConnsPerHost != 0 {
+		t.MaxConnsPerHost = limits.MaxConnsPerHost
+	}
+	if limits.IdleConnTimeout != 0 {
+		t.IdleConnTimeout = limits.IdleConnTimeout
+	}
+	return t
+}
+
+// NewPool creates connection pool with given limits.
+func NewPool(limits PoolLimits) *Pool {
+	return &Pool{t: newTransport(limits)}
+}
+
+func (p *Pool) transport() *http.Transport {
+	p.l.Lock()
+	defer p.l.Unlock()
+	return p.t
+}
+
+// RoundTrip method implements http.RoundTripper.
+func (p *Pool) RoundTrip(req *http.Request) (*http.Response, error) {
+	return p.transport().RoundTrip(req)
+}
+
+// SetLimits method changes limits of the pool. Requests in flight
+// complete on old connections, which are closed once idle.
+func (p *Pool) SetLimits(limits PoolLimits) {
+	t := newTransport(limits)
+	p.l.Lock()
+	old := p.t
+	p.t = t
+	p.l.Unlock()
+	old.CloseIdleConnections()
+}
+
+// Limits method returns limits pool currently enforces.
+func (p *Pool) Limits() PoolLimits {
+	t := p.transport()
+	return PoolLimits{
+		MaxIdleConns:        t.MaxIdleConns,
+		MaxIdleConnsPerHost: t.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     t.MaxConnsPerHost,
+		IdleConnTimeout:     t.IdleConnTimeout,
+	}
+}
+
+// CloseIdleConnections method closes connections of the pool that
+// are not in use.
+func (p *Pool) CloseIdleConnections() {
+	p.transport().CloseIdleConnections()
+}
+
+// AuthPool is connection pool used for calls to ns_server's auth
+// endpoint. It is not shared with any other traffic (in particular
+// metakv), so auth verifications don't wait behind it.
+var AuthPool = NewPool(DefaultAuthPoolLimits)
+
+// AuthClient is HTTP client used for calls to ns_server's auth
+// endpoint. It may be replaced (e.g. by tests) before cbauth is used.
+var AuthClient = &http.Client{Transport: AuthPool}
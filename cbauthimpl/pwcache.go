@@ -0,0 +1,133 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sync"
+)
+
+// maxPwdCacheEntries limits number of remembered verifications.
+const maxPwdCacheEntries = 4096
+
+// pwdCacheKey is per process key that is used to fingerprint
+// presented passwords, so that cache never holds them in any
+// reversible or offline-attackable form.
+var pwdCacheKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// pwdCache remembers successful PBKDF2 verifications. It maps
+// fingerprint of (user, presented password) to identity of stored
+// hash that password was verified against, so that change of stored
+// hash (e.g. password change) invalidates entry immediately.
+type pwdCache struct {
+	l       sync.Mutex
+	entries map[string]string
+}
+
+func (c *pwdCache) get(key string) string {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return c.entries[key]
+}
+
+func (c *pwdCache) put(key, hashID string) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.entries == nil || len(c.entries) >= maxPwdCacheEntries {
+		c.entries = make(map[string]string)
+	}
+	c.entries[key] = hashID
+}
+
+func pwdFingerprint(user, password string) string {
+	mac := hmac.New(sha256.New, pwdCacheKey)
+	mac.Write([]byte(password))
+	return user + "\x00" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (u *User) hashID() string {
+	return fmt.Sprintf("%s:%d:%d:%d:%x:%x", u.Algorithm, u.Iterations, u.Memory, u.Parallelism, u.Salt, u.Mac)
+}
+
+func pbkdf2Hash(algorithm string) func() hash.Hash {
+	switch algorithm {
+	case "pbkdf2-sha512":
+		return sha512.New
+	case "pbkdf2-sha256":
+		return sha256.New
+	case "pbkdf2-sha1":
+		return sha1.New
+	}
+	return nil
+}
+
+// verifySlowHash verifies given password against PBKDF2 or argon2id
+// hash of given user. Successful verifications are remembered by Svc
+// of given db, so repeated verifications of same password are cheap.
+func verifySlowHash(db *credsDB, u User, password string) bool {
+	var c *pwdCache
+	if db.svc != nil {
+		c = &db.svc.pwdCache
+	}
+	key := pwdFingerprint(u.User, password)
+	hashID := u.hashID()
+	if c != nil && c.get(key) == hashID {
+		return true
+	}
+
+	if len(u.Mac) == 0 {
+		return false
+	}
+	var dk []byte
+	if u.Algorithm == AlgorithmArgon2id {
+		if !validArgon2Params(&u) {
+			return false
+		}
+		dk = slowHash(func() []byte {
+			return argon2idKey([]byte(password), u.Salt, uint32(u.Iterations), u.Memory, u.Parallelism, uint32(len(u.Mac)))
+		})
+	} else {
+		newHash := pbkdf2Hash(u.Algorithm)
+		if newHash == nil {
+			return false
+		}
+		dk = slowHash(func() []byte {
+			dk, _ := pbkdf2.Key(newHash, password, u.Salt, u.Iterations, len(u.Mac))
+			return dk
+		})
+	}
+	if dk == nil || !hmac.Equal(dk, u.Mac) {
+		return false
+	}
+	if c != nil {
+		c.put(key, hashID)
+	}
+	return true
+}
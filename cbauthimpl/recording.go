@@ -0,0 +1,166 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import "sort"
+
+// CredsRecord struct describes everything permission checks of some
+// creds depend on besides cache. It carries no secrets, so it can be
+// recorded and used to recreate equivalent creds offline (see
+// ReplayCreds).
+type CredsRecord struct {
+	Name      string    `json:"name"`
+	Source    string    `json:"source"`
+	Domain    string    `json:"domain,omitempty"`
+	Mechanism Mechanism `json:"mechanism,omitempty"`
+	Roles     []Role    `json:"roles,omitempty"`
+	Admin     bool      `json:"admin,omitempty"`
+	ROAdmin   bool      `json:"roAdmin,omitempty"`
+	Legacy    bool      `json:"legacy,omitempty"`
+	// ServerVerified is true if creds were verified by ns_server
+	ServerVerified bool `json:"serverVerified,omitempty"`
+	// Scope and Extra are permissions of scoped and elevated
+	// creds
+	Scope []string `json:"scope,omitempty"`
+	Extra []string `json:"extra,omitempty"`
+}
+
+func permList(perms map[string]bool) []string {
+	if perms == nil {
+		return nil
+	}
+	rv := make([]string, 0, len(perms))
+	for p := range perms {
+		rv = append(rv, p)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+func permSet(perms []string) map[string]bool {
+	if perms == nil {
+		return nil
+	}
+	rv := make(map[string]bool, len(perms))
+	for _, p := range perms {
+		rv[p] = true
+	}
+	return rv
+}
+
+// Record method returns record of this creds.
+func (c *CredsImpl) Record() CredsRecord {
+	rv := CredsRecord{
+		Name:           c.name,
+		Source:         c.source,
+		Mechanism:      c.mechanism,
+		Roles:          append([]Role(nil), c.credsRoles()...),
+		Admin:          c.isAdmin,
+		ROAdmin:        c.isROAdmin,
+		Legacy:         c.legacy,
+		ServerVerified: c.serverVerified,
+		Scope:          permList(c.scope),
+		Extra:          permList(c.extra),
+	}
+	if c.identity != nil {
+		rv.Domain = c.identity.Domain
+	}
+	return rv
+}
+
+// ReplayCreds returns creds described by given record whose
+// permissions are decided against current cache of given service.
+func ReplayCreds(s *Svc, r *CredsRecord) (*CredsImpl, error) {
+	db := currentDB(s)
+	if db == nil {
+		return nil, staleError(s)
+	}
+	rv := &CredsImpl{name: r.Name, source: r.Source, db: db, mechanism: r.Mechanism,
+		isAdmin: r.Admin, isROAdmin: r.ROAdmin, legacy: r.Legacy, serverVerified: r.ServerVerified,
+		scope: permSet(r.Scope), extra: permSet(r.Extra)}
+	roles := append([]Role(nil), r.Roles...)
+	if r.ServerVerified {
+		rv.identity = &Identity{Version: AuthResponseVersion, Roles: roles, Domain: r.Domain}
+	} else {
+		rv.roles = roles
+	}
+	if len(roles) > 0 {
+		rv.perms = buildRolePerms(roles, db.permsMask)
+	}
+	return rv, nil
+}
+
+// Recorder struct holds functions that receive events of some
+// service (see SetRecorder). They are called synchronously, so they
+// must not block for long.
+type Recorder struct {
+	// Cache receives snapshot (see SnapshotCache) of cache after
+	// every update pushed by ns_server.
+	Cache func(c *Cache)
+	// Permission receives outcome of every IsAllowed check of
+	// creds verified by service.
+	Permission func(c *CredsImpl, permission string, allowed bool, err error)
+}
+
+type recorderBox struct{ r *Recorder }
+
+// SetRecorder makes given recorder (or nothing if nil is passed)
+// receive events of given service.
+func SetRecorder(s *Svc, r *Recorder) {
+	s.recorder.Store(recorderBox{r})
+}
+
+func getRecorder(s *Svc) *Recorder {
+	b, _ := s.recorder.Load().(recorderBox)
+	return b.r
+}
+
+// currentDB returns db of given service without waiting for it to
+// become fresh.
+func currentDB(s *Svc) *credsDB {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.db
+}
+
+// SnapshotCacheNow is SnapshotCache that doesn't wait for stale cache
+// to become fresh.
+func SnapshotCacheNow(s *Svc) (*Cache, error) {
+	db := currentDB(s)
+	if db == nil {
+		return nil, staleError(s)
+	}
+	return snapshotDB(db), nil
+}
+
+func recordCache(s *Svc) {
+	r := getRecorder(s)
+	if r == nil || r.Cache == nil {
+		return
+	}
+	if db := currentDB(s); db != nil {
+		r.Cache(snapshotDB(db))
+	}
+}
+
+func recordPermission(c *CredsImpl, permission string, allowed bool, err error) {
+	if c.db == nil || c.db.svc == nil {
+		return
+	}
+	if r := getRecorder(c.db.svc); r != nil && r.Permission != nil {
+		r.Permission(c, permission, allowed, err)
+	}
+}
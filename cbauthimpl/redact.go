@@ -0,0 +1,53 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// TagUserData wraps given string into couchbase log redaction tags
+// for user data.
+func TagUserData(s string) string {
+	return "<ud>" + s + "</ud>"
+}
+
+// String method implements fmt.Stringer. It returns redaction
+// tagged user name and source of creds and never includes secrets.
+func (c *CredsImpl) String() string {
+	if c.actor != "" {
+		return fmt.Sprintf("Creds(%s, source: %s, actor: %s)", TagUserData(c.name), c.source, c.actor)
+	}
+	return fmt.Sprintf("Creds(%s, source: %s)", TagUserData(c.name), c.source)
+}
+
+// GoString method implements fmt.GoStringer. It makes sure that %#v
+// doesn't reveal secrets either.
+func (c *CredsImpl) GoString() string {
+	return c.String()
+}
+
+// LogValue method implements slog.LogValuer.
+func (c *CredsImpl) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("user", TagUserData(c.name)),
+		slog.String("source", c.source))
+}
+
+var _ fmt.Stringer = (*CredsImpl)(nil)
+var _ fmt.GoStringer = (*CredsImpl)(nil)
+var _ slog.LogValuer = (*CredsImpl)(nil)
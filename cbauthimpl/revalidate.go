@@ -0,0 +1,128 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import "errors"
+
+// ErrCredsRevoked is returned by Revalidate when creds are no longer
+// valid or their permissions changed.
+var ErrCredsRevoked = errors.New("creds were revoked or their permissions changed")
+
+// Generation method returns number of cache update these creds were
+// derived from. Generations of creds verified by same Svc only grow.
+func (c *CredsImpl) Generation() uint64 {
+	if c.db == nil {
+		return 0
+	}
+	return c.db.generation
+}
+
+// CurrentGeneration returns number of cache update that is currently
+// installed to given service or 0 if cache is stale.
+func CurrentGeneration(s *Svc) uint64 {
+	if db := currentDB(s); db != nil {
+		return db.generation
+	}
+	return 0
+}
+
+// Revalidate method checks whether this creds are still valid
+// according to current state of cbauth cache. Returns nil if cache
+// wasn't updated since creds were derived or if user's roles didn't
+// change, ErrCredsRevoked if they did (or if creds expired or were
+// revoked by ns_server, see Revoke) and stale error if cache is
+// stale. Roles that came from custom lookup (see VerifyClientCertVia)
+// are rechecked with it after cache updates. Otherwise it is cheap and doesn't block, so long running
+// operations may call it periodically in order to abort if
+// permissions were revoked mid-flight.
+func (c *CredsImpl) Revalidate() error {
+	if c.expired() || c.Revoked() {
+		return ErrCredsRevoked
+	}
+	if c.db == nil || c.db.svc == nil {
+		return nil
+	}
+	s := c.db.svc
+	s.l.Lock()
+	db, staleErr := usableDBLocked(s), staleErrorLocked(s)
+	s.l.Unlock()
+
+	if db == nil {
+		return staleErr
+	}
+	if db.generation == c.db.generation || c.stillValid(db) {
+		return nil
+	}
+	return ErrCredsRevoked
+}
+
+func (c *CredsImpl) stillValid(db *credsDB) bool {
+	switch {
+	case c.scope != nil:
+		// scoped tokens are short lived, so they only get
+		// revoked if key they're signed with changes
+		return db.specialPassword == c.db.specialPassword
+	case c.serverVerified:
+		// roles of creds verified by ns_server (e.g. external
+		// users) can't be rechecked against db, except for roles
+		// of their external groups; otherwise they only get
+		// revoked when they expire (see expired)
+		if c.identity == nil || c.identity.Groups == nil {
+			return true
+		}
+		return equalRoles(resolveGroupRolesDB(db, c.identity.Groups),
+			resolveGroupRolesDB(c.db, c.identity.Groups))
+	case c.lookup != nil:
+		roles, domain, err := c.lookup(c.name, c.source)
+		return err == nil && domain == c.source && equalRoles(roles, c.roles)
+	case c.mechanism == MechanismJWT:
+		// roles of token can't be rechecked, but roles of
+		// groups and users of cache can
+		rv := jwtCredsDB(db, c.jwt)
+		return rv != nil && equalRoles(rv.identity.Roles, c.identity.Roles)
+	case c.custom != nil:
+		cred := db.customCreds[customCredKey(c.custom.Type, c.custom.ID)]
+		if cred == nil || !sameCustomCred(cred, c.custom) {
+			return false
+		}
+		rv := customCredsDB(db, cred)
+		return rv != nil && rv.source == c.source && equalRoles(rv.roles, c.roles)
+	case c.mechanism == MechanismMirror:
+		rv := mirrorCredsDB(db, c.name, c.source)
+		return rv != nil && rv.isAdmin == c.isAdmin && rv.isROAdmin == c.isROAdmin &&
+			equalRoles(rv.roles, c.roles)
+	case c.mechanism == MechanismClientCert:
+		rv := certCreds(db, c.name, c.source)
+		return rv != nil && rv.source == c.source && equalRoles(rv.roles, c.roles)
+	}
+	// admin bit of elevated creds comes from elevation token
+	// rather than from db
+	elevated := c.extra[PermissionAdmin]
+	rv := verifyPasswordDB(db, c.name, c.password)
+	return rv != nil && (elevated || rv.isAdmin == c.isAdmin) && rv.isROAdmin == c.isROAdmin
+}
+
+func equalRoles(a, b []Role) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,244 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RevocationRetention is how long revocations (see Svc.Revoke) are
+// remembered. Revocations of tokens that carry expiration are
+// remembered until their tokens expire instead.
+var RevocationRetention = 10 * time.Minute
+
+// Revocation struct is used by ns_server to revoke creds of user or
+// token immediately rather than on next cache update.
+type Revocation struct {
+	// User, if non-empty, is user all creds of whom are revoked.
+	User string `json:"user,omitempty"`
+	// Domain is domain of User. Empty domain revokes creds of
+	// user of any domain.
+	Domain string `json:"domain,omitempty"`
+	// Token, if non-empty, is token (scoped, elevation or JWT
+	// bearer token) that is revoked.
+	Token string `json:"token,omitempty"`
+	// Expires, if set, is when Token expires.
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// RevokeAck struct is reply of Revoke. It is returned once
+// revocation is in effect.
+type RevokeAck struct {
+	// Generation is generation of cache (see Generation method of
+	// creds) that is installed when revocation is in effect.
+	Generation uint64 `json:"generation"`
+}
+
+// ErrEmptyRevocation is returned by Revoke if revocation names
+// neither user nor token.
+var ErrEmptyRevocation = errors.New("revocation names neither user nor token")
+
+// TokenID returns fingerprint that identifies given token in
+// revocations, so that tokens themselves are not retained.
+func TokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type revokedUser struct {
+	name, domain string
+}
+
+type revokedEntry struct {
+	// generation is last generation of cache that creds revoked
+	// by this entry may be derived from
+	generation uint64
+	until      time.Time
+	// seq orders entries against full cache updates (see settle)
+	seq uint64
+	// pending is true until full cache update that reflects
+	// revocation is installed. New creds are refused while it is.
+	pending bool
+}
+
+// revocations holds revocations that are in effect.
+type revocations struct {
+	l sync.Mutex
+	// count is number of entries, so that creds are checked
+	// without locking when there are none
+	count     int32
+	seq       uint64
+	nextPrune time.Time
+	users     map[revokedUser]revokedEntry
+	tokens    map[string]revokedEntry
+}
+
+func (r *revocations) add(rev *Revocation, generation uint64, now time.Time) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.seq++
+	e := revokedEntry{generation: generation, until: now.Add(RevocationRetention),
+		seq: r.seq, pending: true}
+	if rev.User != "" {
+		if r.users == nil {
+			r.users = make(map[revokedUser]revokedEntry)
+		}
+		r.users[revokedUser{rev.User, rev.Domain}] = e
+		r.notePruneLocked(e.until)
+	}
+	if rev.Token != "" {
+		if !rev.Expires.IsZero() {
+			e.until = rev.Expires
+		}
+		if r.tokens == nil {
+			r.tokens = make(map[string]revokedEntry)
+		}
+		r.tokens[TokenID(rev.Token)] = e
+		r.notePruneLocked(e.until)
+	}
+	atomic.StoreInt32(&r.count, int32(len(r.users)+len(r.tokens)))
+}
+
+func (r *revocations) notePruneLocked(until time.Time) {
+	if r.nextPrune.IsZero() || until.Before(r.nextPrune) {
+		r.nextPrune = until
+	}
+}
+
+func (r *revocations) pruneLocked(now time.Time) {
+	if r.nextPrune.IsZero() || now.Before(r.nextPrune) {
+		return
+	}
+	r.nextPrune = time.Time{}
+	for k, e := range r.users {
+		if !now.Before(e.until) {
+			delete(r.users, k)
+		} else {
+			r.notePruneLocked(e.until)
+		}
+	}
+	for k, e := range r.tokens {
+		if !now.Before(e.until) {
+			delete(r.tokens, k)
+		} else {
+			r.notePruneLocked(e.until)
+		}
+	}
+	atomic.StoreInt32(&r.count, int32(len(r.users)+len(r.tokens)))
+}
+
+// mark returns sequence number of last revocation. Full cache
+// update that is received after it reflects revocations up to it.
+func (r *revocations) mark() uint64 {
+	r.l.Lock()
+	defer r.l.Unlock()
+	return r.seq
+}
+
+// settle stops refusing new creds of users revoked up to given
+// mark. Creds that were derived before revocation remain revoked.
+func (r *revocations) settle(mark uint64) {
+	if atomic.LoadInt32(&r.count) == 0 {
+		return
+	}
+	r.l.Lock()
+	defer r.l.Unlock()
+	for k, e := range r.users {
+		if e.pending && e.seq <= mark {
+			e.pending = false
+			r.users[k] = e
+		}
+	}
+}
+
+func (r *revocations) token(id string, now time.Time) bool {
+	if atomic.LoadInt32(&r.count) == 0 {
+		return false
+	}
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.pruneLocked(now)
+	_, ok := r.tokens[id]
+	return ok
+}
+
+func (r *revocations) revokes(c *CredsImpl, now time.Time) bool {
+	if atomic.LoadInt32(&r.count) == 0 {
+		return false
+	}
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.pruneLocked(now)
+	for _, k := range [...]revokedUser{{c.name, c.identityDomain()}, {c.name, ""}} {
+		if e, ok := r.users[k]; ok && (e.pending || c.db.generation <= e.generation) {
+			return true
+		}
+	}
+	for _, id := range c.tokens {
+		if _, ok := r.tokens[id]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Revoked method returns true if this creds were revoked by
+// ns_server (see Revoke).
+func (c *CredsImpl) Revoked() bool {
+	if c.db == nil || c.db.svc == nil || c.name == "" && c.tokens == nil {
+		return false
+	}
+	return c.db.svc.revoked.revokes(c, Now())
+}
+
+// Revoke is a revrpc method that is used by ns_server to revoke
+// creds of given user or given token. Revocation is in effect once
+// it returns: creds of user or token that were derived before fail
+// Revalidate and new ones are refused. New creds of revoked user
+// are accepted again once next full cache update (which is
+// expected to reflect revocation) is installed, while revoked
+// tokens are refused until revocation is forgotten (see
+// RevocationRetention).
+func (s *Svc) Revoke(r *Revocation, ack *RevokeAck) error {
+	if r.User == "" && r.Token == "" {
+		return ErrEmptyRevocation
+	}
+	now := Now()
+	atomic.AddInt32(&s.pending, 1)
+	s.l.Lock()
+	atomic.AddInt32(&s.pending, -1)
+	s.revoked.add(r, s.generation, now)
+	if s.db != nil {
+		// new generation makes sure that auth results and
+		// decisions derived before revocation are rechecked
+		db := *s.db
+		updateDBLocked(s, &db)
+	}
+	if r.User != "" {
+		s.churn.add(r.User, now)
+	}
+	gen := s.generation
+	s.l.Unlock()
+	if ack != nil {
+		ack.Generation = gen
+	}
+	return nil
+}
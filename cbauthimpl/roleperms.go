@@ -0,0 +1,136 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"sync/atomic"
+
+	"github.com/couchbase/cbauth/rbac"
+)
+
+// opMask is set of bucket operations (see BucketPermission).
+type opMask uint8
+
+var opBits = map[string]opMask{
+	BucketOpRead:   1 << 0,
+	BucketOpWrite:  1 << 1,
+	BucketOpDDL:    1 << 2,
+	BucketOpDCP:    1 << 3,
+	BucketOpManage: 1 << 4,
+}
+
+// DefaultPrecomputedBucketOps are bucket operations whose grants are
+// precomputed by default (see SetPrecomputedBucketOps).
+var DefaultPrecomputedBucketOps = []string{BucketOpRead, BucketOpWrite}
+
+var precomputedOps atomic.Value
+
+func init() {
+	SetPrecomputedBucketOps(DefaultPrecomputedBucketOps...)
+}
+
+// SetPrecomputedBucketOps sets bucket operations whose grants are
+// precomputed as bitmasks from roles of every user when cache is
+// updated (and from roles reported by ns_server when creds are
+// verified there), so that checking them is bitmask test rather than
+// walk over roles. Other operations are still checked by walking
+// roles. Unknown operations are ignored. Change takes effect with
+// next cache update. Cluster-wide admin and ro-admin flags are always
+// precomputed.
+func SetPrecomputedBucketOps(ops ...string) {
+	var mask opMask
+	for _, op := range ops {
+		mask |= opBits[op]
+	}
+	precomputedOps.Store(mask)
+}
+
+// PrecomputedBucketOps returns bucket operations whose grants are
+// precomputed.
+func PrecomputedBucketOps() []string {
+	mask := precomputedOps.Load().(opMask)
+	var rv []string
+	for _, op := range rbac.BucketOps() {
+		if mask&opBits[op] != 0 {
+			rv = append(rv, op)
+		}
+	}
+	return rv
+}
+
+// rolePerms are grants of precomputed bucket operations by some set
+// of roles.
+type rolePerms struct {
+	// mask is set of operations that are precomputed
+	mask opMask
+	// any are operations granted on every bucket
+	any     opMask
+	buckets map[string]opMask
+}
+
+func buildRolePerms(roles []Role, mask opMask) *rolePerms {
+	rv := &rolePerms{mask: mask}
+	for _, r := range roles {
+		var granted opMask
+		for _, op := range rbac.BucketRoleOps(r.Name) {
+			granted |= opBits[op] & mask
+		}
+		switch {
+		case granted == 0 || !r.BucketWide():
+		case r.Bucket == AnyBucketRole:
+			rv.any |= granted
+		default:
+			if rv.buckets == nil {
+				rv.buckets = make(map[string]opMask)
+			}
+			rv.buckets[r.Bucket] |= granted
+		}
+	}
+	return rv
+}
+
+// allows method returns whether given operation is granted on given
+// bucket. ok is false if operation is not precomputed.
+func (p *rolePerms) allows(bucket, op string) (granted, ok bool) {
+	bit := opBits[op]
+	if p == nil || p.mask&bit == 0 {
+		return false, false
+	}
+	return (p.any|p.buckets[bucket])&bit != 0, true
+}
+
+// buildUserPerms precomputes grants of roles of given users.
+func buildUserPerms(users []UserInfo, mask opMask) map[string]*rolePerms {
+	if mask == 0 {
+		return nil
+	}
+	rv := make(map[string]*rolePerms, len(users))
+	for i := range users {
+		if len(users[i].Roles) != 0 {
+			rv[userKey(&users[i])] = buildRolePerms(users[i].Roles, mask)
+		}
+	}
+	return rv
+}
+
+// hasBucketRole method returns true iff some role of this creds
+// grants given operation on given bucket (see bucketRole).
+func (c *CredsImpl) hasBucketRole(bucket, op string) bool {
+	if granted, ok := c.perms.allows(bucket, op); ok {
+		return granted
+	}
+	return c.bucketRole(bucket, op) != ""
+}
@@ -0,0 +1,167 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/couchbase/cbauth/rbac"
+)
+
+// Permissions that can be granted to scoped service credentials.
+// Bucket permissions are constructed via BucketPermission.
+const (
+	PermissionAdmin           = rbac.PermissionAdmin
+	PermissionReadAnyMetadata = rbac.PermissionReadAnyMetadata
+)
+
+// Bucket operations that can be passed to BucketPermission.
+const (
+	BucketOpRead   = rbac.BucketOpRead
+	BucketOpWrite  = rbac.BucketOpWrite
+	BucketOpDDL    = rbac.BucketOpDDL
+	BucketOpDCP    = rbac.BucketOpDCP
+	BucketOpManage = rbac.BucketOpManage
+)
+
+// AnyBucket can be passed to BucketPermission to construct
+// permission that applies to every bucket.
+const AnyBucket = rbac.AnyBucket
+
+// ScopedTokenTTL is lifetime of tokens minted by MintScopedToken.
+var ScopedTokenTTL = 5 * time.Minute
+
+const scopedTokenPrefix = "cbauth-scoped-v1:"
+
+// BucketPermission returns permission string for given operation
+// on given bucket.
+func BucketPermission(bucket, op string) string {
+	return rbac.BucketPermission(bucket, op)
+}
+
+type scopedPayload struct {
+	User  string   `json:"sub"`
+	Perms []string `json:"perms"`
+	Exp   int64    `json:"exp"`
+}
+
+func tokenMac(key, payload string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signToken returns token that carries json encoding of given value
+// signed by given key. Signature covers prefix too, so that token of
+// one kind can't be passed off as token of other kind signed by the
+// same key.
+func signToken(prefix, key string, v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return prefix + payload + "." + tokenMac(key, prefix+payload), nil
+}
+
+// verifyToken checks signature of given token and decodes its
+// payload into v. Returns false if token is malformed or its
+// signature doesn't match.
+func verifyToken(prefix, key, token string, v interface{}) bool {
+	if key == "" || !strings.HasPrefix(token, prefix) {
+		return false
+	}
+	parts := strings.SplitN(token[len(prefix):], ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	if !hmac.Equal([]byte(parts[1]), []byte(tokenMac(key, prefix+parts[0]))) {
+		return false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(b, v) == nil
+}
+
+// MintScopedToken returns service user name and token that may be
+// used as password to access service at given host and port with
+// only given permissions. Token is signed by password of target
+// node, so only that node is able to verify it. Returns "", "", nil
+// if host/port represents unknown service.
+func MintScopedToken(s *Svc, host string, port int, permissions []string) (user, token string, err error) {
+	_, user, key, err := GetCreds(s, host, port)
+	if err != nil || user == "" {
+		return "", "", err
+	}
+	token, err = SignScopedToken(key, user, permissions, Now().Add(ScopedTokenTTL))
+	if err != nil {
+		return "", "", err
+	}
+	return user, token, nil
+}
+
+// SignScopedToken returns scoped token (see MintScopedToken) of given
+// internal user that is signed by given key (password of target
+// node) and expires at given time.
+func SignScopedToken(key, user string, permissions []string, expires time.Time) (string, error) {
+	p := scopedPayload{
+		User:  user,
+		Perms: permissions,
+		Exp:   expires.Unix(),
+	}
+	return signToken(scopedTokenPrefix, key, p)
+}
+
+func isScopedToken(password string) bool {
+	return strings.HasPrefix(password, scopedTokenPrefix)
+}
+
+// verifyScopedCreds returns set of permissions granted by given
+// scoped token or nil if token is not valid.
+func verifyScopedCreds(db *credsDB, user, password string) map[string]bool {
+	if !isSpecialUser(user) {
+		return nil
+	}
+	var p scopedPayload
+	if !verifyToken(scopedTokenPrefix, db.specialPassword, password, &p) {
+		return nil
+	}
+	if p.User != user || Now().Unix() >= p.Exp {
+		return nil
+	}
+	rv := make(map[string]bool, len(p.Perms))
+	for _, perm := range p.Perms {
+		rv[perm] = true
+	}
+	return rv
+}
+
+func permsAllow(perms map[string]bool, bucket, op string) bool {
+	return perms[PermissionAdmin] ||
+		perms[BucketPermission(bucket, op)] ||
+		perms[BucketPermission(AnyBucket, op)]
+}
+
+func (c *CredsImpl) scopeAllows(bucket, op string) bool {
+	return permsAllow(c.scope, bucket, op)
+}
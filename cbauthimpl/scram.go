@@ -0,0 +1,161 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"strings"
+)
+
+// ScramIterations is number of PBKDF2 iterations of SCRAM secrets
+// that are derived from cleartext passwords (see GetScramSecret).
+var ScramIterations = 4096
+
+// scramSaltLen is length of salts of derived SCRAM secrets.
+const scramSaltLen = 16
+
+// scramSaltKey is per process key that derived SCRAM salts are
+// computed with, so that salt of given user is stable within
+// process and unpredictable outside of it.
+var scramSaltKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// ScramSecret struct describes SCRAM (RFC 5802) secret of user.
+type ScramSecret struct {
+	Salt           []byte
+	Iterations     int
+	SaltedPassword []byte
+	hash           string
+	// password is cleartext password of user if it's known
+	password       string
+	admin, roadmin bool
+}
+
+// ScramHash returns hash function of given SCRAM hash name ("SHA-1",
+// "SHA-256" or "SHA-512") or nil if hash is not supported.
+func ScramHash(name string) func() hash.Hash {
+	switch name {
+	case "SHA-1":
+		return sha1.New
+	case "SHA-256":
+		return sha256.New
+	case "SHA-512":
+		return sha512.New
+	}
+	return nil
+}
+
+func scramSalt(hashName, user string) []byte {
+	mac := hmac.New(sha256.New, scramSaltKey)
+	mac.Write([]byte(hashName + "\x00" + user))
+	return mac.Sum(nil)[:scramSaltLen]
+}
+
+// hashedScramSecret returns SCRAM secret of given user whose
+// password is known as PBKDF2 hash. Such hash is SaltedPassword of
+// SCRAM if its algorithm matches hash of SCRAM mechanism.
+func hashedScramSecret(u User, hashName string, newHash func() hash.Hash) (ScramSecret, bool) {
+	algorithm := "pbkdf2-" + strings.ToLower(strings.Replace(hashName, "-", "", 1))
+	if u.Iterations == 0 || u.Algorithm != algorithm || len(u.Mac) != newHash().Size() {
+		return ScramSecret{}, false
+	}
+	return ScramSecret{Salt: u.Salt, Iterations: u.Iterations, SaltedPassword: u.Mac, hash: hashName}, true
+}
+
+func scramSecretDB(db *credsDB, user, hashName string) (ScramSecret, bool) {
+	newHash := ScramHash(hashName)
+	rv := ScramSecret{Salt: scramSalt(hashName, user), Iterations: ScramIterations, hash: hashName}
+	if newHash == nil || user == "" {
+		return rv, false
+	}
+
+	switch {
+	case isSpecialUser(user):
+		rv.password = db.specialPassword
+	case db.admin.User == user:
+		s, ok := hashedScramSecret(db.admin, hashName, newHash)
+		s.admin = true
+		return s, ok
+	case db.roadmin.User == user:
+		s, ok := hashedScramSecret(db.roadmin, hashName, newHash)
+		s.roadmin = true
+		return s, ok
+	default:
+		rv.password = db.buckets[user]
+	}
+	if rv.password == "" {
+		return rv, false
+	}
+	dk := slowHash(func() []byte {
+		dk, _ := pbkdf2.Key(newHash, rv.password, rv.Salt, rv.Iterations, newHash().Size())
+		return dk
+	})
+	if dk == nil {
+		return rv, false
+	}
+	rv.SaltedPassword = dk
+	return rv, true
+}
+
+// GetScramSecret returns SCRAM secret of given user for given SCRAM
+// hash (see ScramHash). Secrets of admins are their PBKDF2 hashes
+// (if hash algorithm matches), and secrets of bucket and special
+// users are derived from their cleartext passwords. For unknown
+// users false is returned together with secret that has plausible
+// salt and iterations, so that SCRAM exchange doesn't reveal whether
+// user exists.
+func GetScramSecret(s *Svc, user, hashName string) (ScramSecret, bool, error) {
+	db := fetchDB(s)
+	if db == nil {
+		return ScramSecret{}, false, staleError(s)
+	}
+	sec, ok := scramSecretDB(db, user, hashName)
+	if !ok {
+		sec = ScramSecret{Salt: scramSalt(hashName, user), Iterations: ScramIterations, hash: hashName}
+	}
+	return sec, ok, nil
+}
+
+// ScramCreds returns creds of given user whose SCRAM exchange was
+// verified against given secret (see GetScramSecret). Returns nil,
+// nil if secret of user has changed since it was returned (e.g.
+// because password was changed).
+func ScramCreds(s *Svc, user string, sec ScramSecret) (*CredsImpl, error) {
+	db := fetchDB(s)
+	if db == nil {
+		return nil, staleError(s)
+	}
+	cur, ok := scramSecretDB(db, user, sec.hash)
+	if !ok || !hmac.Equal(cur.SaltedPassword, sec.SaltedPassword) {
+		return nil, nil
+	}
+	if cur.password != "" {
+		return verifyPasswordDB(db, user, cur.password), nil
+	}
+	return &CredsImpl{name: user, source: "ns_server", db: db,
+		isAdmin: cur.admin, isROAdmin: cur.roadmin}, nil
+}
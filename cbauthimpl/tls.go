@@ -0,0 +1,262 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+// TLSSettings struct is used as part of Cache messages to describe
+// TLS configuration of the cluster.
+type TLSSettings struct {
+	// MinVersion is minimal TLS version, e.g. "tlsv1.2". Empty
+	// means crypto/tls default.
+	MinVersion string `json:"minTLSVersion,omitempty"`
+	// CAFile is path to PEM file with cluster CA certificates.
+	CAFile string `json:"caFile,omitempty"`
+	// ClientCertFile and ClientKeyFile are paths to PEM files with
+	// certificate (chain) and key that node presents when it
+	// connects to other nodes.
+	ClientCertFile string `json:"clientCertFile,omitempty"`
+	ClientKeyFile  string `json:"clientKeyFile,omitempty"`
+	// CertFile and KeyFile are paths to PEM files with
+	// certificate (chain) and key that node presents to clients.
+	// CertPEM and KeyPEM carry the same inline; they take
+	// precedence over files.
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	CertPEM  string `json:"certPem,omitempty"`
+	KeyPEM   string `json:"keyPem,omitempty"`
+	// CipherSuites are names of allowed TLS 1.2 cipher suites as
+	// understood by crypto/tls (e.g.
+	// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"). Empty means
+	// crypto/tls default.
+	CipherSuites []string `json:"cipherSuites,omitempty"`
+	// CertVersion is bumped by ns_server every time certificates
+	// are rotated in place, so that rotation is noticed even if
+	// paths stay the same.
+	CertVersion uint64 `json:"certVersion,omitempty"`
+}
+
+func sameTLSSettings(a, b *TLSSettings) bool {
+	return a.MinVersion == b.MinVersion && a.CAFile == b.CAFile &&
+		a.ClientCertFile == b.ClientCertFile && a.ClientKeyFile == b.ClientKeyFile &&
+		a.CertFile == b.CertFile && a.KeyFile == b.KeyFile &&
+		a.CertPEM == b.CertPEM && a.KeyPEM == b.KeyPEM &&
+		equalStrings(a.CipherSuites, b.CipherSuites) && a.CertVersion == b.CertVersion
+}
+
+// Kinds of config changes that are reported to config refresh
+// callbacks (see RegisterConfigRefreshCallback). They are bit flags
+// that can be or-ed together.
+const (
+	// ConfigChangeCerts means that TLS settings changed, e.g.
+	// because certificates were rotated.
+	ConfigChangeCerts uint64 = 1 << iota
+	// ConfigChangeClientCertAuth means that client cert auth
+	// state changed.
+	ConfigChangeClientCertAuth
+	// ConfigChangeClusterEncryption means that cluster
+	// encryption level changed.
+	ConfigChangeClusterEncryption
+)
+
+// Cluster encryption levels (see ClusterEncryption).
+const (
+	ClusterEncryptionControl = "control"
+	ClusterEncryptionAll     = "all"
+	ClusterEncryptionStrict  = "strict"
+)
+
+// ClusterEncryption struct is used as part of Cache messages to
+// describe encryption of node to node traffic.
+type ClusterEncryption struct {
+	// Level is ClusterEncryptionControl, ClusterEncryptionAll or
+	// ClusterEncryptionStrict. Empty means that cluster
+	// encryption is disabled.
+	Level string `json:"level,omitempty"`
+}
+
+// EncryptData method returns true iff data (and not only control)
+// traffic between nodes has to be encrypted.
+func (e *ClusterEncryption) EncryptData() bool {
+	return e.Level == ClusterEncryptionAll || e.Level == ClusterEncryptionStrict
+}
+
+// DisableNonSSLPorts method returns true iff services must not
+// listen on non-TLS ports, except for loopback.
+func (e *ClusterEncryption) DisableNonSSLPorts() bool {
+	return e.Level == ClusterEncryptionStrict
+}
+
+// GetClusterEncryption returns cluster encryption settings.
+func GetClusterEncryption(s *Svc) (ClusterEncryption, error) {
+	db := fetchDB(s)
+	if db == nil {
+		return ClusterEncryption{}, staleError(s)
+	}
+	return db.encryption, nil
+}
+
+// configWatch is state of config refresh notifications of Svc.
+type configWatch struct {
+	// known is TLS settings, client cert auth state and cluster
+	// encryption level of latest db
+	known      *TLSSettings
+	certState  string
+	encryption string
+	// version changes every time TLS settings or client cert
+	// auth state change
+	version   uint64
+	pending   uint64
+	callbacks []configCallback
+	nextID    uint64
+}
+
+// TLSState struct describes latest TLS settings and client cert auth
+// state known to Svc. Version changes every time either of them
+// changes.
+type TLSState struct {
+	Settings        TLSSettings
+	ClientCertState string
+	Version         uint64
+}
+
+// GetTLSState returns latest TLS state of given service. Unlike
+// GetTLSSettings it keeps returning last known state while cache is
+// stale, so that listeners keep accepting connections when ns_server
+// connection is lost.
+func GetTLSState(s *Svc) (TLSState, error) {
+	if rv, ok := lastTLSState(s); ok {
+		return rv, nil
+	}
+	// wait a bit for first db
+	if fetchDB(s) == nil {
+		return TLSState{}, staleError(s)
+	}
+	rv, _ := lastTLSState(s)
+	return rv, nil
+}
+
+func lastTLSState(s *Svc) (TLSState, bool) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.config.known == nil {
+		return TLSState{}, false
+	}
+	rv := TLSState{Settings: *s.config.known, ClientCertState: s.config.certState, Version: s.config.version}
+	if rv.ClientCertState == "" {
+		rv.ClientCertState = ClientCertDisable
+	}
+	return rv, true
+}
+
+type configCallback struct {
+	id    uint64
+	kinds uint64
+	cb    func(changed uint64)
+}
+
+// RegisterConfigRefreshCallback registers function that is called
+// (from separate goroutine) every time config of given kinds (or-ed
+// ConfigChange flags) changes, e.g. so that services can rebuild tls
+// configs of their listeners and clients. Callback is passed kinds of
+// changes it subscribed to that happened since last call. Any number
+// of callbacks may be registered. Calls of all callbacks are
+// serialized: every change is passed to callbacks in order of
+// registration and next change is passed only after all callbacks
+// return. Intermediate changes may be coalesced. Losing ns_server
+// connection doesn't count as change. Returned function unregisters
+// callback; it is safe to call it (or to register callbacks) from
+// callbacks, in which case that takes effect from next change.
+func RegisterConfigRefreshCallback(s *Svc, kinds uint64, cb func(changed uint64)) (unregister func()) {
+	s.l.Lock()
+	s.config.nextID++
+	id := s.config.nextID
+	s.config.callbacks = append(s.config.callbacks, configCallback{id, kinds, cb})
+	s.l.Unlock()
+	return func() {
+		s.l.Lock()
+		defer s.l.Unlock()
+		for i, c := range s.config.callbacks {
+			if c.id == id {
+				s.config.callbacks = append(s.config.callbacks[:i:i], s.config.callbacks[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// RegisterTLSRefreshCallback registers function that is called every
+// time TLS settings or client cert auth state of the cluster change
+// (see RegisterConfigRefreshCallback).
+func RegisterTLSRefreshCallback(s *Svc, cb func()) (unregister func()) {
+	return RegisterConfigRefreshCallback(s, ConfigChangeCerts|ConfigChangeClientCertAuth,
+		func(uint64) { cb() })
+}
+
+// checkConfigLocked notices config changes of given (new) db and
+// notifies config refresh callbacks about them. First db counts as
+// change of everything.
+func checkConfigLocked(s *Svc, db *credsDB) {
+	if db == nil {
+		return
+	}
+	var changed uint64
+	if s.config.known == nil || !sameTLSSettings(s.config.known, &db.tls) {
+		changed |= ConfigChangeCerts
+	}
+	if s.config.known == nil || s.config.certState != db.certAuth.State {
+		changed |= ConfigChangeClientCertAuth
+	}
+	if s.config.known == nil || s.config.encryption != db.encryption.Level {
+		changed |= ConfigChangeClusterEncryption
+	}
+	if changed == 0 {
+		return
+	}
+	settings := db.tls
+	s.config.known = &settings
+	s.config.certState = db.certAuth.State
+	s.config.encryption = db.encryption.Level
+	if changed&(ConfigChangeCerts|ConfigChangeClientCertAuth) != 0 {
+		s.config.version++
+	}
+	if len(s.config.callbacks) > 0 {
+		s.config.pending |= changed
+		go notifyConfig(s)
+	}
+}
+
+func notifyConfig(s *Svc) {
+	s.notifyL.Lock()
+	defer s.notifyL.Unlock()
+	s.l.Lock()
+	pending := s.config.pending
+	s.config.pending = 0
+	cbs := s.config.callbacks
+	s.l.Unlock()
+	for _, c := range cbs {
+		if changed := c.kinds & pending; changed != 0 {
+			c.cb(changed)
+		}
+	}
+}
+
+// GetTLSSettings returns TLS settings of the cluster.
+func GetTLSSettings(s *Svc) (TLSSettings, error) {
+	db := fetchDB(s)
+	if db == nil {
+		return TLSSettings{}, staleError(s)
+	}
+	return db.tls, nil
+}
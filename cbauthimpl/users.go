@@ -0,0 +1,93 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauthimpl
+
+import (
+	"encoding/base64"
+	"errors"
+	"sort"
+
+	"github.com/couchbase/cbauth/rbac"
+)
+
+// Domains of built-in users that are reported by ListUsers.
+const (
+	DomainAdmin   = rbac.DomainAdmin
+	DomainROAdmin = rbac.DomainROAdmin
+)
+
+// ErrInvalidCursor is returned by ListUsers when given cursor was
+// not returned by earlier ListUsers call.
+var ErrInvalidCursor = errors.New("invalid user list cursor")
+
+// UserInfo type is used as part of Cache messages to describe
+// user known to cluster and roles granted to it. It carries no
+// secrets.
+type UserInfo = rbac.User
+
+func userKey(u *UserInfo) string {
+	return u.Domain + "\x00" + u.Name
+}
+
+// buildUserList returns users of given cache (including built-in
+// admin and ro-admin) sorted by domain and name.
+func buildUserList(c *Cache) []UserInfo {
+	rv := make([]UserInfo, 0, len(c.Users)+2)
+	if c.Admin.User != "" {
+		rv = append(rv, UserInfo{Name: c.Admin.User, Domain: DomainAdmin,
+			Roles: []Role{{Name: "admin"}}})
+	}
+	if c.ROAdmin.User != "" {
+		rv = append(rv, UserInfo{Name: c.ROAdmin.User, Domain: DomainROAdmin,
+			Roles: []Role{{Name: "ro_admin"}}})
+	}
+	rv = append(rv, c.Users...)
+	sort.SliceStable(rv, func(i, j int) bool { return userKey(&rv[i]) < userKey(&rv[j]) })
+	return rv
+}
+
+// ListUsers returns up to limit users known to cbauth cache of given
+// service starting after given cursor ("" to start from beginning).
+// Non-positive limit means no limit. Users are ordered by domain and
+// name. Returned cursor can be passed to next call to get next page;
+// it is "" when there are no more users. Since cursor refers to
+// position in that order rather than to cache contents, paging
+// through keeps working when cache is updated in between.
+func ListUsers(s *Svc, cursor string, limit int) (users []UserInfo, next string, err error) {
+	db := fetchDB(s)
+	if db == nil {
+		return nil, "", staleError(s)
+	}
+	start := 0
+	if cursor != "" {
+		after, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		start = sort.Search(len(db.users), func(i int) bool {
+			return userKey(&db.users[i]) > string(after)
+		})
+	}
+	end := len(db.users)
+	if limit > 0 && start+limit < end {
+		end = start + limit
+	}
+	users = append([]UserInfo(nil), db.users[start:end]...)
+	if end < len(db.users) {
+		next = base64.RawURLEncoding.EncodeToString([]byte(userKey(&db.users[end-1])))
+	}
+	return users, next, nil
+}
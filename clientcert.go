@@ -0,0 +1,93 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"crypto/x509"
+	"net/http"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// States of client certificate auth of the cluster.
+const (
+	ClientCertDisable   = cbauthimpl.ClientCertDisable
+	ClientCertEnable    = cbauthimpl.ClientCertEnable
+	ClientCertMandatory = cbauthimpl.ClientCertMandatory
+)
+
+// Certificate fields that username can be extracted from (see
+// CertUserRule).
+const (
+	CertPathSubjectCN = cbauthimpl.CertPathSubjectCN
+	CertPathSANURI    = cbauthimpl.CertPathSANURI
+	CertPathSANDNS    = cbauthimpl.CertPathSANDNS
+	CertPathSANEmail  = cbauthimpl.CertPathSANEmail
+)
+
+// CertUserRule type describes how username is extracted from client
+// certificate.
+type CertUserRule = cbauthimpl.CertUserRule
+
+// ErrCertNotTrusted is returned by AuthClientCert when certificate is
+// not signed by any of client CAs trusted by the cluster.
+var ErrCertNotTrusted = cbauthimpl.ErrCertNotTrusted
+
+func (a *authImpl) AuthClientCert(chain []*x509.Certificate) (Creds, error) {
+	ci, err := cbauthimpl.VerifyClientCertVia(a.svc, chain, a.verifier().LookupRoles)
+	if err != nil {
+		return nil, err
+	}
+	if ci == nil {
+		return NoAccessCreds, nil
+	}
+	tracef(ci.Name(), "client certificate is mapped to %s", TagUserData(ci.Name()))
+	return refuseRevoked(ci), nil
+}
+
+// authWebCert authenticates given request by client certificate
+// according to client certificate auth state of the cluster. ok is
+// false if request has to be authenticated by other means.
+func (a *authImpl) authWebCert(req *http.Request) (creds Creds, ok bool, err error) {
+	if req.TLS == nil {
+		return nil, false, nil
+	}
+	state, err := cbauthimpl.GetClientCertState(a.svc)
+	if err != nil || state == ClientCertDisable {
+		return nil, err != nil, err
+	}
+	mandatory := state == ClientCertMandatory
+	if len(req.TLS.PeerCertificates) == 0 {
+		if mandatory {
+			tracef("", "client certificate is required for request to %s", req.URL.Path)
+			return NoAccessCreds, true, nil
+		}
+		return nil, false, nil
+	}
+	creds, err = a.AuthClientCert(req.TLS.PeerCertificates)
+	switch {
+	case err == ErrCertNotTrusted:
+		tracef("", "untrusted client certificate in request to %s", req.URL.Path)
+		return NoAccessCreds, true, nil
+	case err != nil:
+		return nil, true, err
+	case creds == NoAccessCreds && !mandatory:
+		// username couldn't be extracted; other auth is
+		// allowed unless certificate is mandatory
+		return nil, false, nil
+	}
+	return creds, true, nil
+}
@@ -254,7 +254,7 @@ func maybeReinitCBAuth() {
 	if err != nil {
 		log.Fatal("Failed to parse mgmtURLFlag: ", err)
 	}
-	_, err = cbauth.InternalRetryDefaultInit(u.Host, authU, authP)
+	_, err = cbauth.InitExternalCreds(u.Host, authU, authP)
 	if err != nil {
 		log.Fatal("Failed to initialize cbauth: ", err)
 	}
@@ -0,0 +1,157 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// cbauth-tool is collection of debugging helpers for cbauth.
+//
+// Usage:
+//
+//	cbauth-tool diff <old-snapshot.json> <new-snapshot.json>
+//	cbauth-tool replay <recording.jsonl>
+//	cbauth-tool allowed <snapshot.json> <user> <domain> <permission>...
+//
+// Snapshots are produced by cbauth.WriteCacheSnapshot and recordings
+// by cbauth.StartRecording.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/couchbase/cbauth"
+)
+
+func readSnapshot(path string) (*cbauth.Cache, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c cbauth.Cache
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot `%s': %s", path, err)
+	}
+	return &c, nil
+}
+
+func runDiff(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "usage: %s diff <old-snapshot.json> <new-snapshot.json>\n", os.Args[0])
+		return 2
+	}
+	from, err := readSnapshot(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	to, err := readSnapshot(args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	d := cbauth.DiffCaches(from, to)
+	d.WriteTo(os.Stdout)
+	if d.Empty() {
+		return 0
+	}
+	return 1
+}
+
+func runReplay(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s replay <recording.jsonl>\n", os.Args[0])
+		return 2
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+	report, err := cbauth.Replay(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to replay `%s': %s\n", args[0], err)
+		return 1
+	}
+	fmt.Printf("replayed %d events: %d caches, %d auths, %d permission checks\n",
+		report.Events, report.Caches, report.Auths, report.Permissions)
+	for _, m := range report.Mismatches {
+		fmt.Printf("#%d %s:%s %s: recorded %s, replayed %s",
+			m.Seq, m.Creds.Source, m.Creds.Name, m.Permission, m.Recorded, m.Replayed)
+		if m.Err != nil {
+			fmt.Printf(" (%s)", m.Err)
+		}
+		fmt.Println()
+	}
+	if len(report.Mismatches) == 0 {
+		return 0
+	}
+	return 1
+}
+
+func runAllowed(args []string) int {
+	if len(args) < 4 {
+		fmt.Fprintf(os.Stderr, "usage: %s allowed <snapshot.json> <user> <domain> <permission>...\n", os.Args[0])
+		return 2
+	}
+	c, err := readSnapshot(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	m, err := cbauth.NewMirror(c)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load snapshot `%s': %s\n", args[0], err)
+		return 1
+	}
+	creds, err := m.Creds(args[1], args[2])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if creds == cbauth.NoAccessCreds {
+		fmt.Fprintf(os.Stderr, "user `%s' of domain `%s' is not in snapshot\n", args[1], args[2])
+		return 1
+	}
+	rv := 0
+	for _, p := range args[3:] {
+		allowed, err := creds.IsAllowed(p)
+		switch {
+		case err != nil:
+			fmt.Printf("%s: undecided (%s)\n", p, err)
+			rv = 1
+		case allowed:
+			fmt.Printf("%s: allowed\n", p)
+		default:
+			fmt.Printf("%s: denied\n", p)
+			rv = 1
+		}
+	}
+	return rv
+}
+
+var commands = map[string]func(args []string) int{
+	"diff":    runDiff,
+	"replay":  runReplay,
+	"allowed": runAllowed,
+}
+
+func main() {
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		fmt.Fprintf(os.Stderr, "usage: %s <command> [args]\ncommands: diff, replay, allowed\n", os.Args[0])
+		os.Exit(2)
+	}
+	os.Exit(commands[os.Args[1]](os.Args[2:]))
+}
@@ -84,8 +84,20 @@ func WrapHTTPTransport(transport http.RoundTripper, a Authenticator) http.RoundT
 	}
 }
 
-// SendUnauthorized sends 401 Unauthorized response on given response writer.
+// SendUnauthorized sends 401 Unauthorized response on given response
+// writer. Digest and SCRAM challenges are offered too if digest and
+// SCRAM auth are enabled (see EnableDigestAuth and EnableScramAuth).
 func SendUnauthorized(w http.ResponseWriter) {
+	sendUnauthorized(w, "need auth")
+}
+
+func sendUnauthorized(w http.ResponseWriter, msg string) {
 	w.Header().Set("WWW-Authenticate", "Basic realm=\"Couchbase\"")
-	http.Error(w, "need auth", http.StatusUnauthorized)
+	for _, c := range digestChallenges() {
+		w.Header().Add("WWW-Authenticate", c)
+	}
+	for _, c := range scramChallenges() {
+		w.Header().Add("WWW-Authenticate", c)
+	}
+	http.Error(w, msg, http.StatusUnauthorized)
 }
@@ -0,0 +1,86 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// CorrelationIDHeader is header that carries correlation id of auth
+// attempt. It is sent to ns_server when creds are verified there, so
+// that 401 seen by user can be matched to ns_server's log entries
+// (see CorrelationID).
+const CorrelationIDHeader = cbauthimpl.CorrelationIDHeader
+
+// correlationKey makes correlation ids unguessable, so that they
+// reveal nothing about creds they're derived from.
+var correlationKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+var correlatedHeaders = []string{"Authorization", "Cookie", "ns-server-ui", "ns-server-auth-token"}
+
+func correlationID(hdr http.Header) string {
+	if id := hdr.Get(CorrelationIDHeader); id != "" {
+		return id
+	}
+	mac := hmac.New(sha256.New, correlationKey)
+	for _, name := range correlatedHeaders {
+		mac.Write([]byte(name + ":" + hdr.Get(name) + "\n"))
+	}
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// CorrelationID returns correlation id of auth of given request. It
+// is value of CorrelationIDHeader if request has it (e.g. set by
+// proxy in front of service) or otherwise short fingerprint of
+// request's creds that is stable for lifetime of the process. It is
+// same id that AuthWebCreds sends to ns_server and traces on
+// failures.
+func CorrelationID(req *http.Request) string {
+	return correlationID(req.Header)
+}
+
+// withCorrelationID returns copy of given headers that carries
+// correlation id.
+func withCorrelationID(hdr http.Header) (http.Header, string) {
+	id := correlationID(hdr)
+	if hdr.Get(CorrelationIDHeader) == id {
+		return hdr, id
+	}
+	hdr = hdr.Clone()
+	hdr.Set(CorrelationIDHeader, id)
+	return hdr, id
+}
+
+// SendUnauthorizedWithID is SendUnauthorized that also sends
+// correlation id of auth of given request in response header and
+// body, so that users can quote it in support cases.
+func SendUnauthorizedWithID(w http.ResponseWriter, req *http.Request) {
+	id := CorrelationID(req)
+	w.Header().Set(CorrelationIDHeader, id)
+	sendUnauthorized(w, "need auth (correlation id: "+id+")")
+}
@@ -0,0 +1,87 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"sync"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// CustomCred type describes service specific credential (e.g. FTS
+// alias token) pushed by ns_server as part of cbauth cache.
+type CustomCred = cbauthimpl.CustomCred
+
+// CustomCredVerifier type is function that tells whether secret
+// presented by client matches given custom credential. It must not
+// modify credential.
+type CustomCredVerifier = cbauthimpl.CustomCredVerifier
+
+// ErrUnknownCustomCredType is returned by VerifyCustomCred for types
+// that have no registered verifier.
+var ErrUnknownCustomCredType error = notRegisteredError("custom credential type is not registered")
+
+type customCredType struct {
+	verify CustomCredVerifier
+}
+
+// customCredTypes holds verifiers of registered custom credential
+// types. Zero value has no types.
+type customCredTypes struct {
+	l     sync.Mutex
+	types map[string]*customCredType
+}
+
+func (a *authImpl) RegisterCustomCredType(typ string, verify CustomCredVerifier) (unregister func()) {
+	t := &customCredType{verify}
+	c := &a.customTypes
+	c.l.Lock()
+	if c.types == nil {
+		c.types = make(map[string]*customCredType)
+	}
+	c.types[typ] = t
+	c.l.Unlock()
+
+	return func() {
+		c.l.Lock()
+		defer c.l.Unlock()
+		// type may have been registered again since
+		if c.types[typ] == t {
+			delete(c.types, typ)
+		}
+	}
+}
+
+func (a *authImpl) VerifyCustomCred(typ, id string, secret []byte) (Creds, error) {
+	c := &a.customTypes
+	c.l.Lock()
+	t := c.types[typ]
+	c.l.Unlock()
+	if t == nil {
+		return nil, ErrUnknownCustomCredType
+	}
+
+	ci, err := cbauthimpl.VerifyCustomCred(a.svc, typ, id, secret, t.verify)
+	if err != nil {
+		return nil, err
+	}
+	if ci == nil {
+		tracef("", "%s credential %s was not verified", typ, TagUserData(id))
+		return NoAccessCreds, nil
+	}
+	tracef(ci.Name(), "%s credential %s is mapped to %s", typ, TagUserData(id), TagUserData(ci.Name()))
+	return refuseRevoked(ci), nil
+}
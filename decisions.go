@@ -0,0 +1,128 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Kinds of decisions reported to DecisionObserver.
+const (
+	// DecisionAuth is authentication (AuthWebCreds or Auth).
+	DecisionAuth = "auth"
+	// DecisionPermission is permission check (e.g. by
+	// RouteTable).
+	DecisionPermission = "permission"
+)
+
+// Outcomes of decisions reported to DecisionObserver.
+const (
+	OutcomeAllowed = "allowed"
+	OutcomeDenied  = "denied"
+	OutcomeError   = "error"
+)
+
+// Paths of auth decisions reported to DecisionObserver. They tell
+// where decision was made, so that e.g. cache hits can be measured
+// separately from ns_server round trips.
+const (
+	PathHeaderCache = "header-cache"
+	PathCache       = "cache"
+	PathServer      = "ns_server"
+	PathDigest      = "digest"
+	PathScram       = "scram"
+	PathJWT         = "jwt"
+	PathClientCert  = "client-cert"
+	// PathCustom means that decision was made by CredsVerifier
+	// (see RegisterCredsVerifier).
+	PathCustom = "custom"
+)
+
+// DecisionEvent struct describes single auth or permission decision.
+type DecisionEvent struct {
+	Kind string
+	// Path is set for auth decisions only
+	Path string
+	// Permission is set for permission decisions only
+	Permission string
+	Outcome    string
+	Duration   time.Duration
+	Err        error
+}
+
+// DecisionObserver is notified about every auth and permission
+// decision cbauth makes, so that services can compute cbauth
+// specific SLO metrics in their own telemetry pipelines.
+// ObserveDecision is called synchronously on request path, so it
+// must be cheap and must not retain given event.
+type DecisionObserver interface {
+	ObserveDecision(e *DecisionEvent)
+}
+
+// DecisionObserverFunc type adapts function to DecisionObserver
+// interface.
+type DecisionObserverFunc func(e *DecisionEvent)
+
+// ObserveDecision method simply calls "this" function.
+func (f DecisionObserverFunc) ObserveDecision(e *DecisionEvent) {
+	f(e)
+}
+
+var decisionObserver atomic.Value
+
+type observerBox struct{ o DecisionObserver }
+
+// SetDecisionObserver sets (or clears if nil is passed) observer of
+// auth and permission decisions.
+func SetDecisionObserver(o DecisionObserver) {
+	decisionObserver.Store(observerBox{o})
+}
+
+func getDecisionObserver() DecisionObserver {
+	b, _ := decisionObserver.Load().(observerBox)
+	return b.o
+}
+
+func decisionOutcome(allowed bool, err error) string {
+	switch {
+	case err != nil:
+		return OutcomeError
+	case allowed:
+		return OutcomeAllowed
+	}
+	return OutcomeDenied
+}
+
+// authPath returns where given result of cache lookup or ns_server
+// escalation came from.
+func authPath(c Creds) string {
+	if c != nil && c.Identity().Version != 0 {
+		return PathServer
+	}
+	return PathCache
+}
+
+// observeAuth reports auth decision that started at given time.
+func observeAuth(o DecisionObserver, start time.Time, path string, c Creds, err error) {
+	o.ObserveDecision(&DecisionEvent{
+		Kind:     DecisionAuth,
+		Path:     path,
+		Outcome:  decisionOutcome(c != nil && c != NoAccessCreds, err),
+		Duration: time.Since(start),
+		Err:      err,
+	})
+}
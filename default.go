@@ -16,28 +16,48 @@
 package cbauth
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/rpc"
-	"net/url"
-	"os"
-	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	"github.com/couchbase/cbauth/cbauthimpl"
 	"github.com/couchbase/cbauth/revrpc"
 )
 
-// Default variable holds default authenticator. Default authenticator
-// is constructed automatically from environment variables passed by
+type authenticatorBox struct{ a Authenticator }
+
+var defaultAuth atomic.Value
+
+// GetDefault returns default authenticator. Default authenticator is
+// constructed automatically from environment variables passed by
 // ns_server. It is nil if your process was not (correctly) spawned by
-// ns_server.
-var Default Authenticator
+// ns_server, unless it is initialized explicitly via InitExternal,
+// InitExternalSpec or InitExternalCreds. It is nil again after
+// CloseDefault.
+func GetDefault() Authenticator {
+	if b, ok := defaultAuth.Load().(authenticatorBox); ok {
+		return b.a
+	}
+	return nil
+}
+
+// setDefault replaces default authenticator. It is safe to call
+// concurrently with calls that use default authenticator.
+func setDefault(a Authenticator) {
+	defaultAuth.Store(authenticatorBox{a})
+}
 
 var errDisconnected = errors.New("revrpc connection to ns_server was closed")
 
 func runRPCForSvc(rpcsvc *revrpc.Service, svc *cbauthimpl.Svc) error {
+	lc := &lifecycleSvc{Svc: svc}
+	applyUpdateLimits(rpcsvc, lc)
 	defPolicy := revrpc.DefaultBabysitErrorPolicy.New()
 	// error restart policy that we're going to use simply
 	// resets service before delegating to default restart
@@ -47,24 +67,61 @@ func runRPCForSvc(rpcsvc *revrpc.Service, svc *cbauthimpl.Svc) error {
 		resetErr := err
 		if err == nil {
 			resetErr = errDisconnected
+		} else if err != io.EOF {
+			recordError("revrpc: %s", err)
 		}
+		recordConnEvent("disconnected: %s", resetErr)
 		cbauthimpl.ResetSvc(svc, &DBStaleError{resetErr})
+		lc.degraded(resetErr)
 		return defPolicy(err)
 	}
-	return revrpc.BabysitService(func(s *rpc.Server) error {
-		return s.RegisterName("AuthCacheSvc", svc)
+	err := revrpc.BabysitService(func(s *rpc.Server) error {
+		recordConnEvent("connected")
+		emitLifecycle(LifecycleConnected, nil)
+		return s.RegisterName("AuthCacheSvc", lc)
 	}, rpcsvc, revrpc.FnBabysitErrorPolicy(cbauthPolicy))
+	emitLifecycle(LifecycleStopped, err)
+	return err
 }
 
+// defaultRPCSvc is revrpc service of Default authenticator.
+var defaultRPCSvc *revrpc.Service
+
+var errDefaultClosed = errors.New("default authenticator was closed")
+
 func startDefault(rpcsvc *revrpc.Service) {
 	svc := cbauthimpl.NewSVC(5*time.Second, &DBStaleError{})
-	Default = &authImpl{svc}
+	setDefault(&authImpl{svc: svc})
+	defaultRPCSvc = rpcsvc
+	emitLifecycle(LifecycleInitializing, nil)
 	go func() {
-		panic(runRPCForSvc(rpcsvc, svc))
+		err := runRPCForSvc(rpcsvc, svc)
+		if err == revrpc.ErrServiceClosed {
+			// service was closed on purpose (see CloseDefault)
+			return
+		}
+		reportError("revrpc", err, map[string]string{
+			ReportComponent: "revrpc",
+			ReportFatal:     "true",
+		})
+		giveUp(svc, err)
 	}()
 }
 
+// giveUp makes given service stale for good and applies FatalPolicy
+// to revrpc error that made cbauth give up on ns_server.
+func giveUp(svc *cbauthimpl.Svc, err error) {
+	if err == nil {
+		err = errDisconnected
+	}
+	fatal := &FatalError{Component: "revrpc", Err: err}
+	cbauthimpl.ResetSvc(svc, &DBStaleError{fatal})
+	handleFatal(fatal)
+}
+
 func init() {
+	revrpc.SetDefaultLogPrint(revrpcLogPrint)
+	initTracingFromEnv()
 	rpcsvc, err := revrpc.GetDefaultServiceFromEnv("cbauth")
 	if err != nil {
 		ErrNotInitialized = fmt.Errorf("Unable to initialize cbauth's revrpc: %s", err)
@@ -78,25 +135,33 @@ func init() {
 // testing). This API is subject to change and should be used only if
 // really needed. Returns false if Default Authenticator was already
 // initialized.
+//
+// Deprecated: use InitExternalCreds, which also reports malformed
+// mgmtHostPort.
 func InternalRetryDefaultInit(mgmtHostPort, user, password string) (bool, error) {
-	if Default != nil {
+	if _, _, err := SplitHostPort(mgmtHostPort); err != nil {
 		return false, nil
 	}
-	serviceName := filepath.Base(os.Args[0]) + "-cbauth"
-	host, port, err := SplitHostPort(mgmtHostPort)
-	if err != nil {
-		return false, nil
+	return InitExternalCreds(mgmtHostPort, user, password)
+}
+
+// CloseDefault stops Default authenticator: its connection to
+// ns_server is dropped, it becomes stale for good and default authenticator
+// is reset to nil, so that calls that use default authenticator return
+// ErrNotInitialized until it is initialized again (see InitExternal).
+// It is meant for tools and tests that initialize cbauth explicitly.
+func CloseDefault() {
+	initExternalL.Lock()
+	defer initExternalL.Unlock()
+	if defaultRPCSvc == nil {
+		return
 	}
-	baseurl := fmt.Sprintf("http://%s:%d/%s", host, port, serviceName)
-	u, err := url.Parse(baseurl)
-	if err != nil {
-		return false, fmt.Errorf("Failed to parse constructed url `%s': %s", baseurl, err)
+	defaultRPCSvc.Close()
+	defaultRPCSvc = nil
+	if a, ok := GetDefault().(*authImpl); ok {
+		cbauthimpl.ResetSvc(a.svc, &DBStaleError{errDefaultClosed})
 	}
-	u.User = url.UserPassword(user, password)
-
-	startDefault(revrpc.MustService(u.String()))
-
-	return true, nil
+	setDefault(nil)
 }
 
 // ErrNotInitialized is used to signal that ns_server environment
@@ -115,7 +180,7 @@ func WithDefault(body func(a Authenticator) error) error {
 // returned if a is nil and default authenticator is not configured.
 func WithAuthenticator(a Authenticator, body func(a Authenticator) error) error {
 	if a == nil {
-		a = Default
+		a = GetDefault()
 		if a == nil {
 			return ErrNotInitialized
 		}
@@ -126,36 +191,324 @@ func WithAuthenticator(a Authenticator, body func(a Authenticator) error) error
 // AuthWebCreds method extracts credentials from given http request
 // using default authenticator.
 func AuthWebCreds(req *http.Request) (creds Creds, err error) {
-	if Default == nil {
+	a := GetDefault()
+	if a == nil {
+		return nil, ErrNotInitialized
+	}
+	return a.AuthWebCreds(req)
+}
+
+// AuthWebCredsFresh method verifies credentials of given http request
+// with ns_server bypassing cache (see
+// Authenticator.AuthWebCredsFresh). Uses default authenticator.
+func AuthWebCredsFresh(req *http.Request) (creds Creds, err error) {
+	a := GetDefault()
+	if a == nil {
 		return nil, ErrNotInitialized
 	}
-	return Default.AuthWebCreds(req)
+	return a.AuthWebCredsFresh(req)
 }
 
 // Auth method constructs credentials from given user and password
 // pair. Uses default authenticator.
 func Auth(user, pwd string) (creds Creds, err error) {
-	if Default == nil {
+	a := GetDefault()
+	if a == nil {
 		return nil, ErrNotInitialized
 	}
-	return Default.Auth(user, pwd)
+	return a.Auth(user, pwd)
 }
 
 // GetHTTPServiceAuth returns user/password creds giving "admin"
 // access to given http service inside couchbase cluster. Uses default
 // authenticator.
 func GetHTTPServiceAuth(hostport string) (user, pwd string, err error) {
-	if Default == nil {
+	a := GetDefault()
+	if a == nil {
 		return "", "", ErrNotInitialized
 	}
-	return Default.GetHTTPServiceAuth(hostport)
+	return a.GetHTTPServiceAuth(hostport)
 }
 
 // GetMemcachedServiceAuth returns user/password creds given "admin"
 // access to given memcached service. Uses default authenticator.
 func GetMemcachedServiceAuth(hostport string) (user, pwd string, err error) {
-	if Default == nil {
+	a := GetDefault()
+	if a == nil {
+		return "", "", ErrNotInitialized
+	}
+	return a.GetMemcachedServiceAuth(hostport)
+}
+
+// AuthWebCredsContext is AuthWebCreds that obeys given context (see
+// Authenticator.AuthWebCredsContext). Uses default authenticator.
+func AuthWebCredsContext(ctx context.Context, req *http.Request) (creds Creds, err error) {
+	a := GetDefault()
+	if a == nil {
+		return nil, ErrNotInitialized
+	}
+	return a.AuthWebCredsContext(ctx, req)
+}
+
+// AuthWebCredsFreshContext is AuthWebCredsFresh that obeys given
+// context. Uses default authenticator.
+func AuthWebCredsFreshContext(ctx context.Context, req *http.Request) (creds Creds, err error) {
+	a := GetDefault()
+	if a == nil {
+		return nil, ErrNotInitialized
+	}
+	return a.AuthWebCredsFreshContext(ctx, req)
+}
+
+// AuthContext is Auth that obeys given context. Uses default
+// authenticator.
+func AuthContext(ctx context.Context, user, pwd string) (creds Creds, err error) {
+	a := GetDefault()
+	if a == nil {
+		return nil, ErrNotInitialized
+	}
+	return a.AuthContext(ctx, user, pwd)
+}
+
+// GetHTTPServiceAuthContext is GetHTTPServiceAuth that obeys given
+// context. Uses default authenticator.
+func GetHTTPServiceAuthContext(ctx context.Context, hostport string) (user, pwd string, err error) {
+	a := GetDefault()
+	if a == nil {
+		return "", "", ErrNotInitialized
+	}
+	return a.GetHTTPServiceAuthContext(ctx, hostport)
+}
+
+// GetMemcachedServiceAuthContext is GetMemcachedServiceAuth that
+// obeys given context. Uses default authenticator.
+func GetMemcachedServiceAuthContext(ctx context.Context, hostport string) (user, pwd string, err error) {
+	a := GetDefault()
+	if a == nil {
+		return "", "", ErrNotInitialized
+	}
+	return a.GetMemcachedServiceAuthContext(ctx, hostport)
+}
+
+// ResolveGroupRoles returns roles granted by cluster's group
+// mappings to members of given groups. Uses default authenticator.
+func ResolveGroupRoles(groups []string) ([]Role, error) {
+	a := GetDefault()
+	if a == nil {
+		return nil, ErrNotInitialized
+	}
+	return a.ResolveGroupRoles(groups)
+}
+
+// ListUsers returns page of users known to cluster (see
+// Authenticator.ListUsers). Uses default authenticator.
+func ListUsers(cursor string, limit int) (users []UserInfo, next string, err error) {
+	a := GetDefault()
+	if a == nil {
+		return nil, "", ErrNotInitialized
+	}
+	return a.ListUsers(cursor, limit)
+}
+
+// GetBuckets returns buckets known to cluster. Uses default
+// authenticator.
+func GetBuckets() ([]BucketInfo, error) {
+	a := GetDefault()
+	if a == nil {
+		return nil, ErrNotInitialized
+	}
+	return a.GetBuckets()
+}
+
+// LookupBucket returns bucket with given name (see
+// Authenticator.LookupBucket). Uses default authenticator.
+func LookupBucket(name string) (b BucketInfo, ok bool, err error) {
+	a := GetDefault()
+	if a == nil {
+		return BucketInfo{}, false, ErrNotInitialized
+	}
+	return a.LookupBucket(name)
+}
+
+// LookupBucketByUUID returns bucket with given uuid (see
+// Authenticator.LookupBucketByUUID). Uses default authenticator.
+func LookupBucketByUUID(uuid string) (b BucketInfo, ok bool, err error) {
+	a := GetDefault()
+	if a == nil {
+		return BucketInfo{}, false, ErrNotInitialized
+	}
+	return a.LookupBucketByUUID(uuid)
+}
+
+// GetHashParams returns hash parameters of passwords of cached
+// users. Uses default authenticator.
+func GetHashParams() ([]HashParams, error) {
+	a := GetDefault()
+	if a == nil {
+		return nil, ErrNotInitialized
+	}
+	return a.GetHashParams()
+}
+
+// GetScopedServiceAuth returns user/password creds giving access to
+// given service inside couchbase cluster that is restricted to given
+// permissions. Uses default authenticator.
+func GetScopedServiceAuth(hostport string, permissions ...string) (user, pwd string, err error) {
+	a := GetDefault()
+	if a == nil {
+		return "", "", ErrNotInitialized
+	}
+	return a.GetScopedServiceAuth(hostport, permissions...)
+}
+
+// GetReadOnlyServiceAuth returns user/password creds giving
+// read-only access (see ReadOnlyPermissions) to given service inside
+// couchbase cluster. Uses default authenticator.
+func GetReadOnlyServiceAuth(hostport string) (user, pwd string, err error) {
+	a := GetDefault()
+	if a == nil {
 		return "", "", ErrNotInitialized
 	}
-	return Default.GetMemcachedServiceAuth(hostport)
+	return a.GetReadOnlyServiceAuth(hostport)
+}
+
+// ResolveNodeAddress returns address to dial and creds to use in
+// order to reach service listening on given internal port of node
+// with given uuid. Uses default authenticator.
+func ResolveNodeAddress(nodeUUID string, port int, external bool) (*NodeAddress, error) {
+	a := GetDefault()
+	if a == nil {
+		return nil, ErrNotInitialized
+	}
+	return a.ResolveNodeAddress(nodeUUID, port, external)
+}
+
+// WaitForPermissionChange blocks until next cache update affecting
+// given user is installed or context is done (see
+// Authenticator.WaitForPermissionChange). Uses default authenticator.
+func WaitForPermissionChange(ctx context.Context, user string) error {
+	a := GetDefault()
+	if a == nil {
+		return ErrNotInitialized
+	}
+	return a.WaitForPermissionChange(ctx, user)
+}
+
+// ValidateHost checks that given request is addressed to host
+// allowed by given policy (see Authenticator.ValidateHost). Uses
+// default authenticator.
+func ValidateHost(req *http.Request, p *HostPolicy) error {
+	a := GetDefault()
+	if a == nil {
+		return ErrNotInitialized
+	}
+	return a.ValidateHost(req, p)
+}
+
+// GetClientTLSConfig returns tls.Config for dialing other services
+// of the cluster. Uses default authenticator.
+func GetClientTLSConfig(serverName string) (*tls.Config, error) {
+	a := GetDefault()
+	if a == nil {
+		return nil, ErrNotInitialized
+	}
+	return a.GetClientTLSConfig(serverName)
+}
+
+// GetServerTLSConfig returns tls.Config for listening. Uses default
+// authenticator.
+func GetServerTLSConfig() (*tls.Config, error) {
+	a := GetDefault()
+	if a == nil {
+		return nil, ErrNotInitialized
+	}
+	return a.GetServerTLSConfig()
+}
+
+// GetTLSSettings returns TLS settings of the cluster. Uses default
+// authenticator.
+func GetTLSSettings() (TLSSettings, error) {
+	a := GetDefault()
+	if a == nil {
+		return TLSSettings{}, ErrNotInitialized
+	}
+	return a.GetTLSSettings()
+}
+
+// RegisterTLSRefreshCallback registers function that is called
+// every time TLS settings of the cluster change. Uses default
+// authenticator. It fails with ErrNotInitialized if default
+// authenticator is not initialized.
+func RegisterTLSRefreshCallback(cb func()) (unregister func(), err error) {
+	a := GetDefault()
+	if a == nil {
+		return nil, ErrNotInitialized
+	}
+	return a.RegisterTLSRefreshCallback(cb), nil
+}
+
+// RegisterConfigRefreshCallback registers function that is called
+// every time config of given kinds changes. Uses default
+// authenticator. It fails with ErrNotInitialized if default
+// authenticator is not initialized.
+func RegisterConfigRefreshCallback(kinds uint64, cb func(changed uint64)) (unregister func(), err error) {
+	a := GetDefault()
+	if a == nil {
+		return nil, ErrNotInitialized
+	}
+	return a.RegisterConfigRefreshCallback(kinds, cb), nil
+}
+
+// GetClusterEncryption returns encryption settings of node to node
+// traffic. Uses default authenticator.
+func GetClusterEncryption() (ClusterEncryption, error) {
+	a := GetDefault()
+	if a == nil {
+		return ClusterEncryption{}, ErrNotInitialized
+	}
+	return a.GetClusterEncryption()
+}
+
+// GetClusterEncryptionConfig returns whether node to node traffic
+// has to be encrypted and whether non-TLS listeners must be
+// disabled. Uses default authenticator.
+func GetClusterEncryptionConfig() (ClusterEncryptionConfig, error) {
+	a := GetDefault()
+	if a == nil {
+		return ClusterEncryptionConfig{}, ErrNotInitialized
+	}
+	return a.GetClusterEncryptionConfig()
+}
+
+// Health returns how up to date default authenticator's state is.
+// Stale and lagging health is returned if default authenticator is
+// not initialized.
+func Health() HealthStatus {
+	a := GetDefault()
+	if a == nil {
+		return HealthStatus{Stale: true, Lagging: true}
+	}
+	return a.Health()
+}
+
+// RegisterCustomCredType registers verifier of service specific
+// credentials of given type. Uses default authenticator. It fails
+// with ErrNotInitialized if default authenticator is not
+// initialized.
+func RegisterCustomCredType(typ string, verify CustomCredVerifier) (unregister func(), err error) {
+	a := GetDefault()
+	if a == nil {
+		return nil, ErrNotInitialized
+	}
+	return a.RegisterCustomCredType(typ, verify), nil
+}
+
+// VerifyCustomCred verifies given secret against service specific
+// credential of given type and id. Uses default authenticator.
+func VerifyCustomCred(typ, id string, secret []byte) (Creds, error) {
+	a := GetDefault()
+	if a == nil {
+		return nil, ErrNotInitialized
+	}
+	return a.VerifyCustomCred(typ, id, secret)
 }
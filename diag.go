@@ -0,0 +1,164 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// maxDiagEvents is number of most recent events of each kind that
+// are kept for DumpDiagnostics.
+const maxDiagEvents = 32
+
+type diagEvent struct {
+	at  time.Time
+	msg string
+}
+
+type diagRing struct {
+	events []diagEvent
+	next   int
+}
+
+func (r *diagRing) add(e diagEvent) {
+	if len(r.events) < maxDiagEvents {
+		r.events = append(r.events, e)
+		return
+	}
+	r.events[r.next] = e
+	r.next = (r.next + 1) % maxDiagEvents
+}
+
+func (r *diagRing) list() []diagEvent {
+	return append(append([]diagEvent(nil), r.events[r.next:]...), r.events[:r.next]...)
+}
+
+var diagState struct {
+	sync.Mutex
+	errors      diagRing
+	connections diagRing
+}
+
+func recordError(format string, args ...interface{}) {
+	diagState.Lock()
+	diagState.errors.add(diagEvent{time.Now(), fmt.Sprintf(format, args...)})
+	diagState.Unlock()
+}
+
+func recordConnEvent(format string, args ...interface{}) {
+	diagState.Lock()
+	diagState.connections.add(diagEvent{time.Now(), fmt.Sprintf(format, args...)})
+	diagState.Unlock()
+}
+
+func writeEvents(w io.Writer, title string, events []diagEvent) {
+	fmt.Fprintf(w, "%s:\n", title)
+	if len(events) == 0 {
+		fmt.Fprintf(w, "  none\n")
+	}
+	for _, e := range events {
+		fmt.Fprintf(w, "  %s %s\n", e.at.Format(time.RFC3339Nano), e.msg)
+	}
+}
+
+// DumpDiagnostics writes human readable summary of internal state of
+// default authenticator, recent errors and history of revrpc
+// connections to ns_server to given writer. Output carries no
+// secrets. It is meant for debugging of wedged processes (see also
+// HandleDiagnosticsSignal).
+func DumpDiagnostics(w io.Writer) error {
+	fmt.Fprintf(w, "cbauth diagnostics at %s\n", time.Now().Format(time.RFC3339Nano))
+	def := GetDefault()
+	if a, ok := def.(*authImpl); ok {
+		st := cbauthimpl.GetState(a.svc)
+		fmt.Fprintf(w, "stale: %v\n", st.Stale)
+		if st.Stale {
+			fmt.Fprintf(w, "stale reason: %s\n", st.StaleErr)
+		}
+		fmt.Fprintf(w, "lagging: %v\n", st.Lagging)
+		fmt.Fprintf(w, "last update: %s\n", st.LastUpdate.Format(time.RFC3339Nano))
+		fmt.Fprintf(w, "pending updates: %d\n", st.PendingUpdates)
+		fmt.Fprintf(w, "generation: %d\n", st.Generation)
+		fmt.Fprintf(w, "nodes: %d, local node: %s\n", st.Nodes, st.LocalNode)
+		fmt.Fprintf(w, "buckets: %d, groups: %d, limits: %d\n", st.Buckets, st.Groups, st.Limits)
+		fmt.Fprintf(w, "admin: %v, ro admin: %v, special user: %s\n",
+			st.HasAdmin, st.HasROAdmin, TagUserData(st.SpecialUser))
+		fmt.Fprintf(w, "token check url: %s\n", st.TokenCheckURL)
+	} else if def == nil {
+		fmt.Fprintf(w, "not initialized: %s\n", ErrNotInitialized)
+	} else {
+		fmt.Fprintf(w, "default authenticator: %T\n", def)
+	}
+	fmt.Fprintf(w, "tracing: %v\n", tracingEnabled())
+	fmt.Fprintf(w, "hedged auth calls: %d\n", cbauthimpl.HedgedCalls())
+
+	diagState.Lock()
+	errors := diagState.errors.list()
+	connections := diagState.connections.list()
+	diagState.Unlock()
+
+	writeEvents(w, "recent errors", errors)
+	writeEvents(w, "connection history", connections)
+	var lifecycle []diagEvent
+	for _, e := range lifecycleEvents() {
+		lifecycle = append(lifecycle, diagEvent{e.At, e.String()})
+	}
+	writeEvents(w, "lifecycle", lifecycle)
+	_, err := fmt.Fprintf(w, "end of cbauth diagnostics\n")
+	return err
+}
+
+// HandleDiagnosticsSignal makes process write DumpDiagnostics output
+// to given writer (os.Stderr if nil) every time it receives one of
+// given signals (e.g. syscall.SIGUSR1). Returned function stops
+// handling. Nothing is handled if no signals are given (note that
+// signal.Notify would relay all signals then, including SIGINT and
+// SIGTERM).
+func HandleDiagnosticsSignal(w io.Writer, sigs ...os.Signal) (stop func()) {
+	if len(sigs) == 0 {
+		return func() {}
+	}
+	if w == nil {
+		w = os.Stderr
+	}
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, sigs...)
+	go func() {
+		for {
+			select {
+			case <-ch:
+				DumpDiagnostics(w)
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(done)
+		})
+	}
+}
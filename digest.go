@@ -0,0 +1,353 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// DigestRealm is realm of digest auth challenges sent by
+// SendUnauthorized.
+const DigestRealm = "Couchbase"
+
+// DigestNonceTTL is lifetime of digest auth nonces.
+var DigestNonceTTL = 5 * time.Minute
+
+// maxDigestNonces limits number of used digest auth nonces whose
+// nonce counts are tracked by authenticator.
+const maxDigestNonces = 16384
+
+// digestReplayWindow is number of nonce counts below highest one seen
+// that are still accepted (once each), so that concurrent requests
+// of client are not refused when they arrive out of order.
+const digestReplayWindow = 64
+
+// ErrDigestReplay describes digest auth request that reuses nonce
+// count of earlier request. Such requests are refused as
+// unauthenticated, so that client is challenged again.
+var ErrDigestReplay = errors.New("replayed digest auth request")
+
+var errDigestNoncesExhausted = errors.New("too many digest auth nonces in use")
+
+var digestState struct {
+	sync.Mutex
+	enabled bool
+	// key authenticates nonces, so that nonces need no state
+	// until they are used
+	key []byte
+}
+
+type nonceState struct {
+	expires time.Time
+	// max is highest nonce count seen and bit i of seen is set iff
+	// nonce count max-i was seen
+	max  uint64
+	seen uint64
+}
+
+// digestNonces tracks nonce counts of digest auth nonces used with
+// some authenticator.
+type digestNonces struct {
+	sync.Mutex
+	nonces map[string]*nonceState
+}
+
+// EnableDigestAuth turns on (or off) support of HTTP digest access
+// authentication (RFC 7616) in AuthWebCreds and makes
+// SendUnauthorized offer digest challenge in addition to basic. It
+// is meant for legacy clients that refuse to send basic creds over
+// non-TLS links. Note that digest auth requires password to be known
+// in cleartext, so only bucket and special users can use it.
+// Nonces issued before digest auth is turned off are not accepted
+// after it's turned on again.
+func EnableDigestAuth(enable bool) {
+	digestState.Lock()
+	digestState.enabled = enable
+	if enable && digestState.key == nil {
+		digestState.key = make([]byte, 32)
+		if _, err := rand.Read(digestState.key); err != nil {
+			panic(err)
+		}
+	}
+	if !enable {
+		digestState.key = nil
+	}
+	digestState.Unlock()
+}
+
+func digestEnabled() bool {
+	digestState.Lock()
+	defer digestState.Unlock()
+	return digestState.enabled
+}
+
+func digestKey() []byte {
+	digestState.Lock()
+	defer digestState.Unlock()
+	return digestState.key
+}
+
+// nonce is expiration time, random bytes and mac of both
+const (
+	nonceRandomLen = 8
+	nonceMACLen    = 16
+	nonceLen       = 8 + nonceRandomLen + nonceMACLen
+)
+
+func nonceMAC(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)[:nonceMACLen]
+}
+
+// newDigestNonce returns new nonce or "" if digest auth is disabled.
+// Nonces are authenticated by mac, so no state is kept for them until
+// they are used by authentic requests.
+func newDigestNonce() string {
+	key := digestKey()
+	if key == nil {
+		return ""
+	}
+	var buf [nonceLen]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(time.Now().Add(DigestNonceTTL).UnixNano()))
+	if _, err := rand.Read(buf[8 : 8+nonceRandomLen]); err != nil {
+		panic(err)
+	}
+	copy(buf[8+nonceRandomLen:], nonceMAC(key, buf[:8+nonceRandomLen]))
+	return base64.RawURLEncoding.EncodeToString(buf[:])
+}
+
+// checkDigestNonce returns expiration time of given nonce and true if
+// nonce was issued by newDigestNonce and not expired yet.
+func checkDigestNonce(nonce string) (time.Time, bool) {
+	key := digestKey()
+	buf, err := base64.RawURLEncoding.DecodeString(nonce)
+	if key == nil || err != nil || len(buf) != nonceLen {
+		return time.Time{}, false
+	}
+	if !hmac.Equal(buf[8+nonceRandomLen:], nonceMAC(key, buf[:8+nonceRandomLen])) {
+		return time.Time{}, false
+	}
+	expires := time.Unix(0, int64(binary.BigEndian.Uint64(buf[:8])))
+	return expires, time.Now().Before(expires)
+}
+
+// use method records use of given nonce count of given nonce. It
+// returns ErrDigestReplay if nonce count was already seen (or is too
+// old to tell).
+func (n *digestNonces) use(nonce string, expires time.Time, nc uint64) error {
+	now := time.Now()
+	n.Lock()
+	defer n.Unlock()
+	if n.nonces == nil {
+		n.nonces = make(map[string]*nonceState)
+	}
+	st := n.nonces[nonce]
+	if st == nil {
+		if len(n.nonces) >= maxDigestNonces {
+			for k, s := range n.nonces {
+				if now.After(s.expires) {
+					delete(n.nonces, k)
+				}
+			}
+		}
+		if len(n.nonces) >= maxDigestNonces {
+			// forgetting nonce counts of some nonce would
+			// let its requests be replayed
+			return errDigestNoncesExhausted
+		}
+		st = &nonceState{expires: expires}
+		n.nonces[nonce] = st
+	}
+	switch {
+	case nc == 0:
+		return ErrDigestReplay
+	case nc > st.max:
+		if d := nc - st.max; d < digestReplayWindow {
+			st.seen <<= d
+		} else {
+			st.seen = 0
+		}
+		st.seen |= 1
+		st.max = nc
+	case st.max-nc >= digestReplayWindow:
+		return ErrDigestReplay
+	default:
+		bit := uint64(1) << (st.max - nc)
+		if st.seen&bit != 0 {
+			return ErrDigestReplay
+		}
+		st.seen |= bit
+	}
+	return nil
+}
+
+// digestChallenges returns WWW-Authenticate header values of digest
+// auth challenge (SHA-256 one and MD5 one for legacy clients) or nil
+// if digest auth is disabled.
+func digestChallenges() []string {
+	nonce := newDigestNonce()
+	if nonce == "" {
+		return nil
+	}
+	var rv []string
+	for _, alg := range []string{"SHA-256", "MD5"} {
+		rv = append(rv, fmt.Sprintf(`Digest realm="%s", qop="auth", algorithm=%s, nonce="%s"`,
+			DigestRealm, alg, nonce))
+	}
+	return rv
+}
+
+// digestAuthParams returns params part of given Authorization header
+// value and true if it carries digest auth. As usual, scheme name is
+// case insensitive.
+func digestAuthParams(auth string) (string, bool) {
+	const scheme = "digest "
+	if len(auth) < len(scheme) || !strings.EqualFold(auth[:len(scheme)], scheme) {
+		return "", false
+	}
+	return auth[len(scheme):], true
+}
+
+// parseDigestParams parses comma separated key=value (or
+// key="value") list of digest auth header.
+func parseDigestParams(s string) map[string]string {
+	rv := make(map[string]string)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = s[eq+1:]
+		var val string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				break
+			}
+			val = s[1 : end+1]
+			s = s[end+2:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			val = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		rv[key] = val
+	}
+	return rv
+}
+
+func digestHash(algorithm string) func() hash.Hash {
+	switch strings.ToUpper(algorithm) {
+	case "", "MD5":
+		return md5.New
+	case "SHA-256":
+		return sha256.New
+	}
+	return nil
+}
+
+func hexDigest(newHash func() hash.Hash, parts ...string) string {
+	h := newHash()
+	h.Write([]byte(strings.Join(parts, ":")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// verifyDigest verifies digest auth header params of given request.
+// Returns user's name and password if request is authentic and ""
+// user otherwise. Nonce counts of authentic requests are recorded by
+// authenticator, and ErrDigestReplay is returned for replayed ones.
+func verifyDigest(a *authImpl, req *http.Request, params map[string]string) (user, pwd string, err error) {
+	user = params["username"]
+	newHash := digestHash(params["algorithm"])
+	// qop is required since nonce count is our replay protection
+	if user == "" || newHash == nil || params["qop"] != "auth" ||
+		params["realm"] != DigestRealm || params["uri"] != req.RequestURI {
+		return "", "", nil
+	}
+	nc, err := strconv.ParseUint(params["nc"], 16, 64)
+	if err != nil {
+		return "", "", nil
+	}
+	expires, ok := checkDigestNonce(params["nonce"])
+	if !ok {
+		return "", "", nil
+	}
+
+	pwd, ok, err = cbauthimpl.GetPassword(a.svc, user)
+	if err != nil || !ok {
+		return "", "", err
+	}
+	ha1 := hexDigest(newHash, user, DigestRealm, pwd)
+	ha2 := hexDigest(newHash, req.Method, params["uri"])
+	expected := hexDigest(newHash, ha1, params["nonce"], params["nc"], params["cnonce"], "auth", ha2)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(params["response"]))) != 1 {
+		return "", "", nil
+	}
+	if err := a.digestNonces.use(params["nonce"], expires, nc); err != nil {
+		return user, "", err
+	}
+	return user, pwd, nil
+}
+
+func doDigestAuth(ctx context.Context, a *authImpl, req *http.Request, auth string) (Creds, error) {
+	if !digestEnabled() {
+		return nil, errors.New("Digest auth is not enabled")
+	}
+	user, pwd, err := verifyDigest(a, req, parseDigestParams(auth))
+	if err == ErrDigestReplay || err == errDigestNoncesExhausted {
+		// client is challenged again with fresh nonce
+		tracef(user, "digest auth of %s to %s was refused: %v", TagUserData(user), req.URL.Path, err)
+		return NoAccessCreds, nil
+	}
+	if err != nil {
+		tracef(user, "digest auth of request to %s failed: %v", req.URL.Path, err)
+		return nil, err
+	}
+	if user == "" {
+		tracef("", "digest auth of request to %s was rejected", req.URL.Path)
+		return NoAccessCreds, nil
+	}
+	tracef(user, "digest auth of %s to %s succeeded", TagUserData(user), req.URL.Path)
+	creds, err := doAuth(ctx, a, user, pwd, nil, req.RemoteAddr)
+	if ci, ok := creds.(*cbauthimpl.CredsImpl); ok {
+		creds = cbauthimpl.WithMechanism(ci, MechanismDigest)
+	}
+	return creds, err
+}
@@ -0,0 +1,140 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// ElevationTokenHeader is http header that carries privilege
+// elevation token. AuthWebCreds grants permission of that token on
+// top of permissions of authenticated user.
+const ElevationTokenHeader = "cb-elevation-token"
+
+// MaxElevationTTL is maximal lifetime of elevation tokens.
+const MaxElevationTTL = time.Hour
+
+// Elevation type describes privilege elevation: extra permission
+// granted to some user by some admin until some time.
+type Elevation = cbauthimpl.Elevation
+
+// ErrElevationDenied is returned from AuthWebCreds when elevation
+// token is invalid, expired or was issued to different user.
+var ErrElevationDenied = cbauthimpl.ErrElevationDenied
+
+// ErrNoElevationAuditor is returned when elevation tokens are used
+// but no ElevationAuditor is set. Every elevation must be audited.
+var ErrNoElevationAuditor error = notRegisteredError("privilege elevation requires ElevationAuditor to be set")
+
+// ElevationAuditor function is called every time elevation token is
+// successfully minted (with nil req) or used. Returning non-nil error refuses
+// elevation.
+type ElevationAuditor func(e *Elevation, req *http.Request) error
+
+var elevationAuditor ElevationAuditor
+var elevationAuditorL sync.Mutex
+
+// SetElevationAuditor sets function that audits privilege
+// elevations. Elevation tokens are neither minted nor accepted
+// until auditor is set.
+func SetElevationAuditor(fn ElevationAuditor) {
+	elevationAuditorL.Lock()
+	elevationAuditor = fn
+	elevationAuditorL.Unlock()
+}
+
+func auditElevation(e *Elevation, req *http.Request) error {
+	elevationAuditorL.Lock()
+	fn := elevationAuditor
+	elevationAuditorL.Unlock()
+	if fn == nil {
+		return ErrNoElevationAuditor
+	}
+	return fn(e, req)
+}
+
+func (a *authImpl) MintElevationToken(approver Creds, user, domain, permission string, ttl time.Duration) (string, error) {
+	if ttl <= 0 || ttl > MaxElevationTTL {
+		return "", fmt.Errorf("elevation ttl must be positive and not exceed %s", MaxElevationTTL)
+	}
+	if user == "" || domain == "" {
+		return "", ErrElevationDenied
+	}
+	// approver must be admin in its own right, so that admin
+	// privileges obtained via elevation or scoped token can't be
+	// handed out further
+	ci, ok := approver.(*cbauthimpl.CredsImpl)
+	if !ok || !cbauthimpl.CanApproveElevation(ci) {
+		return "", ErrElevationDenied
+	}
+	e := &Elevation{
+		User:       user,
+		Domain:     domain,
+		Permission: permission,
+		Approver:   approver.Name(),
+		Expires:    cbauthimpl.Now().Add(ttl),
+	}
+	token, err := cbauthimpl.MintElevationToken(a.svc, e)
+	if err != nil {
+		return "", err
+	}
+	// token is only handed out once its minting is audited
+	if err := auditElevation(e, nil); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func maybeElevate(a *authImpl, creds Creds, req *http.Request) (Creds, error) {
+	token := req.Header.Get(ElevationTokenHeader)
+	if token == "" {
+		return creds, nil
+	}
+	ci, ok := creds.(*cbauthimpl.CredsImpl)
+	if !ok {
+		return nil, ErrElevationDenied
+	}
+	e, err := cbauthimpl.VerifyElevationToken(a.svc, token)
+	if err != nil {
+		return nil, err
+	}
+	rv, err := cbauthimpl.Elevate(ci, e)
+	if err != nil {
+		tracef(creds.Name(), "elevation token of %s:%s was refused for %v", e.Domain, TagUserData(e.User), creds)
+		return nil, err
+	}
+	tracef(creds.Name(), "elevated %v with %s approved by %s", creds, e.Permission, TagUserData(e.Approver))
+	if err := auditElevation(e, req); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// MintElevationToken returns token that grants given permission to
+// given user of given domain for given period of time. Approver must
+// be admin. Uses default authenticator.
+func MintElevationToken(approver Creds, user, domain, permission string, ttl time.Duration) (string, error) {
+	a := GetDefault()
+	if a == nil {
+		return "", ErrNotInitialized
+	}
+	return a.MintElevationToken(approver, user, domain, permission, ttl)
+}
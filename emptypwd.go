@@ -0,0 +1,79 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// EmptyPasswordPolicy type determines whether users (including
+// anonymous user) may authenticate with empty password.
+type EmptyPasswordPolicy int32
+
+const (
+	// EmptyPasswordLegacy is default policy: empty passwords are
+	// accepted wherever they match cbauth database, i.e.
+	// anonymous access is allowed iff there is some bucket
+	// without password.
+	EmptyPasswordLegacy EmptyPasswordPolicy = iota
+	// EmptyPasswordReject refuses empty passwords always.
+	EmptyPasswordReject
+	// EmptyPasswordLoopbackOnly accepts empty passwords only in
+	// requests that come from loopback addresses. Auth calls,
+	// which carry no address, are refused.
+	EmptyPasswordLoopbackOnly
+	// EmptyPasswordClusterSetting accepts empty passwords only if
+	// cluster setting (Cache.AllowEmptyPasswords) permits them.
+	EmptyPasswordClusterSetting
+)
+
+var emptyPasswordPolicy int32
+
+// SetEmptyPasswordPolicy sets policy of treatment of empty passwords
+// by every Authenticator.
+func SetEmptyPasswordPolicy(p EmptyPasswordPolicy) {
+	atomic.StoreInt32(&emptyPasswordPolicy, int32(p))
+}
+
+// GetEmptyPasswordPolicy returns current policy of treatment of
+// empty passwords.
+func GetEmptyPasswordPolicy() EmptyPasswordPolicy {
+	return EmptyPasswordPolicy(atomic.LoadInt32(&emptyPasswordPolicy))
+}
+
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func emptyPasswordAllowed(a *authImpl, remoteAddr string) (bool, error) {
+	switch GetEmptyPasswordPolicy() {
+	case EmptyPasswordReject:
+		return false, nil
+	case EmptyPasswordLoopbackOnly:
+		return isLoopback(remoteAddr), nil
+	case EmptyPasswordClusterSetting:
+		return cbauthimpl.EmptyPasswordsAllowed(a.svc)
+	}
+	return true, nil
+}
@@ -0,0 +1,88 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// Errors below classify failures of cbauth calls. They are matched
+// via errors.Is, so that callers can tell bad credentials from
+// missing setup and from ns_server problems and respond accordingly
+// (see ErrorHTTPStatus).
+var (
+	// ErrNoAuth is returned by AuthError for requests that
+	// carried no valid credentials.
+	ErrNoAuth = errors.New("no valid credentials")
+	// ErrStaleCache is matched by DBStaleError (and hence by
+	// CacheTooOldError), i.e. when cbauth has no up to date state
+	// of ns_server.
+	ErrStaleCache = errors.New("cbauth database is stale")
+	// ErrCallbackNotRegistered is matched by errors of calls that
+	// need hook which wasn't set up by service: ErrNoAuditSink,
+	// ErrNoElevationAuditor and ErrUnknownCustomCredType.
+	ErrCallbackNotRegistered = errors.New("required callback is not registered")
+	// ErrTemporaryRPCFailure is matched by RPCFailureError,
+	// i.e. when request to ns_server failed but may succeed if
+	// retried.
+	ErrTemporaryRPCFailure = cbauthimpl.ErrTemporaryRPCFailure
+)
+
+// RPCFailureError type is returned when request to ns_server failed
+// for reasons that may go away by themselves, e.g. connection
+// failure or 5xx response.
+type RPCFailureError = cbauthimpl.RPCFailureError
+
+// notRegisteredError is type of errors that match
+// ErrCallbackNotRegistered.
+type notRegisteredError string
+
+func (e notRegisteredError) Error() string {
+	return string(e)
+}
+
+// Is method returns true for ErrCallbackNotRegistered.
+func (e notRegisteredError) Is(target error) bool {
+	return target == ErrCallbackNotRegistered
+}
+
+// AuthError function folds results of auth calls (e.g. AuthWebCreds)
+// into single error: ErrNoAuth is returned for NoAccessCreds, so that
+// bad credentials can be handled along with other errors.
+func AuthError(creds Creds, err error) error {
+	if err == nil && (creds == nil || creds == NoAccessCreds) {
+		return ErrNoAuth
+	}
+	return err
+}
+
+// ErrorHTTPStatus returns HTTP status that suits given error of cbauth
+// call: 401 for ErrNoAuth, 503 for ErrStaleCache, ErrNotInitialized
+// and ErrTemporaryRPCFailure (i.e. problems that client may wait out)
+// and 500 for everything else.
+func ErrorHTTPStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNoAuth):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrStaleCache), errors.Is(err, ErrNotInitialized),
+		errors.Is(err, ErrTemporaryRPCFailure):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
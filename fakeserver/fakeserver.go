@@ -0,0 +1,300 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fakeserver provides fake ns_server for integration tests
+// of services that use cbauth, revrpc and metakv. Fake server
+// listens on real socket and speaks same protocols as ns_server: it
+// accepts revrpc connections (and lets tests perform json rpc calls
+// to services via them, e.g. to push cbauth cache updates) and serves
+// metakv REST API from memory. It also verifies ui tokens minted by
+// MintUIToken and basic auth creds of users added via AddUser and
+// helps to mint other tokens and client certs with controllable clock
+// (see Clock).
+//
+// Typical use is to start Server, point CBAUTH_REVRPC_URL of service
+// under test to RevRPCURL (or call cbauth.InitExternalCreds with
+// server's HostPort), wait for revrpc connection via
+// WaitConnected and then push cache via PushCache.
+package fakeserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// ErrNotConnected is returned by Call and Push* methods when there is no
+// revrpc connection with given label.
+var ErrNotConnected = errors.New("fakeserver: revrpc service is not connected")
+
+// Server type represents running fake ns_server.
+type Server struct {
+	user     string
+	password string
+	listener net.Listener
+	srv      *http.Server
+	kv       *kvStore
+
+	l       sync.Mutex
+	clients map[string]*rpc.Client
+	caches  map[string]cbauthimpl.Cache
+	changed chan struct{}
+	clock   *Clock
+	tokens  map[string]*uiToken
+	users   map[string]*testUser
+}
+
+// New starts fake ns_server on random loopback port. Revrpc
+// connections are accepted only if they're authenticated with given
+// user and password. Metakv requests are not authenticated.
+func New(user, password string) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		user:     user,
+		password: password,
+		listener: listener,
+		kv:       newKVStore(),
+		clients:  make(map[string]*rpc.Client),
+		caches:   make(map[string]cbauthimpl.Cache),
+		changed:  make(chan struct{}),
+		tokens:   make(map[string]*uiToken),
+		users:    make(map[string]*testUser),
+	}
+	s.srv = &http.Server{Handler: http.HandlerFunc(s.serveHTTP)}
+	go s.srv.Serve(listener)
+	return s, nil
+}
+
+// HostPort returns host:port server is listening on.
+func (s *Server) HostPort() string {
+	return s.listener.Addr().String()
+}
+
+// URL returns base url of server.
+func (s *Server) URL() string {
+	return "http://" + s.HostPort()
+}
+
+// RevRPCURL returns url suitable for CBAUTH_REVRPC_URL environment
+// variable of service with given name.
+func (s *Server) RevRPCURL(service string) string {
+	u := url.URL{
+		Scheme: "http",
+		User:   url.UserPassword(s.user, s.password),
+		Host:   s.HostPort(),
+		Path:   "/" + service,
+	}
+	return u.String()
+}
+
+// Close stops server and closes all revrpc connections.
+func (s *Server) Close() {
+	s.listener.Close()
+	s.kv.close()
+	s.l.Lock()
+	for label, c := range s.clients {
+		c.Close()
+		delete(s.clients, label)
+	}
+	s.l.Unlock()
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "RPCCONNECT" {
+		s.serveRPCConnect(w, req)
+		return
+	}
+	if strings.HasPrefix(req.URL.Path, "/_metakv/") {
+		s.kv.serveHTTP(w, req, strings.TrimPrefix(req.URL.Path, "/_metakv"))
+		return
+	}
+	if req.URL.Path == "/_cbauth" {
+		s.serveAuth(w, req)
+		return
+	}
+	http.NotFound(w, req)
+}
+
+type hijackedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *hijackedConn) Read(buf []byte) (int, error) {
+	return c.r.Read(buf)
+}
+
+func (s *Server) serveRPCConnect(w http.ResponseWriter, req *http.Request) {
+	user, pwd, ok := req.BasicAuth()
+	if !ok || user != s.user || pwd != s.password {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	label := strings.TrimPrefix(req.URL.Path, "/")
+
+	conn, bufrw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	_, err = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	client := jsonrpc.NewClient(&hijackedConn{Conn: conn, r: bufrw.Reader})
+	s.l.Lock()
+	if old := s.clients[label]; old != nil {
+		old.Close()
+	}
+	s.clients[label] = client
+	close(s.changed)
+	s.changed = make(chan struct{})
+	s.l.Unlock()
+}
+
+// Connected returns labels of currently connected revrpc services.
+// Label is path of revrpc url, e.g. "goxdcr-cbauth".
+func (s *Server) Connected() []string {
+	s.l.Lock()
+	defer s.l.Unlock()
+	var rv []string
+	for label := range s.clients {
+		rv = append(rv, label)
+	}
+	return rv
+}
+
+// WaitConnected waits until revrpc service with given label
+// connects to server.
+func (s *Server) WaitConnected(label string, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		s.l.Lock()
+		_, ok := s.clients[label]
+		ch := s.changed
+		s.l.Unlock()
+		if ok {
+			return nil
+		}
+		select {
+		case <-ch:
+		case <-deadline:
+			return fmt.Errorf("fakeserver: timed out waiting for `%s' to connect", label)
+		}
+	}
+}
+
+// Call performs json rpc call of given method (e.g.
+// "AuthCacheSvc.UpdateDB") of revrpc service with given label.
+func (s *Server) Call(label, method string, arg, reply interface{}) error {
+	s.l.Lock()
+	c := s.clients[label]
+	s.l.Unlock()
+	if c == nil {
+		return ErrNotConnected
+	}
+	err := c.Call(method, arg, reply)
+	if err == rpc.ErrShutdown {
+		s.l.Lock()
+		if s.clients[label] == c {
+			delete(s.clients, label)
+		}
+		s.l.Unlock()
+	}
+	return err
+}
+
+// PushCache sends given cbauth cache to cbauth revrpc service with
+// given label the same way ns_server does it.
+func (s *Server) PushCache(label string, c *cbauthimpl.Cache) error {
+	var ok bool
+	if err := s.Call(label, "AuthCacheSvc.UpdateDB", c, &ok); err != nil {
+		return err
+	}
+	s.l.Lock()
+	s.caches[label] = *c
+	s.l.Unlock()
+	return nil
+}
+
+// PushTLSSettings sends given TLS settings to cbauth revrpc service
+// with given label. Like ns_server, it sends them as part of cache:
+// last cache pushed to that service (or empty one) is pushed again
+// with given settings. Pushing same settings again is how ns_server
+// notifies services that certificate files were changed (e.g.
+// rotated) in place.
+func (s *Server) PushTLSSettings(label string, tls cbauthimpl.TLSSettings) error {
+	s.l.Lock()
+	c := s.caches[label]
+	s.l.Unlock()
+	c.TLS = tls
+	return s.PushCache(label, &c)
+}
+
+// PushBucket sends change of single bucket to cbauth revrpc service
+// with given label. cbauthimpl.ErrNoDB is returned (as rpc.ServerError)
+// if service has no cache to apply it to.
+func (s *Server) PushBucket(label string, u *cbauthimpl.BucketUpdate) error {
+	var ok bool
+	return s.Call(label, "AuthCacheSvc.UpdateBucket", u, &ok)
+}
+
+// Revoke revokes creds of user or token of given revocation at
+// cbauth revrpc service with given label. Revocation is in effect
+// once it returns.
+func (s *Server) Revoke(label string, r *cbauthimpl.Revocation) (*cbauthimpl.RevokeAck, error) {
+	var ack cbauthimpl.RevokeAck
+	if err := s.Call(label, "AuthCacheSvc.Revoke", r, &ack); err != nil {
+		return nil, err
+	}
+	return &ack, nil
+}
+
+// Disconnect closes revrpc connection with given label. It is
+// useful to test reconnection logic of services.
+func (s *Server) Disconnect(label string) {
+	s.l.Lock()
+	c := s.clients[label]
+	delete(s.clients, label)
+	s.l.Unlock()
+	if c != nil {
+		c.Close()
+	}
+}
+
+// SetMetakv sets given metakv key to given value.
+func (s *Server) SetMetakv(path string, value []byte) {
+	s.kv.set(path, value)
+}
+
+// GetMetakv returns value of given metakv key or nil if key doesn't
+// exist.
+func (s *Server) GetMetakv(path string) []byte {
+	return s.kv.get(path)
+}
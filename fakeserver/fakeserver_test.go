@@ -0,0 +1,584 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fakeserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/rpc"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/cbauth"
+	"github.com/couchbase/cbauth/cbauthimpl"
+	"github.com/couchbase/cbauth/revrpc"
+)
+
+func mkUser(user, password, salt string) (u cbauthimpl.User) {
+	u.User = user
+	u.Salt = []byte(salt)
+	h := hmac.New(sha1.New, u.Salt)
+	h.Write([]byte(password))
+	u.Mac = h.Sum(nil)
+	return
+}
+
+func TestCBAuthWiring(t *testing.T) {
+	s, err := New("@ns_server", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ok, err := cbauth.InitExternalCreds(s.HostPort(), "@ns_server", "secret")
+	if err != nil || !ok {
+		t.Fatalf("Failed to init cbauth: %v, %v", ok, err)
+	}
+	label := filepath.Base(os.Args[0]) + "-cbauth"
+	if err := s.WaitConnected(label, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.PushCache(label, &cbauthimpl.Cache{Admin: mkUser("admin", "asdasd", "nacl")}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := cbauth.Auth("admin", "asdasd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isAdmin, _ := c.IsAdmin(); !isAdmin {
+		t.Fatal("Expect pushed admin to be recognised")
+	}
+
+	// events that happened before observer was set are replayed
+	stages := make(chan cbauth.LifecycleStage, 64)
+	cbauth.SetLifecycleObserver(cbauth.LifecycleObserverFunc(func(e *cbauth.LifecycleEvent) {
+		stages <- e.Stage
+	}))
+	defer cbauth.SetLifecycleObserver(nil)
+	expectStages := func(exp ...cbauth.LifecycleStage) {
+		t.Helper()
+		for _, st := range exp {
+			select {
+			case got := <-stages:
+				if got != st {
+					t.Fatalf("Expect lifecycle stage %s. Got: %s", st, got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for lifecycle stage %s", st)
+			}
+		}
+	}
+	expectStages(cbauth.LifecycleInitializing, cbauth.LifecycleConnected, cbauth.LifecycleSynced)
+
+	// oversized update must be rejected without touching cache
+	defer cbauth.SetCacheUpdateLimits(cbauth.DefaultMaxCacheUpdateSize, cbauth.KeepPreviousCache)
+	cbauth.SetCacheUpdateLimits(1024, cbauth.KeepPreviousCache)
+	big := &cbauthimpl.Cache{Admin: mkUser("admin", "other", "nacl")}
+	for i := 0; i < 100; i++ {
+		big.Buckets = append(big.Buckets, cbauthimpl.Bucket{Name: "bucket" + strconv.Itoa(i)})
+	}
+	if err := s.PushCache(label, big); err == nil || !strings.Contains(err.Error(), "exceed") {
+		t.Fatalf("Expect oversized push to be rejected. Got: %v", err)
+	}
+	if c, err := cbauth.Auth("admin", "asdasd"); err != nil || c == cbauth.NoAccessCreds {
+		t.Fatalf("Expect previous cache to be intact. Got: %v, %v", c, err)
+	}
+	cbauth.SetCacheUpdateLimits(1024, cbauth.MarkCacheStale)
+	if err := s.PushCache(label, big); err == nil {
+		t.Fatal("Expect oversized push to be rejected")
+	}
+	if _, err := cbauth.Auth("admin", "asdasd"); err == nil {
+		t.Fatal("Expect cache to be stale after rejected push")
+	}
+	if err := s.PushCache(label, &cbauthimpl.Cache{Admin: mkUser("admin", "asdasd", "nacl")}); err != nil {
+		t.Fatal(err)
+	}
+	expectStages(cbauth.LifecycleDegraded, cbauth.LifecycleSynced)
+	if c, err := cbauth.Auth("admin", "asdasd"); err != nil || c == cbauth.NoAccessCreds {
+		t.Fatalf("Expect connection to survive rejected push. Got: %v, %v", c, err)
+	}
+
+	// service must reconnect and become stale until next push
+	s.Disconnect(label)
+	if err := s.WaitConnected(label, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PushCache(label, &cbauthimpl.Cache{}); err != nil {
+		t.Fatal(err)
+	}
+	c, err = cbauth.Auth("admin", "asdasd")
+	if err != nil || c != cbauth.NoAccessCreds {
+		t.Fatalf("Expect admin to be gone after push. Got: %v, %v", c, err)
+	}
+	expectStages(cbauth.LifecycleDegraded, cbauth.LifecycleConnected, cbauth.LifecycleSynced)
+}
+
+func TestRevRPCAuth(t *testing.T) {
+	s, err := New("@ns_server", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	req, _ := http.NewRequest("RPCCONNECT", s.URL()+"/test", nil)
+	req.SetBasicAuth("@ns_server", "wrong")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expect bad creds to be refused. Got: %s", resp.Status)
+	}
+	if err := s.Call("test", "Foo.Bar", nil, nil); err != ErrNotConnected {
+		t.Fatalf("Expect ErrNotConnected. Got: %v", err)
+	}
+}
+
+func TestMetakv(t *testing.T) {
+	s, err := New("@ns_server", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	req, _ := http.NewRequest("PUT", s.URL()+"/_metakv/a/b", strings.NewReader(url.Values{"value": {"v1"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if string(s.GetMetakv("/a/b")) != "v1" {
+		t.Fatalf("Expect PUT to set value. Got: %s", s.GetMetakv("/a/b"))
+	}
+
+	s.SetMetakv("/a/c", []byte("v2"))
+	resp, err = http.Get(s.URL() + "/_metakv/a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	var paths []string
+	for {
+		var e kvEntry
+		if dec.Decode(&e) != nil {
+			break
+		}
+		paths = append(paths, e.Path+"="+string(e.Value))
+	}
+	if strings.Join(paths, ",") != "/a/b=v1,/a/c=v2" {
+		t.Fatalf("Unexpected children: %v", paths)
+	}
+}
+
+func TestRevRPCSRVDiscovery(t *testing.T) {
+	s, err := New("@ns_server", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadPort := dead.Addr().(*net.TCPAddr).Port
+	dead.Close()
+	port := s.listener.Addr().(*net.TCPAddr).Port
+
+	defer func(old func(service, proto, name string) (string, []*net.SRV, error)) {
+		revrpc.LookupSRV = old
+	}(revrpc.LookupSRV)
+	lookups := 0
+	revrpc.LookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		lookups++
+		if service != "cbauth" || proto != "tcp" || name != "cluster.test" {
+			t.Errorf("Unexpected SRV lookup: %s %s %s", service, proto, name)
+		}
+		return "", []*net.SRV{
+			{Target: "127.0.0.1.", Port: uint16(deadPort)},
+			{Target: "127.0.0.1.", Port: uint16(port)},
+		}, nil
+	}
+
+	svc, err := revrpc.NewService("http+srv://@ns_server:secret@cluster.test/srv-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go revrpc.BabysitService(func(*rpc.Server) error { return nil }, svc, revrpc.NoRestartsBabysitErrorPolicy)
+	if err := s.WaitConnected("srv-test", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := url.Parse("http+srv://cluster.test/_metakv")
+	defer revrpc.ForgetResolvedURL(u)
+	lookups = 0
+	for i := 0; i < 2; i++ {
+		resolved, err := revrpc.ResolveURL(u)
+		if err != nil || resolved.String() != "http://127.0.0.1:"+strconv.Itoa(port)+"/_metakv" {
+			t.Fatalf("Expect url to resolve to reachable endpoint. Got: %v, %v", resolved, err)
+		}
+	}
+	if lookups != 1 {
+		t.Fatalf("Expect resolved endpoint to be reused. Got %d lookups", lookups)
+	}
+	revrpc.ForgetResolvedURL(u)
+	if _, err := revrpc.ResolveURL(u); err != nil || lookups != 2 {
+		t.Fatalf("Expect forgotten url to be resolved again. Got %d lookups, %v", lookups, err)
+	}
+}
+
+func TestPushTLSSettings(t *testing.T) {
+	s, err := New("@ns_server", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	rpcsvc, err := revrpc.NewService(s.RevRPCURL("tls-test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := cbauthimpl.NewSVC(0, errors.New("stale"))
+	go revrpc.BabysitService(func(srv *rpc.Server) error {
+		return srv.RegisterName("AuthCacheSvc", svc)
+	}, rpcsvc, revrpc.NoRestartsBabysitErrorPolicy)
+	if err := s.WaitConnected("tls-test", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.PushCache("tls-test", &cbauthimpl.Cache{Admin: mkUser("admin", "asdasd", "nacl")}); err != nil {
+		t.Fatal(err)
+	}
+	settings := cbauthimpl.TLSSettings{MinVersion: "tlsv1.3", CAFile: "/certs/ca.pem"}
+	if err := s.PushTLSSettings("tls-test", settings); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := cbauthimpl.GetTLSSettings(svc); err != nil || !reflect.DeepEqual(got, settings) {
+		t.Fatalf("Expect pushed TLS settings. Got: %+v, %v", got, err)
+	}
+	if c, err := cbauthimpl.VerifyPassword(svc, "admin", "asdasd"); err != nil || c == nil {
+		t.Fatalf("Expect rest of cache to be kept. Got: %v, %v", c, err)
+	}
+	if err := s.PushTLSSettings("unknown", settings); err != ErrNotConnected {
+		t.Fatalf("Expect push to unknown service to fail. Got: %v", err)
+	}
+}
+
+func TestRevRPCClose(t *testing.T) {
+	s, err := New("@ns_server", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	t.Setenv("CBAUTH_REVRPC_URL", s.RevRPCURL("close"))
+	rpcsvc, err := revrpc.GetDefaultServiceFromEnv("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := revrpc.GetDefaultServiceFromEnv("test"); err == nil {
+		t.Fatal("Expect default service to be obtained only once")
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- revrpc.BabysitService(func(*rpc.Server) error { return nil }, rpcsvc, nil)
+	}()
+	if err := s.WaitConnected("close-test", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	rpcsvc.Close()
+	select {
+	case err := <-done:
+		if err != revrpc.ErrServiceClosed {
+			t.Fatalf("Expect babysitter to stop with ErrServiceClosed. Got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expect babysitter to stop after service is closed")
+	}
+	if err := rpcsvc.Run(func(*rpc.Server) error { return nil }); err != revrpc.ErrServiceClosed {
+		t.Fatalf("Expect closed service to refuse to run. Got: %v", err)
+	}
+	again, err := revrpc.GetDefaultServiceFromEnv("test")
+	if err != nil {
+		t.Fatalf("Expect closed default service to be released. Got: %v", err)
+	}
+	again.Close()
+}
+
+func TestRevRPCLogThrottling(t *testing.T) {
+	s, err := New("@ns_server", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	svc, err := revrpc.NewService("http://@ns_server:wrong@" + s.HostPort() + "/throttled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logged []string
+	policy := revrpc.DefaultErrorPolicy{
+		RestartsToExit:       20,
+		SleepBetweenRestarts: time.Millisecond,
+		LogPrint:             func(args ...interface{}) { logged = append(logged, fmt.Sprint(args...)) },
+		LogBurst:             3,
+		LogRefill:            time.Hour,
+	}
+	if err := revrpc.BabysitService(func(*rpc.Server) error { return nil }, svc, policy); err == nil {
+		t.Fatal("Expect babysitter to give up")
+	}
+	if len(logged) != 5 ||
+		!strings.Contains(logged[3], "suppressed 16 similar messages") ||
+		!strings.HasPrefix(logged[4], "Will not retry") {
+		t.Fatalf("Unexpected log output: %q", logged)
+	}
+
+	logged = nil
+	policy.LogRefill = 0
+	if err := revrpc.BabysitService(func(*rpc.Server) error { return nil }, svc, policy); err == nil {
+		t.Fatal("Expect babysitter to give up")
+	}
+	if len(logged) != 5 {
+		t.Fatalf("Unexpected log output with default refill: %q", logged)
+	}
+
+	logged = nil
+	print := revrpc.ThrottleLogPrint(policy.LogPrint, 2, 0)
+	for i := 0; i < 4; i++ {
+		print("msg")
+	}
+	if len(logged) != 2 {
+		t.Fatalf("Unexpected throttled output: %q", logged)
+	}
+}
+
+func TestTokenGenerators(t *testing.T) {
+	s, err := New("@ns_server", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	clock := NewClock(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	s.SetClock(clock)
+	defer clock.Install()()
+
+	svc := cbauthimpl.NewSVC(0, errors.New("stale"))
+	err = svc.UpdateDB(&cbauthimpl.Cache{
+		Nodes: []cbauthimpl.Node{{Host: "127.0.0.1", User: "_admin", Password: "nodepwd",
+			Ports: []int{9000}, Local: true}},
+		SpecialUser:   "@component",
+		TokenCheckURL: s.AuthURL(),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := s.MintUIToken("alice", "local", []cbauthimpl.Role{{Name: "admin"}}, time.Minute)
+	hdr := http.Header{}
+	hdr.Set("ns-server-ui", "yes")
+	hdr.Set(UITokenHeader, token)
+	c, err := cbauthimpl.VerifyOnServer(svc, hdr)
+	if err != nil || c == nil || c.Name() != "alice" {
+		t.Fatalf("Expect ui token to be accepted. Got: %v, %v", c, err)
+	}
+	if isAdmin, _ := c.IsAdmin(); !isAdmin || c.Revalidate() != nil {
+		t.Fatalf("Expect valid admin creds. Got: %v", c)
+	}
+	clock.Advance(time.Minute)
+	if c.Revalidate() != cbauthimpl.ErrCredsRevoked {
+		t.Fatal("Expect creds of expired ui token to be revoked")
+	}
+	if c, err := cbauthimpl.VerifyOnServer(svc, hdr); err != nil || c != nil {
+		t.Fatalf("Expect expired ui token to be refused. Got: %v, %v", c, err)
+	}
+
+	pwd, err := s.MintInternalToken("nodepwd", "@cbq-engine", []string{cbauthimpl.PermissionAdmin}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := cbauthimpl.VerifyPassword(svc, "@cbq-engine", pwd); err != nil || c == nil || !c.IsInternal() {
+		t.Fatalf("Expect internal token to be accepted. Got: %v, %v", c, err)
+	}
+	clock.Advance(time.Minute)
+	if c, _ := cbauthimpl.VerifyPassword(svc, "@cbq-engine", pwd); c != nil {
+		t.Fatal("Expect expired internal token to be refused")
+	}
+
+	ca, err := NewTestCA(clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, err := ca.Issue("alice", time.Hour, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	opts := x509.VerifyOptions{Roots: roots, CurrentTime: clock.Now(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	if _, err := cert.Verify(opts); err != nil || cert.EmailAddresses[0] != "alice@example.com" {
+		t.Fatalf("Expect valid client cert. Got: %v", err)
+	}
+	opts.CurrentTime = clock.Now().Add(2 * time.Hour)
+	if _, err := cert.Verify(opts); err == nil {
+		t.Fatal("Expect cert to expire")
+	}
+}
+
+func TestCollectionRoles(t *testing.T) {
+	s, err := New("@ns_server", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var cache cbauthimpl.Cache
+	err = json.Unmarshal([]byte(`{"users": [{"name": "bob", "domain": "local",
+		"roles": ["data_reader[foo:inventory:airline]", {"role": "data_writer", "bucket_name": "foo", "scope_name": "inventory"}]}]}`), &cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := MustParseRoles("data_reader[foo:inventory:airline]", "data_writer[foo:inventory]"); !reflect.DeepEqual(cache.Users[0].Roles, want) {
+		t.Fatalf("Unexpected roles of cache user: %v", cache.Users[0].Roles)
+	}
+	for _, r := range []string{`"data_reader[foo:]"`, `{"role": "data_reader", "bucket_name": "foo", "collection_name": "airline"}`,
+		`{"role": "data_reader", "scope_name": "inventory"}`} {
+		var bad cbauthimpl.Cache
+		if err := json.Unmarshal([]byte(`{"users": [{"name": "bob", "roles": [`+r+`]}]}`), &bad); err == nil {
+			t.Fatalf("Expect malformed role %s to be refused", r)
+		}
+	}
+
+	svc := cbauthimpl.NewSVC(0, errors.New("stale"))
+	cache.TokenCheckURL = s.AuthURL()
+	if err := svc.UpdateDB(&cache, nil); err != nil {
+		t.Fatal(err)
+	}
+	if roles, _, err := cbauthimpl.LookupRoles(svc, "bob", "local"); err != nil || len(roles) != 2 || roles[0].Collection != "airline" {
+		t.Fatalf("Unexpected roles of bob: %v, %v", roles, err)
+	}
+
+	s.AddUser("alice", "pwd", "local", MustParseRoles("data_reader[foo:inventory:airline]",
+		"data_writer[foo:inventory]", "bucket_full_access[*:*:hotel]"))
+	req, err := http.NewRequest("GET", "http://q:11234/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("alice", "pwd")
+	c, err := cbauthimpl.VerifyOnServer(svc, req.Header)
+	if err != nil || c == nil || c.Name() != "alice" {
+		t.Fatalf("Expect alice to be accepted. Got: %v, %v", c, err)
+	}
+	for _, tc := range []struct {
+		bucket, scope, collection string
+		read, access              bool
+	}{
+		{"foo", "inventory", "airline", true, true},
+		{"foo", "inventory", "route", false, false},
+		{"foo", "tenant", "airline", false, false},
+		{"bar", "any", "hotel", true, true},
+	} {
+		if ok, _ := c.CanReadCollection(tc.bucket, tc.scope, tc.collection); ok != tc.read {
+			t.Fatalf("Unexpected read access to %+v: %v", tc, ok)
+		}
+		if ok, _ := c.CanAccessCollection(tc.bucket, tc.scope, tc.collection); ok != tc.access {
+			t.Fatalf("Unexpected access to %+v: %v", tc, ok)
+		}
+	}
+	if ok, _ := c.CanReadBucket("foo"); ok {
+		t.Fatal("Expect collection roles to not grant bucket access")
+	}
+
+	req.SetBasicAuth("alice", "wrong")
+	if c, err := cbauthimpl.VerifyOnServer(svc, req.Header); err != nil || c != nil {
+		t.Fatalf("Expect wrong password to be refused. Got: %v, %v", c, err)
+	}
+	s.RemoveUser("alice")
+	req.SetBasicAuth("alice", "pwd")
+	if c, err := cbauthimpl.VerifyOnServer(svc, req.Header); err != nil || c != nil {
+		t.Fatalf("Expect removed user to be refused. Got: %v, %v", c, err)
+	}
+}
+
+func TestCloseDefault(t *testing.T) {
+	// Default may be left over from other tests
+	cbauth.CloseDefault()
+	if _, err := cbauth.Auth("admin", "asdasd"); err != cbauth.ErrNotInitialized {
+		t.Fatalf("Expect closed default authenticator to be gone. Got: %v", err)
+	}
+
+	s, err := New("@ns_server", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if ok, err := cbauth.InitExternalCreds(s.HostPort(), "@ns_server", "secret"); err != nil || !ok {
+		t.Fatalf("Expect cbauth to be initialized again. Got: %v, %v", ok, err)
+	}
+	label := filepath.Base(os.Args[0]) + "-cbauth"
+	if err := s.WaitConnected(label, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PushCache(label, &cbauthimpl.Cache{Admin: mkUser("admin", "asdasd", "nacl")}); err != nil {
+		t.Fatal(err)
+	}
+	a := cbauth.GetDefault()
+	if c, err := a.Auth("admin", "asdasd"); err != nil || c == cbauth.NoAccessCreds {
+		t.Fatalf("Expect pushed admin to be recognised. Got: %v, %v", c, err)
+	}
+
+	cbauth.CloseDefault()
+	if cbauth.GetDefault() != nil {
+		t.Fatal("Expect default authenticator to be reset")
+	}
+	if _, err := a.Auth("admin", "asdasd"); !errors.Is(err, cbauth.ErrStaleCache) {
+		t.Fatalf("Expect closed authenticator to be stale. Got: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.PushCache(label, &cbauthimpl.Cache{}) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Expect connection to ns_server to be dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,227 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fakeserver
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type kvEntry struct {
+	Path  string
+	Value []byte
+	Rev   []byte
+}
+
+type kvStore struct {
+	l           sync.Mutex
+	counter     uint64
+	data        map[string]kvEntry
+	subscribers map[chan kvEntry]bool
+	closed      chan struct{}
+}
+
+func newKVStore() *kvStore {
+	return &kvStore{
+		data:        make(map[string]kvEntry),
+		subscribers: make(map[chan kvEntry]bool),
+		closed:      make(chan struct{}),
+	}
+}
+
+func (kv *kvStore) close() {
+	kv.l.Lock()
+	defer kv.l.Unlock()
+	select {
+	case <-kv.closed:
+	default:
+		close(kv.closed)
+	}
+}
+
+func (kv *kvStore) broadcastLocked(e kvEntry) {
+	for ch := range kv.subscribers {
+		select {
+		case ch <- e:
+		default:
+			// slow subscriber; drop it so that it reconnects
+			// and observes current state
+			delete(kv.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (kv *kvStore) setLocked(path string, value []byte) {
+	rev := make([]byte, 8)
+	binary.BigEndian.PutUint64(rev, kv.counter)
+	kv.counter++
+	e := kvEntry{Path: path, Value: value, Rev: rev}
+	kv.data[path] = e
+	kv.broadcastLocked(e)
+}
+
+func (kv *kvStore) deleteLocked(path string) {
+	kv.counter++
+	delete(kv.data, path)
+	kv.broadcastLocked(kvEntry{Path: path})
+}
+
+func (kv *kvStore) set(path string, value []byte) {
+	kv.l.Lock()
+	kv.setLocked(path, value)
+	kv.l.Unlock()
+}
+
+func (kv *kvStore) get(path string) []byte {
+	kv.l.Lock()
+	defer kv.l.Unlock()
+	if e, ok := kv.data[path]; ok {
+		return e.Value
+	}
+	return nil
+}
+
+func (kv *kvStore) revMatchesLocked(path, rev string) bool {
+	if rev == "" {
+		return true
+	}
+	e, ok := kv.data[path]
+	return ok && string(e.Rev) == rev
+}
+
+// setRevisionLocked reports current store revision the way metakv
+// does so that read-your-writes tokens work against fake server.
+func (kv *kvStore) setRevisionLocked(w http.ResponseWriter) {
+	w.Header().Set("X-Metakv-Revision", strconv.FormatUint(kv.counter, 10))
+}
+
+func (kv *kvStore) serveHTTP(w http.ResponseWriter, req *http.Request, path string) {
+	isDir := strings.HasSuffix(path, "/")
+	if req.Method == "GET" && isDir {
+		kv.serveIterate(w, req, path)
+		return
+	}
+
+	kv.l.Lock()
+	defer kv.l.Unlock()
+
+	switch req.Method {
+	case "GET":
+		kv.setRevisionLocked(w)
+		e, ok := kv.data[path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		json.NewEncoder(w).Encode(e)
+	case "PUT":
+		req.ParseForm()
+		if !kv.revMatchesLocked(path, req.PostForm.Get("rev")) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if _, exists := kv.data[path]; exists && req.PostForm.Get("create") != "" {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		kv.setLocked(path, []byte(req.PostForm.Get("value")))
+		kv.setRevisionLocked(w)
+	case "DELETE":
+		if isDir {
+			for p := range kv.data {
+				if strings.HasPrefix(p, path) {
+					kv.deleteLocked(p)
+				}
+			}
+			kv.setRevisionLocked(w)
+			return
+		}
+		if !kv.revMatchesLocked(path, req.URL.Query().Get("rev")) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if _, exists := kv.data[path]; exists {
+			kv.deleteLocked(path)
+		}
+		kv.setRevisionLocked(w)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (kv *kvStore) serveIterate(w http.ResponseWriter, req *http.Request, dir string) {
+	continuous := req.URL.Query().Get("feed") == "continuous"
+
+	kv.l.Lock()
+	var entries []kvEntry
+	for p, e := range kv.data {
+		if strings.HasPrefix(p, dir) {
+			entries = append(entries, e)
+		}
+	}
+	var ch chan kvEntry
+	if continuous {
+		ch = make(chan kvEntry, 64)
+		kv.subscribers[ch] = true
+	}
+	kv.l.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if enc.Encode(e) != nil {
+			break
+		}
+	}
+	if !continuous {
+		return
+	}
+
+	defer func() {
+		kv.l.Lock()
+		if kv.subscribers[ch] {
+			delete(kv.subscribers, ch)
+		}
+		kv.l.Unlock()
+	}()
+
+	w.(http.Flusher).Flush()
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if !strings.HasPrefix(e.Path, dir) {
+				continue
+			}
+			if enc.Encode(e) != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		case <-req.Context().Done():
+			return
+		case <-kv.closed:
+			return
+		}
+	}
+}
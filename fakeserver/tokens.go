@@ -0,0 +1,257 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fakeserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// UITokenHeader is header that carries ui tokens minted by
+// MintUIToken. Note that cbauth passes request to ns_server (i.e. to
+// AuthURL) only if "ns-server-ui: yes" header is also set.
+const UITokenHeader = "ns-server-auth-token"
+
+// Clock type is controllable clock that lets tests exercise expiry
+// of tokens and certificates deterministically.
+type Clock struct {
+	l   sync.Mutex
+	now time.Time
+}
+
+// NewClock returns clock that shows given time until it is moved.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now method returns current time of clock.
+func (c *Clock) Now() time.Time {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return c.now
+}
+
+// Advance method moves clock forward by given duration.
+func (c *Clock) Advance(d time.Duration) {
+	c.l.Lock()
+	c.now = c.now.Add(d)
+	c.l.Unlock()
+}
+
+// Set method sets current time of clock.
+func (c *Clock) Set(now time.Time) {
+	c.l.Lock()
+	c.now = now
+	c.l.Unlock()
+}
+
+// Install method makes cbauth's expiry checks (of scoped, elevation
+// and ui tokens) use this clock until returned function is called.
+func (c *Clock) Install() (restore func()) {
+	old := cbauthimpl.SetNow(c.Now)
+	return func() { cbauthimpl.SetNow(old) }
+}
+
+type uiToken struct {
+	user    string
+	domain  string
+	roles   []cbauthimpl.Role
+	expires time.Time
+}
+
+// SetClock sets clock that server uses to mint and expire tokens. nil
+// clock means real time.
+func (s *Server) SetClock(c *Clock) {
+	s.l.Lock()
+	s.clock = c
+	s.l.Unlock()
+}
+
+func (s *Server) now() time.Time {
+	s.l.Lock()
+	c := s.clock
+	s.l.Unlock()
+	if c == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
+
+// AuthURL returns url of server's auth endpoint that verifies ui
+// tokens. It is meant to be pushed as TokenCheckURL of cbauth cache.
+func (s *Server) AuthURL() string {
+	return s.URL() + "/_cbauth"
+}
+
+// MintUIToken returns ui token of given user that expires after given
+// duration (according to server's clock). Auth endpoint reports given
+// domain and roles for it.
+func (s *Server) MintUIToken(user, domain string, roles []cbauthimpl.Role, ttl time.Duration) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	t := &uiToken{user: user, domain: domain, roles: roles, expires: s.now().Add(ttl)}
+	s.l.Lock()
+	s.tokens[token] = t
+	s.l.Unlock()
+	return token
+}
+
+// RevokeUIToken makes given ui token invalid, as if user logged out.
+func (s *Server) RevokeUIToken(token string) {
+	s.l.Lock()
+	delete(s.tokens, token)
+	s.l.Unlock()
+}
+
+// MintInternalToken returns scoped token of given internal user (see
+// cbauth.GetScopedServiceAuth) that is signed by given node password
+// and expires after given duration according to server's clock.
+func (s *Server) MintInternalToken(nodePassword, user string, permissions []string, ttl time.Duration) (string, error) {
+	return cbauthimpl.SignScopedToken(nodePassword, user, permissions, s.now().Add(ttl))
+}
+
+func (s *Server) serveAuth(w http.ResponseWriter, req *http.Request) {
+	token := req.Header.Get(UITokenHeader)
+	now := s.now()
+	s.l.Lock()
+	var t *uiToken
+	if token != "" {
+		t = s.tokens[token]
+	} else {
+		t = s.userTokenLocked(req)
+	}
+	s.l.Unlock()
+	if t == nil || (!t.expires.IsZero() && !now.Before(t.expires)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	resp := map[string]interface{}{
+		"version": cbauthimpl.AuthResponseVersion,
+		"user":    t.user,
+		"source":  t.domain,
+		"domain":  t.domain,
+		"roles":   t.roles,
+	}
+	if !t.expires.IsZero() {
+		resp["expiry"] = t.expires.Unix()
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// TestCA type is certificate authority that issues client
+// certificates for tests.
+type TestCA struct {
+	// Cert is CA certificate and CertPEM is its PEM encoding.
+	Cert    *x509.Certificate
+	CertPEM []byte
+	key     *ecdsa.PrivateKey
+	clock   *Clock
+
+	l      sync.Mutex
+	serial int64
+}
+
+func (ca *TestCA) now() time.Time {
+	if ca.clock == nil {
+		return time.Now()
+	}
+	return ca.clock.Now()
+}
+
+// NewTestCA returns new CA that is valid for a year from now
+// according to given clock (nil means real time).
+func NewTestCA(clock *Clock) (*TestCA, error) {
+	ca := &TestCA{clock: clock, serial: 1}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(ca.serial),
+		Subject:               pkix.Name{CommonName: "fakeserver test CA"},
+		NotBefore:             ca.now().Add(-time.Minute),
+		NotAfter:              ca.now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	ca.Cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	ca.CertPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	ca.key = key
+	return ca, nil
+}
+
+// Issue method returns PEM encoded client certificate with given
+// common name (and optional email/dns subject alt names) and its
+// key. Certificate is valid from now until given duration passes
+// according to CA's clock.
+func (ca *TestCA) Issue(commonName string, ttl time.Duration, sans ...string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca.l.Lock()
+	ca.serial++
+	serial := ca.serial
+	ca.l.Unlock()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    ca.now(),
+		NotAfter:     ca.now().Add(ttl),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, san := range sans {
+		if strings.Contains(san, "@") {
+			tmpl.EmailAddresses = append(tmpl.EmailAddresses, san)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, san)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
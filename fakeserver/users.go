@@ -0,0 +1,91 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fakeserver
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+	"github.com/couchbase/cbauth/rbac"
+)
+
+// testUser struct describes user added via AddUser.
+type testUser struct {
+	password string
+	domain   string
+	roles    []cbauthimpl.Role
+}
+
+// AddUser method makes auth endpoint accept basic auth creds of given
+// user with given password and report given domain and roles for
+// them. Together with TokenCheckURL of cache pointed to AuthURL this
+// lets tests exercise bucket, scope and collection authorization of
+// services end-to-end. Adding same user again replaces it.
+func (s *Server) AddUser(user, password, domain string, roles []cbauthimpl.Role) {
+	u := &testUser{password: password, domain: domain,
+		roles: append([]cbauthimpl.Role(nil), roles...)}
+	s.l.Lock()
+	s.users[user] = u
+	s.l.Unlock()
+}
+
+// RemoveUser method makes auth endpoint refuse creds of given user.
+func (s *Server) RemoveUser(user string) {
+	s.l.Lock()
+	delete(s.users, user)
+	s.l.Unlock()
+}
+
+// userTokenLocked returns token of user whose basic auth creds given
+// request carries or nil if there is no such user. Such tokens never
+// expire. Must be called with s.l held.
+func (s *Server) userTokenLocked(req *http.Request) *uiToken {
+	user, password, ok := req.BasicAuth()
+	u := s.users[user]
+	if !ok || u == nil || subtle.ConstantTimeCompare([]byte(password), []byte(u.password)) != 1 {
+		return nil
+	}
+	return &uiToken{user: user, domain: u.domain, roles: u.roles}
+}
+
+// ParseRoles parses given roles in ns_server notation, e.g.
+// "data_reader[foo:inventory:airline]". It is meant for construction
+// of roles of users and groups of test caches and of users given to
+// AddUser and MintUIToken.
+func ParseRoles(roles ...string) ([]cbauthimpl.Role, error) {
+	rv := make([]cbauthimpl.Role, len(roles))
+	for i, s := range roles {
+		r, err := rbac.ParseRole(s)
+		if err != nil {
+			return nil, fmt.Errorf("fakeserver: %v", err)
+		}
+		rv[i] = r
+	}
+	return rv, nil
+}
+
+// MustParseRoles is ParseRoles that panics if some of given roles
+// are malformed. It is only meant for roles that are literals of
+// tests.
+func MustParseRoles(roles ...string) []cbauthimpl.Role {
+	rv, err := ParseRoles(roles...)
+	if err != nil {
+		panic(err)
+	}
+	return rv
+}
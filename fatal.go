@@ -0,0 +1,80 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// FatalError struct describes error that cbauth can't recover from
+// without restart of process, e.g. giving up on revrpc connection to
+// ns_server (see FatalPolicy).
+type FatalError struct {
+	Component string
+	Err       error
+}
+
+func (e *FatalError) Error() string {
+	return fmt.Sprintf("cbauth: fatal %s error: %s", e.Component, e.Err)
+}
+
+// Unwrap method returns underlying error.
+func (e *FatalError) Unwrap() error {
+	return e.Err
+}
+
+// FatalPolicy interface decides what happens after cbauth hits
+// FatalError. Default authenticator stays stale after that and its
+// calls fail with DBStaleError that wraps FatalError, so policies
+// that don't terminate process (or do that gracefully later) only
+// need to arrange for service to be restarted eventually.
+type FatalPolicy interface {
+	HandleFatal(err *FatalError)
+}
+
+// FatalPolicyFunc type adapts function to FatalPolicy interface.
+type FatalPolicyFunc func(err *FatalError)
+
+// HandleFatal method simply calls "this" function.
+func (f FatalPolicyFunc) HandleFatal(err *FatalError) {
+	f(err)
+}
+
+// PanicOnFatal is default FatalPolicy. It panics, so that ns_server
+// restarts service.
+var PanicOnFatal FatalPolicy = FatalPolicyFunc(func(err *FatalError) {
+	panic(err)
+})
+
+type fatalPolicyBox struct{ p FatalPolicy }
+
+var fatalPolicy atomic.Value
+
+// SetFatalPolicy sets policy that handles fatal errors of cbauth.
+// nil restores PanicOnFatal.
+func SetFatalPolicy(p FatalPolicy) {
+	fatalPolicy.Store(fatalPolicyBox{p})
+}
+
+func handleFatal(err *FatalError) {
+	b, _ := fatalPolicy.Load().(fatalPolicyBox)
+	if b.p == nil {
+		PanicOnFatal.HandleFatal(err)
+		return
+	}
+	b.p.HandleFatal(err)
+}
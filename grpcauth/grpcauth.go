@@ -0,0 +1,200 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package grpcauth provides gRPC interceptors that authenticate
+// incoming calls with cbauth and PerRPCCredentials that authenticate
+// outgoing calls to other services of the cluster.
+package grpcauth
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/couchbase/cbauth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Options struct configures server interceptors.
+type Options struct {
+	// Authenticator is used to authenticate calls. Default
+	// authenticator is used if it's nil.
+	Authenticator cbauth.Authenticator
+	// Permission, if non-empty, must be granted to creds (see
+	// cbauth.HasPermission), otherwise call fails with
+	// PermissionDenied.
+	Permission string
+	// Authorize, if non-nil, is called after permission check with
+	// full name of called method. If it returns false, call fails
+	// with PermissionDenied.
+	Authorize func(c cbauth.Creds, fullMethod string) (bool, error)
+}
+
+// UnaryServerInterceptor returns interceptor that authenticates
+// unary calls (see StreamServerInterceptor).
+func UnaryServerInterceptor(opts Options) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authenticate(ctx, info.FullMethod, &opts)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns interceptor that authenticates
+// streaming calls. Creds are extracted from call metadata the same
+// way AuthWebCreds extracts them from http headers (i.e. basic auth
+// and token "authorization" metadata as well as ns_server ui
+// tokens are understood) and put to stream context (see
+// cbauth.CredsFromContext). Calls without valid creds fail with
+// Unauthenticated, calls that are not authorized fail with
+// PermissionDenied and calls that couldn't be checked fail with
+// Unavailable (if cbauth database is stale or ns_server is
+// temporarily unreachable, see cbauth.ErrorHTTPStatus) or Internal.
+func StreamServerInterceptor(opts Options) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticate(ss.Context(), info.FullMethod, &opts)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &credsStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+type credsStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *credsStream) Context() context.Context {
+	return s.ctx
+}
+
+// metadataRequest builds http request that carries metadata of
+// incoming call as headers, so that it can be passed to
+// AuthWebCreds.
+func metadataRequest(ctx context.Context, fullMethod string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", "/"+strings.TrimPrefix(fullMethod, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for k, vs := range md {
+		if strings.HasPrefix(k, ":") || strings.HasPrefix(k, "grpc-") || strings.HasSuffix(k, "-bin") {
+			continue
+		}
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if p.Addr != nil {
+			req.RemoteAddr = p.Addr.String()
+		}
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			req.TLS = &info.State
+		}
+	}
+	return req, nil
+}
+
+func authenticate(ctx context.Context, fullMethod string, opts *Options) (context.Context, error) {
+	req, err := metadataRequest(ctx, fullMethod)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	var creds cbauth.Creds
+	err = cbauth.WithAuthenticator(opts.Authenticator, func(a cbauth.Authenticator) (err error) {
+		creds, err = a.AuthWebCredsContext(ctx, req)
+		return
+	})
+	if err != nil {
+		return nil, authError(err)
+	}
+	if creds == cbauth.NoAccessCreds {
+		return nil, status.Errorf(codes.Unauthenticated, "unauthenticated (correlation id: %s)", cbauth.CorrelationID(req))
+	}
+	ok := true
+	if opts.Permission != "" {
+		ok, err = cbauth.HasPermission(creds, opts.Permission)
+	}
+	if err == nil && ok && opts.Authorize != nil {
+		ok, err = opts.Authorize(creds, fullMethod)
+	}
+	if err != nil {
+		return nil, authError(err)
+	}
+	if !ok {
+		return nil, status.Error(codes.PermissionDenied, "forbidden")
+	}
+	return cbauth.ContextWithCreds(ctx, creds), nil
+}
+
+// authError converts error returned by auth or permission check to
+// gRPC status error.
+func authError(err error) error {
+	if cbauth.ErrorHTTPStatus(err) == http.StatusServiceUnavailable {
+		return status.Error(codes.Unavailable, "auth database is not available")
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.Internal, "internal server error")
+}
+
+// ServiceCreds struct implements credentials.PerRPCCredentials that
+// authenticate outgoing calls to service of the cluster with creds
+// returned by GetMemcachedServiceAuth for its host:port. Creds are
+// looked up on every call, so rotated passwords are picked up
+// automatically.
+type ServiceCreds struct {
+	// Authenticator is used to get creds. Default authenticator is
+	// used if it's nil.
+	Authenticator cbauth.Authenticator
+	// HostPort of service calls are made to.
+	HostPort string
+	// RequireTLS makes grpc refuse to send creds over insecure
+	// connections.
+	RequireTLS bool
+}
+
+// GetRequestMetadata returns basic auth "authorization" metadata.
+func (c *ServiceCreds) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	var user, pwd string
+	err := cbauth.WithAuthenticator(c.Authenticator, func(a cbauth.Authenticator) (err error) {
+		user, pwd, err = a.GetMemcachedServiceAuthContext(ctx, c.HostPort)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pwd)),
+	}, nil
+}
+
+// RequireTransportSecurity returns value of RequireTLS.
+func (c *ServiceCreds) RequireTransportSecurity() bool {
+	return c.RequireTLS
+}
+
+var _ credentials.PerRPCCredentials = (*ServiceCreds)(nil)
@@ -0,0 +1,147 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcauth
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/couchbase/cbauth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type testCreds struct {
+	cbauth.Creds
+	name  string
+	admin bool
+}
+
+func (c *testCreds) Name() string { return c.name }
+
+func (c *testCreds) IsAdmin() (bool, error) { return c.admin, nil }
+
+type testAuthenticator struct {
+	cbauth.Authenticator
+	users map[string]cbauth.Creds
+}
+
+func (a *testAuthenticator) AuthWebCredsContext(ctx context.Context, req *http.Request) (cbauth.Creds, error) {
+	user, _, _ := req.BasicAuth()
+	switch user {
+	case "broken":
+		return nil, errors.New("boom")
+	case "stale":
+		return nil, &cbauth.DBStaleError{}
+	}
+	if c, ok := a.users[user]; ok {
+		return c, nil
+	}
+	return cbauth.NoAccessCreds, nil
+}
+
+func (a *testAuthenticator) GetMemcachedServiceAuthContext(ctx context.Context, hostport string) (string, string, error) {
+	if hostport != "127.0.0.1:11210" {
+		return "", "", errors.New("unknown service")
+	}
+	return "@svc", "pwd", nil
+}
+
+type testStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *testStream) Context() context.Context { return s.ctx }
+
+func TestInterceptors(t *testing.T) {
+	a := &testAuthenticator{users: map[string]cbauth.Creds{
+		"admin": &testCreds{name: "admin", admin: true},
+		"user":  &testCreds{name: "user"},
+	}}
+	opts := Options{Authenticator: a, Permission: cbauth.PermissionAdmin}
+	unary := UnaryServerInterceptor(opts)
+	stream := StreamServerInterceptor(opts)
+
+	a.users["@svc"] = &testCreds{name: "@svc", admin: true}
+	clientCreds := &ServiceCreds{Authenticator: a, HostPort: "127.0.0.1:11210"}
+	incoming := func(user string) context.Context {
+		md := metadata.MD{}
+		switch user {
+		case "":
+		case "@svc":
+			m, err := clientCreds.GetRequestMetadata(context.Background())
+			if err != nil {
+				t.Fatalf("GetRequestMetadata failed: %s", err)
+			}
+			md = metadata.New(m)
+		default:
+			md.Set("authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":pwd")))
+		}
+		return metadata.NewIncomingContext(context.Background(), md)
+	}
+
+	for _, tc := range []struct {
+		user string
+		code codes.Code
+	}{
+		{"admin", codes.OK},
+		{"@svc", codes.OK},
+		{"user", codes.PermissionDenied},
+		{"", codes.Unauthenticated},
+		{"nobody", codes.Unauthenticated},
+		{"broken", codes.Internal},
+		{"stale", codes.Unavailable},
+	} {
+		var name string
+		_, err := unary(incoming(tc.user), nil, &grpc.UnaryServerInfo{FullMethod: "/svc.Svc/Get"},
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				c, _ := cbauth.CredsFromContext(ctx)
+				name = c.Name()
+				return nil, nil
+			})
+		if status.Code(err) != tc.code {
+			t.Fatalf("Unexpected unary result for %s: %v", tc.user, err)
+		}
+		if tc.code == codes.OK && name != tc.user {
+			t.Fatalf("Expected creds of %s in context. Got %s", tc.user, name)
+		}
+
+		name = ""
+		err = stream(nil, &testStream{ctx: incoming(tc.user)}, &grpc.StreamServerInfo{FullMethod: "/svc.Svc/Watch"},
+			func(srv interface{}, ss grpc.ServerStream) error {
+				c, _ := cbauth.CredsFromContext(ss.Context())
+				name = c.Name()
+				return nil
+			})
+		if status.Code(err) != tc.code {
+			t.Fatalf("Unexpected stream result for %s: %v", tc.user, err)
+		}
+		if tc.code == codes.OK && name != tc.user {
+			t.Fatalf("Expected creds of %s in stream context. Got %s", tc.user, name)
+		}
+	}
+
+	_, err := (&ServiceCreds{Authenticator: a, HostPort: "bad:1"}).GetRequestMetadata(context.Background())
+	if err == nil {
+		t.Fatalf("Expect GetRequestMetadata to fail for unknown service")
+	}
+}
@@ -0,0 +1,162 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// HostPolicy struct configures which hosts incoming requests may be
+// addressed to (see Authenticator.ValidateHost). Host names of local
+// node (internal and alternate), "localhost" and IP literals are
+// always allowed. DNS rebinding relies on attacker controlled host
+// name resolving to node's address, so restricting host names
+// protects browser exposed ports from having creds (e.g. cookies)
+// of node's users misused by pages of other origins.
+type HostPolicy struct {
+	// AllowedHosts are additional host names (e.g. names of load
+	// balancers) requests may be addressed to. Names starting
+	// with "." match every subdomain of given domain.
+	AllowedHosts []string
+	// StrictIPs makes IP literals allowed only if they are listed
+	// in AllowedHosts or are addresses of local node (or
+	// loopback).
+	StrictIPs bool
+	// CheckPort requires port of Host header, if given, to be one
+	// of ports of local node.
+	CheckPort bool
+}
+
+// HostNotAllowedError is returned by ValidateHost for requests that
+// are addressed to host that is not allowed by policy.
+type HostNotAllowedError struct {
+	Host string
+}
+
+func (e *HostNotAllowedError) Error() string {
+	return fmt.Sprintf("requests to host `%s' are not allowed", e.Host)
+}
+
+// normalizeHost lowercases host names and formats IP literals
+// canonically, so that they can be compared.
+func normalizeHost(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func (p *HostPolicy) allowsName(host string, local []string) bool {
+	for _, h := range local {
+		if normalizeHost(h) == host {
+			return true
+		}
+	}
+	for _, h := range p.AllowedHosts {
+		h = normalizeHost(h)
+		if h == host || (strings.HasPrefix(h, ".") && strings.HasSuffix(host, h)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *HostPolicy) check(hostport string, local []string, ports []int) error {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]"), ""
+	}
+	host = normalizeHost(host)
+	allowed := host == "localhost"
+	if ip := net.ParseIP(host); ip != nil {
+		allowed = !p.StrictIPs || ip.IsLoopback()
+	}
+	if !allowed && !p.allowsName(host, local) {
+		return &HostNotAllowedError{hostport}
+	}
+	if !p.CheckPort || port == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(port)
+	if err == nil {
+		for _, p := range ports {
+			if p == n {
+				return nil
+			}
+		}
+	}
+	return &HostNotAllowedError{hostport}
+}
+
+func (a *authImpl) ValidateHost(req *http.Request, p *HostPolicy) error {
+	if p == nil {
+		p = &HostPolicy{}
+	}
+	local, ports, err := cbauthimpl.LocalAddresses(a.svc)
+	if err != nil {
+		return err
+	}
+	if req.Host == "" {
+		return &HostNotAllowedError{}
+	}
+	if err := p.check(req.Host, local, ports); err != nil {
+		return err
+	}
+	if req.URL != nil && req.URL.Host != "" && req.URL.Host != req.Host {
+		return p.check(req.URL.Host, local, ports)
+	}
+	return nil
+}
+
+// RequireValidHost returns handler that passes to next handler only
+// requests that are addressed to hosts allowed by given policy (see
+// Authenticator.ValidateHost). Other requests get 421 Misdirected
+// Request. Authenticator a is used to find out addresses of local
+// node. Default authenticator is used if it's nil.
+func RequireValidHost(next http.Handler, a Authenticator, p HostPolicy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		err := WithAuthenticator(a, func(a Authenticator) error {
+			return a.ValidateHost(req, &p)
+		})
+		if err != nil {
+			sendHostError(w, err)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// SendHostError sends response for error returned by ValidateHost:
+// 421 if host is not allowed and same response as SendAuthError
+// otherwise.
+func SendHostError(w http.ResponseWriter, err error) {
+	sendHostError(w, err)
+}
+
+func sendHostError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*HostNotAllowedError); ok {
+		recordError("rejected request: %s", err)
+		http.Error(w, "unexpected host", http.StatusMisdirectedRequest)
+		return
+	}
+	sendAuthError(w, err)
+}
@@ -0,0 +1,422 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jwks implements fetching and caching of JSON Web Key Sets
+// (RFC 7517) published by external token issuers. KeySet keeps keys
+// of all configured JWKS urls in memory and periodically refreshes
+// them in background, so that validation of externally issued tokens
+// keeps working across key rollovers of identity provider.
+package jwks
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrKeyNotFound is returned from KeySet.Key when none of configured
+// key sets has key with given id.
+var ErrKeyNotFound = errors.New("jwks: key not found")
+
+// ErrClosed is returned from KeySet.Key after KeySet was closed.
+var ErrClosed = errors.New("jwks: key set is closed")
+
+// maxDocumentSize limits size of fetched JWKS documents.
+const maxDocumentSize = 1 << 20
+
+// Key struct describes single public key obtained from JWKS
+// document.
+type Key struct {
+	// ID is key id ("kid") of key. It is matched against "kid"
+	// header of tokens.
+	ID string
+	// Algorithm is optional "alg" attribute of key.
+	Algorithm string
+	// Public is actual public key. It is one of *rsa.PublicKey,
+	// *ecdsa.PublicKey or ed25519.PublicKey.
+	Public crypto.PublicKey
+}
+
+// Config struct describes KeySet configuration.
+type Config struct {
+	// URLs is list of JWKS urls to poll.
+	URLs []string
+	// RefreshInterval specifies how often key sets are
+	// refetched when everything is fine. Default is 1 hour.
+	RefreshInterval time.Duration
+	// MinRefreshInterval is minimal period of time between
+	// fetches of same url. It rate-limits refetches caused by
+	// lookups of unknown key ids. Default is 10 seconds.
+	MinRefreshInterval time.Duration
+	// MaxBackoff caps exponentially growing delay between
+	// retries of failed fetches. Default is 5 minutes.
+	MaxBackoff time.Duration
+	// Client is http client used to fetch key sets. Default is
+	// http.DefaultClient.
+	Client *http.Client
+	// LogPrint function, if non-nil, is used to log fetch
+	// errors. log.Print function is one suitable
+	// implementation.
+	LogPrint func(args ...interface{})
+}
+
+type source struct {
+	url       string
+	keys      map[string]*Key
+	lastFetch time.Time
+	lastErr   error
+	failures  uint
+	kick      chan struct{}
+	// inflight is closed once refetch requested by lookup of
+	// unknown key is done
+	inflight chan struct{}
+}
+
+// KeySet type keeps keys of configured JWKS urls and keeps them
+// fresh.
+type KeySet struct {
+	cfg     Config
+	l       sync.Mutex
+	sources []*source
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func (cfg *Config) setDefaults() {
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = time.Hour
+	}
+	if cfg.MinRefreshInterval <= 0 {
+		cfg.MinRefreshInterval = 10 * time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 5 * time.Minute
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+}
+
+// NewKeySet constructs KeySet for given configuration and starts
+// background refresh of all configured urls. Initial fetch is
+// performed asynchronously, so NewKeySet succeeds even if urls
+// are not reachable yet. Close method must be called to stop
+// background refresh.
+func NewKeySet(cfg Config) (*KeySet, error) {
+	if len(cfg.URLs) == 0 {
+		return nil, errors.New("jwks: at least one url is required")
+	}
+	cfg.setDefaults()
+	ks := &KeySet{cfg: cfg, done: make(chan struct{})}
+	for _, u := range cfg.URLs {
+		s := &source{url: u, kick: make(chan struct{})}
+		ks.sources = append(ks.sources, s)
+	}
+	for _, s := range ks.sources {
+		ks.wg.Add(1)
+		go ks.runSource(s)
+	}
+	return ks, nil
+}
+
+// Close stops background refresh. Key lookups on closed KeySet
+// return ErrClosed.
+func (ks *KeySet) Close() {
+	ks.l.Lock()
+	select {
+	case <-ks.done:
+		ks.l.Unlock()
+		return
+	default:
+	}
+	close(ks.done)
+	ks.l.Unlock()
+	ks.wg.Wait()
+}
+
+func (ks *KeySet) logPrint(args ...interface{}) {
+	if ks.cfg.LogPrint != nil {
+		ks.cfg.LogPrint(args...)
+	}
+}
+
+func (ks *KeySet) backoff(failures uint) time.Duration {
+	d := time.Second
+	for i := uint(1); i < failures && d < ks.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > ks.cfg.MaxBackoff {
+		d = ks.cfg.MaxBackoff
+	}
+	return d
+}
+
+func (ks *KeySet) runSource(s *source) {
+	defer ks.wg.Done()
+	kicked := false
+	for {
+		err := ks.refresh(s)
+
+		ks.l.Lock()
+		if kicked {
+			close(s.inflight)
+			s.inflight = nil
+			kicked = false
+		}
+		delay := ks.cfg.RefreshInterval
+		if err != nil {
+			delay = ks.backoff(s.failures)
+		}
+		ks.l.Unlock()
+
+		if err != nil {
+			ks.logPrint(fmt.Sprintf("jwks: failed to fetch `%s' (%s). Will retry in %s", s.url, err, delay))
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ks.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-s.kick:
+			timer.Stop()
+			kicked = true
+		}
+	}
+}
+
+func (ks *KeySet) refresh(s *source) error {
+	keys, err := fetch(ks.cfg.Client, s.url)
+
+	ks.l.Lock()
+	defer ks.l.Unlock()
+	s.lastFetch = time.Now()
+	s.lastErr = err
+	if err != nil {
+		// keep previously fetched keys, so that temporary
+		// unavailability of identity provider doesn't break
+		// validation of tokens
+		s.failures++
+		return err
+	}
+	s.failures = 0
+	s.keys = keys
+	return nil
+}
+
+func (ks *KeySet) lookupLocked(kid string) *Key {
+	for _, s := range ks.sources {
+		if k, ok := s.keys[kid]; ok {
+			return k
+		}
+	}
+	return nil
+}
+
+// Key method returns key with given id. If key is not known, key
+// sets that were not fetched during last MinRefreshInterval are
+// refetched, so that keys that were just rotated in by identity
+// provider are recognised without waiting for periodic refresh.
+// Concurrent lookups of unknown keys share refetches.
+func (ks *KeySet) Key(kid string) (*Key, error) {
+	ks.l.Lock()
+	select {
+	case <-ks.done:
+		ks.l.Unlock()
+		return nil, ErrClosed
+	default:
+	}
+	if k := ks.lookupLocked(kid); k != nil {
+		ks.l.Unlock()
+		return k, nil
+	}
+	var toKick []*source
+	var toWait []chan struct{}
+	for _, s := range ks.sources {
+		if s.inflight == nil && (s.lastFetch.IsZero() || time.Since(s.lastFetch) >= ks.cfg.MinRefreshInterval) {
+			s.inflight = make(chan struct{})
+			toKick = append(toKick, s)
+		}
+		if s.inflight != nil {
+			toWait = append(toWait, s.inflight)
+		}
+	}
+	ks.l.Unlock()
+
+	for _, s := range toKick {
+		select {
+		case s.kick <- struct{}{}:
+		case <-ks.done:
+			return nil, ErrClosed
+		}
+	}
+	for _, w := range toWait {
+		select {
+		case <-w:
+		case <-ks.done:
+			return nil, ErrClosed
+		}
+	}
+
+	ks.l.Lock()
+	defer ks.l.Unlock()
+	if k := ks.lookupLocked(kid); k != nil {
+		return k, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+// LastErrors returns last fetch error of every url that failed to
+// be fetched last time. It is intended for diagnostics.
+func (ks *KeySet) LastErrors() map[string]error {
+	ks.l.Lock()
+	defer ks.l.Unlock()
+	rv := make(map[string]error)
+	for _, s := range ks.sources {
+		if s.lastErr != nil {
+			rv[s.url] = s.lastErr
+		}
+	}
+	return rv
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func fetch(client *http.Client, url string) (map[string]*Key, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDocumentSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxDocumentSize {
+		return nil, fmt.Errorf("document is larger than %d bytes", maxDocumentSize)
+	}
+	return Parse(body)
+}
+
+// Parse parses given JWKS document. Keys that are not signing keys,
+// have unsupported types or are malformed are skipped (as RFC 7517
+// section 5 suggests), so that one bad key doesn't make whole key
+// set unusable.
+func Parse(body []byte) (map[string]*Key, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	rv := make(map[string]*Key)
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil || pub == nil {
+			continue
+		}
+		rv[k.Kid] = &Key{ID: k.Kid, Algorithm: k.Alg, Public: pub}
+	}
+	return rv, nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("rsa exponent is too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, nil
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("bad ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
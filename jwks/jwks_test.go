@@ -0,0 +1,184 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jwks
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func mkRSAJWK(t *testing.T, kid string) (string, *rsa.PublicKey) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := &priv.PublicKey
+	n := base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+	e := base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	return fmt.Sprintf(`{"kty":"RSA","kid":"%s","use":"sig","alg":"RS256","n":"%s","e":"%s"}`, kid, n, e), pub
+}
+
+type fakeIdP struct {
+	l       sync.Mutex
+	keys    string
+	fail    bool
+	fetches int
+}
+
+func (idp *fakeIdP) set(keys string, fail bool) {
+	idp.l.Lock()
+	idp.keys = keys
+	idp.fail = fail
+	idp.l.Unlock()
+}
+
+func (idp *fakeIdP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	idp.l.Lock()
+	defer idp.l.Unlock()
+	idp.fetches++
+	if idp.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, `{"keys":[%s]}`, idp.keys)
+}
+
+func TestParse(t *testing.T) {
+	k1, pub := mkRSAJWK(t, "k1")
+	keys, err := Parse([]byte(`{"keys":[` + k1 + `,{"kty":"RSA","kid":"enc","use":"enc"},{"kty":"oct","kid":"sym"},` +
+		`{"kty":"RSA","kid":"bad","n":"!!!","e":"AQAB"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("Expected only well formed signing rsa key to be parsed. Got: %v", keys)
+	}
+	got, ok := keys["k1"].Public.(*rsa.PublicKey)
+	if !ok || got.N.Cmp(pub.N) != 0 || got.E != pub.E {
+		t.Fatalf("Parsed key doesn't match. Got: %v", keys["k1"])
+	}
+}
+
+func TestConcurrentLookups(t *testing.T) {
+	k1, _ := mkRSAJWK(t, "k1")
+	var fetches, gated int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&gated) != 0 {
+			atomic.AddInt32(&fetches, 1)
+			<-release
+		}
+		fmt.Fprintf(w, `{"keys":[%s]}`, k1)
+	}))
+	defer srv.Close()
+
+	ks, err := NewKeySet(Config{URLs: []string{srv.URL}, MinRefreshInterval: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ks.Close()
+	if _, err := ks.Key("k1"); err != nil {
+		t.Fatalf("Expected k1 to be found. Got: %v", err)
+	}
+	atomic.StoreInt32(&gated, 1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := ks.Key("unknown"); err != ErrKeyNotFound {
+				t.Errorf("Expected ErrKeyNotFound. Got: %v", err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Fatalf("Expected lookups to share single refetch. Got %d fetches", n)
+	}
+}
+
+func TestLargeDocument(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"keys":[],"pad":"%s"}`, strings.Repeat("x", maxDocumentSize))
+	}))
+	defer srv.Close()
+	if _, err := fetch(http.DefaultClient, srv.URL); err == nil {
+		t.Fatal("Expected oversized document to be refused")
+	}
+}
+
+func TestRotationAndFailures(t *testing.T) {
+	k1, _ := mkRSAJWK(t, "k1")
+	k2, _ := mkRSAJWK(t, "k2")
+
+	idp := &fakeIdP{keys: k1}
+	srv := httptest.NewServer(idp)
+	defer srv.Close()
+
+	ks, err := NewKeySet(Config{
+		URLs:               []string{srv.URL},
+		RefreshInterval:    time.Hour,
+		MinRefreshInterval: time.Nanosecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ks.Close()
+
+	if _, err := ks.Key("k1"); err != nil {
+		t.Fatalf("Expected k1 to be found. Got: %v", err)
+	}
+
+	// identity provider rotates keys: unknown kid must trigger
+	// refetch
+	idp.set(k2, false)
+	if _, err := ks.Key("k2"); err != nil {
+		t.Fatalf("Expected rotated in k2 to be found. Got: %v", err)
+	}
+	if _, err := ks.Key("k1"); err != ErrKeyNotFound {
+		t.Fatalf("Expected rotated out k1 to be gone. Got: %v", err)
+	}
+
+	// failed fetches must not drop previously known keys
+	idp.set("", true)
+	if _, err := ks.Key("unknown"); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+	}
+	if _, err := ks.Key("k2"); err != nil {
+		t.Fatalf("Expected k2 to survive failed fetch. Got: %v", err)
+	}
+	if errs := ks.LastErrors(); errs[srv.URL] == nil {
+		t.Fatalf("Expected fetch error to be recorded. Got: %v", errs)
+	}
+
+	ks.Close()
+	if _, err := ks.Key("k2"); err != ErrClosed {
+		t.Fatalf("Expected ErrClosed. Got: %v", err)
+	}
+}
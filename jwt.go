@@ -0,0 +1,293 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+	"github.com/couchbase/cbauth/jwks"
+	"github.com/couchbase/cbauth/rbac"
+)
+
+// JWTClockSkew is how much clocks of token issuers and this node
+// may differ when "exp" and "nbf" claims of JWT bearer tokens are
+// checked.
+var JWTClockSkew = time.Minute
+
+// JWTIssuer type describes trusted issuer of JWT bearer tokens.
+type JWTIssuer = cbauthimpl.JWTIssuer
+
+// JWTSettings type describes JWT bearer token auth settings of the
+// cluster.
+type JWTSettings = cbauthimpl.JWTSettings
+
+// jwtKeySets keeps key sets of configured JWKS urls. Key sets are
+// created when first token of issuer is verified and are closed
+// when issuer's url is no longer configured.
+type jwtKeySets struct {
+	sync.Mutex
+	sets map[string]*jwks.KeySet
+}
+
+func (k *jwtKeySets) get(settings *JWTSettings, url string) (*jwks.KeySet, error) {
+	k.Lock()
+	defer k.Unlock()
+	for u, ks := range k.sets {
+		configured := false
+		for i := range settings.Issuers {
+			configured = configured || settings.Issuers[i].JWKSURL == u
+		}
+		if !configured {
+			ks.Close()
+			delete(k.sets, u)
+		}
+	}
+	if ks := k.sets[url]; ks != nil {
+		return ks, nil
+	}
+	ks, err := jwks.NewKeySet(jwks.Config{URLs: []string{url},
+		LogPrint: func(args ...interface{}) { tracef("", "%s", fmt.Sprint(args...)) }})
+	if err != nil {
+		return nil, err
+	}
+	if k.sets == nil {
+		k.sets = make(map[string]*jwks.KeySet)
+	}
+	k.sets[url] = ks
+	return ks, nil
+}
+
+// jwtBearerToken returns token of JWT bearer auth of given request.
+// Bearer tokens are only claimed by cbauth if some issuers are
+// configured, so that such requests can be handled by CredsVerifier
+// otherwise.
+func (a *authImpl) jwtBearerToken(req *http.Request) (string, *JWTSettings, bool) {
+	hdr := req.Header.Get("Authorization")
+	if len(hdr) < 7 || !strings.EqualFold(hdr[:7], "bearer ") {
+		return "", nil, false
+	}
+	settings, err := cbauthimpl.GetJWTSettings(a.svc)
+	if err != nil || len(settings.Issuers) == 0 {
+		return "", nil, false
+	}
+	return strings.TrimSpace(hdr[7:]), &settings, true
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+func verifyJWTSignature(alg string, pub crypto.PublicKey, signed string, sig []byte) error {
+	if alg == "EdDSA" {
+		if k, ok := pub.(ed25519.PublicKey); ok && ed25519.Verify(k, []byte(signed), sig) {
+			return nil
+		}
+		return errors.New("bad signature")
+	}
+	hash, ok := jwtHashes[alg]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm `%s'", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		switch alg[0] {
+		case 'R':
+			return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+		case 'P':
+			return rsa.VerifyPSS(k, hash, digest, sig,
+				&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[0] == 'E' && len(sig) == 2*size {
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if ecdsa.Verify(k, digest, r, s) {
+				return nil
+			}
+			return errors.New("bad signature")
+		}
+	}
+	return fmt.Errorf("key does not match algorithm `%s'", alg)
+}
+
+func jwtStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var rv []string
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				rv = append(rv, s)
+			}
+		}
+		return rv
+	}
+	return nil
+}
+
+func jwtTime(claims map[string]interface{}, name string) (time.Time, bool) {
+	v, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(v), 0), true
+}
+
+func hasAnyString(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeJWTPart(s string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifyJWT verifies signature and standard claims of given token
+// and returns claims that creds are derived from.
+func (a *authImpl) verifyJWT(settings *JWTSettings, token string) (*cbauthimpl.JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var hdr jwtHeader
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[0], &hdr); err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %v", err)
+	}
+
+	issName, _ := claims["iss"].(string)
+	var iss *JWTIssuer
+	for i := range settings.Issuers {
+		if settings.Issuers[i].Name == issName {
+			iss = &settings.Issuers[i]
+		}
+	}
+	if iss == nil {
+		return nil, fmt.Errorf("untrusted issuer `%s'", issName)
+	}
+	if len(iss.Algorithms) > 0 && !hasAnyString(iss.Algorithms, []string{hdr.Alg}) {
+		return nil, fmt.Errorf("algorithm `%s' is not accepted", hdr.Alg)
+	}
+	ks, err := a.jwtKeySets.get(settings, iss.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ks.Key(hdr.Kid)
+	if err != nil {
+		return nil, fmt.Errorf("key `%s': %v", hdr.Kid, err)
+	}
+	if key.Algorithm != "" && key.Algorithm != hdr.Alg {
+		return nil, fmt.Errorf("key `%s' does not match algorithm `%s'", hdr.Kid, hdr.Alg)
+	}
+	if err := verifyJWTSignature(hdr.Alg, key.Public, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	exp, ok := jwtTime(claims, "exp")
+	if !ok || now.After(exp.Add(JWTClockSkew)) {
+		return nil, errors.New("token is expired")
+	}
+	if nbf, ok := jwtTime(claims, "nbf"); ok && now.Add(JWTClockSkew).Before(nbf) {
+		return nil, errors.New("token is not valid yet")
+	}
+	if len(iss.Audiences) > 0 && !hasAnyString(iss.Audiences, jwtStrings(claims["aud"])) {
+		return nil, errors.New("token is issued for other audience")
+	}
+
+	subClaim := iss.SubClaim
+	if subClaim == "" {
+		subClaim = "sub"
+	}
+	rv := &cbauthimpl.JWTClaims{Issuer: issName, Expires: exp,
+		TokenID: cbauthimpl.TokenID(token)}
+	rv.User, _ = claims[subClaim].(string)
+	if iss.GroupsClaim != "" {
+		rv.Groups = jwtStrings(claims[iss.GroupsClaim])
+	}
+	if iss.RolesClaim != "" {
+		for _, s := range jwtStrings(claims[iss.RolesClaim]) {
+			role, err := rbac.ParseRole(s)
+			if err != nil {
+				tracef(rv.User, "ignoring role of token of %s: %v", TagUserData(rv.User), err)
+				continue
+			}
+			rv.Roles = append(rv.Roles, role)
+		}
+	}
+	return rv, nil
+}
+
+func doJWTAuth(ctx context.Context, a *authImpl, req *http.Request, token string, settings *JWTSettings) (Creds, error) {
+	claims, err := a.verifyJWT(settings, token)
+	if err != nil {
+		tracef("", "jwt auth of request to %s was rejected: %v", req.URL.Path, err)
+		return NoAccessCreds, nil
+	}
+	ci, err := cbauthimpl.JWTCreds(a.svc, claims)
+	if err != nil {
+		return nil, err
+	}
+	if ci == nil {
+		tracef("", "jwt auth of request to %s was rejected: issuer `%s' is not trusted", req.URL.Path, claims.Issuer)
+		return NoAccessCreds, nil
+	}
+	tracef(ci.Name(), "jwt auth of %s to %s succeeded", TagUserData(ci.Name()), req.URL.Path)
+	return ci, nil
+}
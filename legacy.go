@@ -0,0 +1,63 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// LegacyAuthLogPrint function, if non-nil, is used to log
+// deprecation warnings about legacy bucket name and password auth
+// unless Logger is set (see SetLogger), in which case they are passed
+// to Logger at warning level. Every user is only logged once.
+var LegacyAuthLogPrint func(args ...interface{})
+
+// maxLoggedLegacyUsers limits number of users deprecation warnings
+// are remembered for.
+const maxLoggedLegacyUsers = 1024
+
+var legacyAuths uint64
+
+var legacyLogged struct {
+	sync.Mutex
+	users map[string]bool
+}
+
+// LegacyAuthCount returns number of successful authentications via
+// deprecated bucket name and password auth (see Creds.IsLegacy) done
+// by this process. Services may export it as metric to detect
+// clients that need migration.
+func LegacyAuthCount() uint64 {
+	return atomic.LoadUint64(&legacyAuths)
+}
+
+func noteLegacyAuth(user string) {
+	atomic.AddUint64(&legacyAuths, 1)
+
+	legacyLogged.Lock()
+	if legacyLogged.users == nil || len(legacyLogged.users) >= maxLoggedLegacyUsers {
+		legacyLogged.users = make(map[string]bool)
+	}
+	logged := legacyLogged.users[user]
+	legacyLogged.users[user] = true
+	legacyLogged.Unlock()
+
+	if !logged {
+		logVia(LegacyAuthLogPrint, logWarn, "cbauth: deprecated bucket password auth is used by "+TagUserData(user),
+			"user", TagUserData(user))
+	}
+}
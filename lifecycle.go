@@ -0,0 +1,175 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// LifecycleStage type represents stage of lifecycle of default
+// authenticator.
+type LifecycleStage string
+
+// Lifecycle stages that are reported to LifecycleObserver.
+const (
+	// LifecycleInitializing is reported when default
+	// authenticator is constructed.
+	LifecycleInitializing LifecycleStage = "initializing"
+	// LifecycleConnected is reported every time revrpc
+	// connection to ns_server is established.
+	LifecycleConnected LifecycleStage = "connected"
+	// LifecycleSynced is reported when first cache update is
+	// applied after initialization or after cache became stale.
+	LifecycleSynced LifecycleStage = "synced"
+	// LifecycleDegraded is reported when synced cache becomes
+	// stale (e.g. revrpc connection is lost or update is
+	// rejected).
+	LifecycleDegraded LifecycleStage = "degraded"
+	// LifecycleStopped is reported when cbauth gives up on
+	// ns_server connection. FatalPolicy is applied right after
+	// that (see SetFatalPolicy).
+	LifecycleStopped LifecycleStage = "stopped"
+)
+
+// LifecycleEvent struct describes transition of default
+// authenticator to some lifecycle stage.
+type LifecycleEvent struct {
+	Stage LifecycleStage
+	At    time.Time
+	// Err is reason of LifecycleDegraded and LifecycleStopped
+	// transitions
+	Err error
+}
+
+func (e *LifecycleEvent) String() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s", e.Stage, e.Err)
+	}
+	return string(e.Stage)
+}
+
+// LifecycleObserver is notified about lifecycle events of default
+// authenticator. ObserveLifecycle calls are serialized, so they must
+// be cheap.
+type LifecycleObserver interface {
+	ObserveLifecycle(e *LifecycleEvent)
+}
+
+// LifecycleObserverFunc type adapts function to LifecycleObserver
+// interface.
+type LifecycleObserverFunc func(e *LifecycleEvent)
+
+// ObserveLifecycle method simply calls "this" function.
+func (f LifecycleObserverFunc) ObserveLifecycle(e *LifecycleEvent) {
+	f(e)
+}
+
+// LifecycleLogPrint function, if non-nil, is used to log lifecycle
+// events unless Logger is set (see SetLogger), in which case they are
+// passed to Logger at info level, or at warning level if they carry
+// error.
+var LifecycleLogPrint func(args ...interface{})
+
+var lifecycleState struct {
+	sync.Mutex
+	observer LifecycleObserver
+	events   []LifecycleEvent
+}
+
+// lifecycleNotifyL serializes observer calls (and logging) of
+// lifecycle events. Observers are called without lifecycleState
+// held, so that they can e.g. dump diagnostics.
+var lifecycleNotifyL sync.Mutex
+
+// SetLifecycleObserver sets (or clears if nil is passed) observer of
+// lifecycle events. Since default authenticator is constructed
+// during package initialization, before observer can be set, up to
+// maxDiagEvents most recent events are replayed to new observer
+// first.
+func SetLifecycleObserver(o LifecycleObserver) {
+	lifecycleNotifyL.Lock()
+	defer lifecycleNotifyL.Unlock()
+	lifecycleState.Lock()
+	lifecycleState.observer = o
+	events := append([]LifecycleEvent(nil), lifecycleState.events...)
+	lifecycleState.Unlock()
+	if o == nil {
+		return
+	}
+	for i := range events {
+		o.ObserveLifecycle(&events[i])
+	}
+}
+
+func lifecycleEvents() []LifecycleEvent {
+	lifecycleState.Lock()
+	defer lifecycleState.Unlock()
+	return append([]LifecycleEvent(nil), lifecycleState.events...)
+}
+
+func emitLifecycle(stage LifecycleStage, err error) {
+	e := LifecycleEvent{Stage: stage, At: time.Now(), Err: err}
+	lifecycleNotifyL.Lock()
+	defer lifecycleNotifyL.Unlock()
+	lifecycleState.Lock()
+	if len(lifecycleState.events) == maxDiagEvents {
+		lifecycleState.events = lifecycleState.events[1:]
+	}
+	lifecycleState.events = append(lifecycleState.events, e)
+	o := lifecycleState.observer
+	lifecycleState.Unlock()
+
+	level, fields := logInfo, []interface{}{"stage", string(e.Stage)}
+	if e.Err != nil {
+		level, fields = logWarn, append(fields, "error", e.Err)
+	}
+	logVia(LifecycleLogPrint, level, "cbauth: lifecycle: "+e.String(), fields...)
+	if o != nil {
+		o.ObserveLifecycle(&e)
+	}
+}
+
+// lifecycleSvc wraps cbauth service that is registered with revrpc
+// to notice when cache gets synced.
+type lifecycleSvc struct {
+	*cbauthimpl.Svc
+	// synced is 1 if update was applied since last
+	// LifecycleDegraded transition
+	synced int32
+}
+
+// UpdateDB method applies cache update and reports
+// LifecycleSynced if it is first update since cache became stale.
+func (s *lifecycleSvc) UpdateDB(c *cbauthimpl.Cache, outparam *bool) error {
+	err := s.Svc.UpdateDB(c, outparam)
+	if err == nil && atomic.CompareAndSwapInt32(&s.synced, 0, 1) {
+		emitLifecycle(LifecycleSynced, nil)
+	}
+	return err
+}
+
+// degraded method reports LifecycleDegraded if cache was synced, so
+// that repeated failures to reconnect are only reported once.
+func (s *lifecycleSvc) degraded(err error) {
+	if atomic.CompareAndSwapInt32(&s.synced, 1, 0) {
+		emitLifecycle(LifecycleDegraded, err)
+	}
+}
@@ -0,0 +1,146 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+)
+
+// Logger interface describes sinks of cbauth log messages. Fields
+// are alternating keys and values, as in log/slog; *slog.Logger
+// implements Logger (see SlogLogger).
+type Logger interface {
+	Debug(msg string, fields ...interface{})
+	Info(msg string, fields ...interface{})
+	Warn(msg string, fields ...interface{})
+	Error(msg string, fields ...interface{})
+}
+
+var _ Logger = (*slog.Logger)(nil)
+
+type loggerBox struct{ l Logger }
+
+var logger atomic.Value
+
+// SetLogger sets logger that cbauth messages (auth tracing,
+// lifecycle events, shadow verification mismatches, deprecation
+// warnings, revrpc retries) are passed to. Once logger is set, it
+// takes precedence over *LogPrint variables (e.g. TraceLogPrint),
+// which are only used while no logger is set. nil restores default
+// logger that passes messages and their fields to log.Print.
+func SetLogger(l Logger) {
+	logger.Store(loggerBox{l})
+}
+
+// GetLogger returns logger set via SetLogger or default logger if
+// none is set. It is meant for companion packages (e.g. metakv) to
+// log through same logger as cbauth.
+func GetLogger() Logger {
+	return currentLogger()
+}
+
+// SlogLogger returns Logger that passes messages to given slog
+// logger (slog.Default() if nil) at corresponding levels.
+func SlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		return slog.Default()
+	}
+	return l
+}
+
+// stdLogger is default Logger. Fields are appended to message as
+// key=value pairs.
+type stdLogger struct{}
+
+func (stdLogger) Debug(msg string, fields ...interface{}) { stdPrint(msg, fields) }
+func (stdLogger) Info(msg string, fields ...interface{})  { stdPrint(msg, fields) }
+func (stdLogger) Warn(msg string, fields ...interface{})  { stdPrint(msg, fields) }
+func (stdLogger) Error(msg string, fields ...interface{}) { stdPrint(msg, fields) }
+
+func stdPrint(msg string, fields []interface{}) {
+	if len(fields) == 0 {
+		log.Print(msg)
+		return
+	}
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i < len(fields); i += 2 {
+		if i+1 < len(fields) {
+			fmt.Fprintf(&b, " %v=%v", fields[i], fields[i+1])
+		} else {
+			// same as log/slog does for dangling values
+			fmt.Fprintf(&b, " !BADKEY=%v", fields[i])
+		}
+	}
+	log.Print(b.String())
+}
+
+// configuredLogger returns logger set via SetLogger or nil.
+func configuredLogger() Logger {
+	b, _ := logger.Load().(loggerBox)
+	return b.l
+}
+
+func currentLogger() Logger {
+	if l := configuredLogger(); l != nil {
+		return l
+	}
+	return stdLogger{}
+}
+
+type logLevel int
+
+const (
+	logDebug logLevel = iota
+	logInfo
+	logWarn
+	logError
+)
+
+// logVia passes given message to Logger at given level if one is set
+// via SetLogger. Otherwise message is passed to given print function
+// if it's non-nil, so that services that redirected it keep getting
+// same messages, or to default logger.
+func logVia(print func(args ...interface{}), level logLevel, msg string, fields ...interface{}) {
+	l := configuredLogger()
+	if l == nil {
+		if print != nil {
+			print(msg)
+			return
+		}
+		l = stdLogger{}
+	}
+	switch level {
+	case logDebug:
+		l.Debug(msg, fields...)
+	case logInfo:
+		l.Info(msg, fields...)
+	case logWarn:
+		l.Warn(msg, fields...)
+	default:
+		l.Error(msg, fields...)
+	}
+}
+
+// revrpcLogPrint passes messages of revrpc's default error policy
+// to Logger.
+func revrpcLogPrint(args ...interface{}) {
+	logVia(nil, logWarn, fmt.Sprint(args...))
+}
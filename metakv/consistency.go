@@ -0,0 +1,123 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metakv
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// revisionHeader is the response header in which metakv reports the
+// revision of the store that served the request.
+const revisionHeader = "X-Metakv-Revision"
+
+// Token is an opaque marker of a metakv write. Reads given a token
+// observe the store at least as new as the write the token was
+// returned from. Zero token imposes no constraint. Tokens may be
+// freely passed between goroutines.
+type Token uint64
+
+// Merge method returns token that is at least as new as both t and
+// other.
+func (t Token) Merge(other Token) Token {
+	if other > t {
+		return other
+	}
+	return t
+}
+
+// ErrStaleRead error is returned from GetAtLeast when metakv keeps
+// serving revisions that are older than given token.
+var ErrStaleRead = errors.New("metakv read is older than consistency token")
+
+// StaleReadRetries is the number of times a read that observed stale
+// revision is retried before ErrStaleRead is returned.
+var StaleReadRetries = 5
+
+// StaleReadBackoff is the pause before the first retry of a stale
+// read. It doubles with every next retry.
+var StaleReadBackoff = 20 * time.Millisecond
+
+func responseToken(r *http.Response) Token {
+	v, err := strconv.ParseUint(r.Header.Get(revisionHeader), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return Token(v)
+}
+
+func (s *store) getAtLeast(path string, token Token) (value []byte, rev interface{}, err error) {
+	assertValidPath(path)
+	if token == 0 {
+		return s.get(path)
+	}
+	values := url.Values{"minRev": {strconv.FormatUint(uint64(token), 10)}}
+	backoff := StaleReadBackoff
+	for attempt := 0; ; attempt++ {
+		var kve kvEntry
+		var seen Token
+		seen, err = doJSONCallToken(s, "GET", path, values, &kve)
+		if err != nil && err != errNotFound {
+			return nil, nil, err
+		}
+		if seen >= token {
+			if err == errNotFound || kve.Rev == nil {
+				return kve.Value, nil, nil
+			}
+			return kve.Value, kve.Rev, nil
+		}
+		if attempt >= StaleReadRetries {
+			return nil, nil, ErrStaleRead
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// GetAtLeast is Get that only returns value if it was read from store
+// revision at least as new as given token. Stale reads are retried
+// and ErrStaleRead is returned if they persist.
+func GetAtLeast(path string, token Token) (value []byte, rev interface{}, err error) {
+	return defaultStore.getAtLeast(path, token)
+}
+
+// SetWithToken is Set that also returns token of the write.
+func SetWithToken(path string, value []byte, rev interface{}) (Token, error) {
+	assertValidPath(path)
+	return mutateToken(defaultStore, "PUT", path, value, rev, false, false)
+}
+
+// SetSensitiveWithToken is SetSensitive that also returns token of
+// the write.
+func SetSensitiveWithToken(path string, value []byte, rev interface{}) (Token, error) {
+	assertValidPath(path)
+	return mutateToken(defaultStore, "PUT", path, value, rev, false, true)
+}
+
+// AddWithToken is Add that also returns token of the write.
+func AddWithToken(path string, value []byte) (Token, error) {
+	assertValidPath(path)
+	return mutateToken(defaultStore, "PUT", path, value, nil, true, false)
+}
+
+// DeleteWithToken is Delete that also returns token of the write.
+func DeleteWithToken(path string, rev interface{}) (Token, error) {
+	assertValidPath(path)
+	return mutateToken(defaultStore, "DELETE", path, nil, rev, false, false)
+}
@@ -5,6 +5,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
+
+	"github.com/couchbase/cbauth"
 )
 
 func performAppend(path string, value []byte) error {
@@ -24,11 +26,13 @@ func serveDebugReq(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path == "/_list" {
 		l, err := ListAllChildren("/")
 		if err != nil {
-			panic(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 		b, err := json.Marshal(l)
 		if err != nil {
-			panic(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 		w.Write(b)
 		return
@@ -42,31 +46,37 @@ func serveDebugReq(w http.ResponseWriter, r *http.Request) {
 				"rev":   rev,
 			})
 			if err != nil {
-				panic(err)
+				return err
 			}
 			w.Write(b)
 			w.Write([]byte("\n\n"))
 			w.(http.Flusher).Flush()
 			return nil
-		}, make(chan struct{}))
+		}, r.Context().Done())
 		if err != nil {
-			panic(err)
+			// feed has started already, so there's no way to
+			// report error other than to cut it short
+			cbauth.GetLogger().Warn("metakv debug endpoint: watch failed", "path", path, "error", err)
 		}
 		return
 	}
 	if strings.HasPrefix(r.URL.Path, "/_put/") && r.Method == "POST" {
 		b, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			panic(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 		path := r.URL.Path[5:]
-		Set(path, b, nil)
+		if err := Set(path, b, nil); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 		return
 	}
 	if strings.HasPrefix(r.URL.Path, "/_get/") && r.Method == "GET" {
 		b, rev, err := Get(r.URL.Path[5:])
 		if err != nil {
-			panic(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 		h, _ := json.Marshal(rev)
 		w.Header().Set("X-Rev", string(h))
@@ -76,30 +86,40 @@ func serveDebugReq(w http.ResponseWriter, r *http.Request) {
 	if strings.HasPrefix(r.URL.Path, "/_append/") && r.Method == "POST" {
 		b, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			panic(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
 		path := r.URL.Path[len("/_append/")-1:]
 		err = performAppend(path, b)
 		if err != nil {
-			panic(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 		return
 	}
 	if r.Method == "DELETE" {
 		err := Delete(r.URL.Path, nil)
 		if err != nil {
-			panic(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 		return
 	}
 	w.WriteHeader(404)
 }
 
-// GoRunDebugEndpoint function can be used to run simple http server
-// for "manual" debugging of metakv facility.
+// RunDebugEndpoint function runs simple http server for "manual"
+// debugging of metakv facility. It only returns if server fails.
+func RunDebugEndpoint(listen string) error {
+	return http.ListenAndServe(listen, http.HandlerFunc(serveDebugReq))
+}
+
+// GoRunDebugEndpoint function runs RunDebugEndpoint in background.
+// Failures of server are logged.
 func GoRunDebugEndpoint(listen string) {
 	go func() {
-		panic(http.ListenAndServe(listen, http.HandlerFunc(serveDebugReq)))
+		err := RunDebugEndpoint(listen)
+		cbauth.GetLogger().Error("metakv debug endpoint failed", "listen", listen, "error", err)
 	}()
 }
@@ -29,12 +29,14 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
 
 	"github.com/couchbase/cbauth"
+	"github.com/couchbase/cbauth/revrpc"
 )
 
 // ErrRevMismatch error is returned from Set and Delete when there is
@@ -56,11 +58,25 @@ type store struct {
 	client *http.Client
 }
 
+// DefaultPoolLimits are limits of connection pool used for metakv
+// calls.
+var DefaultPoolLimits = cbauth.PoolLimits{}
+
+// pool is dedicated to metakv so that bursts of metakv calls
+// (e.g. watches reconnecting) don't starve auth calls of connections.
+var pool = cbauth.NewPool(DefaultPoolLimits)
+
+// SetPoolLimits sets limits of connection pool used for metakv
+// calls. See also cbauth.SetAuthPoolLimits.
+func SetPoolLimits(limits cbauth.PoolLimits) {
+	pool.SetLimits(limits)
+}
+
 var defaultStore = initDefaultStore()
 
 func initDefaultStore() *store {
 	c := *http.DefaultClient
-	c.Transport = cbauth.WrapHTTPTransport(http.DefaultTransport, nil)
+	c.Transport = cbauth.WrapHTTPTransport(pool, nil)
 
 	authURL := os.Getenv("CBAUTH_REVRPC_URL")
 	u, err := url.Parse(authURL)
@@ -73,12 +89,23 @@ func initDefaultStore() *store {
 	return &store{url: u, client: &c}
 }
 
-func doCallInner(s *store, method, path string, values url.Values) (resp *http.Response, err error) {
+// isDialError returns true iff given error means that endpoint could
+// not be connected to.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func doCallOnce(s *store, method, path string, values url.Values) (*http.Response, error) {
 	var body io.Reader
 	if method == "PUT" && values != nil {
 		body = strings.NewReader(values.Encode())
 	}
-	url := *s.url
+	u, err := revrpc.ResolveURL(s.url)
+	if err != nil {
+		return nil, err
+	}
+	url := *u
 	url.Path += path
 	req, err := http.NewRequest(method, url.String(), body)
 	if err != nil {
@@ -90,7 +117,17 @@ func doCallInner(s *store, method, path string, values url.Values) (resp *http.R
 	if method != "PUT" && values != nil {
 		req.URL.RawQuery = values.Encode()
 	}
-	r, err := s.client.Do(req)
+	return s.client.Do(req)
+}
+
+func doCallInner(s *store, method, path string, values url.Values) (resp *http.Response, err error) {
+	r, err := doCallOnce(s, method, path, values)
+	if err != nil && isDialError(err) && revrpc.IsSRVURL(s.url) {
+		// endpoint that was resolved before went away, so
+		// next one is tried
+		revrpc.ForgetResolvedURL(s.url)
+		r, err = doCallOnce(s, method, path, values)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -98,7 +135,10 @@ func doCallInner(s *store, method, path string, values url.Values) (resp *http.R
 		return nil, ErrRevMismatch
 	}
 	if r.StatusCode == http.StatusNotFound {
-		return nil, errNotFound
+		// response is kept so that its headers could still be
+		// inspected
+		r.Body.Close()
+		return r, errNotFound
 	}
 	if r.StatusCode != 200 {
 		return nil, fmt.Errorf("ns_server _metakv returned: %s", r.Status)
@@ -107,20 +147,34 @@ func doCallInner(s *store, method, path string, values url.Values) (resp *http.R
 }
 
 func doCall(s *store, method, path string, values url.Values) (body []byte, err error) {
+	body, _, err = doCallToken(s, method, path, values)
+	return
+}
+
+func doCallToken(s *store, method, path string, values url.Values) (body []byte, token Token, err error) {
 	r, err := doCallInner(s, method, path, values)
+	if err == errNotFound {
+		return nil, responseToken(r), err
+	}
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer r.Body.Close()
-	return ioutil.ReadAll(r.Body)
+	body, err = ioutil.ReadAll(r.Body)
+	return body, responseToken(r), err
 }
 
 func doJSONCall(s *store, method, path string, values url.Values, place interface{}) error {
-	body, err := doCall(s, method, path, values)
+	_, err := doJSONCallToken(s, method, path, values, place)
+	return err
+}
+
+func doJSONCallToken(s *store, method, path string, values url.Values, place interface{}) (Token, error) {
+	body, token, err := doCallToken(s, method, path, values)
 	if err != nil {
-		return err
+		return token, err
 	}
-	return json.Unmarshal(body, place)
+	return token, json.Unmarshal(body, place)
 }
 
 type kvEntry struct {
@@ -169,6 +223,11 @@ func (s *store) get(path string) (value []byte, rev interface{}, err error) {
 }
 
 func mutate(s *store, method string, path string, value []byte, rev interface{}, create bool, sensitive bool) error {
+	_, err := mutateToken(s, method, path, value, rev, create, sensitive)
+	return err
+}
+
+func mutateToken(s *store, method string, path string, value []byte, rev interface{}, create bool, sensitive bool) (Token, error) {
 	values := url.Values{
 		"value": {string(value)},
 	}
@@ -181,7 +240,7 @@ func mutate(s *store, method string, path string, value []byte, rev interface{},
 	if rev != nil {
 		revBytes, ok := rev.([]byte)
 		if !ok {
-			return ErrRevMismatch
+			return 0, ErrRevMismatch
 		}
 		values.Set("rev", string(revBytes))
 	}
@@ -192,8 +251,8 @@ func mutate(s *store, method string, path string, value []byte, rev interface{},
 		values.Set("sensitive", "false")
 	}
 
-	_, err := doCall(s, method, path, values)
-	return err
+	_, token, err := doCallToken(s, method, path, values)
+	return token, err
 }
 
 // Set updates given key-value pair. If non-nil, rev is a form of CAS
@@ -245,6 +304,13 @@ func (s *store) runObserveChildren(dirpath string, callback Callback, cancel <-c
 }
 
 func doRunObserveChildren(s *store, dirpath string, callback Callback, cancel <-chan struct{}) error {
+	return observeChildren(s, dirpath, callback, cancel, nil)
+}
+
+// observeChildren is doRunObserveChildren that calls opened (if
+// non-nil) once feed is established but before any of its entries is
+// passed to callback. Error returned from opened is returned.
+func observeChildren(s *store, dirpath string, callback Callback, cancel <-chan struct{}, opened func() error) error {
 	assertValidDirPath(dirpath)
 	values := url.Values{}
 	if cancel != nil {
@@ -257,14 +323,22 @@ func doRunObserveChildren(s *store, dirpath string, callback Callback, cancel <-
 
 	defer r.Body.Close()
 
+	if opened != nil {
+		if err := opened(); err != nil {
+			return err
+		}
+	}
+
 	errChan := make(chan error, 1)
 	kveChan := make(chan kvEntry)
 
 	go func() {
 		dec := json.NewDecoder(r.Body)
-		var kve kvEntry
 		for {
-			err = dec.Decode(&kve)
+			// fresh entry every time, since decoding into
+			// previous one may reuse its slices
+			var kve kvEntry
+			err := dec.Decode(&kve)
 			if err != nil {
 				errChan <- err
 				close(kveChan)
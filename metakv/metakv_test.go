@@ -3,15 +3,20 @@ package metakv
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
 )
 
 type entry struct {
@@ -25,6 +30,11 @@ type mockKV struct {
 	data        map[string]entry
 	subscribers map[uint64]chan KVEntry
 	srv         *httptest.Server
+
+	// staleReads makes that many next GETs be served from the
+	// state preceding last write as if by lagging cache
+	staleReads int
+	prev       map[string]entry
 }
 
 func (kv *mockKV) runMock() func() {
@@ -32,6 +42,7 @@ func (kv *mockKV) runMock() func() {
 	if kv.data == nil {
 		kv.data = make(map[string]entry)
 		kv.subscribers = make(map[uint64]chan KVEntry)
+		kv.prev = make(map[string]entry)
 	}
 	kv.srv = srv
 	return func() {
@@ -55,6 +66,7 @@ func (kv *mockKV) setLocked(path string, value string) {
 	kv.counter++
 	v := []byte(value)
 	e := entry{v, rev}
+	kv.prev[path] = kv.data[path]
 	kv.data[path] = e
 
 	kv.broadcast(KVEntry{Path: path, Value: v, Rev: rev})
@@ -109,6 +121,13 @@ func (kv *mockKV) Handle(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case "GET":
 		e, exists := kv.data[path]
+		revision := kv.counter
+		if kv.staleReads > 0 {
+			kv.staleReads--
+			e, exists = kv.prev[path], kv.prev[path].r != nil
+			revision--
+		}
+		w.Header().Set(revisionHeader, strconv.FormatUint(revision, 10))
 		if !exists {
 			w.Write([]byte("{}"))
 			return
@@ -134,6 +153,7 @@ func (kv *mockKV) Handle(w http.ResponseWriter, req *http.Request) {
 			}
 		}
 		kv.setLocked(path, value)
+		w.Header().Set(revisionHeader, strconv.FormatUint(kv.counter, 10))
 	case "DELETE":
 		rev := req.URL.Query().Get("rev")
 
@@ -143,7 +163,10 @@ func (kv *mockKV) Handle(w http.ResponseWriter, req *http.Request) {
 		}
 
 		kv.broadcast(KVEntry{path, nil, nil})
+		kv.prev[path] = kv.data[path]
 		delete(kv.data, path)
+		kv.counter++
+		w.Header().Set(revisionHeader, strconv.FormatUint(kv.counter, 10))
 	default:
 		w.WriteHeader(404)
 	}
@@ -224,8 +247,22 @@ func (t *myT) emptyBody(resp *http.Response, err error) {
 	}
 }
 
+func (t *myT) noErr(err error) {
+	if err != nil {
+		t.Fatalf("Got unexpected error: %v", err)
+	}
+}
+
 func must(t *testing.T) *myT { return &myT{t} }
 
+func (kv *mockKV) store() *store {
+	u, err := url.Parse(kv.srv.URL + "/_metakv")
+	if err != nil {
+		panic(err)
+	}
+	return &store{url: u, client: http.DefaultClient}
+}
+
 func (kv *mockKV) fullPath(path string) string {
 	return kv.srv.URL + "/_metakv" + path
 }
@@ -274,13 +311,215 @@ func TestSanity(t *testing.T) {
 	kv := &mockKV{}
 	defer kv.runMock()()
 
-	mockStore := &store{
-		url:    kv.srv.URL + "/_metakv",
-		client: http.DefaultClient,
-	}
+	mockStore := kv.store()
 
 	if err := mockStore.add("/_sanity/garbage", []byte("v"), false); err != nil {
 		t.Logf("add failed with: %v", err)
 	}
-	doExecuteBasicSanityTest(t.Log, mockStore)
+	if err := doExecuteBasicSanityTest(t.Log, mockStore); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScopedStore(t *testing.T) {
+	kv := &mockKV{}
+	defer kv.runMock()()
+
+	svc := cbauthimpl.NewSVC(0, errors.New("stale"))
+	svc.UpdateDB(&cbauthimpl.Cache{Nodes: []cbauthimpl.Node{
+		{Host: "127.0.0.1", User: "_admin", Password: "nodepwd", Local: true}}}, nil)
+	mint := func(readOnly bool, ttl time.Duration) string {
+		token, err := cbauthimpl.MintMetakvToken(svc, &cbauthimpl.MetakvScope{
+			User: "@backup", Prefix: "/backup/", ReadOnly: readOnly, Expires: time.Now().Add(ttl)})
+		must(t).noErr(err)
+		return token
+	}
+
+	token := mint(false, time.Hour)
+	sc, err := cbauthimpl.VerifyMetakvToken(svc, token)
+	must(t).noErr(err)
+	if sc.User != "@backup" || sc.Prefix != "/backup/" {
+		t.Fatalf("Unexpected scope: %+v", sc)
+	}
+	if _, err := cbauthimpl.VerifyMetakvToken(svc, token+"x"); err != cbauthimpl.ErrMetakvTokenInvalid {
+		t.Fatalf("Expect tampered token to be refused. Got: %v", err)
+	}
+
+	// mock doesn't need service creds that default client adds
+	proxy := &ScopedProxy{s: kv.store(), v: metakvVerifier(func(token string) (*cbauthimpl.MetakvScope, error) {
+		return cbauthimpl.VerifyMetakvToken(svc, token)
+	})}
+	psrv := httptest.NewServer(proxy)
+	defer psrv.Close()
+	proxyURL := psrv.URL + "/_metakv"
+
+	ss, err := NewScopedStore(proxyURL, token)
+	must(t).noErr(err)
+	must(t).noErr(ss.Add("/backup/config", []byte("v")))
+	value, _, err := ss.Get("/backup/config")
+	must(t).noErr(err)
+	if string(value) != "v" {
+		t.Fatalf("Unexpected value: %s", value)
+	}
+	entries, err := ss.ListAllChildren("/backup/")
+	must(t).noErr(err)
+	if len(entries) != 1 {
+		t.Fatalf("Unexpected entries: %v", entries)
+	}
+	if _, _, err := ss.Get("/other/config"); err != ErrOutOfScope {
+		t.Fatalf("Expect key out of scope to be refused. Got: %v", err)
+	}
+	if _, err := ss.ListAllChildren("/"); err != ErrOutOfScope {
+		t.Fatalf("Expect parent directory to be refused. Got: %v", err)
+	}
+	if _, _, err := ss.Get("/backup/../secret"); err != ErrOutOfScope {
+		t.Fatalf("Expect unclean path to be refused. Got: %v", err)
+	}
+
+	// proxy enforces scope on server side too
+	get := func(path, pwd string) int {
+		req, err := http.NewRequest("GET", proxyURL+path, nil)
+		must(t).noErr(err)
+		req.SetBasicAuth("@backup", pwd)
+		resp, err := http.DefaultClient.Do(req)
+		must(t).noErr(err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get("/other/config", token); code != http.StatusForbidden {
+		t.Fatalf("Expect proxy to refuse key out of scope. Got: %d", code)
+	}
+	if code := get("/backup/config", "garbage"); code != http.StatusUnauthorized {
+		t.Fatalf("Expect proxy to refuse invalid token. Got: %d", code)
+	}
+	if code := get("/backup/config", token); code != http.StatusOK {
+		t.Fatalf("Expect proxy to serve key in scope. Got: %d", code)
+	}
+
+	ss, err = NewScopedStore(proxyURL, mint(true, time.Hour))
+	must(t).noErr(err)
+	if _, _, err := ss.Get("/backup/config"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.Set("/backup/config", []byte("w"), nil); err != ErrOutOfScope {
+		t.Fatalf("Expect read only token to refuse writes. Got: %v", err)
+	}
+
+	ss, err = NewScopedStore(proxyURL, mint(false, -time.Second))
+	must(t).noErr(err)
+	if _, _, err := ss.Get("/backup/config"); err != ErrTokenExpired {
+		t.Fatalf("Expect expired token to be refused. Got: %v", err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	kv := &mockKV{}
+	defer kv.runMock()()
+	s := kv.store()
+
+	must(t).noErr(s.add("/svc/a", []byte("12345"), false))
+	must(t).noErr(s.add("/other/a", []byte("12345"), false))
+	sz, err := s.getSubtreeSize("/svc/")
+	must(t).noErr(err)
+	if sz != (SubtreeSize{Keys: 1, Bytes: int64(len("/svc/a") + 5)}) {
+		t.Fatalf("Unexpected subtree size: %+v", sz)
+	}
+
+	type report struct {
+		level QuotaLevel
+		size  SubtreeSize
+	}
+	reports := make(chan report, 16)
+	cancel := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- s.watchQuota("/svc/", Quota{MaxKeys: 4}, func(l QuotaLevel, sz SubtreeSize) {
+			reports <- report{l, sz}
+		}, cancel)
+	}()
+	expect := func(level QuotaLevel, keys int) {
+		t.Helper()
+		select {
+		case r := <-reports:
+			if r.level != level || r.size.Keys != keys {
+				t.Fatalf("Expect %s at %d keys. Got: %s at %+v", level, keys, r.level, r.size)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %s", level)
+		}
+	}
+
+	// warning threshold is 0.8 * 4 = 3.2 keys
+	must(t).noErr(s.add("/svc/b", []byte("v"), false))
+	must(t).noErr(s.add("/svc/c", []byte("v"), false))
+	must(t).noErr(s.add("/svc/d", []byte("v"), false))
+	expect(QuotaWarning, 4)
+	must(t).noErr(s.add("/svc/e", []byte("v"), false))
+	expect(QuotaExceeded, 5)
+	must(t).noErr(s.delete("/svc/e", nil))
+	expect(QuotaWarning, 4)
+	must(t).noErr(s.delete("/svc/d", nil))
+	expect(QuotaOK, 3)
+
+	close(cancel)
+	must(t).noErr(<-done)
+}
+
+type metakvVerifier func(token string) (*cbauthimpl.MetakvScope, error)
+
+func (f metakvVerifier) VerifyMetakvToken(token string) (*cbauthimpl.MetakvScope, error) {
+	return f(token)
+}
+
+func TestReadYourWrites(t *testing.T) {
+	kv := &mockKV{}
+	defer kv.runMock()()
+	s := kv.store()
+
+	defer func(d time.Duration) { StaleReadBackoff = d }(StaleReadBackoff)
+	StaleReadBackoff = time.Millisecond
+
+	must(t).noErr(s.add("/svc/cfg", []byte("v1"), false))
+	token, err := mutateToken(s, "PUT", "/svc/cfg", []byte("v2"), nil, false, false)
+	must(t).noErr(err)
+	if token == 0 {
+		t.Fatalf("Expected non-zero token")
+	}
+
+	kv.l.Lock()
+	kv.staleReads = 2
+	kv.l.Unlock()
+	v, rev, err := s.getAtLeast("/svc/cfg", token)
+	must(t).noErr(err)
+	if string(v) != "v2" || rev == nil {
+		t.Fatalf("Expected v2 after stale reads. Got: %s, %v", v, rev)
+	}
+
+	// plain reads don't wait for anything
+	kv.l.Lock()
+	kv.staleReads = 1
+	kv.l.Unlock()
+	v, _, err = s.get("/svc/cfg")
+	must(t).noErr(err)
+	if string(v) != "v1" {
+		t.Fatalf("Expected stale v1 from plain get. Got: %s", v)
+	}
+
+	kv.l.Lock()
+	kv.staleReads = StaleReadRetries + 1
+	kv.l.Unlock()
+	if _, _, err = s.getAtLeast("/svc/cfg", token); err != ErrStaleRead {
+		t.Fatalf("Expected ErrStaleRead. Got: %v", err)
+	}
+
+	token, err = mutateToken(s, "DELETE", "/svc/cfg", nil, nil, false, false)
+	must(t).noErr(err)
+	kv.l.Lock()
+	kv.staleReads = 1
+	kv.l.Unlock()
+	v, rev, err = s.getAtLeast("/svc/cfg", token.Merge(1))
+	must(t).noErr(err)
+	if v != nil || rev != nil {
+		t.Fatalf("Expected deleted key. Got: %s, %v", v, rev)
+	}
 }
@@ -0,0 +1,56 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metakv
+
+import (
+	"path"
+
+	"github.com/couchbase/cbauth"
+)
+
+// WatchPolicy keeps policy of given route table in sync with
+// cbauth.Policy stored (in json) under given metakv path. Policy
+// updates that fail to parse are passed to onError (if non-nil) and
+// previously loaded policy stays in effect. So does deletion of
+// policy key. Returns under same conditions as RunObserveChildren.
+func WatchPolicy(policyPath string, rt *cbauth.RouteTable, onError func(error), cancel <-chan struct{}) error {
+	return defaultStore.watchPolicy(policyPath, rt, onError, cancel)
+}
+
+// StartWatchPolicy runs WatchPolicy in background until returned
+// watcher is stopped.
+func StartWatchPolicy(policyPath string, rt *cbauth.RouteTable, onError func(error)) *cbauth.Watcher {
+	return cbauth.StartWatcher(func(cancel <-chan struct{}) error {
+		return WatchPolicy(policyPath, rt, onError, cancel)
+	})
+}
+
+func (s *store) watchPolicy(policyPath string, rt *cbauth.RouteTable, onError func(error), cancel <-chan struct{}) error {
+	assertValidPath(policyPath)
+	dir := path.Dir(policyPath)
+	if dir != "/" {
+		dir += "/"
+	}
+	return s.runObserveChildren(dir, func(p string, value []byte, rev interface{}) error {
+		if p != policyPath || value == nil {
+			return nil
+		}
+		if err := rt.LoadPolicy(value); err != nil && onError != nil {
+			onError(err)
+		}
+		return nil
+	}, cancel)
+}
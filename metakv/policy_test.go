@@ -0,0 +1,85 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metakv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/couchbase/cbauth"
+)
+
+func TestWatchPolicy(t *testing.T) {
+	kv := &mockKV{}
+	defer kv.runMock()()
+	s := kv.store()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	rt, err := cbauth.NewRouteTable(nil, next, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codeOf := func(path string) int {
+		req, _ := http.NewRequest("GET", "http://host"+path, nil)
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, req)
+		return w.Code
+	}
+	waitFor := func(path string, code int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for codeOf(path) != code {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s to return %d", path, code)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if err := s.add("/policy/svc", []byte(`{"routes": [{"pattern": "/a", "anonymous": true}]}`), false); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 16)
+	cancel := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- s.watchPolicy("/policy/svc", rt, func(err error) { errs <- err }, cancel)
+	}()
+
+	waitFor("/a", 200)
+
+	must(t).noErr(s.set("/policy/other", []byte(`garbage`), nil, false))
+	must(t).noErr(s.set("/policy/svc", []byte(`garbage`), nil, false))
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected malformed policy to be reported")
+	}
+	if codeOf("/a") != 200 {
+		t.Fatal("Expected previous policy to stay in effect")
+	}
+
+	must(t).noErr(s.set("/policy/svc", []byte(`{"routes": [{"pattern": "/b", "anonymous": true}]}`), nil, false))
+	waitFor("/b", 200)
+	waitFor("/a", 403)
+
+	close(cancel)
+	if err := <-done; err != nil {
+		t.Fatalf("Expected nil error after cancel. Got: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metakv
+
+import (
+	"strings"
+
+	"github.com/couchbase/cbauth"
+)
+
+// SubtreeSize struct describes size of metakv subtree. Bytes counts
+// both keys and values.
+type SubtreeSize struct {
+	Keys  int
+	Bytes int64
+}
+
+func entrySize(path string, value []byte) int64 {
+	return int64(len(path) + len(value))
+}
+
+// DefaultQuotaWarnAt is fraction of quota at which QuotaWarning is
+// reported if Quota.WarnAt is not set.
+const DefaultQuotaWarnAt = 0.8
+
+// Quota struct describes limits of size of metakv subtree. Zero
+// limit means no limit.
+type Quota struct {
+	MaxKeys  int
+	MaxBytes int64
+	// WarnAt is fraction of limits at which QuotaWarning is
+	// reported (DefaultQuotaWarnAt if zero).
+	WarnAt float64
+}
+
+// QuotaLevel type describes how close size of subtree is to its
+// quota.
+type QuotaLevel int
+
+const (
+	// QuotaOK means subtree is below warning threshold.
+	QuotaOK QuotaLevel = iota
+	// QuotaWarning means subtree reached warning threshold of
+	// some limit.
+	QuotaWarning
+	// QuotaExceeded means subtree exceeded some limit.
+	QuotaExceeded
+)
+
+func (l QuotaLevel) String() string {
+	switch l {
+	case QuotaOK:
+		return "ok"
+	case QuotaWarning:
+		return "warning"
+	case QuotaExceeded:
+		return "exceeded"
+	}
+	return "unknown"
+}
+
+func limitLevel(value, limit int64, warnAt float64) QuotaLevel {
+	switch {
+	case limit <= 0:
+		return QuotaOK
+	case value > limit:
+		return QuotaExceeded
+	case float64(value) >= warnAt*float64(limit):
+		return QuotaWarning
+	}
+	return QuotaOK
+}
+
+// Level method returns level of given size with respect to this
+// quota.
+func (q *Quota) Level(sz SubtreeSize) QuotaLevel {
+	warnAt := q.WarnAt
+	if warnAt <= 0 {
+		warnAt = DefaultQuotaWarnAt
+	}
+	l := limitLevel(int64(sz.Keys), int64(q.MaxKeys), warnAt)
+	if bl := limitLevel(sz.Bytes, q.MaxBytes, warnAt); bl > l {
+		l = bl
+	}
+	return l
+}
+
+// GetSubtreeSize returns number of keys under given directory path
+// and their total size.
+func GetSubtreeSize(dirpath string) (SubtreeSize, error) {
+	return defaultStore.getSubtreeSize(dirpath)
+}
+
+func (s *store) getSubtreeSize(dirpath string) (sz SubtreeSize, err error) {
+	err = s.iterateChildren(dirpath, func(path string, value []byte, rev interface{}) error {
+		if strings.HasPrefix(path, dirpath) {
+			sz.Keys++
+			sz.Bytes += entrySize(path, value)
+		}
+		return nil
+	})
+	return
+}
+
+// WatchQuota tracks size of subtree under given directory path and
+// calls callback every time its level with respect to given quota
+// changes (including initial transition to QuotaWarning or
+// QuotaExceeded, if any). Returns under same conditions as
+// RunObserveChildren.
+func WatchQuota(dirpath string, q Quota, callback func(level QuotaLevel, size SubtreeSize), cancel <-chan struct{}) error {
+	return defaultStore.watchQuota(dirpath, q, callback, cancel)
+}
+
+// StartWatchQuota runs WatchQuota in background until returned
+// watcher is stopped.
+func StartWatchQuota(dirpath string, q Quota, callback func(level QuotaLevel, size SubtreeSize)) *cbauth.Watcher {
+	return cbauth.StartWatcher(func(cancel <-chan struct{}) error {
+		return WatchQuota(dirpath, q, callback, cancel)
+	})
+}
+
+func (s *store) watchQuota(dirpath string, q Quota, callback func(level QuotaLevel, size SubtreeSize), cancel <-chan struct{}) error {
+	var sz SubtreeSize
+	level := QuotaOK
+	// sizes of entries are remembered so that mutations and
+	// deletions can be accounted for
+	sizes := make(map[string]int64)
+	return s.runObserveChildren(dirpath, func(path string, value []byte, rev interface{}) error {
+		if !strings.HasPrefix(path, dirpath) {
+			return nil
+		}
+		if old, ok := sizes[path]; ok {
+			sz.Keys--
+			sz.Bytes -= old
+			delete(sizes, path)
+		}
+		if value != nil {
+			sizes[path] = entrySize(path, value)
+			sz.Keys++
+			sz.Bytes += sizes[path]
+		}
+		if l := q.Level(sz); l != level {
+			level = l
+			callback(level, sz)
+		}
+		return nil
+	}, cancel)
+}
@@ -0,0 +1,134 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metakv
+
+import (
+	"fmt"
+	"time"
+)
+
+// RevResync is special revision that is passed to callbacks of
+// RunObserveChildrenResuming (together with watched directory path and
+// nil value) when watch reconnected after missing some changes.
+// Callback is expected to forget what it knows about children of
+// directory, since all current children are passed to it next.
+var RevResync = &struct{}{}
+
+// WatchRetryBackoff is the pause before the first reconnection of
+// watch of RunObserveChildrenResuming. It doubles with every next
+// failed reconnection up to WatchRetryMaxBackoff.
+var WatchRetryBackoff = 100 * time.Millisecond
+
+// WatchRetryMaxBackoff is the longest pause between reconnections of
+// watch of RunObserveChildrenResuming.
+var WatchRetryMaxBackoff = 10 * time.Second
+
+// revKey returns comparable form of given revision.
+func revKey(rev interface{}) string {
+	if b, ok := rev.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(rev)
+}
+
+// RunObserveChildrenResuming is RunObserveChildren that survives
+// disconnects of watch: it reconnects (with backoff, see
+// WatchRetryBackoff) and compares revisions of children with those
+// passed to callback before disconnect. If nothing changed during the
+// gap, children are not passed to callback again. Otherwise callback
+// is passed RevResync and then every current child. Returns only when
+// cancel channel is closed (with nil error) or when callback returns
+// error.
+func RunObserveChildrenResuming(dirpath string, callback Callback, cancel <-chan struct{}) error {
+	return defaultStore.runObserveChildrenResuming(dirpath, callback, cancel)
+}
+
+func (s *store) runObserveChildrenResuming(dirpath string, callback Callback, cancel <-chan struct{}) error {
+	assertValidDirPath(dirpath)
+	if cancel == nil {
+		return nil
+	}
+	// revs are revisions of children as last passed to callback;
+	// nil until first watch is established
+	var revs map[string]string
+	var cbErr error
+	dedup := func(path string, value []byte, rev interface{}) error {
+		if old, ok := revs[path]; ok == (value != nil) && (value == nil || old == revKey(rev)) {
+			return nil
+		}
+		if value == nil {
+			delete(revs, path)
+		} else {
+			revs[path] = revKey(rev)
+		}
+		cbErr = callback(path, value, rev)
+		return cbErr
+	}
+	// resume checks whether children changed while watch was down.
+	// Since feed is established already, changes that happen after
+	// listing are passed to callback by feed itself.
+	resume := func() error {
+		if revs == nil {
+			revs = make(map[string]string)
+			return nil
+		}
+		entries, err := s.listAllChildren(dirpath)
+		if err != nil {
+			return err
+		}
+		gap := len(entries) != len(revs)
+		for _, e := range entries {
+			if old, ok := revs[e.Path]; !ok || old != revKey(e.Rev) {
+				gap = true
+			}
+		}
+		if !gap {
+			return nil
+		}
+		revs = make(map[string]string)
+		cbErr = callback(dirpath, nil, RevResync)
+		return cbErr
+	}
+
+	backoff := WatchRetryBackoff
+	for {
+		established := false
+		err := observeChildren(s, dirpath, dedup, cancel, func() error {
+			if err := resume(); err != nil {
+				return err
+			}
+			established = true
+			return nil
+		})
+		if cbErr != nil {
+			return cbErr
+		}
+		if err == nil {
+			return nil
+		}
+		if established {
+			backoff = WatchRetryBackoff
+		}
+		select {
+		case <-cancel:
+			return nil
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > WatchRetryMaxBackoff {
+			backoff = WatchRetryMaxBackoff
+		}
+	}
+}
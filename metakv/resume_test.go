@@ -0,0 +1,120 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metakv
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestObserveChildrenResuming(t *testing.T) {
+	kv := &mockKV{}
+	defer kv.runMock()()
+	s := kv.store()
+
+	defer func(d time.Duration) { WatchRetryBackoff = d }(WatchRetryBackoff)
+	WatchRetryBackoff = time.Millisecond
+
+	must(t).noErr(s.add("/svc/a", []byte("v1"), false))
+	events := make(chan string, 16)
+	cancel := make(chan struct{})
+	done := make(chan error, 1)
+	stopped := false
+	stop := func() error {
+		if stopped {
+			return nil
+		}
+		stopped = true
+		close(cancel)
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for watch to stop")
+		}
+		return nil
+	}
+	defer stop()
+	go func() {
+		done <- s.runObserveChildrenResuming("/svc/", func(path string, value []byte, rev interface{}) error {
+			if rev == RevResync {
+				events <- "resync " + path
+				return nil
+			}
+			events <- path + "=" + string(value)
+			return nil
+		}, cancel)
+	}()
+	expect := func(want ...string) {
+		for _, w := range want {
+			select {
+			case e := <-events:
+				if e != w {
+					t.Fatalf("Expected event %s. Got: %s", w, e)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for event %s", w)
+			}
+		}
+	}
+	subscriber := func() (id uint64) {
+		kv.l.Lock()
+		defer kv.l.Unlock()
+		for id = range kv.subscribers {
+		}
+		return
+	}
+	// reconnect breaks watch and waits for it to be established
+	// again
+	reconnect := func() {
+		old := subscriber()
+		kv.srv.CloseClientConnections()
+		deadline := time.Now().Add(5 * time.Second)
+		for id := subscriber(); id == old || id == 0; id = subscriber() {
+			if time.Now().After(deadline) {
+				t.Fatal("Timed out waiting for watch to reconnect")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	expect("/svc/a=v1")
+	must(t).noErr(s.set("/svc/b", []byte("v2"), nil, false))
+	expect("/svc/b=v2")
+
+	reconnect()
+	select {
+	case e := <-events:
+		t.Fatalf("Expected no events after gap without changes. Got: %s", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+	must(t).noErr(s.set("/svc/c", []byte("v3"), nil, false))
+	expect("/svc/c=v3")
+
+	// changes that feed doesn't see
+	kv.l.Lock()
+	delete(kv.data, "/svc/a")
+	rev := make([]byte, 8)
+	binary.LittleEndian.PutUint64(rev, kv.counter)
+	kv.counter++
+	kv.data["/svc/b"] = entry{[]byte("v4"), rev}
+	kv.l.Unlock()
+	reconnect()
+	expect("resync /svc/", "/svc/b=v4", "/svc/c=v3")
+
+	must(t).noErr(stop())
+}
@@ -4,10 +4,9 @@ import (
 	"fmt"
 )
 
-func noPanic(err error) {
-	if err != nil {
-		panic(err)
-	}
+// errSanity returns error of failed sanity test step.
+func errSanity(format string, args ...interface{}) error {
+	return fmt.Errorf("metakv sanity test failed: "+format, args...)
 }
 
 func doAppend(s *store, path string, value []byte) error {
@@ -29,28 +28,35 @@ func kvEqual(a, b KVEntry) bool {
 	return a.Path == b.Path && string(a.Value) == string(b.Value)
 }
 
-// ExecuteBasicSanityTest runs basic sanity test.
-func ExecuteBasicSanityTest(log func(v ...interface{})) {
-	doExecuteBasicSanityTest(log, defaultStore)
+// ExecuteBasicSanityTest runs basic sanity test. Returns error
+// describing first failed step, if any.
+func ExecuteBasicSanityTest(log func(v ...interface{})) error {
+	return doExecuteBasicSanityTest(log, defaultStore)
 }
 
-func doExecuteBasicSanityTest(log func(v ...interface{}), s *store) {
+func doExecuteBasicSanityTest(log func(v ...interface{}), s *store) error {
 	log("Starting basic sanity test")
 	l, err := s.listAllChildren("/_sanity/")
-	noPanic(err)
+	if err != nil {
+		return err
+	}
 	for _, kve := range l {
-		err := s.delete(kve.Path, nil)
-		noPanic(err)
+		if err := s.delete(kve.Path, nil); err != nil {
+			return err
+		}
 	}
 	log("cleaned up /_sanity/ subspace")
 
 	v, r, err := s.get("/_sanity/nonexistant")
-	noPanic(err)
+	if err != nil {
+		return err
+	}
 	if v != nil || r != nil {
-		panic("badness")
+		return errSanity("nonexistent key has value %q", v)
 	}
 
 	buf := make(chan KVEntry, 128)
+	observeErr := make(chan error, 1)
 	cancelChan := make(chan struct{})
 
 	defer func() {
@@ -65,42 +71,48 @@ func doExecuteBasicSanityTest(log func(v ...interface{}), s *store) {
 			return nil
 		}, cancelChan)
 		log("Sanity observe loop exited")
+		observeErr <- err
 		close(buf)
-		if err != nil {
-			panic(err)
-		}
 	}()
 
-	err = doAppend(s, "/_sanity/key", []byte("value"))
-	noPanic(err)
+	if err := doAppend(s, "/_sanity/key", []byte("value")); err != nil {
+		return err
+	}
 
 	v, r, err = s.get("/_sanity/key")
-	noPanic(err)
+	if err != nil {
+		return err
+	}
 	if r == nil || string(v) != "value" {
-		panic("badness")
+		return errSanity("expected value. Got: %q", v)
 	}
 
-	err = s.set("/_sanity/key", []byte("new value"), r, false)
-	noPanic(err)
+	if err := s.set("/_sanity/key", []byte("new value"), r, false); err != nil {
+		return err
+	}
 
-	err = s.delete("/_sanity/key", r)
-	if err != ErrRevMismatch {
-		panic("must have ErrRevMismatch")
+	if err := s.delete("/_sanity/key", r); err != ErrRevMismatch {
+		return errSanity("expected ErrRevMismatch. Got: %v", err)
 	}
 
 	v, r, err = s.get("/_sanity/key")
-	noPanic(err)
+	if err != nil {
+		return err
+	}
 	if r == nil || string(v) != "new value" {
-		panic("bad")
+		return errSanity("expected new value. Got: %q", v)
 	}
 
-	err = s.delete("/_sanity/key", r)
-	noPanic(err)
+	if err := s.delete("/_sanity/key", r); err != nil {
+		return err
+	}
 
 	l, err = s.listAllChildren("/_sanity/")
-	noPanic(err)
+	if err != nil {
+		return err
+	}
 	if len(l) != 0 {
-		panic("len is bad")
+		return errSanity("expected no keys. Got: %v", l)
 	}
 
 	close(cancelChan)
@@ -110,39 +122,48 @@ func doExecuteBasicSanityTest(log func(v ...interface{}), s *store) {
 	for kve := range buf {
 		allMutations = append(allMutations, kve)
 	}
+	if err := <-observeErr; err != nil {
+		return err
+	}
 
 	if len(allMutations) != 3 {
-		panic(fmt.Sprintf("bad mutations size: %d (%v)", len(allMutations), allMutations))
+		return errSanity("bad mutations size: %d (%v)", len(allMutations), allMutations)
 	}
 
 	if !kvEqual(allMutations[0], KVEntry{Path: "/_sanity/key", Value: []byte("value")}) {
-		panic("bad mutation")
+		return errSanity("bad mutation: %v", allMutations[0])
 	}
 
 	if !kvEqual(allMutations[1], KVEntry{Path: "/_sanity/key", Value: []byte("new value")}) {
-		panic("bad mutation")
+		return errSanity("bad mutation: %v", allMutations[1])
 	}
 
 	// deletions signal rev that is interface{}([]byte(nil))
-	if !kvEqual(allMutations[2], KVEntry{Path: "/_sanity/key", Value: nil}) || len(allMutations[2].Rev.([]byte)) != 0 {
-		log(fmt.Sprintf("bad mutation: %v", allMutations[2]))
-		panic("bad mutation")
+	if rev, ok := allMutations[2].Rev.([]byte); !kvEqual(allMutations[2], KVEntry{Path: "/_sanity/key", Value: nil}) || !ok || len(rev) != 0 {
+		return errSanity("bad mutation: %v", allMutations[2])
 	}
 
-	err = s.set("/_sanity/key", []byte("more value"), nil, false)
-	noPanic(err)
+	if err := s.set("/_sanity/key", []byte("more value"), nil, false); err != nil {
+		return err
+	}
 	v, r, err = s.get("/_sanity/key")
-	noPanic(err)
+	if err != nil {
+		return err
+	}
 	if r == nil || string(v) != "more value" {
-		panic("expecting more value got: " + string(v))
+		return errSanity("expecting more value got: %q", v)
+	}
+	if err := s.delete("/_sanity/key", nil); err != nil {
+		return err
+	}
+	_, r, err = s.get("/_sanity/key")
+	if err != nil {
+		return err
 	}
-	err = s.delete("/_sanity/key", nil)
-	noPanic(err)
-	v, r, err = s.get("/_sanity/key")
-	noPanic(err)
 	if r != nil {
-		panic("expected key to be missing after successful delete")
+		return errSanity("expected key to be missing after successful delete")
 	}
 
 	log("Completed metakv sanity test")
+	return nil
 }
@@ -1,17 +1,22 @@
 package metakv
 
 import (
-	"log"
+	"fmt"
 	"os"
+
+	"github.com/couchbase/cbauth"
 )
 
 func init() {
 	if os.Getenv("COUCHBASE_METAKV_SANITY") != "" {
-		ExecuteBasicSanityTest(log.Print)
+		logf := func(args ...interface{}) { cbauth.GetLogger().Info(fmt.Sprint(args...)) }
+		if err := ExecuteBasicSanityTest(logf); err != nil {
+			cbauth.GetLogger().Error("metakv sanity test failed", "error", err)
+		}
 	}
 
 	if l := os.Getenv("COUCHBASE_METAKV_DEBUG"); l != "" {
-		log.Printf("Starting _metakv debugging endpoint on `%s'", l)
+		cbauth.GetLogger().Info("starting _metakv debugging endpoint", "listen", l)
 		GoRunDebugEndpoint(l)
 	}
 }
@@ -0,0 +1,278 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metakv
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/couchbase/cbauth"
+	"github.com/couchbase/cbauth/revrpc"
+)
+
+// ErrOutOfScope is returned by ScopedStore when operation is not
+// permitted by scope of its token.
+var ErrOutOfScope = errors.New("metakv path is out of token scope")
+
+// ErrTokenExpired is returned by ScopedStore once its token expires.
+var ErrTokenExpired = errors.New("metakv token expired")
+
+// ScopedStore type provides metakv API restricted to scope of metakv
+// token (see cbauth.Authenticator.MintMetakvToken). It lets
+// auxiliary processes (e.g. backup agents) access their part of
+// metakv without full internal credentials. Scope is enforced on
+// client side, before requests are sent, and requests carry token
+// as basic auth password. ns_server doesn't accept metakv tokens, so
+// ScopedStore has to talk to ScopedProxy of service that minted
+// token, which enforces scope again on server side.
+type ScopedStore struct {
+	s     *store
+	scope *cbauth.MetakvScope
+}
+
+type tokenTransport struct {
+	user, token string
+	rt          http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(t.user, t.token)
+	return t.rt.RoundTrip(req)
+}
+
+// NewScopedStore returns ScopedStore that accesses metakv via
+// ScopedProxy at given url (e.g. "http://127.0.0.1:9110/_metakv")
+// with given metakv token. Empty url means url of default store.
+func NewScopedStore(metakvURL, token string) (*ScopedStore, error) {
+	scope, err := cbauth.DecodeMetakvToken(token)
+	if err != nil {
+		return nil, err
+	}
+	u := defaultStore.url
+	if metakvURL != "" {
+		if u, err = url.Parse(metakvURL); err != nil {
+			return nil, err
+		}
+	}
+	if u == nil {
+		return nil, errors.New("metakv url is unknown")
+	}
+	client := &http.Client{Transport: &tokenTransport{scope.User, token, pool}}
+	return &ScopedStore{s: &store{url: u, client: client}, scope: scope}, nil
+}
+
+// Scope method returns scope of token of this store.
+func (ss *ScopedStore) Scope() cbauth.MetakvScope {
+	return *ss.scope
+}
+
+func (ss *ScopedStore) check(path string, write bool) error {
+	if ss.scope.Expired() {
+		return ErrTokenExpired
+	}
+	if !ss.scope.Allows(path, write) {
+		return ErrOutOfScope
+	}
+	return nil
+}
+
+// Get is Get restricted to scope of token.
+func (ss *ScopedStore) Get(path string) (value []byte, rev interface{}, err error) {
+	if err := ss.check(path, false); err != nil {
+		return nil, nil, err
+	}
+	return ss.s.get(path)
+}
+
+// Set is Set restricted to scope of token.
+func (ss *ScopedStore) Set(path string, value []byte, rev interface{}) error {
+	if err := ss.check(path, true); err != nil {
+		return err
+	}
+	return ss.s.set(path, value, rev, false)
+}
+
+// SetSensitive is SetSensitive restricted to scope of token.
+func (ss *ScopedStore) SetSensitive(path string, value []byte, rev interface{}) error {
+	if err := ss.check(path, true); err != nil {
+		return err
+	}
+	return ss.s.set(path, value, rev, true)
+}
+
+// Add is Add restricted to scope of token.
+func (ss *ScopedStore) Add(path string, value []byte) error {
+	if err := ss.check(path, true); err != nil {
+		return err
+	}
+	return ss.s.add(path, value, false)
+}
+
+// Delete is Delete restricted to scope of token.
+func (ss *ScopedStore) Delete(path string, rev interface{}) error {
+	if err := ss.check(path, true); err != nil {
+		return err
+	}
+	return ss.s.delete(path, rev)
+}
+
+// RecursiveDelete is RecursiveDelete restricted to scope of token.
+func (ss *ScopedStore) RecursiveDelete(dirpath string) error {
+	if err := ss.check(dirpath, true); err != nil {
+		return err
+	}
+	return ss.s.recursiveDelete(dirpath)
+}
+
+// IterateChildren is IterateChildren restricted to scope of token.
+func (ss *ScopedStore) IterateChildren(dirpath string, callback Callback) error {
+	if err := ss.check(dirpath, false); err != nil {
+		return err
+	}
+	return ss.s.iterateChildren(dirpath, callback)
+}
+
+// RunObserveChildren is RunObserveChildren restricted to scope of
+// token. Note that it keeps running after token expires.
+func (ss *ScopedStore) RunObserveChildren(dirpath string, callback Callback, cancel <-chan struct{}) error {
+	if err := ss.check(dirpath, false); err != nil {
+		return err
+	}
+	return ss.s.runObserveChildren(dirpath, callback, cancel)
+}
+
+// ListAllChildren is ListAllChildren restricted to scope of token.
+func (ss *ScopedStore) ListAllChildren(dirpath string) (entries []KVEntry, err error) {
+	if err := ss.check(dirpath, false); err != nil {
+		return nil, err
+	}
+	return ss.s.listAllChildren(dirpath)
+}
+
+// MetakvTokenVerifier interface is implemented by
+// cbauth.Authenticator.
+type MetakvTokenVerifier interface {
+	VerifyMetakvToken(token string) (*cbauth.MetakvScope, error)
+}
+
+// ScopedProxy is http.Handler that serves metakv REST API to holders
+// of metakv tokens (see ScopedStore). It verifies token of every
+// request, refuses requests out of token's scope and forwards the
+// rest to ns_server's metakv with service's own credentials. It is
+// meant to be mounted under "/_metakv" of service that mints tokens.
+type ScopedProxy struct {
+	s *store
+	v MetakvTokenVerifier
+}
+
+// NewScopedProxy returns ScopedProxy that verifies tokens with given
+// verifier (default authenticator if nil) and forwards requests to
+// metakv at given url (default store if empty).
+func NewScopedProxy(metakvURL string, v MetakvTokenVerifier) (*ScopedProxy, error) {
+	s := defaultStore
+	if metakvURL != "" {
+		u, err := url.Parse(metakvURL)
+		if err != nil {
+			return nil, err
+		}
+		s = &store{url: u, client: defaultStore.client}
+	}
+	if s.url == nil {
+		return nil, errors.New("metakv url is unknown")
+	}
+	return &ScopedProxy{s: s, v: v}, nil
+}
+
+func (p *ScopedProxy) verify(token string) (*cbauth.MetakvScope, error) {
+	if p.v != nil {
+		return p.v.VerifyMetakvToken(token)
+	}
+	a := cbauth.GetDefault()
+	if a == nil {
+		return nil, cbauth.ErrNotInitialized
+	}
+	return a.VerifyMetakvToken(token)
+}
+
+func (p *ScopedProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	user, token, ok := req.BasicAuth()
+	if !ok {
+		cbauth.SendUnauthorized(w)
+		return
+	}
+	scope, err := p.verify(token)
+	if err == cbauth.ErrMetakvTokenInvalid || (err == nil && scope.User != user) {
+		cbauth.SendUnauthorized(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to verify metakv token", http.StatusServiceUnavailable)
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/_metakv")
+	if !scope.Allows(path, req.Method != "GET") {
+		cbauth.SendForbidden(w)
+		return
+	}
+
+	u, err := revrpc.ResolveURL(p.s.url)
+	if err != nil {
+		http.Error(w, "metakv is unavailable", http.StatusBadGateway)
+		return
+	}
+	target := *u
+	target.Path += path
+	target.RawQuery = req.URL.RawQuery
+	out, err := http.NewRequestWithContext(req.Context(), req.Method, target.String(), req.Body)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	out.Header.Set("Content-Type", req.Header.Get("Content-Type"))
+	resp, err := p.s.client.Do(out)
+	if err != nil {
+		if isDialError(err) {
+			revrpc.ForgetResolvedURL(p.s.url)
+		}
+		http.Error(w, "metakv is unavailable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.WriteHeader(resp.StatusCode)
+	// continuous feeds are streamed as they arrive
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metakv
+
+import (
+	"path"
+
+	"github.com/couchbase/cbauth"
+)
+
+// DefaultTracePath is metakv key that operators are expected to use
+// to control tracing of cbauth instances of all services at once.
+const DefaultTracePath = "/cbauth/trace"
+
+// WatchTracing keeps tracing of cbauth (see cbauth.EnableTracing) in
+// sync with cbauth.TraceSettings stored (in json) under given metakv
+// path. Deletion of that key turns tracing off. Settings that fail
+// to parse are passed to onError (if non-nil) and tracing is kept
+// intact. Returns under same conditions as RunObserveChildren.
+func WatchTracing(tracePath string, onError func(error), cancel <-chan struct{}) error {
+	return defaultStore.watchTracing(tracePath, onError, cancel)
+}
+
+// StartWatchTracing runs WatchTracing in background until returned
+// watcher is stopped.
+func StartWatchTracing(tracePath string, onError func(error)) *cbauth.Watcher {
+	return cbauth.StartWatcher(func(cancel <-chan struct{}) error {
+		return WatchTracing(tracePath, onError, cancel)
+	})
+}
+
+func (s *store) watchTracing(tracePath string, onError func(error), cancel <-chan struct{}) error {
+	assertValidPath(tracePath)
+	dir := path.Dir(tracePath)
+	if dir != "/" {
+		dir += "/"
+	}
+	return s.runObserveChildren(dir, func(p string, value []byte, rev interface{}) error {
+		if p != tracePath {
+			return nil
+		}
+		if value == nil {
+			cbauth.ApplyTraceSettings(cbauth.TraceSettings{})
+			return nil
+		}
+		if err := cbauth.LoadTraceSettings(value); err != nil && onError != nil {
+			onError(err)
+		}
+		return nil
+	}, cancel)
+}
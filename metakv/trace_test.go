@@ -0,0 +1,79 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metakv
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/cbauth"
+)
+
+func TestWatchTracing(t *testing.T) {
+	kv := &mockKV{}
+	defer kv.runMock()()
+	s := kv.store()
+	defer cbauth.DisableTracing()
+
+	waitFor := func(enabled bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			var b bytes.Buffer
+			cbauth.DumpDiagnostics(&b)
+			if strings.Contains(b.String(), fmt.Sprintf("tracing: %v", enabled)) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for tracing to be %v", enabled)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	errs := make(chan error, 16)
+	cancel := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- s.watchTracing(DefaultTracePath, func(err error) { errs <- err }, cancel)
+	}()
+
+	must(t).noErr(s.add(DefaultTracePath, []byte(`{"enabled": true}`), false))
+	waitFor(true)
+
+	must(t).noErr(s.set(DefaultTracePath, []byte(`garbage`), nil, false))
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected malformed settings to be reported")
+	}
+	waitFor(true)
+
+	must(t).noErr(s.set(DefaultTracePath, []byte(`{"enabled": false}`), nil, false))
+	waitFor(false)
+
+	must(t).noErr(s.set(DefaultTracePath, []byte(`{"enabled": true}`), nil, false))
+	waitFor(true)
+	must(t).noErr(s.delete(DefaultTracePath, nil))
+	waitFor(false)
+
+	close(cancel)
+	if err := <-done; err != nil {
+		t.Fatalf("Expected nil error after cancel. Got: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"time"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// MetakvScope type describes metakv access granted by metakv token
+// (see Authenticator.MintMetakvToken).
+type MetakvScope = cbauthimpl.MetakvScope
+
+// ErrMetakvTokenInvalid is returned when metakv token is malformed,
+// expired or isn't signed by local node.
+var ErrMetakvTokenInvalid = cbauthimpl.ErrMetakvTokenInvalid
+
+func (a *authImpl) MintMetakvToken(user, prefix string, readOnly bool, ttl time.Duration) (string, error) {
+	return cbauthimpl.MintMetakvToken(a.svc, &MetakvScope{
+		User:     user,
+		Prefix:   prefix,
+		ReadOnly: readOnly,
+		Expires:  cbauthimpl.Now().Add(ttl),
+	})
+}
+
+func (a *authImpl) VerifyMetakvToken(token string) (*MetakvScope, error) {
+	return cbauthimpl.VerifyMetakvToken(a.svc, token)
+}
+
+// DecodeMetakvToken returns scope of given metakv token without
+// verifying it. Holders of token (e.g. metakv.ScopedStore) use it
+// to enforce scope on their side.
+func DecodeMetakvToken(token string) (*MetakvScope, error) {
+	return cbauthimpl.DecodeMetakvToken(token)
+}
+
+// MintMetakvToken returns token that grants given user access only
+// to metakv keys under given prefix for given period of time. Uses
+// default authenticator.
+func MintMetakvToken(user, prefix string, readOnly bool, ttl time.Duration) (string, error) {
+	a := GetDefault()
+	if a == nil {
+		return "", ErrNotInitialized
+	}
+	return a.MintMetakvToken(user, prefix, readOnly, ttl)
+}
@@ -0,0 +1,98 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package middleware provides http.Handler wrappers that protect
+// handlers with cbauth, so that services don't have to reimplement
+// authentication boilerplate. For table driven authorization of
+// whole services see cbauth.RouteTable.
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/couchbase/cbauth"
+)
+
+// Options struct configures RequireCreds.
+type Options struct {
+	// Authenticator is used to authenticate requests. Default
+	// authenticator is used if it's nil.
+	Authenticator cbauth.Authenticator
+	// Permission, if non-empty, must be granted to creds (see
+	// cbauth.HasPermission), otherwise 403 is sent.
+	Permission string
+	// Authorize, if non-nil, is called after permission check.
+	// If it returns false, 403 is sent.
+	Authorize func(c cbauth.Creds, req *http.Request) (bool, error)
+	// CorrelationID makes 401 responses carry correlation id of
+	// failed auth (see cbauth.SendUnauthorizedWithID).
+	CorrelationID bool
+	// Hosts, if non-nil, is policy requests are checked against
+	// before authentication (see cbauth.HostPolicy). Requests to
+	// other hosts get 421.
+	Hosts *cbauth.HostPolicy
+}
+
+// RequireCreds returns handler that authenticates requests with
+// AuthWebCreds and passes them to next handler with creds put to
+// request context (see cbauth.CredsFromContext). Requests without
+// valid creds get 401 with WWW-Authenticate challenges, requests
+// that are not authorized get 403 and requests that couldn't be
+// checked (e.g. because cbauth database is stale) get 503 or 500.
+// Auth is done under request context, so it is aborted if client
+// goes away.
+func RequireCreds(next http.Handler, opts Options) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var creds cbauth.Creds
+		err := cbauth.WithAuthenticator(opts.Authenticator, func(a cbauth.Authenticator) (err error) {
+			if opts.Hosts != nil {
+				if err = a.ValidateHost(req, opts.Hosts); err != nil {
+					return
+				}
+			}
+			creds, err = a.AuthWebCredsContext(req.Context(), req)
+			return
+		})
+		if err != nil {
+			cbauth.SendHostError(w, err)
+			return
+		}
+		if creds == cbauth.NoAccessCreds {
+			if opts.CorrelationID {
+				cbauth.SendUnauthorizedWithID(w, req)
+			} else {
+				cbauth.SendUnauthorized(w)
+			}
+			return
+		}
+		ok := true
+		if opts.Permission != "" {
+			ok, err = cbauth.HasPermission(creds, opts.Permission)
+		}
+		if err == nil && ok && opts.Authorize != nil {
+			ok, err = opts.Authorize(creds, req)
+		}
+		if err != nil {
+			cbauth.SendAuthError(w, err)
+			return
+		}
+		if !ok {
+			cbauth.SendForbidden(w)
+			return
+		}
+		cbauth.SetAuthenticationInfo(w, creds)
+		next.ServeHTTP(w, req.WithContext(cbauth.ContextWithCreds(req.Context(), creds)))
+	})
+}
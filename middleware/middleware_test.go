@@ -0,0 +1,121 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/couchbase/cbauth"
+)
+
+type testCreds struct {
+	cbauth.Creds
+	name  string
+	admin bool
+}
+
+func (c *testCreds) Name() string { return c.name }
+
+func (c *testCreds) IsAdmin() (bool, error) { return c.admin, nil }
+
+type testAuthenticator struct {
+	cbauth.Authenticator
+	users map[string]cbauth.Creds
+}
+
+func (a *testAuthenticator) AuthWebCredsContext(ctx context.Context, req *http.Request) (cbauth.Creds, error) {
+	user, _, _ := req.BasicAuth()
+	if user == "broken" {
+		return nil, errors.New("boom")
+	}
+	if c, ok := a.users[user]; ok {
+		return c, nil
+	}
+	return cbauth.NoAccessCreds, nil
+}
+
+func (a *testAuthenticator) ValidateHost(req *http.Request, p *cbauth.HostPolicy) error {
+	if req.Host != "node1.internal" {
+		return &cbauth.HostNotAllowedError{Host: req.Host}
+	}
+	return nil
+}
+
+func TestRequireCreds(t *testing.T) {
+	a := &testAuthenticator{users: map[string]cbauth.Creds{
+		"admin": &testCreds{name: "admin", admin: true},
+		"user":  &testCreds{name: "user"},
+	}}
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c, ok := cbauth.CredsFromContext(req.Context())
+		if !ok {
+			t.Errorf("Expect creds in context")
+			return
+		}
+		w.Write([]byte(c.Name()))
+	})
+	h := RequireCreds(next, Options{
+		Authenticator: a,
+		Permission:    cbauth.PermissionAdmin,
+		CorrelationID: true,
+	})
+
+	serve := func(user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/x", nil)
+		if user != "" {
+			req.SetBasicAuth(user, "pwd")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := serve("admin"); w.Code != 200 || w.Body.String() != "admin" {
+		t.Fatalf("Expect admin to pass. Got: %d %s", w.Code, w.Body)
+	}
+	if w := serve("user"); w.Code != 403 {
+		t.Fatalf("Expect 403 for non admin. Got: %d", w.Code)
+	}
+	w := serve("")
+	if w.Code != 401 || w.Header().Get("WWW-Authenticate") == "" || w.Header().Get(cbauth.CorrelationIDHeader) == "" {
+		t.Fatalf("Expect 401 with challenge and correlation id. Got: %d %v", w.Code, w.Header())
+	}
+	if w := serve("broken"); w.Code != 500 {
+		t.Fatalf("Expect 500 on auth error. Got: %d", w.Code)
+	}
+
+	h = RequireCreds(next, Options{
+		Authenticator: a,
+		Authorize: func(c cbauth.Creds, req *http.Request) (bool, error) {
+			return c.Name() == "user", nil
+		},
+	})
+	if w := serve("user"); w.Code != 200 {
+		t.Fatalf("Expect user to be authorized. Got: %d", w.Code)
+	}
+	if w := serve("admin"); w.Code != 403 {
+		t.Fatalf("Expect admin to be refused. Got: %d", w.Code)
+	}
+
+	h = RequireCreds(next, Options{Authenticator: a, Hosts: &cbauth.HostPolicy{}})
+	if w := serve("user"); w.Code != 421 {
+		t.Fatalf("Expect 421 for unexpected host. Got: %d", w.Code)
+	}
+}
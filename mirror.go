@@ -0,0 +1,81 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// Mirror type is read-only Authenticator that answers questions
+// against cache snapshot (see WriteCacheSnapshot) offline, so that
+// support tools can analyze permissions without cluster access.
+// Snapshots carry fingerprints rather than passwords, so mirror
+// can't authenticate anyone; creds of users are looked up by Creds
+// instead. Mirror never talks to ns_server: permissions that roles of
+// snapshot can't decide are reported as ErrUndecidedPermission.
+type Mirror struct {
+	*authImpl
+}
+
+// NewMirror returns mirror of given cache snapshot.
+func NewMirror(c *Cache) (*Mirror, error) {
+	snapshot := *c
+	snapshot.TokenCheckURL = ""
+	snapshot.PermissionCheckURL = ""
+	svc := cbauthimpl.NewSVC(0, &DBStaleError{})
+	if err := svc.UpdateDB(&snapshot, nil); err != nil {
+		return nil, err
+	}
+	return &Mirror{&authImpl{svc: svc}}, nil
+}
+
+// ReadMirror returns mirror of json cache snapshot read from given
+// reader.
+func ReadMirror(r io.Reader) (*Mirror, error) {
+	var c Cache
+	if err := json.NewDecoder(r).Decode(&c); err != nil {
+		return nil, err
+	}
+	return NewMirror(&c)
+}
+
+// Creds method returns creds of given user of given domain (any
+// domain if it's empty) as known to snapshot or NoAccessCreds if
+// snapshot doesn't know such user. Built-in admin and read-only admin
+// are users of "admin" and "ro_admin" domains.
+func (m *Mirror) Creds(user, domain string) (Creds, error) {
+	c, err := cbauthimpl.MirrorCreds(m.svc, user, domain)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return NoAccessCreds, nil
+	}
+	return c, nil
+}
+
+// IsAllowed method returns true iff given user of given domain is
+// granted given permission according to snapshot (see Creds).
+func (m *Mirror) IsAllowed(user, domain, permission string) (bool, error) {
+	c, err := m.Creds(user, domain)
+	if err != nil {
+		return false, err
+	}
+	return c.IsAllowed(permission)
+}
@@ -0,0 +1,105 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// OnBehalfOfHeader is http header by which internal users (i.e.
+// other services of this cluster, e.g. query or XDCR) assert user
+// that request is made on behalf of. Its value is base64 encoding
+// of "user:domain". AuthWebCreds returns creds of asserted user that
+// report internal user as their Actor.
+const OnBehalfOfHeader = cbauthimpl.OnBehalfOfHeader
+
+// ErrOnBehalfOfDenied is returned from AuthWebCreds when creds that
+// are not internal assert other user or when asserted user is
+// malformed.
+var ErrOnBehalfOfDenied = cbauthimpl.ErrOnBehalfOfDenied
+
+// OnBehalfOfValue returns OnBehalfOfHeader value that asserts given
+// user of given domain.
+func OnBehalfOfValue(user, domain string) string {
+	return base64.StdEncoding.EncodeToString([]byte(user + ":" + domain))
+}
+
+func parseOnBehalfOf(v string) (user, domain string, ok bool) {
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return "", "", false
+	}
+	// user names may contain colons, domains can't
+	i := strings.LastIndexByte(string(b), ':')
+	if i <= 0 || i == len(b)-1 {
+		return "", "", false
+	}
+	return string(b[:i]), string(b[i+1:]), true
+}
+
+// maybeOnBehalfOf returns creds of user asserted by on-behalf-of
+// header of given request if there is one (see OnBehalfOfHeader).
+func maybeOnBehalfOf(ctx context.Context, a *authImpl, creds Creds, req *http.Request) (Creds, error) {
+	v := req.Header.Get(OnBehalfOfHeader)
+	if v == "" || creds == NoAccessCreds {
+		return creds, nil
+	}
+	ci, ok := creds.(*cbauthimpl.CredsImpl)
+	if !ok {
+		return nil, ErrOnBehalfOfDenied
+	}
+	user, domain, ok := parseOnBehalfOf(v)
+	if !ok {
+		tracef(creds.Name(), "malformed on-behalf-of header from %v", creds)
+		return nil, ErrOnBehalfOfDenied
+	}
+	rv, err := cbauthimpl.OnBehalfOf(ci, user, domain)
+	if err != nil {
+		tracef(creds.Name(), "on-behalf-of %s:%s was refused for %v", domain, TagUserData(user), creds)
+		return nil, err
+	}
+	if rv != nil {
+		tracef(user, "%v acts on behalf of %s:%s", creds, domain, TagUserData(user))
+		return rv, nil
+	}
+
+	// user is unknown to cache (e.g. it's external), so ns_server
+	// is asked to resolve assertion
+	tracef(user, "%s:%s asserted by %v is unknown to cache, escalating to ns_server",
+		domain, TagUserData(user), creds)
+	c, err := doOnServer(ctx, a.svc, user, req.Header)
+	if err != nil || c == NoAccessCreds {
+		return c, err
+	}
+	sc, ok := c.(*cbauthimpl.CredsImpl)
+	if !ok {
+		return nil, ErrOnBehalfOfDenied
+	}
+	scDomain := sc.Identity().Domain
+	if scDomain == "" {
+		scDomain = sc.Source()
+	}
+	if sc.Name() != user || scDomain != domain {
+		tracef(user, "ns_server resolved %s:%s asserted by %v to %v", domain, TagUserData(user), creds, sc)
+		return nil, ErrOnBehalfOfDenied
+	}
+	return cbauthimpl.WithActor(sc, ci.Name()), nil
+}
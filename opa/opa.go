@@ -0,0 +1,159 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package opa implements cbauth.SecondaryAuthorizer that consults
+// Open Policy Agent. Decisions are obtained from OPA's REST data API
+// and are cached for a short period of time.
+//
+// Embedded rego evaluation is not implemented here in order to keep
+// cbauth free of OPA dependencies. It can be plugged by wrapping
+// rego evaluation into Evaluator and passing it to NewCachingAuthorizer.
+package opa
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/couchbase/cbauth"
+)
+
+// Evaluator type adapts function evaluating authorization requests
+// to cbauth.SecondaryAuthorizer interface.
+type Evaluator func(in *cbauth.AuthzInput) (bool, error)
+
+// Authorize method simply calls "this" function.
+func (e Evaluator) Authorize(in *cbauth.AuthzInput) (bool, error) {
+	return e(in)
+}
+
+// NewRESTEvaluator returns Evaluator that queries given OPA data api
+// url (e.g. http://127.0.0.1:8181/v1/data/couchbase/allow). Document
+// at that url is expected to be boolean. Undefined document means
+// access is denied. If nil client is passed http.DefaultClient is
+// used.
+func NewRESTEvaluator(url string, client *http.Client) Evaluator {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return func(in *cbauth.AuthzInput) (bool, error) {
+		body, err := json.Marshal(map[string]interface{}{"input": in})
+		if err != nil {
+			return false, err
+		}
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return false, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return false, fmt.Errorf("opa returned: %s", resp.Status)
+		}
+		var rv struct {
+			Result *bool `json:"result"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&rv); err != nil {
+			return false, err
+		}
+		return rv.Result != nil && *rv.Result, nil
+	}
+}
+
+type cacheEntry struct {
+	allowed bool
+	expires time.Time
+}
+
+// CachingAuthorizer is cbauth.SecondaryAuthorizer that caches
+// decisions of another SecondaryAuthorizer. Errors are not cached.
+type CachingAuthorizer struct {
+	inner      cbauth.SecondaryAuthorizer
+	ttl        time.Duration
+	maxEntries int
+
+	l     sync.Mutex
+	cache map[cbauth.AuthzInput]cacheEntry
+}
+
+// NewCachingAuthorizer returns CachingAuthorizer that caches
+// decisions of given authorizer for given ttl. At most maxEntries
+// decisions are cached.
+func NewCachingAuthorizer(inner cbauth.SecondaryAuthorizer, ttl time.Duration, maxEntries int) *CachingAuthorizer {
+	return &CachingAuthorizer{
+		inner:      inner,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		cache:      make(map[cbauth.AuthzInput]cacheEntry),
+	}
+}
+
+// NewRESTAuthorizer returns CachingAuthorizer that consults OPA at
+// given data api url (see NewRESTEvaluator) and caches decisions for
+// given ttl.
+func NewRESTAuthorizer(url string, ttl time.Duration, maxEntries int) *CachingAuthorizer {
+	return NewCachingAuthorizer(NewRESTEvaluator(url, nil), ttl, maxEntries)
+}
+
+// Authorize method returns cached decision for given input or
+// consults inner authorizer if there is none.
+func (ca *CachingAuthorizer) Authorize(in *cbauth.AuthzInput) (bool, error) {
+	now := time.Now()
+	ca.l.Lock()
+	e, ok := ca.cache[*in]
+	ca.l.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.allowed, nil
+	}
+
+	allowed, err := ca.inner.Authorize(in)
+	if err != nil {
+		return false, err
+	}
+
+	ca.l.Lock()
+	defer ca.l.Unlock()
+	if len(ca.cache) >= ca.maxEntries {
+		ca.evictLocked(now)
+	}
+	if len(ca.cache) < ca.maxEntries {
+		ca.cache[*in] = cacheEntry{allowed, now.Add(ca.ttl)}
+	}
+	return allowed, nil
+}
+
+func (ca *CachingAuthorizer) evictLocked(now time.Time) {
+	for k, e := range ca.cache {
+		if !now.Before(e.expires) {
+			delete(ca.cache, k)
+		}
+	}
+	// if nothing is expired, evict arbitrary entry
+	for k := range ca.cache {
+		if len(ca.cache) < ca.maxEntries {
+			break
+		}
+		delete(ca.cache, k)
+	}
+}
+
+// Flush drops all cached decisions (e.g. after policy change).
+func (ca *CachingAuthorizer) Flush() {
+	ca.l.Lock()
+	ca.cache = make(map[cbauth.AuthzInput]cacheEntry)
+	ca.l.Unlock()
+}
@@ -0,0 +1,76 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opa
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/couchbase/cbauth"
+)
+
+func TestRESTAuthorizer(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		var req struct {
+			Input cbauth.AuthzInput `json:"input"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+		switch req.Input.User {
+		case "alice":
+			w.Write([]byte(`{"result": true}`))
+		case "bob":
+			w.Write([]byte(`{"result": false}`))
+		default:
+			// undefined document
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer srv.Close()
+
+	ca := NewRESTAuthorizer(srv.URL+"/v1/data/couchbase/allow", time.Hour, 2)
+	for _, c := range []struct {
+		user    string
+		allowed bool
+	}{{"alice", true}, {"bob", false}, {"alice", true}, {"bob", false}, {"carol", false}} {
+		allowed, err := ca.Authorize(&cbauth.AuthzInput{User: c.user, Path: "/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != c.allowed {
+			t.Fatalf("Expected %v for %s. Got %v", c.allowed, c.user, allowed)
+		}
+	}
+	if calls != 3 {
+		t.Fatalf("Expected decisions to be cached. Got %d calls", calls)
+	}
+	if len(ca.cache) > 2 {
+		t.Fatalf("Expected cache to be bounded. Got %d entries", len(ca.cache))
+	}
+
+	ca.Flush()
+	ca.Authorize(&cbauth.AuthzInput{User: "alice", Path: "/"})
+	if calls != 4 {
+		t.Fatalf("Expected flush to drop cached decisions. Got %d calls", calls)
+	}
+}
@@ -0,0 +1,114 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+)
+
+// Policy struct describes service-level authorization policy that
+// can be loaded into RouteTable. It is usually kept in json file or
+// in metakv, so that operators can change it without redeploying
+// services. E.g.:
+//
+//	{"routes": [{"method": "GET", "pattern": "/ping", "anonymous": true},
+//	            {"pattern": "/settings", "permission": "cluster.admin"}],
+//	 "deny": ["mallory"]}
+type Policy struct {
+	// Routes are matched in order, see RouteTable.
+	Routes []Route `json:"routes"`
+	// Deny is list of users that are refused access to every
+	// non-anonymous route regardless of their permissions.
+	// Entries of the form "domain:name" (e.g. "external:mallory")
+	// only match users of that domain (see Identity), plain names
+	// match users of any domain.
+	Deny []string `json:"deny,omitempty"`
+}
+
+// DefaultPolicyWatchInterval is interval WatchPolicyFile re-checks
+// policy file with if non-positive interval is given.
+const DefaultPolicyWatchInterval = 10 * time.Second
+
+// ParsePolicy parses json encoded Policy.
+func ParsePolicy(data []byte) (*Policy, error) {
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// LoadPolicy parses given json encoded policy and installs it into
+// route table. Route table is kept intact if policy is invalid.
+func (rt *RouteTable) LoadPolicy(data []byte) error {
+	p, err := ParsePolicy(data)
+	if err != nil {
+		return err
+	}
+	return rt.SetPolicy(p)
+}
+
+// StartWatchPolicyFile runs WatchPolicyFile in background until
+// returned watcher is stopped.
+func StartWatchPolicyFile(rt *RouteTable, path string, interval time.Duration, onError func(error)) *Watcher {
+	return StartWatcher(func(cancel <-chan struct{}) error {
+		return WatchPolicyFile(rt, path, interval, onError, cancel)
+	})
+}
+
+// WatchPolicyFile loads policy from given file into given route
+// table and then re-checks that file every interval, reloading policy
+// when file contents change. Errors of initial load are returned.
+// Later errors (e.g. operator saved malformed policy) are passed to
+// onError (if it's non-nil) and previously loaded policy stays in
+// effect. Returns nil when cancel channel is closed. Non-positive
+// interval means DefaultPolicyWatchInterval.
+func WatchPolicyFile(rt *RouteTable, path string, interval time.Duration, onError func(error), cancel <-chan struct{}) error {
+	if interval <= 0 {
+		interval = DefaultPolicyWatchInterval
+	}
+	last, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := rt.LoadPolicy(last); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cancel:
+			return nil
+		case <-ticker.C:
+		}
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			if bytes.Equal(data, last) {
+				continue
+			}
+			err = rt.LoadPolicy(data)
+			last = data
+		}
+		if err != nil && onError != nil {
+			onError(err)
+		}
+	}
+}
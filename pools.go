@@ -0,0 +1,73 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"time"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// PoolLimits struct describes limits of HTTP connection pool. Zero
+// fields keep defaults of http.DefaultTransport.
+type PoolLimits = cbauthimpl.PoolLimits
+
+// Pool is HTTP round tripper backed by its own connection pool.
+type Pool = cbauthimpl.Pool
+
+// DefaultAuthPoolLimits are limits of pool used for calls to
+// ns_server's auth endpoint.
+var DefaultAuthPoolLimits = cbauthimpl.DefaultAuthPoolLimits
+
+// NewPool creates connection pool with given limits. Traffic sent
+// through it doesn't compete for connections with other pools.
+func NewPool(limits PoolLimits) *Pool {
+	return cbauthimpl.NewPool(limits)
+}
+
+// SetAuthPoolLimits sets limits of connection pool used for calls to
+// ns_server's auth endpoint (see AuthWebCreds). This pool is not
+// shared with metakv, which has its own (see metakv.SetPoolLimits).
+func SetAuthPoolLimits(limits PoolLimits) {
+	cbauthimpl.AuthPool.SetLimits(limits)
+}
+
+// HashPoolConfig struct configures pool of workers that compute slow
+// password hashes.
+type HashPoolConfig = cbauthimpl.HashPoolConfig
+
+// ErrAffinityUnsupported is returned by SetHashPool if CPUs are given
+// on platform where threads can't be pinned.
+var ErrAffinityUnsupported = cbauthimpl.ErrAffinityUnsupported
+
+// SetHashPool makes PBKDF2 and argon2id hashes of password
+// verifications be computed by given number of workers, optionally
+// pinned to given CPUs, so that bursts of new connections don't take
+// cycles from latency critical goroutines. By default hashes are
+// computed by goroutines that verify passwords.
+func SetHashPool(cfg HashPoolConfig) error {
+	return cbauthimpl.SetHashPool(cfg)
+}
+
+// SetAuthHedgeDelay makes calls to ns_server's auth endpoint that
+// are not answered within given delay be hedged: identical request
+// is sent once more and whichever response arrives first is used. It
+// cuts tail latency of auth when loopback networking is jittery at
+// the cost of extra calls. Zero delay (which is default) disables
+// hedging.
+func SetAuthHedgeDelay(d time.Duration) {
+	cbauthimpl.SetAuthHedgeDelay(d)
+}
@@ -0,0 +1,263 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrRateLimited is returned by AuthWebCreds when request is refused
+// without verification because too many auth attempts of its user or
+// from its source address failed recently (see SetAuthRateLimit).
+// Services are expected to respond with 429 Too Many Requests.
+var ErrRateLimited = errors.New("too many failed auth attempts")
+
+// DefaultAuthRateLimitBurst is number of failed attempts that are
+// allowed at once if AuthRateLimit.Burst is not positive.
+const DefaultAuthRateLimitBurst = 10
+
+// authRateLimitSize is maximal number of users (and of source
+// addresses) failed attempts of which are tracked.
+const authRateLimitSize = 4096
+
+// Kinds of limits of RateLimitEvent.
+const (
+	RateLimitIdentity = "identity"
+	RateLimitSource   = "source"
+)
+
+// RateLimitEvent struct describes limit that tripped.
+type RateLimitEvent struct {
+	// Kind is either RateLimitIdentity or RateLimitSource.
+	Kind string
+	// Key is user name or source ip address limit of which
+	// tripped.
+	Key string
+	// Request is request that was refused first.
+	Request *http.Request
+}
+
+// AuthRateLimit struct configures limiting of failed auth attempts
+// of AuthWebCreds. Every attempt that results in NoAccessCreds
+// spends allowance of user it names (for basic auth) and of address
+// it comes from. Once either allowance is spent, requests are
+// refused with ErrRateLimited until it is replenished, so that
+// floods of bad creds don't reach ns_server.
+type AuthRateLimit struct {
+	// PerIdentity is number of failed attempts per second that
+	// are allowed for every user. Zero disables limit.
+	PerIdentity float64
+	// PerSource is number of failed attempts per second that are
+	// allowed from every source ip address. Zero disables limit.
+	PerSource float64
+	// Burst is number of failed attempts that are allowed at once.
+	Burst int
+	// OnLimit, if non-nil, is called when limit trips, i.e. when
+	// first request is refused after allowance was spent. It is
+	// called synchronously, so it must not block.
+	OnLimit func(e RateLimitEvent)
+}
+
+type authRateLimitBox struct {
+	l *AuthRateLimit
+}
+
+var authRateLimit atomic.Value
+
+// SetAuthRateLimit sets (or clears if nil is passed) limit of failed
+// auth attempts of every Authenticator.
+func SetAuthRateLimit(l *AuthRateLimit) {
+	authRateLimit.Store(authRateLimitBox{l})
+}
+
+func getAuthRateLimit() *AuthRateLimit {
+	b, _ := authRateLimit.Load().(authRateLimitBox)
+	return b.l
+}
+
+func (l *AuthRateLimit) burst() float64 {
+	if l.Burst <= 0 {
+		return DefaultAuthRateLimitBurst
+	}
+	return float64(l.Burst)
+}
+
+type rateBucket struct {
+	allowance float64
+	last      time.Time
+	tripped   bool
+}
+
+func (b *rateBucket) refill(rate, burst float64, now time.Time) {
+	b.allowance += now.Sub(b.last).Seconds() * rate
+	if b.allowance > burst {
+		b.allowance = burst
+	}
+	b.last = now
+}
+
+// rateTable tracks allowances of failed attempts keyed by user or
+// source address. Keys that have full allowance are not tracked.
+type rateTable struct {
+	entries map[string]*rateBucket
+}
+
+// limited returns true if allowance of given key is spent. tripped
+// is true if it wasn't spent last time it was checked.
+func (t *rateTable) limited(key string, rate, burst float64, now time.Time) (limited, tripped bool) {
+	b := t.entries[key]
+	if b == nil {
+		return false, false
+	}
+	b.refill(rate, burst, now)
+	if b.allowance >= 1 {
+		b.tripped = false
+		return false, false
+	}
+	tripped = !b.tripped
+	b.tripped = true
+	return true, tripped
+}
+
+func (t *rateTable) spend(key string, rate, burst float64, now time.Time) {
+	b := t.entries[key]
+	if b == nil {
+		if t.entries == nil {
+			t.entries = make(map[string]*rateBucket)
+		}
+		if len(t.entries) >= authRateLimitSize && !t.evict(rate, burst, now) {
+			// every tracked key is limited, so new key is
+			// not tracked rather than lifting their limits
+			return
+		}
+		b = &rateBucket{allowance: burst, last: now}
+		t.entries[key] = b
+	}
+	b.refill(rate, burst, now)
+	if b.allowance >= 1 {
+		b.allowance--
+	} else {
+		b.allowance = 0
+	}
+}
+
+// evict makes room for new key: it forgets keys with full allowance
+// or, if there are none, key with most allowance left. Keys with
+// spent allowance are never forgotten. Returns false if there's no
+// room.
+func (t *rateTable) evict(rate, burst float64, now time.Time) bool {
+	var victim string
+	most := 1.0
+	for k, e := range t.entries {
+		e.refill(rate, burst, now)
+		if e.allowance >= burst {
+			delete(t.entries, k)
+		} else if e.allowance >= most {
+			victim, most = k, e.allowance
+		}
+	}
+	if len(t.entries) < authRateLimitSize {
+		return true
+	}
+	if victim == "" {
+		return false
+	}
+	delete(t.entries, victim)
+	return true
+}
+
+// authRateLimiter holds allowances of failed attempts of
+// Authenticator. Zero value has every allowance full.
+type authRateLimiter struct {
+	l          sync.Mutex
+	identities rateTable
+	sources    rateTable
+}
+
+// rateLimitKeys returns user and source address of given request
+// that failed attempts are accounted to.
+func rateLimitKeys(req *http.Request) (user, source string) {
+	user, _, _ = req.BasicAuth()
+	source, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		source = req.RemoteAddr
+	}
+	return user, source
+}
+
+// check returns ErrRateLimited if allowance of user or source of
+// given request is spent.
+func (r *authRateLimiter) check(req *http.Request) error {
+	cfg := getAuthRateLimit()
+	if cfg == nil {
+		return nil
+	}
+	user, source := rateLimitKeys(req)
+	now, burst := time.Now(), cfg.burst()
+	var refused bool
+	var events []RateLimitEvent
+	r.l.Lock()
+	if cfg.PerSource > 0 && source != "" {
+		limited, tripped := r.sources.limited(source, cfg.PerSource, burst, now)
+		refused = limited
+		if tripped {
+			events = append(events, RateLimitEvent{RateLimitSource, source, req})
+		}
+	}
+	if cfg.PerIdentity > 0 && user != "" {
+		limited, tripped := r.identities.limited(user, cfg.PerIdentity, burst, now)
+		refused = refused || limited
+		if tripped {
+			events = append(events, RateLimitEvent{RateLimitIdentity, user, req})
+		}
+	}
+	r.l.Unlock()
+
+	if cfg.OnLimit != nil {
+		for _, e := range events {
+			cfg.OnLimit(e)
+		}
+	}
+	if refused {
+		tracef(user, "auth of %s from %s is rate limited", TagUserData(user), source)
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// fail spends allowances of user and source of given request which
+// auth failed.
+func (r *authRateLimiter) fail(req *http.Request) {
+	cfg := getAuthRateLimit()
+	if cfg == nil {
+		return
+	}
+	user, source := rateLimitKeys(req)
+	now, burst := time.Now(), cfg.burst()
+	r.l.Lock()
+	defer r.l.Unlock()
+	if cfg.PerSource > 0 && source != "" {
+		r.sources.spend(source, cfg.PerSource, burst, now)
+	}
+	if cfg.PerIdentity > 0 && user != "" {
+		r.identities.spend(user, cfg.PerIdentity, burst, now)
+	}
+}
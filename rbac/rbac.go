@@ -0,0 +1,387 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rbac is authorization data model of cbauth: roles as
+// ns_server grants them, RBAC permissions and evaluation of
+// permissions against roles. It has no dependencies on live cbauth
+// state, so that tools (e.g. offline analyzers and policy linters)
+// can decide whether some user would be allowed something against
+// cache snapshot (see Snapshot and cbauth.WriteCacheSnapshot).
+package rbac
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Cluster-wide permissions. Bucket permissions are constructed via
+// BucketPermission.
+const (
+	PermissionAdmin           = "cluster.admin"
+	PermissionReadAnyMetadata = "cluster.settings!read"
+)
+
+// Bucket operations that can be passed to BucketPermission.
+const (
+	BucketOpRead   = "data!read"
+	BucketOpWrite  = "data!write"
+	BucketOpDDL    = "views!write"
+	BucketOpDCP    = "data.dcp!read"
+	BucketOpManage = "settings!write"
+)
+
+// BucketOps returns all bucket operations.
+func BucketOps() []string {
+	return []string{BucketOpRead, BucketOpWrite, BucketOpDDL, BucketOpDCP, BucketOpManage}
+}
+
+// AnyBucket can be passed to BucketPermission to construct
+// permission that applies to every bucket.
+const AnyBucket = "."
+
+// AnyParam is parameter of role (bucket, scope or collection) that
+// means any.
+const AnyParam = "*"
+
+// BucketPermission returns permission string for given operation
+// on given bucket.
+func BucketPermission(bucket, op string) string {
+	return "cluster.bucket[" + bucket + "]." + op
+}
+
+// Role struct describes role (possibly parameterized by bucket, scope
+// and collection) granted to some user or group. AnyParam parameter
+// means any.
+type Role struct {
+	Name       string `json:"role"`
+	Bucket     string `json:"bucket_name,omitempty"`
+	Scope      string `json:"scope_name,omitempty"`
+	Collection string `json:"collection_name,omitempty"`
+}
+
+// String method returns role in ns_server notation, e.g.
+// "data_reader[foo:inventory:airline]".
+func (r Role) String() string {
+	if r.Bucket == "" {
+		return r.Name
+	}
+	params := r.Bucket
+	if r.Scope != "" {
+		params += ":" + r.Scope
+		if r.Collection != "" {
+			params += ":" + r.Collection
+		}
+	}
+	return r.Name + "[" + params + "]"
+}
+
+// ParseRole parses role in ns_server notation (see Role.String).
+func ParseRole(s string) (Role, error) {
+	open := strings.IndexByte(s, '[')
+	if open < 0 {
+		if s == "" || strings.ContainsAny(s, "]:") {
+			return Role{}, fmt.Errorf("malformed role: `%s'", s)
+		}
+		return Role{Name: s}, nil
+	}
+	if open == 0 || !strings.HasSuffix(s, "]") {
+		return Role{}, fmt.Errorf("malformed role: `%s'", s)
+	}
+	params := strings.Split(s[open+1:len(s)-1], ":")
+	if len(params) > 3 {
+		return Role{}, fmt.Errorf("malformed role: `%s'", s)
+	}
+	for _, p := range params {
+		if p == "" || strings.ContainsAny(p, "[]") {
+			return Role{}, fmt.Errorf("malformed role: `%s'", s)
+		}
+	}
+	rv := Role{Name: s[:open], Bucket: params[0]}
+	if len(params) > 1 {
+		rv.Scope = params[1]
+	}
+	if len(params) > 2 {
+		rv.Collection = params[2]
+	}
+	return rv, nil
+}
+
+// UnmarshalJSON method decodes role either from object with role,
+// bucket_name, scope_name and collection_name fields or from string
+// in ns_server notation (see ParseRole). Roles with scope but without
+// bucket or with collection but without scope are refused, since they
+// would otherwise be granted on every scope or collection.
+func (r *Role) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		rv, err := ParseRole(s)
+		if err != nil {
+			return err
+		}
+		*r = rv
+		return nil
+	}
+	type role Role
+	var rv role
+	if err := json.Unmarshal(data, &rv); err != nil {
+		return err
+	}
+	if rv.Name == "" || (rv.Scope != "" && rv.Bucket == "") || (rv.Collection != "" && rv.Scope == "") {
+		return fmt.Errorf("malformed role: `%s'", data)
+	}
+	*r = Role(rv)
+	return nil
+}
+
+// BucketWide method returns true iff role is granted on whole bucket
+// (or on every bucket) rather than on some of its scopes or
+// collections.
+func (r Role) BucketWide() bool {
+	return (r.Scope == "" || r.Scope == AnyParam) &&
+		(r.Collection == "" || r.Collection == AnyParam)
+}
+
+// OnBucket method returns true iff role is granted on whole given
+// bucket.
+func (r Role) OnBucket(bucket string) bool {
+	return (r.Bucket == bucket || r.Bucket == AnyParam) && r.BucketWide()
+}
+
+// OnCollection method returns true iff role is granted on given
+// collection, its scope or its bucket.
+func (r Role) OnCollection(bucket, scope, collection string) bool {
+	matches := func(param, name string) bool {
+		return param == "" || param == AnyParam || param == name
+	}
+	return (r.Bucket == bucket || r.Bucket == AnyParam) &&
+		matches(r.Scope, scope) && matches(r.Collection, collection)
+}
+
+// bucketRoleOps maps names of bucket roles to bucket operations they
+// grant. Other roles grant no bucket operations.
+var bucketRoleOps = map[string][]string{
+	"bucket_full_access": {BucketOpRead, BucketOpWrite, BucketOpDDL, BucketOpDCP},
+	"bucket_admin":       {BucketOpManage},
+	"data_reader":        {BucketOpRead},
+	"data_writer":        {BucketOpWrite},
+	"data_dcp_reader":    {BucketOpRead, BucketOpDCP},
+	"views_admin":        {BucketOpDDL},
+}
+
+// BucketRoleOps returns bucket operations granted by role of given
+// name wherever it is granted.
+func BucketRoleOps(name string) []string {
+	return bucketRoleOps[name]
+}
+
+// Grants method returns true iff role grants given bucket operation
+// wherever it is granted.
+func (r Role) Grants(op string) bool {
+	for _, o := range bucketRoleOps[r.Name] {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// Permission struct is parsed RBAC permission, e.g.
+// "cluster.bucket[foo].data.docs!write" is Path [cluster bucket[foo]
+// data docs] and Op write. PermissionAdmin has no Op.
+type Permission struct {
+	Path []string
+	Op   string
+}
+
+// ParsePermission parses RBAC permission string. Dots inside of
+// brackets (e.g. in bucket names) don't separate path components.
+func ParsePermission(s string) (*Permission, error) {
+	bang := strings.LastIndex(s, "!")
+	if bang < 0 {
+		if s == PermissionAdmin {
+			return &Permission{Path: []string{"cluster", "admin"}}, nil
+		}
+		return nil, fmt.Errorf("malformed permission: `%s'", s)
+	}
+	rv := &Permission{Op: s[bang+1:]}
+	depth, start := 0, 0
+	obj := s[:bang]
+	for i := 0; i <= len(obj); i++ {
+		switch {
+		case i == len(obj) || (obj[i] == '.' && depth == 0):
+			if i == start {
+				return nil, fmt.Errorf("malformed permission: `%s'", s)
+			}
+			rv.Path = append(rv.Path, obj[start:i])
+			start = i + 1
+		case obj[i] == '[':
+			depth++
+		case obj[i] == ']':
+			depth--
+		}
+		if depth < 0 {
+			return nil, fmt.Errorf("malformed permission: `%s'", s)
+		}
+	}
+	if depth != 0 || rv.Op == "" || strings.ContainsAny(rv.Op, ".[]") || rv.Path[0] != "cluster" {
+		return nil, fmt.Errorf("malformed permission: `%s'", s)
+	}
+	return rv, nil
+}
+
+// String method returns permission string.
+func (p *Permission) String() string {
+	s := strings.Join(p.Path, ".")
+	if p.Op == "" {
+		return s
+	}
+	return s + "!" + p.Op
+}
+
+// Bucket method returns name of bucket permission is about or "" if
+// it isn't bucket permission.
+func (p *Permission) Bucket() string {
+	if len(p.Path) < 2 || !strings.HasPrefix(p.Path[1], "bucket[") || !strings.HasSuffix(p.Path[1], "]") {
+		return ""
+	}
+	return p.Path[1][len("bucket[") : len(p.Path[1])-1]
+}
+
+// IsAnyBucket returns true iff given bucket name of permission or
+// role means every bucket.
+func IsAnyBucket(bucket string) bool {
+	return bucket == AnyBucket || bucket == AnyParam
+}
+
+// Covers method returns true iff permission p grants permission o,
+// i.e. it is the same operation on same object or on one of its
+// parents. Permission on any bucket covers permissions on every
+// bucket.
+func (p *Permission) Covers(o *Permission) bool {
+	if p.Op != o.Op || len(p.Path) > len(o.Path) {
+		return false
+	}
+	for i, c := range p.Path {
+		if c == o.Path[i] {
+			continue
+		}
+		if i != 1 || !IsAnyBucket(p.Bucket()) || o.Bucket() == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// PermsCover returns true iff one of given permissions grants o.
+// PermissionAdmin grants everything.
+func PermsCover(perms map[string]bool, o *Permission) bool {
+	if perms[PermissionAdmin] {
+		return true
+	}
+	for s := range perms {
+		if p, err := ParsePermission(s); err == nil && p.Covers(o) {
+			return true
+		}
+	}
+	return false
+}
+
+// Decision struct is result of evaluation of permission. If Decided
+// is false, roles may grant permission this package doesn't know
+// about, so permission has to be checked by ns_server.
+type Decision struct {
+	Allowed bool
+	Decided bool
+}
+
+// Subject struct describes whom permissions are evaluated for.
+// Admin and ROAdmin are cluster-wide admin and read-only admin
+// (which roles "admin" and "ro_admin" grant too).
+type Subject struct {
+	Admin   bool
+	ROAdmin bool
+	Roles   []Role
+}
+
+// grants returns true iff some role of subject grants given bucket
+// operation on whole given bucket.
+func (s *Subject) grants(bucket, op string) bool {
+	for _, r := range s.Roles {
+		if r.OnBucket(bucket) && r.Grants(op) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Subject) hasRole(name string) bool {
+	for _, r := range s.Roles {
+		if r.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate method decides given permission (e.g.
+// "cluster.bucket[foo].data.docs!write") for subject.
+func (s *Subject) Evaluate(permission string) (Decision, error) {
+	o, err := ParsePermission(permission)
+	if err != nil {
+		return Decision{}, err
+	}
+	return s.EvaluateParsed(o), nil
+}
+
+// EvaluateParsed method is Evaluate of parsed permission.
+func (s *Subject) EvaluateParsed(o *Permission) Decision {
+	if s.Admin || s.hasRole("admin") {
+		return Decision{Allowed: true, Decided: true}
+	}
+	if bucket := o.Bucket(); bucket != "" && !IsAnyBucket(bucket) {
+		for _, op := range BucketOps() {
+			p, _ := ParsePermission(BucketPermission(bucket, op))
+			if p.Covers(o) && s.grants(bucket, op) {
+				return Decision{Allowed: true, Decided: true}
+			}
+		}
+	}
+	if s.ROAdmin || s.hasRole("ro_admin") {
+		if d, ok := ROAdminDecision(o); ok {
+			return d
+		}
+	}
+	return Decision{}
+}
+
+// ROAdminDecision returns decision of given permission for read-only
+// admin and true if read-only admin flag alone decides it (i.e. if
+// it grants permission or if permission is read one, which read-only
+// admin may be granted beyond what this package knows).
+func ROAdminDecision(o *Permission) (Decision, bool) {
+	p, _ := ParsePermission(PermissionReadAnyMetadata)
+	if p.Covers(o) {
+		return Decision{Allowed: true, Decided: true}, true
+	}
+	// ro_admin reads much more than metadata
+	if o.Op == "read" {
+		return Decision{}, true
+	}
+	return Decision{}, false
+}
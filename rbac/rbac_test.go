@@ -0,0 +1,181 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParsePermission(t *testing.T) {
+	for _, s := range []string{
+		"cluster.admin",
+		"cluster.settings!read",
+		"cluster.bucket[foo.bar].data.docs!write",
+	} {
+		p, err := ParsePermission(s)
+		if err != nil || p.String() != s {
+			t.Fatalf("Expect %s to round trip. Got: %v, %v", s, p, err)
+		}
+	}
+	p, _ := ParsePermission("cluster.bucket[foo.bar].data.docs!write")
+	if b := p.Bucket(); b != "foo.bar" {
+		t.Fatalf("Expect bucket foo.bar. Got: %s", b)
+	}
+	for _, s := range []string{"", "cluster", "cluster.bucket[foo!read", "bucket[foo].data!read",
+		"cluster..data!read", "cluster.data!re.ad"} {
+		if _, err := ParsePermission(s); err == nil {
+			t.Fatalf("Expect `%s' to be malformed", s)
+		}
+	}
+}
+
+func TestCovers(t *testing.T) {
+	for _, c := range []struct {
+		p, o   string
+		covers bool
+	}{
+		{BucketPermission("foo", BucketOpRead), "cluster.bucket[foo].data.docs!read", true},
+		{BucketPermission(AnyBucket, BucketOpRead), "cluster.bucket[foo].data.docs!read", true},
+		{BucketPermission("foo", BucketOpRead), "cluster.bucket[bar].data.docs!read", false},
+		{BucketPermission("foo", BucketOpRead), "cluster.bucket[foo].data.docs!write", false},
+		{BucketPermission(AnyBucket, BucketOpRead), "cluster.settings!read", false},
+		{"cluster.bucket[foo].data.docs!read", BucketPermission("foo", BucketOpRead), false},
+	} {
+		p, err := ParsePermission(c.p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o, err := ParsePermission(c.o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Covers(o) != c.covers {
+			t.Fatalf("Expect %s covers %s to be %v", c.p, c.o, c.covers)
+		}
+	}
+	o, _ := ParsePermission("cluster.bucket[foo].data.docs!read")
+	if !PermsCover(map[string]bool{PermissionAdmin: true}, o) || PermsCover(map[string]bool{"garbage": true}, o) {
+		t.Fatalf("Unexpected PermsCover result")
+	}
+}
+
+func TestRoles(t *testing.T) {
+	r := Role{Name: "data_reader", Bucket: "foo", Scope: "inventory", Collection: "airline"}
+	if s := r.String(); s != "data_reader[foo:inventory:airline]" {
+		t.Fatalf("Unexpected role string: %s", s)
+	}
+	if r.BucketWide() || r.OnBucket("foo") || !r.OnCollection("foo", "inventory", "airline") ||
+		r.OnCollection("foo", "inventory", "hotel") {
+		t.Fatalf("Unexpected scope of %s", r)
+	}
+	any := Role{Name: "data_writer", Bucket: AnyParam}
+	if !any.OnBucket("foo") || !any.Grants(BucketOpWrite) || any.Grants(BucketOpRead) {
+		t.Fatalf("Unexpected grants of %s", any)
+	}
+	for _, s := range []string{"admin", "data_reader[foo]", "data_reader[foo:inventory:airline]", "bucket_admin[*]"} {
+		if p, err := ParseRole(s); err != nil || p.String() != s {
+			t.Fatalf("Expect %s to round trip. Got: %v, %v", s, p, err)
+		}
+	}
+	for _, s := range []string{"", "[foo]", "data_reader[foo", "data_reader[]", "data_reader[a:b:c:d]", "data:reader"} {
+		if _, err := ParseRole(s); err == nil {
+			t.Fatalf("Expect %q to be rejected", s)
+		}
+	}
+	var decoded []Role
+	if err := json.Unmarshal([]byte(`["data_reader[foo:inventory:airline]", {"role": "data_reader", "bucket_name": "foo", "scope_name": "inventory", "collection_name": "airline"}]`), &decoded); err != nil ||
+		len(decoded) != 2 || decoded[0] != r || decoded[1] != r {
+		t.Fatalf("Expect both forms to decode to %s. Got: %v, %v", r, decoded, err)
+	}
+	for _, s := range []string{`"data_reader[foo"`, `{"role": "data_reader", "collection_name": "airline", "bucket_name": "foo"}`, `{"bucket_name": "foo"}`} {
+		if err := json.Unmarshal([]byte(s), new(Role)); err == nil {
+			t.Fatalf("Expect %s to be rejected", s)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	for _, c := range []struct {
+		s          Subject
+		permission string
+		d          Decision
+	}{
+		{Subject{Admin: true}, "cluster.xdcr!write", Decision{true, true}},
+		{Subject{Roles: []Role{{Name: "admin"}}}, "cluster.xdcr!write", Decision{true, true}},
+		{Subject{ROAdmin: true}, PermissionReadAnyMetadata, Decision{true, true}},
+		{Subject{ROAdmin: true}, "cluster.logs!read", Decision{false, false}},
+		{Subject{ROAdmin: true}, "cluster.settings!write", Decision{false, false}},
+		{Subject{Roles: []Role{{Name: "data_reader", Bucket: "foo"}}},
+			"cluster.bucket[foo].data.docs!read", Decision{true, true}},
+		{Subject{Roles: []Role{{Name: "data_reader", Bucket: "foo"}}},
+			"cluster.bucket[bar].data.docs!read", Decision{false, false}},
+		{Subject{Roles: []Role{{Name: "data_reader", Bucket: "foo", Scope: "s"}}},
+			"cluster.bucket[foo].data.docs!read", Decision{false, false}},
+		{Subject{Roles: []Role{{Name: "query_select", Bucket: "foo"}}},
+			"cluster.bucket[foo].n1ql.select!execute", Decision{false, false}},
+	} {
+		d, err := c.s.Evaluate(c.permission)
+		if err != nil || d != c.d {
+			t.Fatalf("Expect %+v for %s of %+v. Got: %+v, %v", c.d, c.permission, c.s, d, err)
+		}
+	}
+	var s Subject
+	if _, err := s.Evaluate("garbage"); err == nil {
+		t.Fatalf("Expect malformed permission to fail")
+	}
+}
+
+const testSnapshot = `{
+  "Admin": {"User": "admin", "Salt": "x"},
+  "roAdmin": {"User": ""},
+  "users": [
+    {"name": "alice", "domain": "local", "roles": [{"role": "data_reader", "bucket_name": "foo"}]},
+    {"name": "bob", "domain": "external"}
+  ],
+  "Groups": [
+    {"Name": "writers", "Roles": [{"role": "data_writer", "bucket_name": "*"}], "ldapGroupRef": "cn=writers"}
+  ]
+}`
+
+func TestSnapshot(t *testing.T) {
+	s, err := ReadSnapshot(strings.NewReader(testSnapshot))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := BucketPermission("foo", BucketOpWrite)
+	for _, c := range []struct {
+		user, domain, permission string
+		groups                   []string
+		d                        Decision
+	}{
+		{"admin", DomainAdmin, write, nil, Decision{true, true}},
+		{"admin", "local", write, nil, Decision{false, true}},
+		{"", DomainROAdmin, PermissionReadAnyMetadata, nil, Decision{false, true}},
+		{"alice", "local", BucketPermission("foo", BucketOpRead), nil, Decision{true, true}},
+		{"alice", "local", write, nil, Decision{false, false}},
+		{"alice", "local", write, []string{"writers"}, Decision{true, true}},
+		{"bob", "external", write, []string{"cn=writers"}, Decision{true, true}},
+		{"carol", "local", BucketPermission("foo", BucketOpRead), nil, Decision{false, true}},
+	} {
+		d, err := s.IsAllowed(c.user, c.domain, c.permission, c.groups...)
+		if err != nil || d != c.d {
+			t.Fatalf("Expect %s of %s:%s (groups %v) to be %v. Got: %+v, %v",
+				c.permission, c.domain, c.user, c.groups, c.d, d, err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rbac
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Domains of built-in admin and read-only admin (see Snapshot).
+const (
+	DomainAdmin   = "admin"
+	DomainROAdmin = "ro_admin"
+)
+
+// User struct describes user and roles granted to it.
+type User struct {
+	Name   string `json:"name"`
+	Domain string `json:"domain"`
+	Roles  []Role `json:"roles,omitempty"`
+}
+
+// Group struct describes group and roles granted to its members.
+// LDAPGroupRef is external group name the group is mapped to.
+type Group struct {
+	Name         string
+	Roles        []Role
+	LDAPGroupRef string `json:"ldapGroupRef"`
+}
+
+// BuiltinUser struct names built-in admin or read-only admin.
+type BuiltinUser struct {
+	User string
+}
+
+// Snapshot struct is part of cbauth cache snapshot (as written by
+// cbauth.WriteCacheSnapshot) that authorization decisions depend on.
+type Snapshot struct {
+	Admin   BuiltinUser
+	ROAdmin BuiltinUser `json:"roAdmin"`
+	Users   []User      `json:"users,omitempty"`
+	Groups  []Group
+}
+
+// ReadSnapshot reads json cache snapshot from given reader.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	var s Snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Subject method returns subject of given user of given domain and
+// true if snapshot knows user. Roles of given groups (matched both by
+// names and by external group names) are added to roles of user,
+// since snapshot doesn't tell which groups users are members of.
+func (s *Snapshot) Subject(user, domain string, groups ...string) (Subject, bool) {
+	var rv Subject
+	known := false
+	switch {
+	case domain == DomainAdmin && user == s.Admin.User && user != "":
+		rv.Admin, known = true, true
+	case domain == DomainROAdmin && user == s.ROAdmin.User && user != "":
+		rv.ROAdmin, known = true, true
+	default:
+		for _, u := range s.Users {
+			if u.Name == user && u.Domain == domain {
+				rv.Roles = append(rv.Roles, u.Roles...)
+				known = true
+				break
+			}
+		}
+	}
+	for _, name := range groups {
+		for _, g := range s.Groups {
+			if name != "" && (g.Name == name || g.LDAPGroupRef == name) {
+				rv.Roles = append(rv.Roles, g.Roles...)
+				known = true
+			}
+		}
+	}
+	return rv, known
+}
+
+// IsAllowed method decides whether given user of given domain (member
+// of given groups) would be granted given permission according to
+// snapshot. Users unknown to snapshot are denied.
+func (s *Snapshot) IsAllowed(user, domain, permission string, groups ...string) (Decision, error) {
+	o, err := ParsePermission(permission)
+	if err != nil {
+		return Decision{}, err
+	}
+	subject, known := s.Subject(user, domain, groups...)
+	if !known {
+		return Decision{Decided: true}, nil
+	}
+	return subject.EvaluateParsed(o), nil
+}
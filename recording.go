@@ -0,0 +1,245 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// Kinds of recorded events (see StartRecording).
+const (
+	RecordCache      = "cache"
+	RecordAuth       = "auth"
+	RecordPermission = "permission"
+)
+
+// CredsRecord type describes everything permission checks of some
+// creds depend on besides cache. It carries no secrets.
+type CredsRecord = cbauthimpl.CredsRecord
+
+// RecordedEvent struct is single entry of recording. Recordings are
+// written as json lines.
+type RecordedEvent struct {
+	Seq  int       `json:"seq"`
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	// Cache is set for cache events. Passwords and password
+	// hashes are replaced by fingerprints (see
+	// WriteCacheSnapshot).
+	Cache *Cache `json:"cache,omitempty"`
+	// Path is set for auth events (see PathCache)
+	Path string `json:"path,omitempty"`
+	// Creds are set for auth events that produced creds and for
+	// permission events
+	Creds      *CredsRecord `json:"creds,omitempty"`
+	Permission string       `json:"permission,omitempty"`
+	// Outcome is OutcomeAllowed, OutcomeDenied or OutcomeError
+	Outcome string `json:"outcome,omitempty"`
+	Err     string `json:"err,omitempty"`
+}
+
+// ErrRecordingActive is returned by StartRecording if authenticator
+// is already being recorded.
+var ErrRecordingActive = errors.New("recording is already active")
+
+// Recording type records cache pushes, auth results and IsAllowed
+// checks of authenticator (see StartRecording).
+type Recording struct {
+	a   *authImpl
+	l   sync.Mutex
+	enc *json.Encoder
+	seq int
+	err error
+}
+
+type recordingBox struct{ r *Recording }
+
+// StartRecording starts recording of cache pushes, auth results and
+// IsAllowed checks of default authenticator to given writer, so that
+// authorization anomalies can be reproduced offline by Replay.
+// Recording starts with snapshot of current cache. Recorded events
+// carry user names and roles, but no passwords or tokens.
+func StartRecording(w io.Writer) (*Recording, error) {
+	a, ok := GetDefault().(*authImpl)
+	if !ok {
+		return nil, ErrNotInitialized
+	}
+	return startRecording(a, w)
+}
+
+func startRecording(a *authImpl, w io.Writer) (*Recording, error) {
+	a.recordingL.Lock()
+	defer a.recordingL.Unlock()
+	if getRecording(a) != nil {
+		return nil, ErrRecordingActive
+	}
+	r := &Recording{a: a, enc: json.NewEncoder(w)}
+	if c, err := cbauthimpl.SnapshotCacheNow(a.svc); c != nil && err == nil {
+		r.write(&RecordedEvent{Kind: RecordCache, Cache: c})
+	}
+	a.recording.Store(recordingBox{r})
+	cbauthimpl.SetRecorder(a.svc, &cbauthimpl.Recorder{
+		Cache: func(c *Cache) {
+			r.write(&RecordedEvent{Kind: RecordCache, Cache: c})
+		},
+		Permission: func(c *cbauthimpl.CredsImpl, permission string, allowed bool, err error) {
+			rec := c.Record()
+			r.write(&RecordedEvent{Kind: RecordPermission, Creds: &rec, Permission: permission,
+				Outcome: decisionOutcome(allowed, err), Err: errString(err)})
+		},
+	})
+	return r, nil
+}
+
+// Stop method stops recording. It returns first error of writing
+// recording, if any.
+func (r *Recording) Stop() error {
+	r.a.recordingL.Lock()
+	if getRecording(r.a) == r {
+		cbauthimpl.SetRecorder(r.a.svc, nil)
+		r.a.recording.Store(recordingBox{})
+	}
+	r.a.recordingL.Unlock()
+
+	r.l.Lock()
+	defer r.l.Unlock()
+	return r.err
+}
+
+func getRecording(a *authImpl) *Recording {
+	b, _ := a.recording.Load().(recordingBox)
+	return b.r
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func (r *Recording) write(e *RecordedEvent) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	if r.err != nil {
+		return
+	}
+	r.seq++
+	e.Seq = r.seq
+	e.Time = time.Now()
+	r.err = r.enc.Encode(e)
+}
+
+// recordAuth records auth result of given authenticator if it is
+// being recorded.
+func recordAuth(a *authImpl, path string, c Creds, err error) {
+	r := getRecording(a)
+	if r == nil {
+		return
+	}
+	e := &RecordedEvent{Kind: RecordAuth, Path: path, Outcome: decisionOutcome(c != nil && c != NoAccessCreds, err),
+		Err: errString(err)}
+	if ci, ok := c.(*cbauthimpl.CredsImpl); ok {
+		rec := ci.Record()
+		e.Creds = &rec
+	}
+	r.write(e)
+}
+
+// ReplayMismatch struct describes recorded permission check whose
+// outcome differs on replay.
+type ReplayMismatch struct {
+	Seq        int
+	Creds      CredsRecord
+	Permission string
+	Recorded   string
+	Replayed   string
+	Err        error
+}
+
+// ReplayReport struct describes result of Replay.
+type ReplayReport struct {
+	Events      int
+	Caches      int
+	Auths       int
+	Permissions int
+	Undecided   int
+	Mismatches  []ReplayMismatch
+}
+
+// Replay replays recording made by StartRecording offline: it pushes
+// recorded caches to fresh authenticator in order and decides every
+// recorded permission check again for recorded creds against cache
+// that was current at that point. Checks cbauth couldn't decide by
+// cache alone (ones ns_server was asked about) are only counted as
+// undecided, since replay never talks to ns_server. Returns report
+// that lists checks with different outcome.
+func Replay(r io.Reader) (*ReplayReport, error) {
+	svc := cbauthimpl.NewSVC(0, &DBStaleError{})
+	dec := json.NewDecoder(r)
+	rv := &ReplayReport{}
+	for {
+		var e RecordedEvent
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return rv, nil
+		}
+		if err != nil {
+			return rv, err
+		}
+		rv.Events++
+		switch e.Kind {
+		case RecordCache:
+			if e.Cache == nil {
+				continue
+			}
+			rv.Caches++
+			e.Cache.TokenCheckURL = ""
+			e.Cache.PermissionCheckURL = ""
+			if err := svc.UpdateDB(e.Cache, nil); err != nil {
+				return rv, err
+			}
+		case RecordAuth:
+			rv.Auths++
+		case RecordPermission:
+			if e.Creds == nil {
+				continue
+			}
+			rv.Permissions++
+			c, err := cbauthimpl.ReplayCreds(svc, e.Creds)
+			var allowed bool
+			if err == nil {
+				allowed, err = c.IsAllowed(e.Permission)
+			}
+			if err == ErrUndecidedPermission {
+				rv.Undecided++
+				continue
+			}
+			if outcome := decisionOutcome(allowed, err); outcome != e.Outcome {
+				rv.Mismatches = append(rv.Mismatches, ReplayMismatch{
+					Seq: e.Seq, Creds: *e.Creds, Permission: e.Permission,
+					Recorded: e.Outcome, Replayed: outcome, Err: err,
+				})
+			}
+		}
+	}
+}
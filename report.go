@@ -0,0 +1,77 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// Keys of context passed to ErrorReporter.
+const (
+	// ReportComponent names part of cbauth that failed, e.g.
+	// "revrpc" or "auth".
+	ReportComponent = "component"
+	// ReportMethod names revrpc method whose request was
+	// rejected.
+	ReportMethod = "method"
+	// ReportFatal is set to "true" if failure is about to crash
+	// the process.
+	ReportFatal = "fatal"
+)
+
+// ErrorReporter type describes hooks that are passed internal
+// failures of cbauth, such as cache updates from ns_server that
+// can't be decoded or unexpected responses of ns_server's auth
+// endpoint, so that services can route them to their crash reporting
+// systems rather than only logs. Context carries details of failure
+// (see ReportComponent and friends). Reporter is called
+// synchronously and must not modify context.
+type ErrorReporter func(err error, context map[string]string)
+
+var errorReporter atomic.Value
+
+type reporterBox struct{ r ErrorReporter }
+
+// SetErrorReporter sets (or clears if nil is passed) reporter of
+// internal failures.
+func SetErrorReporter(r ErrorReporter) {
+	errorReporter.Store(reporterBox{r})
+}
+
+// reportError records given failure for DumpDiagnostics and passes
+// it to ErrorReporter, if any. Panics of reporter are recorded
+// rather than propagated.
+func reportError(what string, err error, context map[string]string) {
+	recordError("%s: %s", what, err)
+	b, _ := errorReporter.Load().(reporterBox)
+	if b.r == nil {
+		return
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			recordError("error reporter panicked: %s", fmt.Sprint(p))
+		}
+	}()
+	b.r(err, context)
+}
+
+// BadResponseError is returned (and reported to ErrorReporter) when
+// ns_server's auth endpoint replies with something that can't be
+// made sense of.
+type BadResponseError = cbauthimpl.BadResponseError
@@ -0,0 +1,341 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package revrpc
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"sync"
+)
+
+// maxHeaderValue limits size of request fields other than params
+// (i.e. method and id).
+const maxHeaderValue = 64 << 10
+
+var errMalformedRequest = errors.New("revrpc: malformed json rpc request")
+
+// RequestTooLargeError is returned to ns_server (and passed to
+// request error handler) when params of rpc request exceed
+// configured maximum size (see SetMaxRequestSize). Such request is
+// consumed without buffering it and is not passed to rpc method.
+type RequestTooLargeError struct {
+	Method string
+	Limit  int64
+}
+
+func (e *RequestTooLargeError) Error() string {
+	return fmt.Sprintf("revrpc: params of %s exceed %d bytes limit", e.Method, e.Limit)
+}
+
+// SetMaxRequestSize sets maximum size of params of rpc requests
+// handled by service. Zero or negative size means no limit. It can
+// be changed while service is running.
+func (s *Service) SetMaxRequestSize(n int64) {
+	s.l.Lock()
+	s.maxRequestSize = n
+	s.l.Unlock()
+}
+
+// SetRequestErrorHandler sets function that is called when rpc
+// request is rejected before reaching rpc method, because it is too
+// large (see RequestTooLargeError) or its params are malformed.
+// Error is also returned to ns_server as usual.
+func (s *Service) SetRequestErrorHandler(fn func(method string, err error)) {
+	s.l.Lock()
+	s.onRequestError = fn
+	s.l.Unlock()
+}
+
+func (s *Service) requestLimits() (int64, func(method string, err error)) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.maxRequestSize, s.onRequestError
+}
+
+// serverCodec is rpc.ServerCodec that speaks same json rpc 1.0
+// dialect as net/rpc/jsonrpc, but decodes requests incrementally so
+// that size of params can be limited.
+type serverCodec struct {
+	svc *Service
+	r   *bufio.Reader
+	c   io.Closer
+	enc *json.Encoder
+
+	// fields of request being read; net/rpc reads requests
+	// sequentially
+	method     string
+	params     []byte
+	paramsErr  error
+	onReqError func(method string, err error)
+
+	l       sync.Mutex
+	seq     uint64
+	pending map[uint64]*json.RawMessage
+}
+
+func newServerCodec(svc *Service, r *bufio.Reader, conn io.ReadWriteCloser) *serverCodec {
+	return &serverCodec{
+		svc:     svc,
+		r:       r,
+		c:       conn,
+		enc:     json.NewEncoder(conn),
+		pending: make(map[uint64]*json.RawMessage),
+	}
+}
+
+func skipSpace(r *bufio.Reader) (byte, error) {
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+		default:
+			return c, nil
+		}
+	}
+}
+
+// readValue reads single json value from r. Value is returned if it
+// is not longer than limit bytes. Otherwise rest of it is consumed
+// without buffering and over is set. Validity of returned value is
+// not checked beyond matching of brackets and quotes.
+func readValue(r *bufio.Reader, limit int64) (buf []byte, over bool, err error) {
+	c, err := skipSpace(r)
+	if err != nil {
+		return nil, false, err
+	}
+	put := func(c byte) {
+		if over {
+			return
+		}
+		if limit > 0 && int64(len(buf)) >= limit {
+			over = true
+			buf = nil
+			return
+		}
+		buf = append(buf, c)
+	}
+
+	scalar := c != '{' && c != '[' && c != '"'
+	depth := 0
+	inString := false
+	escaped := false
+	for {
+		switch {
+		case scalar:
+			switch c {
+			case ',', '}', ']', ' ', '\t', '\r', '\n':
+				return buf, over, r.UnreadByte()
+			}
+		case inString:
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+				if depth == 0 {
+					put(c)
+					return
+				}
+			}
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
+			if depth < 0 {
+				return nil, false, errMalformedRequest
+			}
+			if depth == 0 {
+				put(c)
+				return
+			}
+		}
+		put(c)
+		c, err = r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, false, err
+		}
+	}
+}
+
+func (c *serverCodec) readRequest() (method string, id *json.RawMessage, err error) {
+	c.params, c.paramsErr = nil, nil
+
+	b, err := skipSpace(c.r)
+	if err != nil {
+		return "", nil, err
+	}
+	// limits are fetched only when request starts arriving,
+	// because we may wait for it for a long time
+	limit, onReqError := c.svc.requestLimits()
+	c.onReqError = onReqError
+	if b != '{' {
+		return "", nil, errMalformedRequest
+	}
+	paramsOver := false
+	for {
+		b, err = skipSpace(c.r)
+		if err != nil {
+			return "", nil, err
+		}
+		if b == '}' {
+			break
+		}
+		c.r.UnreadByte()
+
+		rawKey, over, err := readValue(c.r, maxHeaderValue)
+		if err != nil {
+			return "", nil, err
+		}
+		var key string
+		if over || json.Unmarshal(rawKey, &key) != nil {
+			return "", nil, errMalformedRequest
+		}
+		if b, err = skipSpace(c.r); err != nil || b != ':' {
+			return "", nil, errMalformedRequest
+		}
+
+		valueLimit := int64(maxHeaderValue)
+		if key == "params" {
+			valueLimit = limit
+		}
+		value, over, err := readValue(c.r, valueLimit)
+		if err != nil {
+			return "", nil, err
+		}
+		switch {
+		case key == "params":
+			c.params, paramsOver = value, over
+		case over:
+			return "", nil, errMalformedRequest
+		case key == "method":
+			if json.Unmarshal(value, &method) != nil {
+				return "", nil, errMalformedRequest
+			}
+		case key == "id":
+			raw := json.RawMessage(value)
+			id = &raw
+		}
+
+		b, err = skipSpace(c.r)
+		if err != nil {
+			return "", nil, err
+		}
+		if b == '}' {
+			break
+		}
+		if b != ',' {
+			return "", nil, errMalformedRequest
+		}
+	}
+	if paramsOver {
+		c.paramsErr = &RequestTooLargeError{Method: method, Limit: limit}
+	}
+	return method, id, nil
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	method, id, err := c.readRequest()
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return err
+		}
+		if err != io.EOF {
+			err = fmt.Errorf("revrpc: failed to read request: %s", err)
+		}
+		return err
+	}
+	r.ServiceMethod = method
+	c.method = method
+
+	c.l.Lock()
+	c.seq++
+	c.pending[c.seq] = id
+	r.Seq = c.seq
+	c.l.Unlock()
+
+	return nil
+}
+
+func (c *serverCodec) requestError(err error) error {
+	if c.onReqError != nil {
+		c.onReqError(c.method, err)
+	}
+	return err
+}
+
+func (c *serverCodec) ReadRequestBody(x interface{}) error {
+	if x == nil {
+		return nil
+	}
+	if c.paramsErr != nil {
+		return c.requestError(c.paramsErr)
+	}
+	if c.params == nil {
+		return c.requestError(errors.New("revrpc: request has no params"))
+	}
+	params := [1]interface{}{x}
+	if err := json.Unmarshal(c.params, &params); err != nil {
+		return c.requestError(err)
+	}
+	return nil
+}
+
+var null = json.RawMessage([]byte("null"))
+
+type serverResponse struct {
+	ID     *json.RawMessage `json:"id"`
+	Result interface{}      `json:"result"`
+	Error  interface{}      `json:"error"`
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, x interface{}) error {
+	c.l.Lock()
+	id, ok := c.pending[r.Seq]
+	if !ok {
+		c.l.Unlock()
+		return errors.New("revrpc: invalid sequence number in response")
+	}
+	delete(c.pending, r.Seq)
+	c.l.Unlock()
+
+	if id == nil {
+		id = &null
+	}
+	resp := serverResponse{ID: id}
+	if r.Error == "" {
+		resp.Result = x
+	} else {
+		resp.Error = r.Error
+	}
+	return c.enc.Encode(resp)
+}
+
+func (c *serverCodec) Close() error {
+	return c.c.Close()
+}
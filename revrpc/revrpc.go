@@ -20,6 +20,7 @@ package revrpc
 
 import (
 	"bufio"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -27,7 +28,6 @@ import (
 	"net"
 	"net/http"
 	"net/rpc"
-	"net/rpc/jsonrpc"
 	"net/url"
 	"os"
 	"sync"
@@ -50,17 +50,34 @@ type Service struct {
 	user    string
 	pwd     string
 	url     *url.URL
+
+	l              sync.Mutex
+	maxRequestSize int64
+	onRequestError func(method string, err error)
+	connectTimeout time.Duration
+	tlsConfig      *tls.Config
+	closed         bool
+	conn           net.Conn
+	// defaultName is name of service obtained via
+	// GetDefaultServiceFromEnv
+	defaultName string
 }
 
 // ErrAlreadyRunning is returned from Run method to indicate that
 // given Service instance is already running.
 var ErrAlreadyRunning = errors.New("service is already running")
 
+// ErrServiceClosed is returned from Run method and BabysitService
+// after service was closed (see Close).
+var ErrServiceClosed = errors.New("service is closed")
+
 // NewService creates and returns Service instance that connects to
 // given ns_server url (which is expected to have creds
 // encoded). Returns error if url is malformed. Does not actually
 // connect to ns_server, so it will succeed even if ns_server is not
-// running or if creds are not valid admin creds.
+// running or if creds are not valid admin creds. If url has
+// SRVScheme, ns_server endpoint is discovered via DNS SRV records
+// every time service connects.
 func NewService(connectURL string) (*Service, error) {
 	u, err := url.Parse(connectURL)
 	if err != nil {
@@ -91,6 +108,69 @@ func MustService(connectURL string) *Service {
 	return rv
 }
 
+// SetDialTimeout sets timeout of establishing connection to
+// ns_server. Zero timeout (default) means no timeout besides ones
+// imposed by operating system.
+func (s *Service) SetDialTimeout(d time.Duration) {
+	s.l.Lock()
+	s.connectTimeout = d
+	s.l.Unlock()
+}
+
+// SetTLSConfig makes service connect to ns_server over TLS using
+// given config. Nil config (default) means plain tcp connection.
+func (s *Service) SetTLSConfig(cfg *tls.Config) {
+	s.l.Lock()
+	s.tlsConfig = cfg
+	s.l.Unlock()
+}
+
+// Close method drops connection to ns_server, if any, and makes
+// running and future Run calls (and thus BabysitService) return
+// ErrServiceClosed. Services obtained via GetDefaultServiceFromEnv
+// can be obtained again after they are closed, so that dynamically
+// created components can release their services.
+func (s *Service) Close() {
+	s.l.Lock()
+	s.closed = true
+	conn := s.conn
+	name := s.defaultName
+	s.defaultName = ""
+	s.l.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	if name != "" {
+		defaultsGotL.Lock()
+		delete(defaultsGot, name)
+		defaultsGotL.Unlock()
+	}
+}
+
+func (s *Service) isClosed() bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.closed
+}
+
+// setConn records connection Close has to drop. It returns false if
+// service is already closed.
+func (s *Service) setConn(conn net.Conn) bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.closed && conn != nil {
+		return false
+	}
+	s.conn = conn
+	return true
+}
+
+func (s *Service) dialOptions() (time.Duration, *tls.Config) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.connectTimeout, s.tlsConfig
+}
+
 type minirwc struct {
 	net.Conn
 	bufreader *bufio.Reader
@@ -103,24 +183,57 @@ func (r *minirwc) Read(buf []byte) (n int, err error) {
 // Run method connects to ns_server, sets up json rpc instance and
 // handles rpc requests loop until connection is alive. Returned error
 // is always non-nil. In case connection was closed by ns_server
-// io.EOF is returned.
-func (s *Service) Run(setupBody ServiceSetupCallback) error {
+// io.EOF is returned. ErrServiceClosed is returned if service was
+// closed.
+func (s *Service) Run(setupBody ServiceSetupCallback) (err error) {
 	if !atomic.CompareAndSwapInt32(&s.running, 0, 1) {
 		return ErrAlreadyRunning
 	}
 	defer func() {
 		atomic.StoreInt32(&s.running, 0)
 	}()
+	if s.isClosed() {
+		return ErrServiceClosed
+	}
+	// errors caused by Close dropping connection are reported as
+	// ErrServiceClosed
+	defer func() {
+		if s.isClosed() {
+			err = ErrServiceClosed
+		}
+	}()
 
-	conn, err := net.Dial("tcp", s.url.Host)
+	timeout, tlsConfig := s.dialOptions()
+	conn, u, err := dialTimeout(s.url, timeout)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
+	if !s.setConn(conn) {
+		return ErrServiceClosed
+	}
+	defer s.setConn(nil)
 
 	conn.(*net.TCPConn).SetNoDelay(true)
+	if tlsConfig != nil {
+		cfg := tlsConfig.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, cfg)
+		s.setConn(tlsConn)
+		if timeout > 0 {
+			tlsConn.SetDeadline(time.Now().Add(timeout))
+		}
+		err = tlsConn.Handshake()
+		if err != nil {
+			return err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
 
-	req, _ := http.NewRequest("RPCCONNECT", s.url.String(), nil)
+	req, _ := http.NewRequest("RPCCONNECT", u.String(), nil)
 	req.SetBasicAuth(s.user, s.pwd)
 	err = req.Write(conn)
 	if err != nil {
@@ -142,8 +255,7 @@ func (s *Service) Run(setupBody ServiceSetupCallback) error {
 		return err
 	}
 
-	codec := jsonrpc.NewServerCodec(rwc)
-	rpcServer.ServeCodec(codec)
+	rpcServer.ServeCodec(newServerCodec(s, connr, rwc))
 
 	return io.EOF
 }
@@ -176,8 +288,37 @@ type DefaultErrorPolicy struct {
 	// LogPrint function, if non-nil, is used by
 	// DefaultErrorPolicy to log it's events & decisions.
 	// log.Print function is one suitable implementation.
-	LogPrint     func(args ...interface{})
+	LogPrint func(args ...interface{})
+	// LogBurst and LogRefill limit rate of retry messages (see
+	// ThrottleLogPrint) so that long ns_server outage doesn't
+	// flood logs. Zero LogBurst disables throttling and zero
+	// LogRefill means DefaultLogRefill. Message about giving up
+	// is always logged.
+	LogBurst     int
+	LogRefill    time.Duration
 	restartsLeft int
+	throttle     *logThrottle
+}
+
+var defaultLogPrint atomic.Value
+
+type logPrintBox struct{ fn func(args ...interface{}) }
+
+// SetDefaultLogPrint sets function DefaultLogPrint passes messages
+// to. nil restores log.Print. cbauth sets it so that messages of
+// DefaultBabysitErrorPolicy reach its Logger.
+func SetDefaultLogPrint(fn func(args ...interface{})) {
+	defaultLogPrint.Store(logPrintBox{fn})
+}
+
+// DefaultLogPrint is LogPrint of DefaultBabysitErrorPolicy. It passes
+// messages to function set via SetDefaultLogPrint or to log.Print.
+func DefaultLogPrint(args ...interface{}) {
+	if b, _ := defaultLogPrint.Load().(logPrintBox); b.fn != nil {
+		b.fn(args...)
+		return
+	}
+	log.Print(args...)
 }
 
 // DefaultBabysitErrorPolicy is BabysitErrorPolicy instance that is
@@ -186,7 +327,17 @@ type DefaultErrorPolicy struct {
 var DefaultBabysitErrorPolicy BabysitErrorPolicy = DefaultErrorPolicy{
 	RestartsToExit:       -1,
 	SleepBetweenRestarts: time.Second,
-	LogPrint:             log.Print,
+	LogPrint:             DefaultLogPrint,
+	LogBurst:             5,
+	LogRefill:            time.Minute,
+}
+
+func (p *DefaultErrorPolicy) log(force bool, args ...interface{}) {
+	if p.throttle != nil {
+		p.throttle.log(force, args...)
+	} else {
+		p.LogPrint(args...)
+	}
 }
 
 func (p *DefaultErrorPolicy) try(err error) error {
@@ -196,12 +347,12 @@ func (p *DefaultErrorPolicy) try(err error) error {
 			if err == nil {
 				err = errors.New("Retries exceeded")
 			}
-			p.LogPrint("Will not retry on error: ", err)
+			p.log(true, "Will not retry on error: ", err)
 			return err
 		}
 	}
 
-	p.LogPrint(fmt.Sprintf("revrpc: Got error (%s) and will retry in %s", err, p.SleepBetweenRestarts))
+	p.log(false, fmt.Sprintf("revrpc: Got error (%s) and will retry in %s", err, p.SleepBetweenRestarts))
 	time.Sleep(p.SleepBetweenRestarts)
 
 	return nil
@@ -214,6 +365,9 @@ func (p *DefaultErrorPolicy) try(err error) error {
 func (p DefaultErrorPolicy) New() ErrorPolicyFn {
 	// NOTE: that p is _copy_ of policy instance
 	p.restartsLeft = p.RestartsToExit
+	if p.LogBurst > 0 && p.LogPrint != nil {
+		p.throttle = newLogThrottle(p.LogPrint, p.LogBurst, p.LogRefill)
+	}
 	return (&p).try
 }
 
@@ -232,15 +386,19 @@ var NoRestartsBabysitErrorPolicy BabysitErrorPolicy = FnBabysitErrorPolicy(func(
 // BabysitService function runs given service instance, restarting it
 // as needed if allowed by given BabysitErrorPolicy. nil
 // can be passed to errorPolicy argument, in which case value of
-// DefaultBabysitErrorPolicy is used.
+// DefaultBabysitErrorPolicy is used. Closed service is never
+// restarted: ErrServiceClosed is returned instead.
 func BabysitService(setupBody ServiceSetupCallback, svc *Service, errorPolicy BabysitErrorPolicy) error {
 	if errorPolicy == nil {
 		errorPolicy = DefaultBabysitErrorPolicy
 	}
 	errorFn := errorPolicy.New()
 	for {
-		err := errorFn(svc.Run(setupBody))
-		if err != nil {
+		err := svc.Run(setupBody)
+		if err == ErrServiceClosed {
+			return err
+		}
+		if err = errorFn(err); err != nil {
 			return err
 		}
 	}
@@ -249,7 +407,7 @@ func BabysitService(setupBody ServiceSetupCallback, svc *Service, errorPolicy Ba
 func doGetServiceFromEnv(serviceName string) (*Service, error) {
 	rurl := os.Getenv("CBAUTH_REVRPC_URL")
 	if rurl == "" {
-		return nil, fmt.Errorf("cbauth environment variable "+
+		return nil, fmt.Errorf("cbauth environment variable " +
 			"CBAUTH_REVRPC_URL is not set")
 	}
 
@@ -273,7 +431,8 @@ var defaultsGotL sync.Mutex
 // GetDefaultServiceFromEnv returns Service instance that connects to
 // ns_server according to CBAUTH_REVRPC_URL environment variable. Trying to
 // obtain same service twice will return error. I.e. you're supposed to get
-// your Service instance once and only once and hold it forever.
+// your Service instance once and only once and hold it until it's
+// closed (see Service.Close).
 func GetDefaultServiceFromEnv(serviceName string) (*Service, error) {
 	defaultsGotL.Lock()
 	defer defaultsGotL.Unlock()
@@ -283,6 +442,7 @@ func GetDefaultServiceFromEnv(serviceName string) (*Service, error) {
 	svc, err := doGetServiceFromEnv(serviceName)
 	if err == nil {
 		defaultsGot[serviceName] = true
+		svc.defaultName = serviceName
 	}
 	return svc, err
 }
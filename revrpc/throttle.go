@@ -0,0 +1,100 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package revrpc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultLogRefill is refill duration used by log throttling when
+// non-positive one is given.
+const DefaultLogRefill = time.Minute
+
+type logThrottle struct {
+	l          sync.Mutex
+	print      func(args ...interface{})
+	burst      int
+	refill     time.Duration
+	tokens     int
+	last       time.Time
+	suppressed int
+	since      time.Time
+}
+
+func newLogThrottle(print func(args ...interface{}), burst int, refill time.Duration) *logThrottle {
+	if refill <= 0 {
+		refill = DefaultLogRefill
+	}
+	return &logThrottle{print: print, burst: burst, refill: refill}
+}
+
+func (t *logThrottle) flushLocked() {
+	if t.suppressed > 0 {
+		t.print(fmt.Sprintf("revrpc: suppressed %d similar messages in last %s",
+			t.suppressed, time.Since(t.since).Round(time.Second)))
+		t.suppressed = 0
+	}
+}
+
+func (t *logThrottle) log(force bool, args ...interface{}) {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	now := time.Now()
+	if t.last.IsZero() {
+		t.tokens = t.burst
+		t.last = now
+	} else if n := int(now.Sub(t.last) / t.refill); n > 0 {
+		t.tokens += n
+		if t.tokens > t.burst {
+			t.tokens = t.burst
+		}
+		t.last = t.last.Add(time.Duration(n) * t.refill)
+	}
+
+	if t.tokens == 0 && !force {
+		if t.suppressed == 0 {
+			t.since = now
+		}
+		t.suppressed++
+		return
+	}
+	if t.tokens > 0 {
+		t.tokens--
+	}
+	t.flushLocked()
+	t.print(args...)
+}
+
+// ThrottleLogPrint returns log function that passes messages to given
+// print function at rate limited by token bucket: up to burst
+// messages are logged in a row and then one more per refill
+// duration. Messages beyond that are dropped, and number of dropped
+// messages is logged as summary line before next message that gets
+// through. It is useful to keep long outages of ns_server from
+// flooding logs with identical reconnect errors. Non-positive burst
+// disables throttling and non-positive refill means DefaultLogRefill.
+func ThrottleLogPrint(print func(args ...interface{}), burst int, refill time.Duration) func(args ...interface{}) {
+	if burst <= 0 {
+		return print
+	}
+	t := newLogThrottle(print, burst, refill)
+	return func(args ...interface{}) {
+		t.log(false, args...)
+	}
+}
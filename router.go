@@ -0,0 +1,436 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// Route struct describes permission that is required to access
+// endpoints matching given method and path pattern.
+type Route struct {
+	// Method is http method of route. Empty method matches any
+	// method.
+	Method string `json:"method,omitempty"`
+	// Pattern is path pattern of route. Path segments of the
+	// form "{name}" match any single path segment and "*" as last
+	// segment matches any (possibly empty) remainder of path.
+	// E.g. "/buckets/{bucket}/docs/*".
+	Pattern string `json:"pattern"`
+	// Permission is permission required to access route (see
+	// BucketPermission). "{name}" references in permission are
+	// replaced by matched path segments, e.g.
+	// BucketPermission("{bucket}", BucketOpRead). Empty
+	// permission allows access to any authenticated user.
+	Permission string `json:"permission,omitempty"`
+	// Anonymous, if true, allows access without authentication.
+	Anonymous bool `json:"anonymous,omitempty"`
+	// InternalOnly, if true, allows access only to internal
+	// users (see Creds.IsInternal) on top of Permission.
+	InternalOnly bool `json:"internalOnly,omitempty"`
+}
+
+type compiledRoute struct {
+	Route
+	segments []string
+}
+
+type compiledPolicy struct {
+	routes []compiledRoute
+	deny   map[string]bool
+}
+
+// RouteTable is http.Handler that authenticates requests and passes
+// them to next handler only if creds have permission required by
+// first matching route. Requests that match no route are forbidden.
+// Creds of authenticated requests are available to next handler via
+// CredsFromContext. Routes can be replaced at any time via SetPolicy.
+// Requests with non-canonical paths (e.g. with "..", "." or empty
+// segments) are forbidden too, so that they can't slip past routes.
+type RouteTable struct {
+	l         sync.Mutex
+	policy    *compiledPolicy
+	secondary SecondaryAuthorizer
+	next      http.Handler
+	a         Authenticator
+}
+
+// AuthzInput struct describes authorization request that is passed
+// to SecondaryAuthorizer.
+type AuthzInput struct {
+	User       string `json:"user"`
+	Source     string `json:"source"`
+	Mechanism  string `json:"mechanism"`
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	Permission string `json:"permission"`
+}
+
+// SecondaryAuthorizer is consulted by RouteTable after cbauth's own
+// RBAC check allowed access to non-anonymous route (e.g. to enforce
+// centralized policy via Open Policy Agent, see opa package).
+// Access is denied unless Authorize returns true and nil error.
+type SecondaryAuthorizer interface {
+	Authorize(in *AuthzInput) (bool, error)
+}
+
+// SetSecondaryAuthorizer sets (or clears if nil is passed)
+// SecondaryAuthorizer of route table.
+func (rt *RouteTable) SetSecondaryAuthorizer(sa SecondaryAuthorizer) {
+	rt.l.Lock()
+	rt.secondary = sa
+	rt.l.Unlock()
+}
+
+// NewRouteTable constructs RouteTable that protects given handler
+// according to given routes. Routes are matched in order they are
+// given. As usual, if nil authenticator is passed, default
+// authenticator is used.
+func NewRouteTable(routes []Route, next http.Handler, a Authenticator) (*RouteTable, error) {
+	cp, err := compilePolicy(&Policy{Routes: routes})
+	if err != nil {
+		return nil, err
+	}
+	return &RouteTable{policy: cp, next: next, a: a}, nil
+}
+
+// SetPolicy atomically replaces routes and deny list of route
+// table. If given policy is invalid, error is returned and route
+// table is not changed.
+func (rt *RouteTable) SetPolicy(p *Policy) error {
+	cp, err := compilePolicy(p)
+	if err != nil {
+		return err
+	}
+	rt.l.Lock()
+	rt.policy = cp
+	rt.l.Unlock()
+	return nil
+}
+
+func (rt *RouteTable) getPolicy() (*compiledPolicy, SecondaryAuthorizer) {
+	rt.l.Lock()
+	defer rt.l.Unlock()
+	return rt.policy, rt.secondary
+}
+
+func compilePolicy(p *Policy) (*compiledPolicy, error) {
+	cp := &compiledPolicy{deny: make(map[string]bool)}
+	for _, user := range p.Deny {
+		cp.deny[user] = true
+	}
+	for _, r := range p.Routes {
+		if !strings.HasPrefix(r.Pattern, "/") {
+			return nil, fmt.Errorf("route pattern `%s' must begin with /", r.Pattern)
+		}
+		segments := strings.Split(r.Pattern[1:], "/")
+		for i, s := range segments {
+			if strings.Contains(s, "*") && (s != "*" || i != len(segments)-1) {
+				return nil, fmt.Errorf("route pattern `%s' may only have * as last segment", r.Pattern)
+			}
+		}
+		if r.Anonymous && r.InternalOnly {
+			return nil, fmt.Errorf("route `%s' can't be both anonymous and internal only", r.Pattern)
+		}
+		if _, err := evalPermission(NoAccessCreds, r.Permission); err != nil {
+			return nil, err
+		}
+		cp.routes = append(cp.routes, compiledRoute{r, segments})
+	}
+	return cp, nil
+}
+
+// credsDomain returns domain of user of given creds: one reported by
+// ns_server or, for creds verified by cbauth itself, their source.
+func credsDomain(c Creds) string {
+	if d := c.Identity().Domain; d != "" {
+		return d
+	}
+	return c.Source()
+}
+
+// denied method returns true iff given creds match deny list of
+// policy (see Policy.Deny).
+func (cp *compiledPolicy) denied(c Creds) bool {
+	return cp.deny[c.Name()] || cp.deny[credsDomain(c)+":"+c.Name()]
+}
+
+func matchSegments(pattern, path []string) (vars map[string]string, ok bool) {
+	vars = make(map[string]string)
+	for i, p := range pattern {
+		if p == "*" {
+			return vars, true
+		}
+		if i >= len(path) {
+			return nil, false
+		}
+		if strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}") {
+			vars[p] = path[i]
+			continue
+		}
+		if p != path[i] {
+			return nil, false
+		}
+	}
+	return vars, len(pattern) == len(path)
+}
+
+// expandPermission returns given permission with "{name}" references
+// replaced by matched path segments. Replacement is done in single
+// pass, so that segments can't inject further references.
+func expandPermission(permission string, vars map[string]string) string {
+	var b strings.Builder
+	for {
+		start := strings.Index(permission, "{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(permission[start:], "}")
+		if end < 0 {
+			break
+		}
+		end += start + 1
+		b.WriteString(permission[:start])
+		if v, ok := vars[permission[start:end]]; ok {
+			b.WriteString(v)
+		} else {
+			b.WriteString(permission[start:end])
+		}
+		permission = permission[end:]
+	}
+	b.WriteString(permission)
+	return b.String()
+}
+
+func (cp *compiledPolicy) match(req *http.Request) (r *compiledRoute, permission string) {
+	path, err := CanonicalPathSegments(req.URL)
+	if err != nil {
+		return nil, ""
+	}
+	for i := range cp.routes {
+		r := &cp.routes[i]
+		if r.Method != "" && r.Method != req.Method {
+			continue
+		}
+		vars, ok := matchSegments(r.segments, path)
+		if !ok {
+			continue
+		}
+		return r, expandPermission(r.Permission, vars)
+	}
+	return nil, ""
+}
+
+// hasPermission checks given permission (as understood by
+// GetScopedServiceAuth) against given creds. Decisions are cached
+// per cache generation (see CredsImpl.CachedDecision).
+func hasPermission(c Creds, permission string) (bool, error) {
+	o := getDecisionObserver()
+	if o == nil {
+		ok, err := cachedPermission(c, permission)
+		if !ok && err == nil {
+			auditDenied(c, permission)
+		}
+		return ok, err
+	}
+	start := time.Now()
+	ok, err := cachedPermission(c, permission)
+	if !ok && err == nil {
+		auditDenied(c, permission)
+	}
+	o.ObserveDecision(&DecisionEvent{
+		Kind:       DecisionPermission,
+		Permission: permission,
+		Outcome:    decisionOutcome(ok, err),
+		Duration:   time.Since(start),
+		Err:        err,
+	})
+	return ok, err
+}
+
+// HasPermission checks given permission (e.g. PermissionAdmin or
+// BucketPermission) against given creds the same way RouteTable
+// does.
+func HasPermission(c Creds, permission string) (bool, error) {
+	return hasPermission(c, permission)
+}
+
+// HasBucketPermissionByUUID checks permission of given operation
+// (e.g. BucketOpRead) on bucket with given uuid against given creds.
+// Bucket is resolved by uuid against current cache, so permission is
+// denied once bucket is deleted, even if other bucket was created
+// under the same name since. It lets services that keep long lived
+// references to buckets avoid authorizing against wrong bucket.
+// Creds that cbauth didn't derive from its cache (e.g. ones returned
+// by CredsVerifier) are denied, since they can't resolve uuids.
+func HasBucketPermissionByUUID(c Creds, uuid, op string) (bool, error) {
+	ci, ok := c.(*cbauthimpl.CredsImpl)
+	if !ok {
+		return false, nil
+	}
+	name, ok := ci.BucketByUUID(uuid)
+	if !ok {
+		tracef(c.Name(), "bucket with uuid %s is not known", uuid)
+		return false, nil
+	}
+	return hasPermission(c, BucketPermission(name, op))
+}
+
+func cachedPermission(c Creds, permission string) (bool, error) {
+	if ci, ok := c.(*cbauthimpl.CredsImpl); ok {
+		return ci.CachedDecision(permission, func() (bool, error) {
+			return evalPermission(c, permission)
+		})
+	}
+	return evalPermission(c, permission)
+}
+
+func evalPermission(c Creds, permission string) (bool, error) {
+	switch permission {
+	case "":
+		return true, nil
+	case PermissionAdmin:
+		return c.IsAdmin()
+	case PermissionReadAnyMetadata:
+		return c.CanReadAnyMetadata(), nil
+	}
+	if bucket, op, ok := cbauthimpl.ParseBucketPermission(permission); ok {
+		switch op {
+		case BucketOpRead:
+			return c.CanReadBucket(bucket)
+		case BucketOpWrite:
+			return c.CanWriteBucket(bucket)
+		case BucketOpDDL:
+			return c.CanDDLBucket(bucket)
+		case BucketOpDCP:
+			return c.CanDCPBucket(bucket)
+		case BucketOpManage:
+			return c.CanManageBucket(bucket)
+		}
+	}
+	return false, fmt.Errorf("unknown permission: `%s'", permission)
+}
+
+type credsContextKey struct{}
+
+// ContextWithCreds returns copy of given context that carries given
+// creds.
+func ContextWithCreds(ctx context.Context, c Creds) context.Context {
+	return context.WithValue(ctx, credsContextKey{}, c)
+}
+
+// CredsFromContext returns creds that were put to given context by
+// RouteTable (or ContextWithCreds).
+func CredsFromContext(ctx context.Context) (Creds, bool) {
+	c, ok := ctx.Value(credsContextKey{}).(Creds)
+	return c, ok
+}
+
+// SendForbidden sends 403 Forbidden response on given response
+// writer.
+func SendForbidden(w http.ResponseWriter) {
+	http.Error(w, "forbidden", http.StatusForbidden)
+}
+
+// sendAuthError sends response for failed auth or authorization
+// check. Error itself is only recorded for DumpDiagnostics, since it
+// may reveal internals to clients.
+func sendAuthError(w http.ResponseWriter, err error) {
+	if e, ok := err.(*ScramContinueError); ok {
+		w.Header().Set("WWW-Authenticate", e.Challenge)
+		http.Error(w, "need auth", http.StatusUnauthorized)
+		return
+	}
+	recordError("route table check failed: %s", err)
+	switch status := ErrorHTTPStatus(err); status {
+	case http.StatusUnauthorized:
+		SendUnauthorized(w)
+	case http.StatusServiceUnavailable:
+		http.Error(w, "auth database is not available", status)
+	default:
+		http.Error(w, "internal server error", status)
+	}
+}
+
+// SendAuthError sends response for error returned by auth or
+// permission check the same way RouteTable does: 401 continuing SCRAM
+// exchange for ScramContinueError and ErrorHTTPStatus otherwise.
+func SendAuthError(w http.ResponseWriter, err error) {
+	sendAuthError(w, err)
+}
+
+func (rt *RouteTable) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	cp, secondary := rt.getPolicy()
+	r, permission := cp.match(req)
+	if r == nil {
+		SendForbidden(w)
+		return
+	}
+	if r.Anonymous {
+		rt.next.ServeHTTP(w, req)
+		return
+	}
+
+	var creds Creds
+	err := WithAuthenticator(rt.a, func(a Authenticator) (err error) {
+		creds, err = a.AuthWebCreds(req)
+		return
+	})
+	if err != nil {
+		sendAuthError(w, err)
+		return
+	}
+	if creds == NoAccessCreds {
+		SendUnauthorized(w)
+		return
+	}
+	if cp.denied(creds) || (r.InternalOnly && !creds.IsInternal()) {
+		SendForbidden(w)
+		return
+	}
+	ok, err := hasPermission(creds, permission)
+	if err != nil {
+		sendAuthError(w, err)
+		return
+	}
+	if ok && secondary != nil {
+		ok, err = secondary.Authorize(&AuthzInput{
+			User:       creds.Name(),
+			Source:     creds.Source(),
+			Mechanism:  string(creds.Mechanism()),
+			Method:     req.Method,
+			Path:       req.URL.Path,
+			Permission: permission,
+		})
+		if err != nil {
+			sendAuthError(w, err)
+			return
+		}
+	}
+	if !ok {
+		SendForbidden(w)
+		return
+	}
+	SetAuthenticationInfo(w, creds)
+	rt.next.ServeHTTP(w, req.WithContext(ContextWithCreds(req.Context(), creds)))
+}
@@ -0,0 +1,350 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// ScramSessionTTL is how long SCRAM exchange may take between
+// server-first and client-final messages.
+var ScramSessionTTL = time.Minute
+
+// maxScramSessions limits number of SCRAM exchanges that are in
+// progress with some authenticator.
+const maxScramSessions = 4096
+
+// scramMechanisms are SCRAM mechanisms offered by SendUnauthorized,
+// strongest first.
+var scramMechanisms = []string{"SCRAM-SHA-512", "SCRAM-SHA-256", "SCRAM-SHA-1"}
+
+var scramState struct {
+	sync.Mutex
+	enabled bool
+}
+
+// EnableScramAuth turns on (or off) support of SCRAM-SHA-1,
+// SCRAM-SHA-256 and SCRAM-SHA-512 http auth (RFC 7804) in
+// AuthWebCreds and makes SendUnauthorized offer SCRAM challenges in
+// addition to basic. Unlike basic and digest auth, SCRAM works with
+// password hashes, so admins can use it too, provided that their
+// hash algorithm matches mechanism (e.g. pbkdf2-sha512 for
+// SCRAM-SHA-512).
+//
+// SCRAM takes two round trips: first request of exchange is answered
+// with ScramContinueError, that SendAuthError sends as 401 carrying
+// server-first message, and creds of second one report server
+// signature that SetAuthenticationInfo sends to client.
+func EnableScramAuth(enable bool) {
+	scramState.Lock()
+	scramState.enabled = enable
+	scramState.Unlock()
+}
+
+func scramEnabled() bool {
+	scramState.Lock()
+	defer scramState.Unlock()
+	return scramState.enabled
+}
+
+// ScramContinueError is returned by AuthWebCreds for first request
+// of SCRAM exchange. Challenge is WWW-Authenticate header value of
+// 401 response that continues exchange (see SendAuthError).
+type ScramContinueError struct {
+	Challenge string
+}
+
+func (e *ScramContinueError) Error() string {
+	return "SCRAM exchange is not complete"
+}
+
+// AuthenticationInfo returns value of Authentication-Info header that
+// response to request authenticated with given creds should carry
+// (i.e. server signature of SCRAM exchange) or "".
+func AuthenticationInfo(c Creds) string {
+	if ai, ok := c.(interface{ AuthInfo() string }); ok {
+		return ai.AuthInfo()
+	}
+	return ""
+}
+
+// SetAuthenticationInfo sets Authentication-Info header of given
+// response writer if given creds need it (see AuthenticationInfo).
+func SetAuthenticationInfo(w http.ResponseWriter, c Creds) {
+	if info := AuthenticationInfo(c); info != "" {
+		w.Header().Set("Authentication-Info", info)
+	}
+}
+
+type scramSession struct {
+	mech    string
+	newHash func() hash.Hash
+	user    string
+	secret  cbauthimpl.ScramSecret
+	// known is false for unknown users, whose exchanges are
+	// carried out till client-final message in order not to
+	// reveal that user doesn't exist
+	known           bool
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	expires         time.Time
+}
+
+// scramSessions tracks SCRAM exchanges that are in progress with
+// some authenticator.
+type scramSessions struct {
+	sync.Mutex
+	sessions map[string]*scramSession
+}
+
+func randomB64(n int, enc *base64.Encoding) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return enc.EncodeToString(buf)
+}
+
+// add method starts tracking given exchange. It returns sid of
+// exchange or "" if too many exchanges are in progress.
+func (s *scramSessions) add(sess *scramSession) string {
+	now := time.Now()
+	s.Lock()
+	defer s.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[string]*scramSession)
+	}
+	if len(s.sessions) >= maxScramSessions {
+		for k, st := range s.sessions {
+			if now.After(st.expires) {
+				delete(s.sessions, k)
+			}
+		}
+	}
+	if len(s.sessions) >= maxScramSessions {
+		return ""
+	}
+	sid := randomB64(16, base64.RawURLEncoding)
+	sess.expires = now.Add(ScramSessionTTL)
+	s.sessions[sid] = sess
+	return sid
+}
+
+// take method returns exchange with given sid and stops tracking it,
+// so that every exchange can be completed once. Returns nil if there
+// is no such exchange or it has expired.
+func (s *scramSessions) take(sid string) *scramSession {
+	s.Lock()
+	defer s.Unlock()
+	sess := s.sessions[sid]
+	delete(s.sessions, sid)
+	if sess == nil || time.Now().After(sess.expires) {
+		return nil
+	}
+	return sess
+}
+
+// scramChallenges returns WWW-Authenticate header values of SCRAM
+// challenges or nil if SCRAM auth is disabled.
+func scramChallenges() []string {
+	if !scramEnabled() {
+		return nil
+	}
+	var rv []string
+	for _, mech := range scramMechanisms {
+		rv = append(rv, fmt.Sprintf(`%s realm="%s"`, mech, DigestRealm))
+	}
+	return rv
+}
+
+// scramAuthParams returns mechanism and params part of given
+// Authorization header value and true if it carries SCRAM auth.
+func scramAuthParams(auth string) (mech, params string, ok bool) {
+	sp := strings.IndexByte(auth, ' ')
+	if sp < 0 {
+		return "", "", false
+	}
+	mech = strings.ToUpper(auth[:sp])
+	for _, m := range scramMechanisms {
+		if mech == m {
+			return mech, auth[sp+1:], true
+		}
+	}
+	return "", "", false
+}
+
+// scramAttrs parses comma separated attributes of SCRAM message
+// (RFC 5802) which must start with attributes of given names.
+func scramAttrs(msg string, names ...string) ([]string, bool) {
+	parts := strings.Split(msg, ",")
+	if len(parts) < len(names) {
+		return nil, false
+	}
+	rv := make([]string, len(names))
+	for i, name := range names {
+		if !strings.HasPrefix(parts[i], name+"=") {
+			return nil, false
+		}
+		rv[i] = parts[i][len(name)+1:]
+	}
+	return rv, true
+}
+
+func scramHMAC(newHash func() hash.Hash, key []byte, msg string) []byte {
+	mac := hmac.New(newHash, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// scramFirst handles client-first message of SCRAM exchange.
+func scramFirst(a *authImpl, req *http.Request, mech, msg string) (Creds, error) {
+	// gs2 header must not request channel binding or authzid
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 || (parts[0] != "n" && parts[0] != "y") || parts[1] != "" {
+		tracef("", "scram auth of request to %s was rejected: bad gs2 header", req.URL.Path)
+		return NoAccessCreds, nil
+	}
+	attrs, ok := scramAttrs(parts[2], "n", "r")
+	if !ok || attrs[0] == "" || attrs[1] == "" {
+		tracef("", "scram auth of request to %s was rejected: bad client-first message", req.URL.Path)
+		return NoAccessCreds, nil
+	}
+	user := strings.NewReplacer("=2C", ",", "=3D", "=").Replace(attrs[0])
+
+	hashName := strings.TrimPrefix(mech, "SCRAM-")
+	sec, known, err := cbauthimpl.GetScramSecret(a.svc, user, hashName)
+	if err != nil {
+		tracef(user, "scram auth of request to %s failed: %v", req.URL.Path, err)
+		return nil, err
+	}
+	sess := &scramSession{
+		mech:            mech,
+		newHash:         cbauthimpl.ScramHash(hashName),
+		user:            user,
+		secret:          sec,
+		known:           known,
+		gs2Header:       parts[0] + ",,",
+		clientFirstBare: parts[2],
+		nonce:           attrs[1] + randomB64(18, base64.StdEncoding),
+	}
+	sess.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", sess.nonce,
+		base64.StdEncoding.EncodeToString(sec.Salt), sec.Iterations)
+	sid := a.scramSessions.add(sess)
+	if sid == "" {
+		tracef(user, "scram auth of %s to %s was refused: too many exchanges in progress",
+			TagUserData(user), req.URL.Path)
+		return NoAccessCreds, nil
+	}
+	return nil, &ScramContinueError{Challenge: fmt.Sprintf("%s sid=%s, data=%s", mech, sid,
+		base64.StdEncoding.EncodeToString([]byte(sess.serverFirst)))}
+}
+
+// scramFinal handles client-final message of SCRAM exchange with
+// given sid. It returns creds of user and server-final message if
+// client proof is valid and nil creds otherwise.
+func scramFinal(a *authImpl, mech, sid, msg string) (*cbauthimpl.CredsImpl, string, error) {
+	sess := a.scramSessions.take(sid)
+	if sess == nil || sess.mech != mech {
+		return nil, "", nil
+	}
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, "", nil
+	}
+	withoutProof := msg[:i]
+	proof, err := base64.StdEncoding.DecodeString(msg[i+len(",p="):])
+	if err != nil {
+		return nil, "", nil
+	}
+	attrs, ok := scramAttrs(withoutProof, "c", "r")
+	if !ok || attrs[0] != base64.StdEncoding.EncodeToString([]byte(sess.gs2Header)) ||
+		attrs[1] != sess.nonce || !sess.known {
+		return nil, "", nil
+	}
+
+	authMessage := sess.clientFirstBare + "," + sess.serverFirst + "," + withoutProof
+	clientKey := scramHMAC(sess.newHash, sess.secret.SaltedPassword, "Client Key")
+	h := sess.newHash()
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+	signature := scramHMAC(sess.newHash, storedKey, authMessage)
+	if len(proof) != len(signature) {
+		return nil, "", nil
+	}
+	for i := range proof {
+		proof[i] ^= signature[i]
+	}
+	h.Reset()
+	h.Write(proof)
+	if subtle.ConstantTimeCompare(h.Sum(nil), storedKey) != 1 {
+		return nil, "", nil
+	}
+
+	ci, err := cbauthimpl.ScramCreds(a.svc, sess.user, sess.secret)
+	if err != nil || ci == nil {
+		return nil, "", err
+	}
+	serverKey := scramHMAC(sess.newHash, sess.secret.SaltedPassword, "Server Key")
+	serverFinal := "v=" + base64.StdEncoding.EncodeToString(scramHMAC(sess.newHash, serverKey, authMessage))
+	return ci, serverFinal, nil
+}
+
+func doScramAuth(ctx context.Context, a *authImpl, req *http.Request, mech, auth string) (Creds, error) {
+	if !scramEnabled() {
+		return nil, errors.New("SCRAM auth is not enabled")
+	}
+	params := parseDigestParams(auth)
+	data, err := base64.StdEncoding.DecodeString(params["data"])
+	if err != nil || len(data) == 0 {
+		tracef("", "scram auth of request to %s was rejected: bad data", req.URL.Path)
+		return NoAccessCreds, nil
+	}
+	sid := params["sid"]
+	if sid == "" {
+		return scramFirst(a, req, mech, string(data))
+	}
+
+	ci, serverFinal, err := scramFinal(a, mech, sid, string(data))
+	if err != nil {
+		tracef("", "scram auth of request to %s failed: %v", req.URL.Path, err)
+		return nil, err
+	}
+	if ci == nil {
+		tracef("", "scram auth of request to %s was rejected", req.URL.Path)
+		return NoAccessCreds, nil
+	}
+	tracef(ci.Name(), "scram auth of %s to %s succeeded", TagUserData(ci.Name()), req.URL.Path)
+	if ci.IsLegacy() {
+		noteLegacyAuth(ci.Name())
+	}
+	info := fmt.Sprintf("sid=%s, data=%s", sid, base64.StdEncoding.EncodeToString([]byte(serverFinal)))
+	return cbauthimpl.WithAuthInfo(cbauthimpl.WithMechanism(ci, MechanismScram), info), nil
+}
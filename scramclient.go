@@ -0,0 +1,323 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// SASLError is returned when SASL exchange with service fails.
+type SASLError struct {
+	Mech   string
+	Reason string
+}
+
+func (e *SASLError) Error() string {
+	return fmt.Sprintf("SASL %s exchange failed: %s", e.Mech, e.Reason)
+}
+
+// scramMaxIterations is largest iteration count server-first message
+// may ask for, so that malicious or broken server can't make client
+// spin on PBKDF2.
+const scramMaxIterations = 1000000
+
+// scramHashName returns SCRAM hash name (see cbauthimpl.ScramHash) of
+// given mechanism. Both "SCRAM-SHA-256" (as in RFC 7804) and
+// "SCRAM-SHA256" (as memcached spells it) are understood.
+func scramHashName(mech string) string {
+	h := strings.TrimPrefix(strings.ToUpper(mech), "SCRAM-")
+	h = strings.Replace(h, "SHA-", "SHA", 1)
+	if !strings.HasPrefix(h, "SHA") || len(h) == len("SHA") {
+		return ""
+	}
+	return "SHA-" + h[len("SHA"):]
+}
+
+// PickScramMechanism returns strongest SCRAM mechanism of given
+// mechanisms (e.g. as listed by service) or "" if there are none.
+func PickScramMechanism(mechs []string) string {
+	for _, want := range scramMechanisms {
+		for _, m := range mechs {
+			if scramHashName(m) == scramHashName(want) {
+				return m
+			}
+		}
+	}
+	return ""
+}
+
+// ScramClient struct carries out client side of SCRAM exchange
+// (RFC 5802). Exchange consists of First message, Final message
+// computed from server-first message, and Verify of server-final
+// message.
+type ScramClient struct {
+	mech            string
+	newHash         func() hash.Hash
+	user, pwd       string
+	nonce           string
+	clientFirstBare string
+	authMessage     string
+	serverSignature []byte
+}
+
+// NewScramClient returns ScramClient for given mechanism and creds.
+func NewScramClient(mech, user, pwd string) (*ScramClient, error) {
+	newHash := cbauthimpl.ScramHash(scramHashName(mech))
+	if newHash == nil {
+		return nil, &SASLError{Mech: mech, Reason: "unsupported mechanism"}
+	}
+	return &ScramClient{mech: mech, newHash: newHash, user: user, pwd: pwd,
+		nonce: randomB64(18, base64.StdEncoding)}, nil
+}
+
+// First method returns client-first message.
+func (c *ScramClient) First() []byte {
+	user := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(c.user)
+	c.clientFirstBare = "n=" + user + ",r=" + c.nonce
+	return []byte("n,," + c.clientFirstBare)
+}
+
+func (c *ScramClient) fail(reason string) error {
+	return &SASLError{Mech: c.mech, Reason: reason}
+}
+
+// Final method returns client-final message for given server-first
+// message.
+func (c *ScramClient) Final(serverFirst []byte) ([]byte, error) {
+	attrs, ok := scramAttrs(string(serverFirst), "r", "s", "i")
+	if !ok || !strings.HasPrefix(attrs[0], c.nonce) || len(attrs[0]) == len(c.nonce) {
+		return nil, c.fail("bad server-first message")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs[1])
+	if err != nil {
+		return nil, c.fail("bad salt")
+	}
+	iterations, err := strconv.Atoi(attrs[2])
+	if err != nil || iterations <= 0 || iterations > scramMaxIterations {
+		return nil, c.fail("bad iteration count")
+	}
+
+	salted, err := pbkdf2.Key(c.newHash, c.pwd, salt, iterations, c.newHash().Size())
+	if err != nil {
+		return nil, c.fail(err.Error())
+	}
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte("n,,")) + ",r=" + attrs[0]
+	c.authMessage = c.clientFirstBare + "," + string(serverFirst) + "," + withoutProof
+
+	clientKey := scramHMAC(c.newHash, salted, "Client Key")
+	h := c.newHash()
+	h.Write(clientKey)
+	proof := scramHMAC(c.newHash, h.Sum(nil), c.authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	serverKey := scramHMAC(c.newHash, salted, "Server Key")
+	c.serverSignature = scramHMAC(c.newHash, serverKey, c.authMessage)
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// Verify method verifies server signature of given server-final
+// message, so that client knows that server knows its secret.
+func (c *ScramClient) Verify(serverFinal []byte) error {
+	msg := string(serverFinal)
+	if strings.HasPrefix(msg, "e=") {
+		return c.fail(msg[len("e="):])
+	}
+	attrs, ok := scramAttrs(msg, "v")
+	if !ok || c.serverSignature == nil {
+		return c.fail("bad server-final message")
+	}
+	sig, err := base64.StdEncoding.DecodeString(attrs[0])
+	if err != nil || !hmac.Equal(sig, c.serverSignature) {
+		return c.fail("bad server signature")
+	}
+	return nil
+}
+
+// SASLConn interface is connection to service that SASL exchange is
+// carried out over (see ScramAuthenticate). NewMemcachedSASLConn
+// implements it for memcached.
+type SASLConn interface {
+	// SASLMechanisms method returns SASL mechanisms that service
+	// supports.
+	SASLMechanisms() ([]string, error)
+	// SASLStart method sends first message of exchange of given
+	// mechanism. It returns response of service and true if
+	// exchange is complete.
+	SASLStart(mech string, data []byte) (resp []byte, done bool, err error)
+	// SASLStep method sends next message of exchange.
+	SASLStep(mech string, data []byte) (resp []byte, done bool, err error)
+}
+
+// ScramAuthenticate performs SCRAM exchange over given connection
+// with creds returned by GetMemcachedServiceAuth for given host:port
+// of service. Strongest SCRAM mechanism supported by service is
+// used. Default authenticator is used if given authenticator is nil.
+func ScramAuthenticate(a Authenticator, hostport string, conn SASLConn) error {
+	return WithAuthenticator(a, func(a Authenticator) error {
+		user, pwd, err := a.GetMemcachedServiceAuth(hostport)
+		if err != nil {
+			return err
+		}
+		mechs, err := conn.SASLMechanisms()
+		if err != nil {
+			return err
+		}
+		mech := PickScramMechanism(mechs)
+		if mech == "" {
+			return &SASLError{Mech: "SCRAM", Reason: fmt.Sprintf("not supported by %s", hostport)}
+		}
+		return scramExchangeOver(conn, mech, user, pwd)
+	})
+}
+
+func scramExchangeOver(conn SASLConn, mech, user, pwd string) error {
+	c, err := NewScramClient(mech, user, pwd)
+	if err != nil {
+		return err
+	}
+	resp, done, err := conn.SASLStart(mech, c.First())
+	if err != nil {
+		return err
+	}
+	if done {
+		return c.fail("exchange completed prematurely")
+	}
+	final, err := c.Final(resp)
+	if err != nil {
+		return err
+	}
+	resp, done, err = conn.SASLStep(mech, final)
+	if err != nil {
+		return err
+	}
+	if !done {
+		return c.fail("exchange is not complete")
+	}
+	return c.Verify(resp)
+}
+
+// memcached binary protocol opcodes and statuses of SASL (and audit)
+// commands
+const (
+	mcReqMagic           = 0x80
+	mcResMagic           = 0x81
+	mcSASLListMechs      = 0x20
+	mcSASLAuth           = 0x21
+	mcSASLStep           = 0x22
+	mcAuditPut           = 0x27
+	mcStatusSuccess      = 0x00
+	mcStatusAuthError    = 0x20
+	mcStatusAuthContinue = 0x21
+	mcHeaderLen          = 24
+)
+
+// mcMaxBodyLen is largest body of memcached response that is read.
+const mcMaxBodyLen = 1 << 20
+
+type memcachedSASLConn struct {
+	rw io.ReadWriter
+}
+
+// NewMemcachedSASLConn returns SASLConn that speaks memcached binary
+// protocol over given connection. Connection must not be used for
+// anything else until exchange is complete.
+func NewMemcachedSASLConn(rw io.ReadWriter) SASLConn {
+	return &memcachedSASLConn{rw: rw}
+}
+
+func (c *memcachedSASLConn) roundTrip(opcode byte, key string, body []byte) (uint16, []byte, error) {
+	return c.roundTripExtras(opcode, nil, key, body)
+}
+
+func (c *memcachedSASLConn) roundTripExtras(opcode byte, extras []byte, key string, body []byte) (uint16, []byte, error) {
+	req := make([]byte, mcHeaderLen, mcHeaderLen+len(extras)+len(key)+len(body))
+	req[0] = mcReqMagic
+	req[1] = opcode
+	binary.BigEndian.PutUint16(req[2:4], uint16(len(key)))
+	req[4] = byte(len(extras))
+	binary.BigEndian.PutUint32(req[8:12], uint32(len(extras)+len(key)+len(body)))
+	req = append(append(append(req, extras...), key...), body...)
+	if _, err := c.rw.Write(req); err != nil {
+		return 0, nil, err
+	}
+
+	var hdr [mcHeaderLen]byte
+	if _, err := io.ReadFull(c.rw, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	if hdr[0] != mcResMagic || hdr[1] != opcode {
+		return 0, nil, fmt.Errorf("unexpected memcached response header %x", hdr[:2])
+	}
+	bodyLen := binary.BigEndian.Uint32(hdr[8:12])
+	if bodyLen > mcMaxBodyLen {
+		return 0, nil, fmt.Errorf("memcached response of %d bytes is too large", bodyLen)
+	}
+	rest := make([]byte, bodyLen)
+	if _, err := io.ReadFull(c.rw, rest); err != nil {
+		return 0, nil, err
+	}
+	skip := int(binary.BigEndian.Uint16(hdr[2:4])) + int(hdr[4])
+	if skip > len(rest) {
+		return 0, nil, fmt.Errorf("malformed memcached response")
+	}
+	return binary.BigEndian.Uint16(hdr[6:8]), rest[skip:], nil
+}
+
+func (c *memcachedSASLConn) SASLMechanisms() ([]string, error) {
+	status, body, err := c.roundTrip(mcSASLListMechs, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if status != mcStatusSuccess {
+		return nil, fmt.Errorf("memcached refused to list SASL mechanisms: status 0x%x", status)
+	}
+	return strings.Fields(string(body)), nil
+}
+
+func (c *memcachedSASLConn) step(opcode byte, mech string, data []byte) ([]byte, bool, error) {
+	status, body, err := c.roundTrip(opcode, mech, data)
+	if err != nil {
+		return nil, false, err
+	}
+	switch status {
+	case mcStatusSuccess:
+		return body, true, nil
+	case mcStatusAuthContinue:
+		return body, false, nil
+	case mcStatusAuthError:
+		return nil, false, &SASLError{Mech: mech, Reason: "authentication failed"}
+	}
+	return nil, false, &SASLError{Mech: mech, Reason: fmt.Sprintf("unexpected status 0x%x", status)}
+}
+
+func (c *memcachedSASLConn) SASLStart(mech string, data []byte) ([]byte, bool, error) {
+	return c.step(mcSASLAuth, mech, data)
+}
+
+func (c *memcachedSASLConn) SASLStep(mech string, data []byte) ([]byte, bool, error) {
+	return c.step(mcSASLStep, mech, data)
+}
@@ -0,0 +1,205 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// ShadowLogPrint function, if non-nil, is used to log mismatches
+// found by shadow verification (see SetShadowMode) unless Logger is
+// set (see SetLogger), in which case they are passed to Logger at
+// warning level.
+var ShadowLogPrint func(args ...interface{})
+
+// maxShadowInflight limits number of concurrently running shadow
+// verifications. Auths sampled while limit is reached are not
+// mirrored.
+const maxShadowInflight = 16
+
+// ShadowVerifier is secondary verification path that results of
+// password auth are mirrored to (see SetShadowMode). Verify is
+// called with user, password and copy of request headers (nil for
+// Auth calls); it returns nil creds if it doesn't accept them.
+// Verifier must not call Auth or AuthWebCreds, since they would
+// mirror shadow auths too.
+type ShadowVerifier interface {
+	Verify(user, pwd string, hdr http.Header) (Creds, error)
+}
+
+// ShadowVerifierFunc type adapts function to ShadowVerifier
+// interface.
+type ShadowVerifierFunc func(user, pwd string, hdr http.Header) (Creds, error)
+
+// Verify method simply calls "this" function.
+func (f ShadowVerifierFunc) Verify(user, pwd string, hdr http.Header) (Creds, error) {
+	return f(user, pwd, hdr)
+}
+
+// ShadowStats struct describes results of shadow verification.
+type ShadowStats struct {
+	// Compared is number of auths whose results were compared
+	Compared uint64
+	// Mismatches is number of compared auths whose results
+	// differed
+	Mismatches uint64
+	// Errors is number of shadow verifications that failed
+	Errors uint64
+	// Skipped is number of sampled auths that were not
+	// mirrored because too many shadow verifications were
+	// running
+	Skipped uint64
+}
+
+var shadowState struct {
+	sync.Mutex
+	fraction float64
+	verifier ShadowVerifier
+	inflight int
+	stats    ShadowStats
+}
+
+// SetShadowMode makes given fraction (from 0 to 1) of password auths
+// also verified by given verifier, in background. Results are
+// compared with primary ones (access granted, user name and admin
+// bits) and mismatches are logged via ShadowLogPrint. This allows to
+// safely validate new verification logic (e.g. new password hash
+// scheme) in production. Primary results are always the ones
+// returned. Zero fraction or nil verifier turns mirroring off.
+//
+// Note that verifier gets cleartext passwords (and
+// EndpointShadowVerifier sends them to it's endpoint, i.e. out of
+// this process), so only trusted verifiers should be used. Auths of
+// internal users (including scoped tokens) are never mirrored.
+func SetShadowMode(fraction float64, v ShadowVerifier) {
+	shadowState.Lock()
+	shadowState.fraction = fraction
+	shadowState.verifier = v
+	shadowState.Unlock()
+}
+
+// GetShadowStats returns results of shadow verification so far.
+func GetShadowStats() ShadowStats {
+	shadowState.Lock()
+	defer shadowState.Unlock()
+	return shadowState.stats
+}
+
+// EndpointShadowVerifier returns ShadowVerifier that passes creds to
+// given endpoint speaking ns_server's auth endpoint protocol (e.g.
+// ns_server with new verification logic). Given authenticator (nil
+// means default one) supplies auth cache that results are
+// interpreted against.
+func EndpointShadowVerifier(url string, a Authenticator) ShadowVerifier {
+	return ShadowVerifierFunc(func(user, pwd string, hdr http.Header) (Creds, error) {
+		req, err := http.NewRequest("POST", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.SetBasicAuth(user, pwd)
+		var rv Creds
+		err = WithAuthenticator(a, func(a Authenticator) error {
+			ai, ok := a.(*authImpl)
+			if !ok {
+				return fmt.Errorf("authenticator %T doesn't support shadow verification", a)
+			}
+			ci, err := cbauthimpl.VerifyOnEndpoint(ai.svc, url, req.Header)
+			if ci != nil {
+				rv = ci
+			}
+			return err
+		})
+		return rv, err
+	})
+}
+
+// credsSummary returns things primary and shadow auth results are
+// compared by.
+func credsSummary(c Creds) string {
+	if c == nil || c == NoAccessCreds {
+		return "no access"
+	}
+	isAdmin, _ := c.IsAdmin()
+	return fmt.Sprintf("user %s, admin: %v, read any metadata: %v",
+		TagUserData(c.Name()), isAdmin, c.CanReadAnyMetadata())
+}
+
+// mirrorable returns true iff password auth of given user may be
+// mirrored. Passwords of internal users grant access to whole
+// cluster, so they never leave the process.
+func mirrorable(user string, primary Creds) bool {
+	if strings.HasPrefix(user, "@") {
+		return false
+	}
+	return primary == nil || !primary.IsInternal()
+}
+
+// mirrorAuth starts shadow verification of given password auth if it
+// is sampled.
+func mirrorAuth(user, pwd string, hdr http.Header, primary Creds, err error) {
+	if err != nil || !mirrorable(user, primary) {
+		return
+	}
+	shadowState.Lock()
+	v := shadowState.verifier
+	if v == nil || shadowState.fraction <= 0 || rand.Float64() >= shadowState.fraction {
+		shadowState.Unlock()
+		return
+	}
+	if shadowState.inflight >= maxShadowInflight {
+		shadowState.stats.Skipped++
+		shadowState.Unlock()
+		return
+	}
+	shadowState.inflight++
+	shadowState.Unlock()
+
+	if hdr != nil {
+		hdr = hdr.Clone()
+	}
+	expected := credsSummary(primary)
+	go func() {
+		shadow, err := v.Verify(user, pwd, hdr)
+		got := credsSummary(shadow)
+
+		shadowState.Lock()
+		shadowState.inflight--
+		switch {
+		case err != nil:
+			shadowState.stats.Errors++
+		case got != expected:
+			shadowState.stats.Compared++
+			shadowState.stats.Mismatches++
+		default:
+			shadowState.stats.Compared++
+		}
+		shadowState.Unlock()
+
+		if err != nil {
+			logVia(ShadowLogPrint, logWarn, fmt.Sprintf("cbauth: shadow verification of %s failed: %s", TagUserData(user), err),
+				"user", TagUserData(user), "error", err)
+		} else if got != expected {
+			logVia(ShadowLogPrint, logWarn, fmt.Sprintf("cbauth: shadow verification mismatch: primary: %s, shadow: %s", expected, got),
+				"user", TagUserData(user), "primary", expected, "shadow", got)
+		}
+	}()
+}
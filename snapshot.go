@@ -0,0 +1,62 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// CacheDiff type describes differences between two cbauth cache
+// snapshots (see DiffCaches).
+type CacheDiff = cbauthimpl.CacheDiff
+
+// RoleChange type describes change of roles of some user or group.
+type RoleChange = cbauthimpl.RoleChange
+
+// Cache type is cbauth cache as pushed by ns_server. It is used as
+// snapshot format by WriteCacheSnapshot and DiffCaches.
+type Cache = cbauthimpl.Cache
+
+// DiffCaches returns added and removed users, groups, buckets and
+// nodes, users and groups with changed roles, users and buckets
+// with changed passwords and recreated buckets between given
+// snapshots. It helps to debug "this user worked yesterday"
+// reports.
+func DiffCaches(from, to *Cache) *CacheDiff {
+	return cbauthimpl.DiffCaches(from, to)
+}
+
+// WriteCacheSnapshot writes json snapshot of current cache of
+// default authenticator to given writer. Snapshots can be compared
+// by DiffCaches (or by "cbauth-tool diff"). Passwords and password
+// hashes are written as fingerprints that only tell whether they
+// changed.
+func WriteCacheSnapshot(w io.Writer) error {
+	a, ok := GetDefault().(*authImpl)
+	if !ok {
+		return ErrNotInitialized
+	}
+	c, err := cbauthimpl.SnapshotCache(a.svc)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(c)
+}
@@ -0,0 +1,135 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// Names of spans cbauth starts (see SetSpanTracer).
+const (
+	SpanAuthWebCreds      = "cbauth.AuthWebCreds"
+	SpanCacheLookup       = "cbauth.cache_lookup"
+	SpanServerVerify      = "cbauth.ns_server_verify"
+	SpanServerVerifyFresh = "cbauth.ns_server_verify_fresh"
+)
+
+// Attributes cbauth sets on its spans.
+const (
+	// AttrPath is path of auth decision (e.g. PathCache).
+	AttrPath = "cbauth.path"
+	// AttrDecision is outcome of decision (e.g. OutcomeAllowed).
+	AttrDecision = "cbauth.decision"
+	// AttrCacheHit is true if creds were verified without
+	// ns_server.
+	AttrCacheHit = "cbauth.cache_hit"
+	// AttrUserDomain is domain of accepted creds.
+	AttrUserDomain = "cbauth.user.domain"
+)
+
+// Span interface is span started by SpanTracer. It is the part of
+// OpenTelemetry span that cbauth uses.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+// TraceParenter interface may be implemented by Span to propagate
+// its own W3C trace context (rather than trace context of incoming
+// request) to ns_server.
+type TraceParenter interface {
+	TraceParent() (traceparent, tracestate string)
+}
+
+// SpanTracer interface starts spans of auth decisions. It lets
+// services plug in their OpenTelemetry tracer (with few lines of
+// adapter) without cbauth depending on OpenTelemetry. StartSpan is
+// called synchronously on request path.
+type SpanTracer interface {
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+}
+
+type tracerBox struct{ t SpanTracer }
+
+var spanTracer atomic.Value
+
+// SetSpanTracer sets (or clears if nil is passed) tracer that spans
+// of AuthWebCreds, of cache lookups and of calls to ns_server are
+// started with. Trace context of incoming requests (traceparent
+// header) is passed along to ns_server regardless of tracer.
+func SetSpanTracer(t SpanTracer) {
+	spanTracer.Store(tracerBox{t})
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) RecordError(err error)                      {}
+func (noopSpan) End()                                       {}
+
+func startSpan(ctx context.Context, name string) (context.Context, Span) {
+	b, _ := spanTracer.Load().(tracerBox)
+	if b.t == nil {
+		return ctx, noopSpan{}
+	}
+	return b.t.StartSpan(ctx, name)
+}
+
+// annotateAuthSpan sets attributes of given auth result on given span.
+func annotateAuthSpan(span Span, path string, c Creds, err error) {
+	if _, ok := span.(noopSpan); ok {
+		return
+	}
+	span.SetAttribute(AttrPath, path)
+	span.SetAttribute(AttrDecision, decisionOutcome(c != nil && c != NoAccessCreds, err))
+	span.SetAttribute(AttrCacheHit, path == PathCache || path == PathHeaderCache)
+	if err != nil {
+		span.RecordError(err)
+		return
+	}
+	if c != nil && c != NoAccessCreds {
+		domain := c.Identity().Domain
+		if domain == "" {
+			domain = c.Source()
+		}
+		span.SetAttribute(AttrUserDomain, domain)
+	}
+}
+
+// withSpanContext returns copy of given headers that carries trace
+// context of given span if span provides it.
+func withSpanContext(span Span, hdr http.Header) http.Header {
+	tp, ok := span.(TraceParenter)
+	if !ok {
+		return hdr
+	}
+	parent, state := tp.TraceParent()
+	if parent == "" {
+		return hdr
+	}
+	hdr = hdr.Clone()
+	hdr.Set(cbauthimpl.TraceParentHeader, parent)
+	hdr.Del(cbauthimpl.TraceStateHeader)
+	if state != "" {
+		hdr.Set(cbauthimpl.TraceStateHeader, state)
+	}
+	return hdr
+}
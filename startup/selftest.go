@@ -0,0 +1,183 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package startup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/couchbase/cbauth"
+	"github.com/couchbase/cbauth/metakv"
+)
+
+// errNotAdmin is returned by self-test auth check if credential of
+// local node doesn't authenticate as full admin.
+var errNotAdmin = errors.New("internal credential is not authorized as admin")
+
+// SelfTestConfig struct describes what SelfTest checks.
+type SelfTestConfig struct {
+	// HostPort is host:port of local node's management endpoint
+	// (e.g. "127.0.0.1:8091"). Internal credential used to talk
+	// to it is authenticated back through cbauth.
+	HostPort string
+	// MetakvProbePath is metakv key that is read to check
+	// metakv availability. "/cbauth/startup-probe" is used if
+	// empty.
+	MetakvProbePath string
+	// CheckTimeout limits duration of each check. Checks are
+	// only limited by ctx if it's zero.
+	CheckTimeout time.Duration
+}
+
+// CheckResult struct describes outcome of single self-test check.
+type CheckResult struct {
+	Name     string        `json:"name"`
+	OK       bool          `json:"ok"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+
+	err error
+}
+
+// Report struct is returned by SelfTest. Checks are listed in order
+// they were run.
+type Report struct {
+	OK     bool          `json:"ok"`
+	Checks []CheckResult `json:"checks"`
+}
+
+// Err method returns Error describing every failed check of report
+// or nil if all of them passed.
+func (r *Report) Err() error {
+	var rv Error
+	for i := range r.Checks {
+		if !r.Checks[i].OK {
+			rv = append(rv, &StepError{r.Checks[i].Name, r.Checks[i].err})
+		}
+	}
+	if rv != nil {
+		return rv
+	}
+	return nil
+}
+
+// SelfTest exercises full cbauth pipeline against live cluster once:
+// it checks that cbauth has its state from ns_server, authenticates
+// internal credential of local node, fetches client and server TLS
+// configs and reads metakv key. It is intended for install-time
+// verification and smoke tests, so unlike WaitReady it doesn't wait
+// for anything and runs every check regardless of failures of
+// previous ones.
+func SelfTest(ctx context.Context, cfg SelfTestConfig) *Report {
+	probe := cfg.MetakvProbePath
+	if probe == "" {
+		probe = "/cbauth/startup-probe"
+	}
+	checks := []struct {
+		name  string
+		check func(ctx context.Context) error
+	}{
+		{"cbauth", func(context.Context) error {
+			return CBAuthStep(0).Check()
+		}},
+		{"auth", func(ctx context.Context) error {
+			return checkInternalAuth(ctx, cfg.HostPort)
+		}},
+		{"tls", func(context.Context) error {
+			if _, err := cbauth.GetClientTLSConfig(""); err != nil {
+				return fmt.Errorf("client config: %s", err)
+			}
+			if _, err := cbauth.GetServerTLSConfig(); err != nil {
+				return fmt.Errorf("server config: %s", err)
+			}
+			return nil
+		}},
+		{"metakv", func(context.Context) error {
+			_, _, err := metakv.Get(probe)
+			return err
+		}},
+	}
+
+	rv := &Report{OK: true}
+	for _, c := range checks {
+		started := time.Now()
+		err := runCheck(ctx, cfg.CheckTimeout, c.check)
+		res := CheckResult{
+			Name:     c.name,
+			OK:       err == nil,
+			Duration: time.Since(started),
+			err:      err,
+		}
+		if err != nil {
+			res.Error = err.Error()
+			rv.OK = false
+		}
+		rv.Checks = append(rv.Checks, res)
+	}
+	return rv
+}
+
+// runCheck runs check and gives up on it once ctx is done or timeout
+// passes. Checks that don't take context (like metakv reads) are left
+// running in background in that case.
+func runCheck(ctx context.Context, timeout time.Duration,
+	check func(ctx context.Context) error) error {
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func checkInternalAuth(ctx context.Context, hostport string) error {
+	if hostport == "" {
+		return errors.New("host:port of local node is not configured")
+	}
+	user, pwd, err := cbauth.GetHTTPServiceAuthContext(ctx, hostport)
+	if err != nil {
+		return fmt.Errorf("no internal credential for `%s': %s",
+			hostport, err)
+	}
+	creds, err := cbauth.AuthContext(ctx, user, pwd)
+	if err != nil {
+		return err
+	}
+	admin, err := creds.IsAdmin()
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return errNotAdmin
+	}
+	return nil
+}
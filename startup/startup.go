@@ -0,0 +1,177 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package startup sequences boot of services that use cbauth: it
+// waits for cbauth to get its state from ns_server, then for TLS
+// config to become usable, then for metakv to become available.
+// Every step has its own timeout and all failures are reported in
+// single error.
+package startup
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/couchbase/cbauth"
+	"github.com/couchbase/cbauth/metakv"
+)
+
+// PollInterval is how often steps are retried until they succeed or
+// time out.
+var PollInterval = 100 * time.Millisecond
+
+// Step struct describes single startup step. Check is called until
+// it returns nil or Timeout passes.
+type Step struct {
+	Name    string
+	Timeout time.Duration
+	Check   func() error
+}
+
+// StepError struct describes step that failed to complete in time.
+// Err is last error returned by step's Check.
+type StepError struct {
+	Step string
+	Err  error
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Step, e.Err)
+}
+
+// Error type is returned by Run. It describes every step that
+// failed.
+type Error []*StepError
+
+func (e Error) Error() string {
+	var msgs []string
+	for _, se := range e {
+		msgs = append(msgs, se.Error())
+	}
+	return "startup failed: " + strings.Join(msgs, "; ")
+}
+
+func runStep(s *Step) error {
+	deadline := time.Now().Add(s.Timeout)
+	for {
+		err := s.Check()
+		if err == nil {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return err
+		}
+		time.Sleep(PollInterval)
+	}
+}
+
+// Run runs given steps in order. Returns nil if all of them
+// succeeded or Error otherwise. Steps that follow failed step are
+// checked only once (without waiting), so that returned Error
+// describes all problems at once without delaying it.
+func Run(steps ...Step) error {
+	var rv Error
+	for i := range steps {
+		var err error
+		if rv == nil {
+			err = runStep(&steps[i])
+		} else {
+			err = steps[i].Check()
+		}
+		if err != nil {
+			rv = append(rv, &StepError{steps[i].Name, err})
+		}
+	}
+	if rv != nil {
+		return rv
+	}
+	return nil
+}
+
+// errStale is returned by CBAuthStep check while cbauth has no
+// state from ns_server.
+var errStale = errors.New("cbauth has not received its state from ns_server yet")
+
+// CBAuthStep returns step that waits for default authenticator to
+// get initialized and to receive its state from ns_server.
+func CBAuthStep(timeout time.Duration) Step {
+	return Step{
+		Name:    "cbauth",
+		Timeout: timeout,
+		Check: func() error {
+			if cbauth.GetDefault() == nil {
+				return cbauth.ErrNotInitialized
+			}
+			if cbauth.Health().Stale {
+				return errStale
+			}
+			return nil
+		},
+	}
+}
+
+// TLSStep returns step that waits for TLS config of the cluster to
+// become usable (i.e. certificates it refers to to be readable).
+func TLSStep(timeout time.Duration) Step {
+	return Step{
+		Name:    "tls",
+		Timeout: timeout,
+		Check: func() error {
+			_, err := cbauth.GetClientTLSConfig("")
+			return err
+		},
+	}
+}
+
+// MetakvStep returns step that waits for metakv to become
+// available. Availability is checked by reading given key (which
+// doesn't have to exist).
+func MetakvStep(timeout time.Duration, probePath string) Step {
+	return Step{
+		Name:    "metakv",
+		Timeout: timeout,
+		Check: func() error {
+			_, _, err := metakv.Get(probePath)
+			return err
+		},
+	}
+}
+
+// Config struct holds timeouts of WaitReady steps. Zero timeout
+// means that step is only attempted once.
+type Config struct {
+	CBAuthTimeout time.Duration
+	TLSTimeout    time.Duration
+	MetakvTimeout time.Duration
+	// MetakvProbePath is metakv key that is read to check
+	// metakv availability. "/cbauth/startup-probe" is used if
+	// empty.
+	MetakvProbePath string
+}
+
+// WaitReady waits for cbauth, then TLS config, then metakv
+// according to given config.
+func WaitReady(cfg Config) error {
+	probe := cfg.MetakvProbePath
+	if probe == "" {
+		probe = "/cbauth/startup-probe"
+	}
+	return Run(
+		CBAuthStep(cfg.CBAuthTimeout),
+		TLSStep(cfg.TLSTimeout),
+		MetakvStep(cfg.MetakvTimeout, probe))
+}
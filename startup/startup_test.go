@@ -0,0 +1,104 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package startup
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	PollInterval = time.Millisecond
+	var order []string
+	var attempts int
+	errTLS := errors.New("no certs")
+	err := Run(
+		Step{Name: "first", Timeout: time.Second, Check: func() error {
+			order = append(order, "first")
+			attempts++
+			if attempts < 3 {
+				return errors.New("not yet")
+			}
+			return nil
+		}},
+		Step{Name: "second", Timeout: 10 * time.Millisecond, Check: func() error {
+			order = append(order, "second")
+			return errTLS
+		}},
+		Step{Name: "third", Timeout: time.Hour, Check: func() error {
+			order = append(order, "third")
+			return errors.New("down")
+		}})
+
+	se, ok := err.(Error)
+	if !ok || len(se) != 2 || se[0].Step != "second" || se[0].Err != errTLS || se[1].Step != "third" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(err.Error(), "second: no certs; third: down") {
+		t.Fatalf("Unexpected error message: %s", err)
+	}
+	if attempts != 3 || order[len(order)-1] != "third" || order[len(order)-2] != "second" {
+		t.Fatalf("Unexpected order of checks: %v", order)
+	}
+	for _, s := range order[:len(order)-1] {
+		if s == "third" {
+			t.Fatalf("Expect step after failed one to be checked once: %v", order)
+		}
+	}
+
+	if err := Run(Step{Name: "ok", Check: func() error { return nil }}); err != nil {
+		t.Fatalf("Expect nil error. Got: %v", err)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	r := SelfTest(context.Background(), SelfTestConfig{CheckTimeout: time.Second})
+	if r.OK || len(r.Checks) != 4 {
+		t.Fatalf("Unexpected report: %+v", r)
+	}
+	for i, name := range []string{"cbauth", "auth", "tls", "metakv"} {
+		if r.Checks[i].Name != name || r.Checks[i].OK || r.Checks[i].Error == "" {
+			t.Fatalf("Unexpected result of check %d: %+v", i, r.Checks[i])
+		}
+	}
+	se, ok := r.Err().(Error)
+	if !ok || len(se) != 4 || se[0].Step != "cbauth" {
+		t.Fatalf("Unexpected error: %v", r.Err())
+	}
+
+	block := make(chan struct{})
+	defer close(block)
+	err := runCheck(context.Background(), 10*time.Millisecond,
+		func(context.Context) error { <-block; return nil })
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expect hanging check to time out. Got: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r = SelfTest(ctx, SelfTestConfig{})
+	for _, c := range r.Checks {
+		if c.Error != context.Canceled.Error() {
+			t.Fatalf("Expect canceled checks. Got: %+v", c)
+		}
+	}
+	if (&Report{OK: true}).Err() != nil {
+		t.Fatalf("Expect nil error for passed report")
+	}
+}
@@ -0,0 +1,103 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync/atomic"
+)
+
+// StatKeyRedaction type controls how StatKey hides user names.
+type StatKeyRedaction int
+
+const (
+	// StatKeyHashed makes stat keys carry salted hashes of user
+	// names (see SetStatKeySalt). It is default.
+	StatKeyHashed StatKeyRedaction = iota
+	// StatKeyTagged makes stat keys carry user names wrapped in
+	// redaction tags (see TagUserData), so that they are redacted
+	// together with logs.
+	StatKeyTagged
+	// StatKeyPlain makes stat keys carry user names as is. It is
+	// only meant for deployments that don't redact user data.
+	StatKeyPlain
+)
+
+type statKeyConfig struct {
+	redaction StatKeyRedaction
+	salt      []byte
+}
+
+var statKeyBox atomic.Value
+
+func init() {
+	statKeyBox.Store(&statKeyConfig{})
+}
+
+func getStatKeyConfig() *statKeyConfig {
+	return statKeyBox.Load().(*statKeyConfig)
+}
+
+// SetStatKeyRedaction sets how StatKey hides user names.
+func SetStatKeyRedaction(r StatKeyRedaction) {
+	cfg := *getStatKeyConfig()
+	cfg.redaction = r
+	statKeyBox.Store(&cfg)
+}
+
+// SetStatKeySalt sets salt of hashes of StatKeyHashed keys. Keys are
+// only comparable between processes that use same salt, so services
+// that aggregate stats cluster-wide should derive it from something
+// all nodes share. With empty salt (default) hashes of guessable
+// user names can be reversed by brute force.
+func SetStatKeySalt(salt []byte) {
+	cfg := *getStatKeyConfig()
+	cfg.salt = append([]byte(nil), salt...)
+	statKeyBox.Store(&cfg)
+}
+
+// StatKey returns key that given creds' resource usage (e.g. number
+// of queries or scans) can be attributed to in service's metrics. It
+// is "<domain>:<user>" where user is hidden according to
+// SetStatKeyRedaction, so keys are stable for given user and
+// settings but don't leak user names. Internal users (see
+// Creds.IsInternal) are never hidden. Unauthenticated creds get
+// "anonymous".
+func StatKey(c Creds) string {
+	name := c.Name()
+	if c == NoAccessCreds || name == "" {
+		return "anonymous"
+	}
+	domain := c.Source()
+	if d := c.Identity().Domain; d != "" {
+		domain = d
+	}
+	if c.IsInternal() {
+		return domain + ":" + name
+	}
+	cfg := getStatKeyConfig()
+	switch cfg.redaction {
+	case StatKeyTagged:
+		return domain + ":" + TagUserData(name)
+	case StatKeyPlain:
+		return domain + ":" + name
+	}
+	mac := hmac.New(sha256.New, cfg.salt)
+	mac.Write([]byte(domain + ":" + name))
+	return domain + ":" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
@@ -0,0 +1,308 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// TLSSettings type describes TLS configuration of the cluster as
+// pushed by ns_server.
+type TLSSettings = cbauthimpl.TLSSettings
+
+var tlsVersions = map[string]uint16{
+	"tlsv1":   tls.VersionTLS10,
+	"tlsv1.1": tls.VersionTLS11,
+	"tlsv1.2": tls.VersionTLS12,
+	"tlsv1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion converts TLS version name used by ns_server
+// (e.g. "tlsv1.2") to crypto/tls constant. Empty name is converted
+// to 0, i.e. crypto/tls default.
+func ParseTLSVersion(name string) (uint16, error) {
+	if name == "" {
+		return 0, nil
+	}
+	v, ok := tlsVersions[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version: `%s'", name)
+	}
+	return v, nil
+}
+
+// ParseCipherSuites converts cipher suite names (as understood by
+// crypto/tls, e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256") to
+// crypto/tls constants. Insecure suites are refused. Empty list is
+// converted to nil, i.e. crypto/tls default.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		known[s.Name] = s.ID
+	}
+	rv := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite: `%s'", name)
+		}
+		rv = append(rv, id)
+	}
+	return rv, nil
+}
+
+// loadServerCert loads node certificate of given settings, preferring
+// inline PEM to files.
+func loadServerCert(s *TLSSettings) (tls.Certificate, error) {
+	if s.CertPEM != "" || s.KeyPEM != "" {
+		return tls.X509KeyPair([]byte(s.CertPEM), []byte(s.KeyPEM))
+	}
+	if s.CertFile == "" && s.KeyFile == "" {
+		return tls.Certificate{}, errors.New("node certificate is not configured")
+	}
+	return tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+}
+
+// newServerTLSConfig builds server side tls.Config out of given
+// settings and client cert auth state (see GetServerTLSConfig).
+func newServerTLSConfig(s *TLSSettings, certState string) (*tls.Config, error) {
+	minVersion, err := ParseTLSVersion(s.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	suites, err := ParseCipherSuites(s.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := loadServerCert(s)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:   minVersion,
+		CipherSuites: suites,
+		Certificates: []tls.Certificate{cert},
+	}
+	// client certificates are verified by AuthWebCreds against
+	// client CAs of the cluster, so crypto/tls only asks for them
+	switch certState {
+	case ClientCertEnable:
+		cfg.ClientAuth = tls.RequestClientCert
+	case ClientCertMandatory:
+		cfg.ClientAuth = tls.RequireAnyClientCert
+	}
+	return cfg, nil
+}
+
+// newClientTLSConfig builds client side tls.Config out of given
+// settings (see GetClientTLSConfig).
+func newClientTLSConfig(s *TLSSettings, serverName string) (*tls.Config, error) {
+	minVersion, err := ParseTLSVersion(s.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion: minVersion,
+		ServerName: serverName,
+	}
+	if cfg.CipherSuites, err = ParseCipherSuites(s.CipherSuites); err != nil {
+		return nil, err
+	}
+	if s.CAFile != "" {
+		pem, err := ioutil.ReadFile(s.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file `%s'", s.CAFile)
+		}
+	}
+	if s.ClientCertFile != "" || s.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.ClientCertFile, s.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// liveTLS keeps tls configs built out of latest TLS state, so that
+// configs handed out by GetServerTLSConfig and GetClientTLSConfig
+// pick up rotated certificates on next handshake without rereading
+// files on every handshake.
+type liveTLS struct {
+	sync.Mutex
+	built     bool
+	version   uint64
+	server    *tls.Config
+	serverErr error
+	client    *tls.Config
+	clientErr error
+}
+
+// current returns server and client configs of latest TLS state,
+// rebuilding them if state changed since they were built. Client
+// config is built without server name.
+func (l *liveTLS) current(svc *cbauthimpl.Svc) (server, client *tls.Config, serverErr, clientErr error) {
+	st, err := cbauthimpl.GetTLSState(svc)
+	if err != nil {
+		return nil, nil, err, err
+	}
+	l.Lock()
+	defer l.Unlock()
+	if !l.built || l.version != st.Version {
+		l.server, l.serverErr = newServerTLSConfig(&st.Settings, st.ClientCertState)
+		l.client, l.clientErr = newClientTLSConfig(&st.Settings, "")
+		l.built, l.version = true, st.Version
+		if l.serverErr != nil || l.clientErr != nil {
+			tracef("", "rebuilt tls configs of version %d: server: %v, client: %v",
+				st.Version, l.serverErr, l.clientErr)
+		}
+	}
+	return l.server, l.client, l.serverErr, l.clientErr
+}
+
+func (a *authImpl) GetClientTLSConfig(serverName string) (*tls.Config, error) {
+	_, client, _, err := a.liveTLS.current(a.svc)
+	if err != nil {
+		return nil, err
+	}
+	cfg := client.Clone()
+	cfg.ServerName = serverName
+	cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		_, client, _, err := a.liveTLS.current(a.svc)
+		if err != nil {
+			return nil, err
+		}
+		if len(client.Certificates) == 0 {
+			// no certificate is sent
+			return &tls.Certificate{}, nil
+		}
+		return &client.Certificates[0], nil
+	}
+	return cfg, nil
+}
+
+func (a *authImpl) GetServerTLSConfig() (*tls.Config, error) {
+	server, _, err, _ := a.liveTLS.current(a.svc)
+	if err != nil {
+		return nil, err
+	}
+	cfg := server.Clone()
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		server, _, err, _ := a.liveTLS.current(a.svc)
+		return server, err
+	}
+	return cfg, nil
+}
+
+func (a *authImpl) GetTLSSettings() (TLSSettings, error) {
+	return cbauthimpl.GetTLSSettings(a.svc)
+}
+
+// Kinds of config changes that config refresh callbacks subscribe
+// to (see RegisterConfigRefreshCallback).
+const (
+	ConfigChangeCerts             = cbauthimpl.ConfigChangeCerts
+	ConfigChangeClientCertAuth    = cbauthimpl.ConfigChangeClientCertAuth
+	ConfigChangeClusterEncryption = cbauthimpl.ConfigChangeClusterEncryption
+)
+
+// Cluster encryption levels.
+const (
+	ClusterEncryptionControl = cbauthimpl.ClusterEncryptionControl
+	ClusterEncryptionAll     = cbauthimpl.ClusterEncryptionAll
+	ClusterEncryptionStrict  = cbauthimpl.ClusterEncryptionStrict
+)
+
+// ClusterEncryption type describes encryption of node to node
+// traffic.
+type ClusterEncryption = cbauthimpl.ClusterEncryption
+
+func (a *authImpl) GetClusterEncryption() (ClusterEncryption, error) {
+	return cbauthimpl.GetClusterEncryption(a.svc)
+}
+
+// ClusterEncryptionConfig struct tells service how to treat node to
+// node traffic according to cluster encryption level.
+type ClusterEncryptionConfig struct {
+	// EncryptData tells whether data (and not only control)
+	// traffic between nodes has to be encrypted.
+	EncryptData bool
+	// DisableNonSSLPorts tells whether service must not listen on
+	// non-TLS ports, except for loopback ones.
+	DisableNonSSLPorts bool
+}
+
+// AllowsPlainListener method returns true iff service may listen on
+// given address (host:port) without TLS. When non-TLS ports are
+// disabled only loopback addresses are allowed; addresses that bind
+// all interfaces (e.g. ":8091") are not.
+func (c ClusterEncryptionConfig) AllowsPlainListener(addr string) bool {
+	if !c.DisableNonSSLPorts {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (a *authImpl) GetClusterEncryptionConfig() (ClusterEncryptionConfig, error) {
+	e, err := a.GetClusterEncryption()
+	if err != nil {
+		return ClusterEncryptionConfig{}, err
+	}
+	return ClusterEncryptionConfig{EncryptData: e.EncryptData(), DisableNonSSLPorts: e.DisableNonSSLPorts()}, nil
+}
+
+func (a *authImpl) RegisterConfigRefreshCallback(kinds uint64, cb func(changed uint64)) (unregister func()) {
+	return cbauthimpl.RegisterConfigRefreshCallback(a.svc, kinds, func(changed uint64) {
+		// panic of one callback must not prevent others from
+		// being notified
+		defer func() {
+			if p := recover(); p != nil {
+				reportError("config refresh callback", fmt.Errorf("panic: %v", p),
+					map[string]string{ReportComponent: "tls"})
+			}
+		}()
+		cb(changed)
+	})
+}
+
+func (a *authImpl) RegisterTLSRefreshCallback(cb func()) (unregister func()) {
+	return a.RegisterConfigRefreshCallback(ConfigChangeCerts|ConfigChangeClientCertAuth,
+		func(uint64) { cb() })
+}
@@ -0,0 +1,167 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceLogPrint function, if non-nil, is used to log auth tracing
+// messages (see EnableTracing) unless Logger is set (see SetLogger),
+// in which case they are passed to Logger at info level, so that
+// enabled tracing is visible at default levels of loggers.
+var TraceLogPrint func(args ...interface{})
+
+var traceActive int32
+
+var traceState struct {
+	sync.Mutex
+	until time.Time
+	user  string
+}
+
+// EnableTracing turns on logging of every step of authentication
+// (credentials extraction, cache lookups and escalations to
+// ns_server) through TraceLogPrint. Tracing is automatically turned
+// off after given duration, unless duration is 0. If user is
+// non-empty, only authentication attempts of that user are traced.
+func EnableTracing(duration time.Duration, user string) {
+	traceState.Lock()
+	traceState.user = user
+	traceState.until = time.Time{}
+	if duration > 0 {
+		traceState.until = time.Now().Add(duration)
+	}
+	atomic.StoreInt32(&traceActive, 1)
+	traceState.Unlock()
+}
+
+// DisableTracing turns off tracing enabled by EnableTracing.
+func DisableTracing() {
+	traceState.Lock()
+	atomic.StoreInt32(&traceActive, 0)
+	traceState.Unlock()
+}
+
+// TraceSettings struct describes tracing that is controlled
+// cluster-wide by operators (see metakv.WatchTracing). Until is
+// absolute time, so that all services stop tracing at same time no
+// matter when they read settings. Zero Until means that tracing
+// stays on until it's turned off.
+type TraceSettings struct {
+	Enabled bool      `json:"enabled"`
+	User    string    `json:"user,omitempty"`
+	Until   time.Time `json:"until,omitempty"`
+}
+
+// ApplyTraceSettings enables tracing as described by given settings
+// or disables it if settings are not enabled.
+func ApplyTraceSettings(s TraceSettings) {
+	traceState.Lock()
+	traceState.user = s.User
+	traceState.until = s.Until
+	if s.Enabled {
+		atomic.StoreInt32(&traceActive, 1)
+	} else {
+		atomic.StoreInt32(&traceActive, 0)
+	}
+	traceState.Unlock()
+}
+
+// LoadTraceSettings parses given json encoded TraceSettings and
+// applies them. Tracing is kept intact if settings are malformed.
+func LoadTraceSettings(data []byte) error {
+	var s TraceSettings
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("malformed trace settings: %v", err)
+	}
+	ApplyTraceSettings(s)
+	return nil
+}
+
+// shouldTrace returns true iff authentication attempt of given user
+// needs to be traced. Empty user means that user is not known yet;
+// such attempts are only traced if tracing is not limited to
+// particular user.
+func shouldTrace(user string) bool {
+	if atomic.LoadInt32(&traceActive) == 0 {
+		return false
+	}
+	traceState.Lock()
+	defer traceState.Unlock()
+	if !traceState.until.IsZero() && time.Now().After(traceState.until) {
+		atomic.StoreInt32(&traceActive, 0)
+		return false
+	}
+	return traceState.user == "" || user == traceState.user
+}
+
+// tracingEnabled returns true iff tracing is enabled and not
+// expired. Unlike shouldTrace it doesn't turn expired tracing off.
+func tracingEnabled() bool {
+	if atomic.LoadInt32(&traceActive) == 0 {
+		return false
+	}
+	traceState.Lock()
+	defer traceState.Unlock()
+	return traceState.until.IsZero() || time.Now().Before(traceState.until)
+}
+
+func tracef(user string, format string, args ...interface{}) {
+	if !shouldTrace(user) {
+		return
+	}
+	var fields []interface{}
+	if user != "" {
+		fields = []interface{}{"user", TagUserData(user)}
+	}
+	logVia(TraceLogPrint, logInfo, "cbauth trace: "+fmt.Sprintf(format, args...), fields...)
+}
+
+// initTracingFromEnv enables tracing if CBAUTH_TRACE environment
+// variable is set. Its value is comma separated list of options:
+// "user=<name>" and "duration=<golang duration>". E.g.
+// CBAUTH_TRACE=user=alice,duration=10m. Any other non-empty value
+// (e.g. "1") enables tracing of all users until DisableTracing is
+// called.
+func initTracingFromEnv() {
+	v := os.Getenv("CBAUTH_TRACE")
+	if v == "" {
+		return
+	}
+	var user string
+	var duration time.Duration
+	for _, opt := range strings.Split(v, ",") {
+		switch {
+		case strings.HasPrefix(opt, "user="):
+			user = opt[len("user="):]
+		case strings.HasPrefix(opt, "duration="):
+			d, err := time.ParseDuration(opt[len("duration="):])
+			if err != nil {
+				currentLogger().Warn("cbauth: ignoring malformed CBAUTH_TRACE duration: "+err.Error(), "error", err)
+				continue
+			}
+			duration = d
+		}
+	}
+	EnableTracing(duration, user)
+}
@@ -0,0 +1,136 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"sync"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// uiTokenHeaders are headers of request that ns_server verification
+// of ui token depends on.
+var uiTokenHeaders = []string{
+	"ns-server-ui", "ns-server-auth-token", "Cookie", "Authorization", OnBehalfOfHeader,
+}
+
+// uiTokenKey returns fingerprint of ui token creds of request with
+// given headers.
+func uiTokenKey(hdr http.Header) string {
+	h := sha256.New()
+	for _, name := range uiTokenHeaders {
+		h.Write([]byte(hdr.Get(name)))
+		h.Write([]byte{0})
+	}
+	return string(h.Sum(nil))
+}
+
+type uiTokenFlight struct {
+	done   chan struct{}
+	cancel context.CancelFunc
+	// callers is number of requests that wait for flight,
+	// including one that started it
+	callers int
+	creds   Creds
+	err     error
+}
+
+// uiTokenFlights coalesces concurrent ns_server verifications of
+// same ui token, since ui pages commonly fire dozens of parallel
+// requests with same cookie. Zero value has no flights.
+type uiTokenFlights struct {
+	l       sync.Mutex
+	flights map[string]*uiTokenFlight
+}
+
+// verify verifies ui token of request with given headers on ns_server
+// or waits for verification of same token that is already in flight.
+// Verification is not cancelled if request that started it gives up,
+// since other requests may be waiting for it. But once all of them
+// give up, verification is cancelled and last request to leave
+// waits for it to stop.
+func (f *uiTokenFlights) verify(ctx context.Context, s *cbauthimpl.Svc, hdr http.Header) (Creds, error) {
+	key := uiTokenKey(hdr)
+	f.l.Lock()
+	fl := f.flights[key]
+	if fl != nil {
+		fl.callers++
+		f.l.Unlock()
+		tracef("", "sharing ns_server verification of ui token that is in flight")
+	} else {
+		flCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		fl = &uiTokenFlight{done: make(chan struct{}), cancel: cancel, callers: 1}
+		if f.flights == nil {
+			f.flights = make(map[string]*uiTokenFlight)
+		}
+		f.flights[key] = fl
+		f.l.Unlock()
+
+		go func() {
+			defer cancel()
+			fl.creds, fl.err = doOnServer(flCtx, s, "", hdr)
+			f.forget(key, fl)
+			close(fl.done)
+		}()
+	}
+
+	select {
+	case <-fl.done:
+		return fl.creds, fl.err
+	case <-ctx.Done():
+	}
+
+	f.l.Lock()
+	fl.callers--
+	last := fl.callers == 0
+	if last {
+		// nobody is going to share cancelled flight
+		f.forgetLocked(key, fl)
+	}
+	f.l.Unlock()
+	if last {
+		fl.cancel()
+		<-fl.done
+	}
+	return nil, ctx.Err()
+}
+
+func (f *uiTokenFlights) forget(key string, fl *uiTokenFlight) {
+	f.l.Lock()
+	f.forgetLocked(key, fl)
+	f.l.Unlock()
+}
+
+func (f *uiTokenFlights) forgetLocked(key string, fl *uiTokenFlight) {
+	if f.flights[key] == fl {
+		delete(f.flights, key)
+	}
+}
+
+// waiting returns number of requests that wait for verification of
+// ui token of request with given headers besides request that started
+// it.
+func (f *uiTokenFlights) waiting(hdr http.Header) int {
+	f.l.Lock()
+	defer f.l.Unlock()
+	if fl := f.flights[uiTokenKey(hdr)]; fl != nil {
+		return fl.callers - 1
+	}
+	return 0
+}
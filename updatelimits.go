@@ -0,0 +1,92 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"sync"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+	"github.com/couchbase/cbauth/revrpc"
+)
+
+// DefaultMaxCacheUpdateSize is default limit of size of cbauth cache
+// updates pushed by ns_server.
+const DefaultMaxCacheUpdateSize = 256 << 20
+
+// RequestTooLargeError is returned to ns_server (and recorded in
+// diagnostics) when cache update exceeds limit set via
+// SetCacheUpdateLimits.
+type RequestTooLargeError = revrpc.RequestTooLargeError
+
+// RejectedUpdatePolicy type defines how cbauth behaves after it
+// rejected cache update that is too large or malformed.
+type RejectedUpdatePolicy int
+
+const (
+	// KeepPreviousCache keeps serving previous cache as if
+	// update never arrived. It is default.
+	KeepPreviousCache RejectedUpdatePolicy = iota
+	// MarkCacheStale makes cbauth return DBStaleError until
+	// next successful update, i.e. auth fails closed.
+	MarkCacheStale
+)
+
+var updateLimits = struct {
+	sync.Mutex
+	maxSize int64
+	policy  RejectedUpdatePolicy
+	rpcsvc  *revrpc.Service
+}{maxSize: DefaultMaxCacheUpdateSize}
+
+// SetCacheUpdateLimits sets maximum size of cache updates accepted
+// from ns_server (zero means no limit) and policy that is applied
+// when update is rejected. Updates are decoded incrementally, so
+// oversized update is dropped without being held in memory.
+func SetCacheUpdateLimits(maxSize int64, policy RejectedUpdatePolicy) {
+	updateLimits.Lock()
+	defer updateLimits.Unlock()
+	updateLimits.maxSize = maxSize
+	updateLimits.policy = policy
+	if updateLimits.rpcsvc != nil {
+		updateLimits.rpcsvc.SetMaxRequestSize(maxSize)
+	}
+}
+
+func rejectedUpdatePolicy() RejectedUpdatePolicy {
+	updateLimits.Lock()
+	defer updateLimits.Unlock()
+	return updateLimits.policy
+}
+
+// applyUpdateLimits makes given revrpc service enforce update limits
+// on behalf of given cbauth service.
+func applyUpdateLimits(rpcsvc *revrpc.Service, svc *lifecycleSvc) {
+	updateLimits.Lock()
+	updateLimits.rpcsvc = rpcsvc
+	rpcsvc.SetMaxRequestSize(updateLimits.maxSize)
+	updateLimits.Unlock()
+
+	rpcsvc.SetRequestErrorHandler(func(method string, err error) {
+		reportError("rejected "+method, err, map[string]string{
+			ReportComponent: "revrpc",
+			ReportMethod:    method,
+		})
+		if rejectedUpdatePolicy() == MarkCacheStale {
+			cbauthimpl.ResetSvc(svc.Svc, &DBStaleError{err})
+			svc.degraded(err)
+		}
+	})
+}
@@ -25,6 +25,8 @@ func SplitHostPort(hostport string) (host string, port int, err error) {
 	return
 }
 
+var errNonBasicAuth = errors.New("Non-basic auth is not supported")
+
 // ExtractCreds extracts Basic auth creds from request.
 func ExtractCreds(req *http.Request) (user string, pwd string, err error) {
 	auth := req.Header.Get("Authorization")
@@ -34,7 +36,7 @@ func ExtractCreds(req *http.Request) (user string, pwd string, err error) {
 
 	basicPrefix := "Basic "
 	if !strings.HasPrefix(auth, basicPrefix) {
-		err = errors.New("Non-basic auth is not supported")
+		err = errNonBasicAuth
 		return
 	}
 	decodedAuth, err := base64.StdEncoding.DecodeString(auth[len(basicPrefix):])
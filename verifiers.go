@@ -0,0 +1,143 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// CredsVerifier verifies credentials of http requests that cbauth
+// doesn't handle itself, e.g. OIDC or SAML bearer tokens (see
+// RegisterCredsVerifier).
+type CredsVerifier interface {
+	// VerifyRequest returns creds of given request. It returns
+	// nil creds and nil error if it doesn't recognise
+	// credentials of request, so that other verifiers are
+	// consulted.
+	VerifyRequest(req *http.Request) (Creds, error)
+}
+
+// CredsVerifierFunc type adapts function to CredsVerifier interface.
+type CredsVerifierFunc func(req *http.Request) (Creds, error)
+
+// VerifyRequest method simply calls "this" function.
+func (f CredsVerifierFunc) VerifyRequest(req *http.Request) (Creds, error) {
+	return f(req)
+}
+
+// VerifierStage type tells when registered CredsVerifier is
+// consulted by AuthWebCreds.
+type VerifierStage int
+
+const (
+	// VerifyBeforeBuiltin verifiers are consulted before cbauth
+	// looks at request.
+	VerifyBeforeBuiltin VerifierStage = iota
+	// VerifyAfterBuiltin verifiers are consulted if neither
+	// cbauth cache nor ns_server recognised creds of request,
+	// including when request carries creds of scheme cbauth
+	// doesn't support.
+	VerifyAfterBuiltin
+)
+
+type registeredVerifier struct {
+	id uint64
+	v  CredsVerifier
+}
+
+type verifierSet struct {
+	before []registeredVerifier
+	after  []registeredVerifier
+}
+
+var credsVerifiers struct {
+	sync.Mutex
+	next uint64
+	// set holds *verifierSet that is replaced rather than
+	// modified, so that request path doesn't need to lock
+	set atomic.Value
+}
+
+func (s *verifierSet) stage(stage VerifierStage) *[]registeredVerifier {
+	if stage == VerifyBeforeBuiltin {
+		return &s.before
+	}
+	return &s.after
+}
+
+func updateVerifiers(body func(s *verifierSet)) {
+	credsVerifiers.Lock()
+	defer credsVerifiers.Unlock()
+	var s verifierSet
+	if old, ok := credsVerifiers.set.Load().(*verifierSet); ok {
+		s.before = append([]registeredVerifier(nil), old.before...)
+		s.after = append([]registeredVerifier(nil), old.after...)
+	}
+	body(&s)
+	credsVerifiers.set.Store(&s)
+}
+
+// RegisterCredsVerifier registers verifier that AuthWebCreds
+// consults at given stage, so that services can accept credentials
+// of external identity providers. Verifiers of same stage are
+// consulted in order of registration and first one that recognises
+// credentials wins. Returned function unregisters verifier.
+func RegisterCredsVerifier(v CredsVerifier, stage VerifierStage) (unregister func()) {
+	var id uint64
+	updateVerifiers(func(s *verifierSet) {
+		credsVerifiers.next++
+		id = credsVerifiers.next
+		l := s.stage(stage)
+		*l = append(*l, registeredVerifier{id, v})
+	})
+	return func() {
+		updateVerifiers(func(s *verifierSet) {
+			l := s.stage(stage)
+			for i, r := range *l {
+				if r.id == id {
+					*l = append((*l)[:i], (*l)[i+1:]...)
+					return
+				}
+			}
+		})
+	}
+}
+
+// verifyCustom consults verifiers of given stage. ok is false if
+// none of them recognised credentials of given request.
+func verifyCustom(req *http.Request, stage VerifierStage) (creds Creds, ok bool, err error) {
+	s, _ := credsVerifiers.set.Load().(*verifierSet)
+	if s == nil {
+		return nil, false, nil
+	}
+	for _, r := range *s.stage(stage) {
+		creds, err = r.v.VerifyRequest(req)
+		if err != nil || creds != nil {
+			tracef(nameOf(creds), "custom verifier handled request to %s: %v, %v", req.URL.Path, creds, err)
+			return creds, true, err
+		}
+	}
+	return nil, false, nil
+}
+
+func nameOf(c Creds) string {
+	if c == nil {
+		return ""
+	}
+	return c.Name()
+}
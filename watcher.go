@@ -0,0 +1,61 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2015 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"sync"
+)
+
+// Watcher is handle of watch (e.g. WatchPolicyFile) that runs in
+// background (see StartWatcher). It lets dynamically created
+// components stop their watches when they go away.
+type Watcher struct {
+	cancel chan struct{}
+	done   chan struct{}
+	once   sync.Once
+	err    error
+}
+
+// StartWatcher runs given watch function in background. Cancel
+// channel passed to it is closed by Stop.
+func StartWatcher(watch func(cancel <-chan struct{}) error) *Watcher {
+	w := &Watcher{cancel: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		w.err = watch(w.cancel)
+		close(w.done)
+	}()
+	return w
+}
+
+// Done returns channel that is closed once watch returns, either
+// because it was stopped or because it failed (see Err).
+func (w *Watcher) Done() <-chan struct{} {
+	return w.done
+}
+
+// Err returns error watch returned with. It must only be called after
+// Done channel is closed.
+func (w *Watcher) Err() error {
+	return w.err
+}
+
+// Stop cancels watch, waits for it to return and returns its error.
+// It is safe to call Stop more than once.
+func (w *Watcher) Stop() error {
+	w.once.Do(func() { close(w.cancel) })
+	<-w.done
+	return w.err
+}